@@ -0,0 +1,81 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeTimers(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+	var fired []time.Duration
+	record := func() { fired = append(fired, c.Now().Sub(start)) }
+	c.AfterFunc(3*time.Second, record)
+	c.AfterFunc(time.Second, record)
+	stopped := c.AfterFunc(2*time.Second, record)
+	if !stopped.Stop() {
+		t.Error("Stop should report a pending timer")
+	}
+
+	c.Advance(500 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Errorf("Timers fired early: %v", fired)
+	}
+	c.Advance(5 * time.Second)
+	if len(fired) != 2 || fired[0] != time.Second || fired[1] != 3*time.Second {
+		t.Errorf("Timers fired at the wrong times: %v", fired)
+	}
+	if got := c.Now().Sub(start); got != 5500*time.Millisecond {
+		t.Errorf("Unexpected time: %v", got)
+	}
+	if stopped.Stop() {
+		t.Error("Stop should report that the timer is not pending")
+	}
+}
+
+func TestFakeTimerReset(t *testing.T) {
+	c := NewFake(time.Unix(0, 0))
+	count := 0
+	var timer Timer
+	// A timer that rearms itself runs repeatedly within one Advance.
+	timer = c.AfterFunc(time.Second, func() {
+		count++
+		timer.Reset(time.Second)
+	})
+	c.Advance(3 * time.Second)
+	if count != 3 {
+		t.Errorf("Expected 3 calls, got %d", count)
+	}
+	if !timer.Reset(10 * time.Second) {
+		t.Error("Reset should report a pending timer")
+	}
+	timer.Stop()
+	c.Advance(time.Minute)
+	if count != 3 {
+		t.Errorf("Stopped timer fired: %d", count)
+	}
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != Real {
+		t.Error("Nil should mean the real clock")
+	}
+	fake := NewFake(time.Now())
+	if Or(fake) != fake {
+		t.Error("Or should return a non-nil clock")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package tuntest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel"
+)
+
+// Data sent on a dropped connection is discarded without stalling the stack,
+// so other connections continue to work.
+func TestBlockDropDoesNotStall(t *testing.T) {
+	server, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The Tunnel doesn't expose the block response, so register a handler directly.
+	dev := NewDevice()
+	tun := tunnel.NewTunnel(dev, core.NewLWIPStack())
+	defer tun.Disconnect()
+	core.RegisterOutputFn(tunnel.OutputFn(tun, dev))
+	blocked := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	f := filter.NewFilter(filter.Blocklist)
+	f.AddCIDR(blocked.IP.String())
+	h := intra.NewTCPHandler(net.TCPAddr{IP: net.IPv4(10, 111, 222, 3), Port: 53}, &net.Dialer{}, fakeListener{})
+	h.SetFilter(f)
+	if err := h.SetBlockResponse(intra.BlockResponseDrop); err != nil {
+		t.Fatal(err)
+	}
+	core.RegisterTCPConnHandler(h)
+	go tunnel.ProcessInputPackets(tun, dev)
+
+	app := &net.TCPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 40020}
+	const iss = 7000
+	dev.Inject((&TCPSegment{Src: app, Dst: blocked, Seq: iss, Flags: SYN}).Marshal())
+	synack := waitForSegment(t, dev, SYN|ACK)
+	dev.Inject((&TCPSegment{Src: app, Dst: blocked, Seq: iss + 1, Ack: synack.Seq + 1, Flags: ACK}).Marshal())
+	sendAll(t, dev, app, blocked, iss+1, synack.Seq+1, make([]byte, 3000), 1000)
+
+	// Another connection is forwarded while the dropped one is held.
+	app2 := &net.TCPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 40021}
+	dst := server.Addr().(*net.TCPAddr)
+	dev.Inject((&TCPSegment{Src: app2, Dst: dst, Seq: iss, Flags: SYN}).Marshal())
+	synack = waitForSegment(t, dev, SYN|ACK)
+	if synack.Dst.Port != app2.Port {
+		t.Fatalf("Unexpected SYN-ACK: %+v", synack)
+	}
+	payload := []byte("hello")
+	dev.Inject((&TCPSegment{Src: app2, Dst: dst, Seq: iss + 1, Ack: synack.Seq + 1, Flags: ACK}).Marshal())
+	dev.Inject((&TCPSegment{Src: app2, Dst: dst, Seq: iss + 1, Ack: synack.Seq + 1, Flags: PSH | ACK, Payload: payload}).Marshal())
+
+	server.SetDeadline(time.Now().Add(2 * time.Second))
+	upstream, err := server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	upstream.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(upstream, buf); err != nil || !bytes.Equal(buf, payload) {
+		t.Errorf("Unexpected payload %q: %v", buf, err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tuntest provides an in-memory TUN device and packet helpers for
+// end-to-end tests of the tunnel.
+package tuntest
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned by ReadPacket if no packet arrives in time.
+var ErrTimeout = errors.New("Timed out waiting for a packet")
+
+// Device is an in-memory TUN device.  Packets passed to Inject are returned by
+// Read, as if they came from an app, and packets passed to Write (i.e. output
+// by the network stack) are returned by ReadPacket.
+type Device struct {
+	in        chan []byte
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDevice returns an open Device.
+func NewDevice() *Device {
+	return &Device{
+		in:     make(chan []byte, 64),
+		out:    make(chan []byte, 64),
+		closed: make(chan struct{}),
+	}
+}
+
+// Inject queues `pkt` to be read from the device.
+func (d *Device) Inject(pkt []byte) error {
+	select {
+	case d.in <- append([]byte{}, pkt...):
+		return nil
+	case <-d.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// ReadPacket returns the next packet written to the device, waiting up to `timeout`.
+func (d *Device) ReadPacket(timeout time.Duration) ([]byte, error) {
+	select {
+	case pkt := <-d.out:
+		return pkt, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Read returns the next injected packet, blocking until one is available or
+// the device is closed.
+func (d *Device) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-d.in:
+		return copy(b, pkt), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+// Write records a packet output by the network stack.  Packets are dropped if
+// they are not read, as on a real device.
+func (d *Device) Write(b []byte) (int, error) {
+	select {
+	case <-d.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case d.out <- append([]byte{}, b...):
+	default:
+	}
+	return len(b), nil
+}
+
+// Close closes the device.  Subsequent reads return io.EOF.
+func (d *Device) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
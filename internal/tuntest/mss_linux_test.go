@@ -0,0 +1,85 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package tuntest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel"
+)
+
+// Connects through the tunnel from an app that advertises `mss`, and returns
+// the MSS of the server's end of the upstream connection.
+func upstreamMSS(t *testing.T, mirror bool, port int, mss uint16) int {
+	server, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dev := NewDevice()
+	tun, err := intra.NewTunnel("10.111.222.3:53", fakeTransport{}, dev, &net.Dialer{}, &net.ListenConfig{}, fakeListener{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Disconnect()
+	tun.SetMirrorClientMSS(mirror)
+	go tunnel.ProcessInputPackets(tun, dev)
+
+	app := &net.TCPAddr{IP: net.IPv4(10, 111, 222, 1), Port: port}
+	dst := server.Addr().(*net.TCPAddr)
+	const iss = 9000
+	dev.Inject((&TCPSegment{Src: app, Dst: dst, Seq: iss, Flags: SYN, MSS: mss}).Marshal())
+	synack := waitForSegment(t, dev, SYN|ACK)
+	dev.Inject((&TCPSegment{Src: app, Dst: dst, Seq: iss + 1, Ack: synack.Seq + 1, Flags: ACK}).Marshal())
+
+	server.SetDeadline(time.Now().Add(2 * time.Second))
+	upstream, err := server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	raw, err := upstream.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	raw.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// The MSS that the app advertises in its SYN is applied to the upstream socket.
+func TestMirrorClientMSS(t *testing.T) {
+	const mss = 600
+	if got := upstreamMSS(t, false, 40010, mss); got <= mss {
+		t.Skipf("Default loopback MSS is only %d", got)
+	}
+	if got := upstreamMSS(t, true, 40011, mss); got <= 0 || got > mss {
+		t.Errorf("Upstream MSS %d does not reflect the client's MSS %d", got, mss)
+	}
+}
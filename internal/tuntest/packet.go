@@ -0,0 +1,141 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tuntest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TCP flags.
+const (
+	FIN = 0x01
+	SYN = 0x02
+	RST = 0x04
+	PSH = 0x08
+	ACK = 0x10
+)
+
+const (
+	ipv4HeaderLen = 20
+	tcpHeaderLen  = 20
+	protocolTCP   = 6
+)
+
+// TCPSegment is a TCP segment in an IPv4 packet.
+type TCPSegment struct {
+	Src, Dst *net.TCPAddr
+	Seq, Ack uint32
+	Flags    uint8
+	Window   uint16
+	// MSS is sent as a TCP option if it is non-zero.  It is not parsed.
+	MSS     uint16
+	Payload []byte
+}
+
+// Marshal returns the segment as an IPv4 packet with valid checksums.
+func (s *TCPSegment) Marshal() []byte {
+	src, dst := s.Src.IP.To4(), s.Dst.IP.To4()
+	header := tcpHeaderLen
+	if s.MSS != 0 {
+		header += 4
+	}
+	total := ipv4HeaderLen + header + len(s.Payload)
+	pkt := make([]byte, total)
+
+	ip := pkt[:ipv4HeaderLen]
+	ip[0] = 0x45 // Version 4, 5-word header.
+	binary.BigEndian.PutUint16(ip[2:], uint16(total))
+	ip[8] = 64 // TTL
+	ip[9] = protocolTCP
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+
+	tcp := pkt[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:], uint16(s.Src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(s.Dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], s.Seq)
+	binary.BigEndian.PutUint32(tcp[8:], s.Ack)
+	tcp[12] = byte(header/4) << 4
+	tcp[13] = s.Flags
+	window := s.Window
+	if window == 0 {
+		window = 65535
+	}
+	binary.BigEndian.PutUint16(tcp[14:], window)
+	if s.MSS != 0 {
+		tcp[20], tcp[21] = 2, 4 // MSS option kind and length.
+		binary.BigEndian.PutUint16(tcp[22:], s.MSS)
+	}
+	copy(tcp[header:], s.Payload)
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudoHeaderSum(src, dst, len(tcp)), tcp))
+	return pkt
+}
+
+// ParseTCP parses an IPv4 packet containing a TCP segment.
+func ParseTCP(pkt []byte) (*TCPSegment, error) {
+	if len(pkt) < ipv4HeaderLen || pkt[0]>>4 != 4 {
+		return nil, errors.New("Not an IPv4 packet")
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(pkt[2:]))
+	if ihl < ipv4HeaderLen || total > len(pkt) || total < ihl+tcpHeaderLen {
+		return nil, fmt.Errorf("Bad IPv4 lengths: %d, %d", ihl, total)
+	}
+	if pkt[9] != protocolTCP {
+		return nil, fmt.Errorf("Not TCP: protocol %d", pkt[9])
+	}
+	tcp := pkt[ihl:total]
+	offset := int(tcp[12]>>4) * 4
+	if offset < tcpHeaderLen || offset > len(tcp) {
+		return nil, fmt.Errorf("Bad TCP data offset: %d", offset)
+	}
+	return &TCPSegment{
+		Src:     &net.TCPAddr{IP: net.IP(append([]byte{}, pkt[12:16]...)), Port: int(binary.BigEndian.Uint16(tcp[0:]))},
+		Dst:     &net.TCPAddr{IP: net.IP(append([]byte{}, pkt[16:20]...)), Port: int(binary.BigEndian.Uint16(tcp[2:]))},
+		Seq:     binary.BigEndian.Uint32(tcp[4:]),
+		Ack:     binary.BigEndian.Uint32(tcp[8:]),
+		Flags:   tcp[13],
+		Window:  binary.BigEndian.Uint16(tcp[14:]),
+		Payload: append([]byte{}, tcp[offset:]...),
+	}, nil
+}
+
+func pseudoHeaderSum(src, dst net.IP, length int) uint32 {
+	var sum uint32
+	for i := 0; i < 4; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(src[i:]))
+		sum += uint32(binary.BigEndian.Uint16(dst[i:]))
+	}
+	return sum + protocolTCP + uint32(length)
+}
+
+// checksum computes the Internet checksum of `b`, starting from `sum`.
+func checksum(sum uint32, b []byte) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
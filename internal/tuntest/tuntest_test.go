@@ -0,0 +1,223 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tuntest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel"
+)
+
+type fakeTransport struct{}
+
+func (fakeTransport) Query(q []byte) ([]byte, error) { return nil, errors.New("No DNS") }
+func (fakeTransport) GetURL() string                 { return "fake" }
+
+type fakeListener struct{}
+
+func (fakeListener) OnTCPSocketClosed(*intra.TCPSocketSummary) {}
+func (fakeListener) OnUDPSocketClosed(*intra.UDPSocketSummary) {}
+func (fakeListener) OnQuery(string) doh.Token                  { return nil }
+func (fakeListener) OnResponse(doh.Token, *doh.Summary)        {}
+
+func TestPacketRoundTrip(t *testing.T) {
+	s := &TCPSegment{
+		Src:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234},
+		Dst:     &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80},
+		Seq:     1,
+		Ack:     2,
+		Flags:   PSH | ACK,
+		Payload: []byte("hello"),
+	}
+	pkt := s.Marshal()
+	if checksum(0, pkt[:ipv4HeaderLen]) != 0 {
+		t.Error("Bad IP checksum")
+	}
+	parsed, err := ParseTCP(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Src.IP.Equal(s.Src.IP) || parsed.Dst.Port != 80 || parsed.Seq != 1 ||
+		parsed.Ack != 2 || parsed.Flags != PSH|ACK || string(parsed.Payload) != "hello" {
+		t.Errorf("Round trip mismatch: %+v", parsed)
+	}
+}
+
+// Waits for a TCP segment with all of `flags` set.
+func waitForSegment(t *testing.T, dev *Device, flags uint8) *TCPSegment {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		pkt, err := dev.ReadPacket(time.Until(deadline))
+		if err != nil {
+			break
+		}
+		if s, err := ParseTCP(pkt); err == nil && s.Flags&flags == flags {
+			return s
+		}
+	}
+	t.Fatalf("No segment with flags %#x", flags)
+	return nil
+}
+
+func TestTCPHandshake(t *testing.T) {
+	server, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dev := NewDevice()
+	tun, err := intra.NewTunnel("10.111.222.3:53", fakeTransport{}, dev, &net.Dialer{}, &net.ListenConfig{}, fakeListener{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Disconnect()
+	go tunnel.ProcessInputPackets(tun, dev)
+
+	app := &net.TCPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 40000}
+	dst := server.Addr().(*net.TCPAddr)
+	const iss = 1000
+	dev.Inject((&TCPSegment{Src: app, Dst: dst, Seq: iss, Flags: SYN}).Marshal())
+	synack := waitForSegment(t, dev, SYN|ACK)
+	if synack.Ack != iss+1 || synack.Dst.Port != app.Port {
+		t.Fatalf("Unexpected SYN-ACK: %+v", synack)
+	}
+	payload := []byte("hello")
+	dev.Inject((&TCPSegment{Src: app, Dst: dst, Seq: iss + 1, Ack: synack.Seq + 1, Flags: ACK}).Marshal())
+	dev.Inject((&TCPSegment{Src: app, Dst: dst, Seq: iss + 1, Ack: synack.Seq + 1, Flags: PSH | ACK, Payload: payload}).Marshal())
+
+	// The tunnel connects to the server and forwards the payload.
+	server.SetDeadline(time.Now().Add(2 * time.Second))
+	upstream, err := server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(upstream, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, payload) {
+		t.Errorf("Unexpected payload: %q", buf)
+	}
+
+	// The server's response is delivered to the app.
+	upstream.Write([]byte("world"))
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s := waitForSegment(t, dev, ACK)
+		if len(s.Payload) > 0 {
+			if string(s.Payload) != "world" || s.Seq != synack.Seq+1 {
+				t.Errorf("Unexpected response: %+v", s)
+			}
+			return
+		}
+	}
+	t.Error("No response from the tunnel")
+}
+
+// Sends `data` from `src` to `dst` in segments of `mss` bytes, starting at
+// sequence number `seq`, and retransmits unacknowledged segments until all of
+// the data is acknowledged, like a simple TCP sender.
+func sendAll(t *testing.T, dev *Device, src, dst *net.TCPAddr, seq, ack uint32, data []byte, mss int) {
+	acked := seq
+	end := seq + uint32(len(data))
+	deadline := time.Now().Add(5 * time.Second)
+	for acked != end {
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d of %d bytes were acknowledged", acked-seq, len(data))
+		}
+		for off := int(acked - seq); off < len(data); off += mss {
+			stop := off + mss
+			if stop > len(data) {
+				stop = len(data)
+			}
+			dev.Inject((&TCPSegment{Src: src, Dst: dst, Seq: seq + uint32(off), Ack: ack, Flags: PSH | ACK, Payload: data[off:stop]}).Marshal())
+		}
+		for {
+			pkt, err := dev.ReadPacket(100 * time.Millisecond)
+			if err != nil {
+				break
+			}
+			if s, err := ParseTCP(pkt); err == nil && s.Flags&ACK != 0 && int32(s.Ack-acked) > 0 {
+				acked = s.Ack
+			}
+		}
+	}
+}
+
+// Data that the client sends immediately after the handshake, while the
+// upstream dial is still in progress, reaches the server intact.
+func TestEarlyData(t *testing.T) {
+	server, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Delay the upstream dial, so that all of the client's data arrives before
+	// the handler accepts the connection.
+	dialer := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			time.Sleep(300 * time.Millisecond)
+			return nil
+		},
+	}
+	dev := NewDevice()
+	tun, err := intra.NewTunnel("10.111.222.3:53", fakeTransport{}, dev, dialer, &net.ListenConfig{}, fakeListener{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Disconnect()
+	go tunnel.ProcessInputPackets(tun, dev)
+
+	app := &net.TCPAddr{IP: net.IPv4(10, 111, 222, 1), Port: 40001}
+	dst := server.Addr().(*net.TCPAddr)
+	const iss = 5000
+	dev.Inject((&TCPSegment{Src: app, Dst: dst, Seq: iss, Flags: SYN}).Marshal())
+	synack := waitForSegment(t, dev, SYN|ACK)
+	dev.Inject((&TCPSegment{Src: app, Dst: dst, Seq: iss + 1, Ack: synack.Seq + 1, Flags: ACK}).Marshal())
+
+	data := make([]byte, 4000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		server.SetDeadline(time.Now().Add(5 * time.Second))
+		upstream, err := server.AcceptTCP()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer upstream.Close()
+		upstream.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, len(data))
+		n, _ := io.ReadFull(upstream, buf)
+		received <- buf[:n]
+	}()
+	sendAll(t, dev, app, dst, iss+1, synack.Seq+1, data, 1000)
+	if buf := <-received; !bytes.Equal(buf, data) {
+		t.Errorf("Server received %d of %d bytes, or corrupted data", len(buf), len(data))
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+)
+
+// normalizeIP converts IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) to their
+// 4-byte IPv4 form.  Other addresses are returned unchanged.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// normalizeTCPAddr returns a copy of `addr` with a normalized IP.
+func normalizeTCPAddr(addr *net.TCPAddr) *net.TCPAddr {
+	return &net.TCPAddr{IP: normalizeIP(addr.IP), Port: addr.Port, Zone: addr.Zone}
+}
+
+// normalizeUDPAddr returns a copy of `addr` with a normalized IP.
+func normalizeUDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	return &net.UDPAddr{IP: normalizeIP(addr.IP), Port: addr.Port, Zone: addr.Zone}
+}
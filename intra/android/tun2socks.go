@@ -79,3 +79,30 @@ func NewDoHTransport(url string, ips string, protector protect.Protector, auth d
 	dialer := protect.MakeDialer(protector)
 	return doh.NewTransport(url, split, dialer, auth, listener)
 }
+
+// NewDoTTransport returns a DNSTransport that connects to the specified
+// DNS-over-TLS server.
+// `addr` is the server's hostname or IP address, with an optional port.  The
+//   default port is 853.
+// `protector` is the socket protector to use for all external network activity.
+// `listener` will be notified after each DNS query succeeds or fails.
+func NewDoTTransport(addr string, protector protect.Protector, listener intra.Listener) (doh.Transport, error) {
+	dialer := protect.MakeDialer(protector)
+	return doh.NewDoTTransport(addr, nil, dialer, 0, listener)
+}
+
+// NewFallbackTransport returns a DNSTransport that sends queries to `primary`,
+// and falls back to `secondary` (e.g. DoT if DoH is blocked) if it fails.  The
+// transport that last answered is tried first.
+func NewFallbackTransport(primary, secondary doh.Transport) (doh.Transport, error) {
+	return doh.NewFailoverTransport([]doh.Transport{primary, secondary}, 0)
+}
+
+// NewCachingTransport returns a DNSTransport that answers repeated queries from
+// a cache in front of `t`, until their TTLs expire.  Negative responses are
+// cached too.
+// `maxEntries` is the maximum number of cached responses, or zero for the
+//   default.
+func NewCachingTransport(t doh.Transport, maxEntries int) doh.Transport {
+	return doh.NewCachingTransport(t, maxEntries)
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// Outcomes reported in audit records.
+const (
+	OutcomeClosed      = "closed"       // The connection was forwarded and closed.
+	OutcomeRetried     = "retried"      // As above, after a split retry.
+	OutcomeDialFailed  = "dial-failed"  // The upstream dial failed.
+	OutcomeDialTimeout = "dial-timeout" // The upstream dial timed out.
+)
+
+// auditRecord is the JSON form of an audit log entry.
+type auditRecord struct {
+	Time     string  `json:"time"` // RFC 3339, when the record was written.
+	Proto    string  `json:"proto"`
+	SrcIP    string  `json:"src_ip,omitempty"`
+	SrcPort  int     `json:"src_port,omitempty"`
+	DstIP    string  `json:"dst_ip"`
+	DstPort  int     `json:"dst_port"`
+	Hostname string  `json:"hostname,omitempty"`
+	Upload   int64   `json:"upload"`
+	Download int64   `json:"download"`
+	Duration float64 `json:"duration"` // Seconds.
+	Strategy string  `json:"strategy,omitempty"`
+	Outcome  string  `json:"outcome"`
+	Error    string  `json:"error,omitempty"`
+	// Experiment is the connection's experiment tag, if any.
+	Experiment string `json:"experiment,omitempty"`
+}
+
+// Auditor writes an audit log of TCP connections, with one JSON object per
+// line.  Auditor.TCPClosed can be used as a TCPCloseHook, and
+// Auditor.DialFailed as a DialFailureHook.  Both are safe for concurrent use.
+//
+// The Auditor only appends to its writer.  Rotating or truncating the log is
+// the caller's responsibility, for example by supplying a writer that rotates
+// files.
+type Auditor struct {
+	mu  sync.Mutex // Serializes writes.
+	enc *json.Encoder
+}
+
+// NewAuditor returns an Auditor that writes to `w`.
+func NewAuditor(w io.Writer) *Auditor {
+	return &Auditor{enc: json.NewEncoder(w)}
+}
+
+// hostPort returns the IP and port of `addr`, if it is a TCP address.
+func hostPort(addr net.Addr) (string, int) {
+	if a, ok := addr.(*net.TCPAddr); ok && a != nil {
+		return a.IP.String(), a.Port
+	}
+	return "", 0
+}
+
+func (a *Auditor) write(r *auditRecord) {
+	r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	r.Proto = "tcp"
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Encode writes each record, including its newline, in a single call.
+	if err := a.enc.Encode(r); err != nil {
+		log.Warnf("Failed to write audit record: %v", err)
+	}
+}
+
+// TCPClosed records a connection that was forwarded and has closed.
+func (a *Auditor) TCPClosed(c TCPConnRecord) {
+	r := &auditRecord{
+		Hostname: c.Hostname,
+		Upload:   c.Summary.UploadBytes,
+		Download: c.Summary.DownloadBytes,
+		Duration: time.Since(c.Start).Seconds(),
+		Strategy: c.Strategy,
+		Outcome:  OutcomeClosed,
+	}
+	r.Experiment = c.ExperimentTag
+	r.SrcIP, r.SrcPort = hostPort(c.Client)
+	r.DstIP, r.DstPort = hostPort(c.Target)
+	if retry := c.Summary.Retry; retry != nil && retry.Retried {
+		r.Outcome = OutcomeRetried
+	}
+	a.write(r)
+}
+
+// DialFailed records a connection whose upstream dial failed.
+func (a *Auditor) DialFailed(f DialFailure) {
+	r := &auditRecord{
+		Outcome: OutcomeDialFailed,
+		Error:   f.Err.Error(),
+	}
+	r.DstIP, r.DstPort = hostPort(f.Target)
+	if f.Timeout {
+		r.Outcome = OutcomeDialTimeout
+	}
+	a.write(r)
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// lineWriter sends each write on a channel.
+type lineWriter chan []byte
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func decodeRecord(t *testing.T, line []byte) *auditRecord {
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		t.Errorf("Record is not a line: %q", line)
+	}
+	var r auditRecord
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&r); err != nil {
+		t.Fatalf("Bad JSON %q: %v", line, err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, r.Time); err != nil {
+		t.Errorf("Bad time: %v", err)
+	}
+	return &r
+}
+
+func TestAuditForwardedConnection(t *testing.T) {
+	lines := make(lineWriter, 1)
+	auditor := NewAuditor(lines)
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetCloseHook(auditor.TCPClosed)
+	})
+	s.app.Write([]byte("hello"))
+	if _, err := io.ReadFull(s.upstream, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	s.upstream.Write([]byte("world!"))
+	s.upstream.Close()
+	s.app.CloseWrite()
+
+	var line []byte
+	select {
+	case line = <-lines:
+	case <-time.After(time.Second):
+		t.Fatal("No audit record")
+	}
+	r := decodeRecord(t, line)
+	if r.Proto != "tcp" || r.Outcome != OutcomeClosed || r.Strategy != StrategyDirect {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+	if r.Upload != 5 || r.Download != 6 {
+		t.Errorf("Unexpected byte counts: %d up, %d down", r.Upload, r.Download)
+	}
+	if r.SrcIP != "127.0.0.1" || r.SrcPort == 0 || r.DstIP != "127.0.0.1" || r.DstPort == 0 {
+		t.Errorf("Bad addresses: %+v", r)
+	}
+	if r.Duration <= 0 {
+		t.Errorf("Bad duration: %v", r.Duration)
+	}
+}
+
+func TestAuditRecords(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewAuditor(&buf)
+	target := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	auditor.TCPClosed(TCPConnRecord{
+		Client:        &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234},
+		Target:        target,
+		Start:         time.Now().Add(-time.Second),
+		Strategy:      StrategySplitRetry,
+		Hostname:      "example.com",
+		Summary:       TCPSocketSummary{Retry: &split.RetryStats{Retried: true, Split: 40}},
+		ExperimentTag: "split-arm",
+	})
+	auditor.DialFailed(DialFailure{Target: target, Err: errors.New("refused")})
+	auditor.DialFailed(DialFailure{Target: target, Err: errors.New("timeout"), Timeout: true})
+
+	scanner := bufio.NewScanner(&buf)
+	var records []*auditRecord
+	for scanner.Scan() {
+		records = append(records, decodeRecord(t, append(scanner.Bytes(), '\n')))
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	if r := records[0]; r.Outcome != OutcomeRetried || r.Hostname != "example.com" || r.DstIP != "2001:db8::1" || r.Duration < 1 || r.Experiment != "split-arm" {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+	if r := records[1]; r.Outcome != OutcomeDialFailed || r.Error != "refused" || r.SrcIP != "" {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+	if r := records[2]; r.Outcome != OutcomeDialTimeout {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+}
+
+func TestAuditConcurrentWrites(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewAuditor(&buf)
+	var wg sync.WaitGroup
+	const n = 50
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			auditor.TCPClosed(TCPConnRecord{
+				Target:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: i + 1},
+				Start:   time.Now(),
+				Summary: TCPSocketSummary{UploadBytes: int64(i)},
+			})
+		}(i)
+	}
+	wg.Wait()
+	scanner := bufio.NewScanner(&buf)
+	count := 0
+	for scanner.Scan() {
+		decodeRecord(t, append(scanner.Bytes(), '\n'))
+		count++
+	}
+	if count != n {
+		t.Errorf("Expected %d records, got %d", n, count)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Responses to a TCP connection whose destination is blocked by policy, as
+// passed to SetBlockResponse.  The client's handshake has already completed
+// when the destination is checked, so each response is shaped after it.
+const (
+	// BlockResponseRefuse resets the connection, which the app sees as a
+	// refusal.  This is the default.
+	BlockResponseRefuse = "refuse"
+	// BlockResponseDrop never responds to the connection, so the app sees a
+	// timeout, until it is reset after blockDropHold.  The client's data is
+	// acknowledged and discarded.
+	BlockResponseDrop = "drop"
+	// BlockResponseClose closes the connection cleanly, so the app sees it
+	// accepted and then closed by the server.
+	BlockResponseClose = "close"
+)
+
+// blockDropHold is how long BlockResponseDrop holds a connection before it is
+// reset, so that ignored connections don't accumulate.
+const blockDropHold = 2 * time.Minute
+
+func (h *tcpHandler) SetBlockResponse(policy string) error {
+	switch policy {
+	case BlockResponseRefuse, BlockResponseDrop, BlockResponseClose:
+		h.blockResponse = policy
+		return nil
+	}
+	return fmt.Errorf("Unknown block response: %s", policy)
+}
+
+// block responds to `conn`, whose destination was blocked with `err`, and
+// returns the result for Handle.
+func (h *tcpHandler) block(conn net.Conn, err error) error {
+	switch h.blockResponse {
+	case BlockResponseDrop:
+		// Tests shorten the hold.
+		hold := h.blockHold
+		if hold <= 0 {
+			hold = blockDropHold
+		}
+		// lwIP delivers the client's data while holding the stack's lock, so it
+		// must be read, or every other connection stalls.
+		time.AfterFunc(hold, func() { abort(conn) })
+		h.goroutines.goroutine(func() { io.Copy(ioutil.Discard, conn) })
+		return nil
+	case BlockResponseClose:
+		conn.Close()
+		return nil
+	}
+	// Returning an error causes the connection to be reset.
+	return err
+}
+
+// abort resets `conn` if it is a core.TCPConn, and otherwise closes it.
+func abort(conn net.Conn) {
+	if c, ok := conn.(core.TCPConn); ok {
+		c.Abort()
+	} else {
+		conn.Close()
+	}
+}
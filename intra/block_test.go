@@ -0,0 +1,78 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
+)
+
+func TestBlockResponse(t *testing.T) {
+	blocked := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}
+	f := filter.NewFilter(filter.Blocklist)
+	f.AddCIDR(blocked.IP.String())
+	for _, policy := range []string{BlockResponseRefuse, BlockResponseDrop, BlockResponseClose} {
+		h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener()).(*tcpHandler)
+		h.SetFilter(f)
+		if err := h.SetBlockResponse(policy); err != nil {
+			t.Fatal(err)
+		}
+		h.blockHold = 300 * time.Millisecond
+		app, local := makePair(t)
+		defer app.Close()
+		conn := &fakeTCPConn{local}
+		// Like the core, reset the connection if Handle fails.
+		if err := h.Handle(conn, blocked); err != nil {
+			conn.Abort()
+		}
+		if n := h.DropCounts()[DropBlocked]; n != 1 {
+			t.Errorf("%s: expected 1 drop, got %d", policy, n)
+		}
+
+		app.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := app.Read(make([]byte, 1))
+		var neterr net.Error
+		switch policy {
+		case BlockResponseRefuse:
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("%s: expected a reset, got %v", policy, err)
+			}
+		case BlockResponseClose:
+			if err != io.EOF {
+				t.Errorf("%s: expected a clean close, got %v", policy, err)
+			}
+		case BlockResponseDrop:
+			if !errors.As(err, &neterr) || !neterr.Timeout() {
+				t.Fatalf("%s: expected a timeout, got %v", policy, err)
+			}
+			// The held connection is eventually reset.
+			app.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := app.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("%s: expected a reset after the hold, got %v", policy, err)
+			}
+		}
+	}
+
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	if err := h.SetBlockResponse("bogus"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// ByteBudget limits the number of bytes that a single TCP connection may
+// transfer.  A connection that reaches any limit is closed, with
+// CloseReasonByteBudget.  Zero fields are unlimited.
+type ByteBudget struct {
+	MaxConnBytes     int64 // Both directions combined.
+	MaxUploadBytes   int64 // From the client to the server.
+	MaxDownloadBytes int64 // From the server to the client.
+}
+
+func (b ByteBudget) unlimited() bool {
+	return b.MaxConnBytes <= 0 && b.MaxUploadBytes <= 0 && b.MaxDownloadBytes <= 0
+}
+
+var errByteBudget = errors.New("Connection byte budget exhausted")
+
+// connBudget tracks one connection's usage of its ByteBudget.  Bytes are
+// charged after each read, rather than reserved before it, so that a read that
+// is blocked in one direction can't starve the other.  Reads that overshoot a
+// limit are truncated, so the limits are exact.
+type connBudget struct {
+	// Byte counts, accessed atomically.  They are first in the struct to ensure
+	// 64-bit alignment on 32-bit platforms.
+	total    int64
+	upload   int64
+	download int64
+	limits   ByteBudget
+}
+
+// remaining returns `n`, or the number of bytes remaining under `limit` if that
+// is smaller.  A limit that is not positive is unlimited.
+func remaining(used *int64, limit, n int64) int64 {
+	if limit <= 0 {
+		return n
+	}
+	if r := limit - atomic.LoadInt64(used); r < n {
+		if r < 0 {
+			return 0
+		}
+		return r
+	}
+	return n
+}
+
+// charge adds `n` bytes to `used`, and returns the number of them that fit
+// under `limit`.
+func charge(used *int64, limit, n int64) int64 {
+	if limit <= 0 {
+		return n
+	}
+	over := atomic.AddInt64(used, n) - limit
+	switch {
+	case over <= 0:
+		return n
+	case over >= n:
+		return 0
+	default:
+		return n - over
+	}
+}
+
+// budgetReader limits reads from `r` to one direction's share of a connBudget.
+// When the budget is exhausted, it calls `exhausted` and fails.
+type budgetReader struct {
+	r         io.Reader
+	budget    *connBudget
+	used      *int64 // budget.upload or budget.download.
+	limit     int64  // The corresponding limit.
+	exhausted func()
+}
+
+func (r budgetReader) Read(p []byte) (int, error) {
+	b := r.budget
+	max := remaining(&b.total, b.limits.MaxConnBytes, remaining(r.used, r.limit, int64(len(p))))
+	if max == 0 && len(p) > 0 {
+		r.exhausted()
+		return 0, errByteBudget
+	}
+	n, err := r.r.Read(p[:max])
+	allowed := charge(&b.total, b.limits.MaxConnBytes, charge(r.used, r.limit, int64(n)))
+	if allowed < int64(n) {
+		r.exhausted()
+		return int(allowed), errByteBudget
+	}
+	return n, err
+}
+
+// exhausted closes the connection when its ByteBudget runs out.
+func (t *tcpTracker) exhausted() {
+	log.Infof("Closing connection to %v: byte budget exhausted", t.remote.RemoteAddr())
+	t.close(CloseReasonByteBudget)
+}
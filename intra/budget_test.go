@@ -0,0 +1,86 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Forwards a large download with `budget`, and returns the number of bytes
+// that the app received and the connection's record.
+func budgetedDownload(t *testing.T, budget ByteBudget) (int, TCPConnRecord) {
+	records := make(chan TCPConnRecord, 1)
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetByteBudget(budget)
+		h.SetCloseHook(func(r TCPConnRecord) { records <- r })
+	})
+	go s.upstream.Write(bytes.Repeat([]byte{'x'}, 1<<20))
+	b, _ := ioutil.ReadAll(s.app)
+	select {
+	case r := <-records:
+		return len(b), r
+	case <-time.After(time.Second):
+		t.Fatal("Connection was not closed")
+	}
+	return 0, TCPConnRecord{}
+}
+
+func TestByteBudgetDownload(t *testing.T) {
+	const limit = 10000
+	n, record := budgetedDownload(t, ByteBudget{MaxDownloadBytes: limit})
+	if n != limit || record.Summary.DownloadBytes != limit {
+		t.Errorf("Transferred %d bytes (%d reported), want %d", n, record.Summary.DownloadBytes, limit)
+	}
+	if record.CloseReason != CloseReasonByteBudget {
+		t.Errorf("Unexpected close reason %q", record.CloseReason)
+	}
+}
+
+func TestByteBudgetTotal(t *testing.T) {
+	const limit = 5000
+	n, record := budgetedDownload(t, ByteBudget{MaxConnBytes: limit})
+	if n != limit {
+		t.Errorf("Transferred %d bytes, want %d", n, limit)
+	}
+	if record.CloseReason != CloseReasonByteBudget {
+		t.Errorf("Unexpected close reason %q", record.CloseReason)
+	}
+}
+
+// Charges that overshoot a limit are truncated.
+func TestCharge(t *testing.T) {
+	var used int64
+	if n := charge(&used, 10, 6); n != 6 {
+		t.Errorf("Charged %d, want 6", n)
+	}
+	if r := remaining(&used, 10, 100); r != 4 {
+		t.Errorf("%d remaining, want 4", r)
+	}
+	if n := charge(&used, 10, 6); n != 4 {
+		t.Errorf("Charged %d, want 4", n)
+	}
+	if n := charge(&used, 10, 1); n != 0 {
+		t.Errorf("Charged %d beyond the limit", n)
+	}
+	if r := remaining(&used, 10, 100); r != 0 {
+		t.Errorf("%d remaining beyond the limit", r)
+	}
+	if n := charge(&used, 0, 100); n != 100 {
+		t.Errorf("Zero limit should be unlimited, charged %d", n)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"encoding/json"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// TCPConfig is the effective configuration of a TCPHandler, after defaults are
+// applied.  Zero durations and limits mean that the feature is disabled.
+type TCPConfig struct {
+	AlwaysSplitHTTPS    bool
+	MinimalSplit        bool
+	SeparatePackets     bool
+	SYNDataSize         int
+	HostStrategies      map[string]string
+	MaxLearnedSplits    int // Zero if learned splits are disabled.
+	RetryListener       bool
+	ControlHook         bool
+	Proxy               bool
+	ProxyFallback       string
+	DialRetries         int
+	DialRetryBackoff    time.Duration
+	UpstreamTTL         int
+	PortMin             int
+	PortMax             int
+	LocalIPv6           string
+	BlockResponse       string
+	MSSClamp            int
+	UpstreamLinger      time.Duration
+	UserTimeout         time.Duration
+	WriteTimeout        time.Duration
+	ECN                 string
+	MirrorClientMSS     bool
+	MirrorClientOptions bool
+	MirrorClientTTL     bool
+	HalfOpenThreshold   time.Duration
+	ReapHalfOpen        bool
+	IdleTimeout         time.Duration
+	MaxConnLifetime     time.Duration
+	HalfCloseGrace      time.Duration
+	ByteBudget          ByteBudget
+	Throughput          ThroughputLimit
+	DuplicateFlowPolicy string
+	ImmediateClose      string
+	// The preface may be a token, so only its lengths are reported.
+	UpstreamPrefaceLen int
+	ServerPrefaceLen   int
+	// Path quality monitoring.  Zero DegradationInterval means it is disabled.
+	DegradationInterval       time.Duration
+	DegradationMaxRTT         time.Duration
+	DegradationMaxRetransmits uint32
+	StackWriteRetries         int
+	DropLogInterval           time.Duration
+	Middlewares               int // The number of middlewares added by Use.
+	Interceptors              int // The number of factories added by Intercept.
+}
+
+// UDPConfig is the effective configuration of a UDPHandler, after defaults are
+// applied.  Zero durations mean that the feature is disabled.
+type UDPConfig struct {
+	IdleTimeout       time.Duration
+	NoDataTimeout     time.Duration
+	PortTimeouts      map[int]time.Duration // Idle timeouts by destination port.
+	MaxFlows          int                   // Zero if the number of associations is unlimited.
+	ControlHook       bool
+	PortMin           int
+	PortMax           int
+	LocalIPv6         string
+	DNSDedupWindow    time.Duration
+	DNSCapture        bool
+	StackWriteRetries int
+	DropLogInterval   time.Duration
+}
+
+// EffectiveConfig is the effective configuration of a Tunnel, for debugging.
+// Secrets are redacted, so it is safe to log.  It can be serialized with
+// encoding/json.
+type EffectiveConfig struct {
+	// DNSURL is the URL of the DoH transport, with any password redacted, or ""
+	// if the transport has no URL.
+	DNSURL            string
+	DoHStrategyDialer bool
+	PacketCheckPolicy string
+	TCP               TCPConfig
+	UDP               UDPConfig
+}
+
+func (h *tcpHandler) EffectiveConfig() TCPConfig {
+	c := TCPConfig{
+		AlwaysSplitHTTPS:    h.alwaysSplitHTTPS,
+		MinimalSplit:        h.minimalSplit,
+		SeparatePackets:     h.forceSeparate,
+		SYNDataSize:         h.synDataSize,
+		Proxy:               h.proxy != nil,
+		ProxyFallback:       h.proxyFallback,
+		DialRetries:         h.dialRetry.Retries,
+		DialRetryBackoff:    h.dialRetry.Backoff,
+		LocalIPv6:           h.localIPv6,
+		BlockResponse:       h.blockResponse,
+		WriteTimeout:        h.writeTimeout,
+		MirrorClientMSS:     atomic.LoadInt32(&h.mirrorMSS) != 0,
+		MirrorClientOptions: atomic.LoadInt32(&h.mirrorOptions) != 0,
+		MirrorClientTTL:     atomic.LoadInt32(&h.mirrorTTL) != 0,
+		ByteBudget:          h.byteBudget,
+		UpstreamPrefaceLen:  len(h.preface.UpstreamPreface),
+		ServerPrefaceLen:    len(h.preface.ServerPreface),
+		ImmediateClose:      h.immediateClose,
+		StackWriteRetries:   h.stackRetries,
+		DropLogInterval:     h.drops.logInterval(),
+		Middlewares:         len(h.middlewares),
+		Interceptors:        len(h.interceptorFactories),
+	}
+	h.dialMu.RLock()
+	c.ControlHook = h.control != nil
+	c.RetryListener = h.retryListener != nil
+	c.UpstreamTTL = h.sockopts.ttl
+	c.PortMin, c.PortMax = h.sockopts.ports.min, h.sockopts.ports.max
+	c.MSSClamp = h.sockopts.mss
+	c.UpstreamLinger = h.sockopts.linger
+	c.UserTimeout = h.sockopts.userTimeout
+	c.ECN = h.sockopts.ecn
+	h.dialMu.RUnlock()
+	c.Throughput = ThroughputLimit{
+		UploadBytesPerSec:   h.throughput.up.bucket.limit(),
+		DownloadBytesPerSec: h.throughput.down.bucket.limit(),
+	}
+	if len(h.hostStrategies) > 0 {
+		c.HostStrategies = make(map[string]string, len(h.hostStrategies))
+		for host, strategy := range h.hostStrategies {
+			c.HostStrategies[host] = strategy
+		}
+	}
+	if h.learnedSplits != nil {
+		c.MaxLearnedSplits = h.learnedSplits.Max()
+	}
+	if p := h.degradation; p.Interval > 0 && p.Hook != nil {
+		c.DegradationInterval = p.Interval
+		c.DegradationMaxRTT = p.MaxRTT
+		c.DegradationMaxRetransmits = p.MaxRetransmits
+	}
+
+	h.conns.mu.Lock()
+	c.HalfOpenThreshold = h.conns.halfOpenThreshold
+	c.ReapHalfOpen = h.conns.reapHalfOpen
+	c.IdleTimeout = h.conns.idleTimeout
+	c.MaxConnLifetime = h.conns.maxLifetime
+	c.HalfCloseGrace = h.conns.halfCloseGrace
+	h.conns.mu.Unlock()
+
+	h.flows.mu.Lock()
+	c.DuplicateFlowPolicy = h.flows.policy
+	h.flows.mu.Unlock()
+	if c.DuplicateFlowPolicy == "" {
+		c.DuplicateFlowPolicy = DuplicateFlowIgnore
+	}
+	if c.ImmediateClose == "" {
+		c.ImmediateClose = ImmediateCloseHalfClose
+	}
+	if c.BlockResponse == "" {
+		c.BlockResponse = BlockResponseRefuse
+	}
+	if c.ProxyFallback == "" {
+		c.ProxyFallback = ProxyFallbackOff
+	}
+	if c.LocalIPv6 == "" {
+		c.LocalIPv6 = LocalIPv6Drop
+	}
+	return c
+}
+
+func (h *udpHandler) EffectiveConfig() UDPConfig {
+	h.RLock()
+	c := UDPConfig{
+		IdleTimeout:       h.timeout,
+		NoDataTimeout:     h.noData,
+		ControlHook:       h.control != nil,
+		PortMin:           h.ports.min,
+		PortMax:           h.ports.max,
+		LocalIPv6:         h.scope,
+		DNSCapture:        h.capture,
+		StackWriteRetries: h.stackRetries,
+		MaxFlows:          h.maxFlows,
+	}
+	if len(h.portTimeouts) > 0 {
+		c.PortTimeouts = make(map[int]time.Duration, len(h.portTimeouts))
+		for port, idle := range h.portTimeouts {
+			c.PortTimeouts[port] = idle
+		}
+	}
+	h.RUnlock()
+	if c.LocalIPv6 == "" {
+		c.LocalIPv6 = LocalIPv6Drop
+	}
+	h.dedup.mu.Lock()
+	c.DNSDedupWindow = h.dedup.window
+	h.dedup.mu.Unlock()
+	c.DropLogInterval = h.drops.logInterval()
+	return c
+}
+
+func (t *intratunnel) EffectiveConfig() EffectiveConfig {
+	c := EffectiveConfig{
+		DoHStrategyDialer: t.dohStrategyDialer,
+		PacketCheckPolicy: t.packets.policy(),
+		TCP:               t.tcp.EffectiveConfig(),
+		UDP:               t.udp.EffectiveConfig(),
+	}
+	if t.dns != nil {
+		c.DNSURL = redactURL(t.dns.GetURL())
+	}
+	return c
+}
+
+func (t *intratunnel) GetEffectiveConfigJSON() (string, error) {
+	b, err := json.Marshal(t.EffectiveConfig())
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// redactURL replaces any password in `rawurl` with "xxxxx".  If `rawurl` can't
+// be parsed, it is omitted entirely, in case it contains a secret.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+// DefaultMaxDestinations is the number of destinations tracked by a
+// DestinationAggregator if no limit is specified.
+const DefaultMaxDestinations = 1000
+
+// DestinationStats is a rollup of the TCP connections to one destination.
+type DestinationStats struct {
+	Destination string // The destination's IP address and port.
+	// Hostname is the most recent TLS SNI observed for this destination, if any.
+	Hostname string
+	// ASN is the destination's autonomous system number, if the TCP handler has
+	// an ASNLookup.
+	ASN           uint32
+	Connections   int64 // Connections that were forwarded and closed.
+	Failures      int64 // Dials that failed.
+	Retries       int64 // Forwarded connections that required a split retry.
+	UploadBytes   int64
+	DownloadBytes int64
+}
+
+// RetryRate returns the fraction of forwarded connections that required a
+// split retry.
+func (s DestinationStats) RetryRate() float64 {
+	if s.Connections == 0 {
+		return 0
+	}
+	return float64(s.Retries) / float64(s.Connections)
+}
+
+// DestinationAggregator accumulates statistics for each destination.
+// DestinationAggregator.TCPClosed can be used as a TCPCloseHook, and
+// DestinationAggregator.DialFailed as a DialFailureHook.  Only the most
+// recently used destinations are kept, so memory use is bounded.  It is safe
+// for concurrent use.
+type DestinationAggregator struct {
+	mu      sync.Mutex // Protects all fields.
+	max     int
+	lru     *list.List // Front is the most recently used.  Values are *DestinationStats.
+	entries map[string]*list.Element
+}
+
+// NewDestinationAggregator returns a DestinationAggregator that tracks at most
+// `maxDestinations` destinations.  If `maxDestinations` is not positive,
+// DefaultMaxDestinations is used.
+func NewDestinationAggregator(maxDestinations int) *DestinationAggregator {
+	if maxDestinations <= 0 {
+		maxDestinations = DefaultMaxDestinations
+	}
+	return &DestinationAggregator{
+		max:     maxDestinations,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the stats for `target`, creating them and evicting the least
+// recently used destination if necessary.  The caller must hold a.mu.
+func (a *DestinationAggregator) get(target net.Addr) *DestinationStats {
+	key := target.String()
+	if elem, ok := a.entries[key]; ok {
+		a.lru.MoveToFront(elem)
+		return elem.Value.(*DestinationStats)
+	}
+	s := &DestinationStats{Destination: key}
+	a.entries[key] = a.lru.PushFront(s)
+	if a.lru.Len() > a.max {
+		oldest := a.lru.Back()
+		a.lru.Remove(oldest)
+		delete(a.entries, oldest.Value.(*DestinationStats).Destination)
+	}
+	return s
+}
+
+// TCPClosed adds a forwarded connection to its destination's stats.
+func (a *DestinationAggregator) TCPClosed(c TCPConnRecord) {
+	if c.Target == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.get(c.Target)
+	s.Connections++
+	s.UploadBytes += c.Summary.UploadBytes
+	s.DownloadBytes += c.Summary.DownloadBytes
+	if retry := c.Summary.Retry; retry != nil && retry.Retried {
+		s.Retries++
+	}
+	if c.Hostname != "" {
+		s.Hostname = c.Hostname
+	}
+	if c.ASN != 0 {
+		s.ASN = c.ASN
+	}
+}
+
+// DialFailed adds a failed dial to its destination's stats.
+func (a *DestinationAggregator) DialFailed(f DialFailure) {
+	if f.Target == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.get(f.Target).Failures++
+}
+
+// Snapshot returns a copy of the stats for each tracked destination, most
+// recently used first.
+func (a *DestinationAggregator) Snapshot() []DestinationStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	snapshot := make([]DestinationStats, 0, a.lru.Len())
+	for elem := a.lru.Front(); elem != nil; elem = elem.Next() {
+		snapshot = append(snapshot, *elem.Value.(*DestinationStats))
+	}
+	return snapshot
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// Returns a server that reads its input and then replies with `reply`.
+func makeReplyServer(t *testing.T, reply string) *net.TCPAddr {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ioutil.ReadAll(c)
+				io.WriteString(c, reply)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestDestinationRollups(t *testing.T) {
+	agg := NewDestinationAggregator(10)
+	closed := make(chan struct{}, 10)
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.SetCloseHook(func(r TCPConnRecord) {
+		agg.TCPClosed(r)
+		closed <- struct{}{}
+	})
+	h.SetDialFailureHook(agg.DialFailed)
+
+	a := makeReplyServer(t, "ab")
+	b := makeReplyServer(t, "abcd")
+	send := func(target *net.TCPAddr, data string) {
+		app, local := makePair(t)
+		if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(app, data)
+		app.CloseWrite()
+		ioutil.ReadAll(app)
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("Connection did not close")
+		}
+	}
+	send(a, "x")
+	send(b, "xyz")
+	send(a, "xy")
+
+	// A failed dial to a closed port.
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().(*net.TCPAddr)
+	l.Close()
+	_, local := makePair(t)
+	if err := h.Handle(&fakeTCPConn{local}, refused); err == nil {
+		t.Fatal("Expected the dial to fail")
+	}
+
+	snapshot := agg.Snapshot()
+	if len(snapshot) != 3 {
+		t.Fatalf("Expected 3 destinations, got %+v", snapshot)
+	}
+	byDest := make(map[string]DestinationStats)
+	for _, s := range snapshot {
+		byDest[s.Destination] = s
+	}
+	if s := byDest[a.String()]; s.Connections != 2 || s.UploadBytes != 3 || s.DownloadBytes != 4 || s.Failures != 0 {
+		t.Errorf("Unexpected stats for %v: %+v", a, s)
+	}
+	if s := byDest[b.String()]; s.Connections != 1 || s.UploadBytes != 3 || s.DownloadBytes != 4 {
+		t.Errorf("Unexpected stats for %v: %+v", b, s)
+	}
+	if s := byDest[refused.String()]; s.Failures != 1 || s.Connections != 0 {
+		t.Errorf("Unexpected stats for %v: %+v", refused, s)
+	}
+	if snapshot[0].Destination != refused.String() {
+		t.Errorf("Snapshot should start with the most recent destination: %+v", snapshot)
+	}
+}
+
+func TestDestinationRetryRate(t *testing.T) {
+	agg := NewDestinationAggregator(0)
+	target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	for i := 0; i < 4; i++ {
+		r := TCPConnRecord{Target: target, Summary: TCPSocketSummary{Retry: &split.RetryStats{}}}
+		if i == 0 {
+			r.Summary.Retry.Split = 32
+			r.Summary.Retry.Retried = true
+			r.Hostname = "example.com"
+		}
+		agg.TCPClosed(r)
+	}
+	s := agg.Snapshot()[0]
+	if s.Retries != 1 || s.RetryRate() != 0.25 || s.Hostname != "example.com" {
+		t.Errorf("Unexpected stats: %+v, rate %v", s, s.RetryRate())
+	}
+	if (DestinationStats{}).RetryRate() != 0 {
+		t.Error("Rate without connections should be zero")
+	}
+}
+
+func TestASNLookup(t *testing.T) {
+	const asn = 64496 // Reserved for documentation.
+	agg := NewDestinationAggregator(0)
+	records := make(chan TCPConnRecord, 1)
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.SetCloseHook(func(r TCPConnRecord) {
+		agg.TCPClosed(r)
+		records <- r
+	})
+	var looked net.IP
+	h.SetASNLookup(func(ip net.IP) uint32 {
+		looked = ip
+		return asn
+	})
+
+	target := makeReplyServer(t, "ab")
+	app, local := makePair(t)
+	if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+		t.Fatal(err)
+	}
+	app.CloseWrite()
+	ioutil.ReadAll(app)
+	select {
+	case r := <-records:
+		if r.ASN != asn || !looked.Equal(target.IP) {
+			t.Errorf("Unexpected ASN %d for %v", r.ASN, looked)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Connection did not close")
+	}
+	if s := agg.Snapshot()[0]; s.ASN != asn {
+		t.Errorf("The ASN should appear in the stats: %+v", s)
+	}
+}
+
+func TestDestinationLRU(t *testing.T) {
+	agg := NewDestinationAggregator(2)
+	addr := func(port int) *net.TCPAddr {
+		return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}
+	}
+	agg.DialFailed(DialFailure{Target: addr(1)})
+	agg.DialFailed(DialFailure{Target: addr(2)})
+	// Use port 1 so that port 2 is the least recently used.
+	agg.TCPClosed(TCPConnRecord{Target: addr(1)})
+	agg.DialFailed(DialFailure{Target: addr(3)})
+
+	snapshot := agg.Snapshot()
+	if len(snapshot) != 2 || snapshot[0].Destination != addr(3).String() || snapshot[1].Destination != addr(1).String() {
+		t.Fatalf("Unexpected destinations: %+v", snapshot)
+	}
+	if s := snapshot[1]; s.Failures != 1 || s.Connections != 1 {
+		t.Errorf("Stats were not retained: %+v", s)
+	}
+}
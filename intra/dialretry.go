@@ -0,0 +1,71 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/httpproxy"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// DialRetryPolicy re-runs the whole dial of a connection if it fails, e.g. so
+// that a ProxyDialer can select a different proxy.  Each attempt dials through
+// the proxy (and falls back according to SetProxyFallback), or dials directly
+// with the HTTPS strategy.
+//
+// Only the dial is retried.  Once the upstream connection is established,
+// failures are left to the split-retry strategy, which re-sends the hello
+// itself, so the two never retry the same failure.
+type DialRetryPolicy struct {
+	Retries int           // Attempts after the first.  Zero disables retries.
+	Backoff time.Duration // The wait before the first retry, doubled for each later retry.
+}
+
+func (h *tcpHandler) SetDialRetryPolicy(p DialRetryPolicy) {
+	h.dialRetry = p
+}
+
+// retryable reports whether a dial that failed with `err` might succeed if it
+// is attempted again.  The proxy's credentials, and its decision to refuse the
+// destination, won't change between attempts.
+func retryable(err error) bool {
+	return !errors.Is(err, httpproxy.ErrAuthRequired) && !errors.Is(err, httpproxy.ErrRefused)
+}
+
+// dial connects to `target` for `conn`, retrying according to the
+// DialRetryPolicy.  It returns the strategy of the successful attempt, or the
+// error from the last attempt.  Shutdown cancels the wait between attempts.
+func (h *tcpHandler) dial(conn net.Conn, target *net.TCPAddr, summary *TCPSocketSummary) (split.DuplexConn, string, error) {
+	backoff := h.dialRetry.Backoff
+	for attempt := 0; ; attempt++ {
+		c, strategy, err := h.dialOnce(conn, target, summary)
+		if err == nil || attempt >= h.dialRetry.Retries || !retryable(err) {
+			return c, strategy, err
+		}
+		log.Infof("Dial %d to %s failed, retrying in %v: %v", attempt+1, target, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-h.ctx.Done():
+			timer.Stop()
+			return c, strategy, err
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/httpproxy"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// Returns the address of a working CONNECT proxy.
+func makeConnectProxy(t *testing.T) string {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					fmt.Fprint(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				fmt.Fprint(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() {
+					io.Copy(upstream, r)
+					upstream.(*net.TCPConn).CloseWrite()
+				}()
+				io.Copy(c, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Returns an address where nothing is listening.
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+// rotatingProxy uses each of its proxies in turn.
+type rotatingProxy struct {
+	proxies []string
+	dials   int32 // Accessed atomically.
+}
+
+func (p *rotatingProxy) DialTCP(addr string) (split.DuplexConn, error) {
+	n := atomic.AddInt32(&p.dials, 1) - 1
+	d := &httpproxy.Dialer{Proxy: p.proxies[int(n)%len(p.proxies)]}
+	return d.DialTCP(addr)
+}
+
+func TestDialRetryDifferentProxy(t *testing.T) {
+	server, _ := makeEchoServer(t)
+	for _, retries := range []int{0, 1} {
+		proxy := &rotatingProxy{proxies: []string{closedAddr(t), makeConnectProxy(t)}}
+		h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+		h.SetProxy(proxy)
+		h.SetDialRetryPolicy(DialRetryPolicy{Retries: retries, Backoff: 10 * time.Millisecond})
+		err := handleEcho(t, h, server)
+		if retries == 0 && err == nil {
+			t.Error("The first proxy should fail without retries")
+		} else if retries > 0 && err != nil {
+			t.Errorf("The retry should use the second proxy: %v", err)
+		}
+		if n := atomic.LoadInt32(&proxy.dials); int(n) != retries+1 {
+			t.Errorf("Expected %d attempts, got %d", retries+1, n)
+		}
+	}
+}
+
+func TestDialRetryRefused(t *testing.T) {
+	server, _ := makeEchoServer(t)
+	proxy, requests := makeRefusingProxy(t, "403 Forbidden")
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.SetProxy(&httpproxy.Dialer{Proxy: proxy})
+	h.SetDialRetryPolicy(DialRetryPolicy{Retries: 2, Backoff: time.Hour})
+	if err := handleEcho(t, h, server); err == nil {
+		t.Error("Expected the dial to fail")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("Refusals should not be retried: %d attempts", n)
+	}
+}
+
+func TestDialRetryShutdown(t *testing.T) {
+	server, _ := makeEchoServer(t)
+	proxy := &rotatingProxy{proxies: []string{closedAddr(t)}}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.SetProxy(proxy)
+	h.SetDialRetryPolicy(DialRetryPolicy{Retries: 2, Backoff: time.Hour})
+	app, local := makePair(t)
+	defer app.Close()
+	done := make(chan error)
+	go func() {
+		done <- h.Handle(&fakeTCPConn{local}, server)
+	}()
+	for atomic.LoadInt32(&proxy.dials) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	h.Shutdown()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected the dial to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown should cancel the backoff")
+	}
+	if n := atomic.LoadInt32(&proxy.dials); n != 1 {
+		t.Errorf("Dials should not be retried after Shutdown: %d attempts", n)
+	}
+}
+
+func TestDialRetryAuthRequired(t *testing.T) {
+	server, _ := makeEchoServer(t)
+	proxy, requests := makeRefusingProxy(t, "407 Proxy Authentication Required")
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.SetProxy(&httpproxy.Dialer{Proxy: proxy})
+	h.SetDialRetryPolicy(DialRetryPolicy{Retries: 2})
+	if err := handleEcho(t, h, server); err == nil {
+		t.Error("Expected the dial to fail")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("Missing credentials should not be retried: %d attempts", n)
+	}
+}
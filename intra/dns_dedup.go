@@ -0,0 +1,91 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// dnsWaiter is a UDP association that is waiting for a DNS response.
+type dnsWaiter struct {
+	conn core.UDPConn
+	t    *tracker
+	from *net.UDPAddr // The response's source address.
+}
+
+// dnsQuery is an outstanding DNS query.
+type dnsQuery struct {
+	start   time.Time
+	waiters []dnsWaiter
+}
+
+// dnsDedup suppresses retransmissions of outstanding DNS queries.  Queries are
+// keyed by their exact bytes, so only queries with the same ID and question
+// are treated as duplicates.
+type dnsDedup struct {
+	mu sync.Mutex // Protects all fields.
+	// A query that is identical to an outstanding query sent less than this long
+	// ago is not sent upstream.  Instead, the original query's response is
+	// delivered to it.  Zero disables deduplication.
+	window  time.Duration
+	pending map[string]*dnsQuery
+}
+
+// join registers `w` as waiting for the response to `key`.  If the result is
+// true, the caller must send the query and then call finish.  Otherwise, an
+// identical query is already outstanding, and its response will satisfy `w`.
+func (d *dnsDedup) join(key string, w dnsWaiter) (*dnsQuery, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if q, ok := d.pending[key]; ok && now.Sub(q.start) < d.window {
+		for _, existing := range q.waiters {
+			if existing.conn == w.conn {
+				// The response will be delivered to this association already.
+				return q, false
+			}
+		}
+		q.waiters = append(q.waiters, w)
+		return q, false
+	}
+	q := &dnsQuery{start: now, waiters: []dnsWaiter{w}}
+	if d.window > 0 {
+		if d.pending == nil {
+			d.pending = make(map[string]*dnsQuery)
+		}
+		d.pending[key] = q
+	}
+	return q, true
+}
+
+// finish stops accepting duplicates of `q`, and returns its waiters.
+func (d *dnsDedup) finish(key string, q *dnsQuery) []dnsWaiter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending[key] == q {
+		delete(d.pending, key)
+	}
+	return q.waiters
+}
+
+func (d *dnsDedup) setWindow(window time.Duration) {
+	d.mu.Lock()
+	d.window = window
+	d.mu.Unlock()
+}
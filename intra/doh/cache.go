@@ -0,0 +1,268 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/clock"
+)
+
+// DefaultCacheSize is the maximum number of cached responses if no size is
+// specified.
+const DefaultCacheSize = 1000
+
+// DefaultMaxNegativeTTL is the longest time that a negative response
+// (NXDOMAIN or NODATA) is cached, unless changed by SetMaxNegativeTTL.
+const DefaultMaxNegativeTTL = 5 * time.Minute
+
+// CacheStats describes the state of a CachingTransport.
+type CacheStats struct {
+	Size   int   // Number of cached responses.
+	Hits   int64 // Queries answered from the cache.
+	Misses int64 // Queries sent to the underlying transport.
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	key     string
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// CachingTransport is a Transport that caches successful responses from
+// another Transport until their TTL expires.  Negative responses are also
+// cached, as described in RFC 2308.  The number of cached responses is
+// bounded, and the least recently used response is evicted when the cache is
+// full.
+type CachingTransport struct {
+	Transport
+	mu      sync.Mutex // Protects all fields below.
+	max     int
+	negTTL  time.Duration
+	lru     *list.List // Front is the most recently used.  Values are *cacheEntry.
+	entries map[string]*list.Element
+	hits    int64
+	misses  int64
+	clock   clock.Clock // Source of time for TTLs.  Nil means clock.Real.
+}
+
+// NewCachingTransport returns a CachingTransport that forwards cache misses
+// to `t`, and holds at most `maxEntries` responses.  If `maxEntries` is not
+// positive, DefaultCacheSize is used.
+func NewCachingTransport(t Transport, maxEntries int) *CachingTransport {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheSize
+	}
+	return &CachingTransport{
+		Transport: t,
+		max:       maxEntries,
+		negTTL:    DefaultMaxNegativeTTL,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// SetMaxNegativeTTL sets the longest time that a negative response is cached,
+// regardless of the TTL in its SOA record.  Zero disables negative caching.
+// Responses that are already cached are not affected.
+func (c *CachingTransport) SetMaxNegativeTTL(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.negTTL = d
+}
+
+// cacheKey returns the cache key for the query `q`, which ignores the query ID.
+func cacheKey(q []byte) string {
+	return string(q[2:])
+}
+
+// Query returns a cached response if possible, and otherwise queries the
+// underlying transport.
+func (c *CachingTransport) Query(q []byte) ([]byte, error) {
+	return c.QueryContext(context.Background(), q)
+}
+
+// QueryContext is like Query, but cache misses are canceled when `ctx` is
+// done.
+func (c *CachingTransport) QueryContext(ctx context.Context, q []byte) ([]byte, error) {
+	if len(q) < 2 {
+		return QueryContext(ctx, c.Transport, q)
+	}
+	key := cacheKey(q)
+	if resp := c.lookup(key, id(q)); resp != nil {
+		return resp, nil
+	}
+	resp, err := QueryContext(ctx, c.Transport, q)
+	if err == nil {
+		c.store(key, resp)
+	}
+	return resp, err
+}
+
+// lookup returns the cached response for `key` with its ID set to `qid` and
+// its TTLs reduced by the time spent in the cache, or nil on a cache miss.
+func (c *CachingTransport) lookup(key string, qid uint16) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	now := clock.Or(c.clock).Now()
+	if ok && now.After(elem.Value.(*cacheEntry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil
+	}
+	e := elem.Value.(*cacheEntry)
+	msg := e.msg
+	msg.ID = qid
+	age := uint32(now.Sub(e.stored).Seconds())
+	msg.Answers = aged(e.msg.Answers, age)
+	msg.Authorities = aged(e.msg.Authorities, age)
+	resp, err := msg.Pack()
+	if err != nil {
+		c.remove(elem)
+		c.misses++
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	c.hits++
+	return resp
+}
+
+// aged returns a copy of `rrs` with their TTLs reduced by `age` seconds, but
+// not below zero.
+func aged(rrs []dnsmessage.Resource, age uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return rrs
+	}
+	out := append([]dnsmessage.Resource{}, rrs...)
+	for i := range out {
+		if out[i].Header.TTL > age {
+			out[i].Header.TTL -= age
+		} else {
+			out[i].Header.TTL = 0
+		}
+	}
+	return out
+}
+
+// negativeTTL returns the TTL of the negative response `msg`, which is the
+// lesser of its SOA record's TTL and MINIMUM field (RFC 2308, Section 5).  A
+// negative response without an SOA record should not be cached, so zero is
+// returned.
+func negativeTTL(msg *dnsmessage.Message) uint32 {
+	for _, a := range msg.Authorities {
+		soa, ok := a.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+		if soa.MinTTL < a.Header.TTL {
+			return soa.MinTTL
+		}
+		return a.Header.TTL
+	}
+	return 0
+}
+
+// store caches `resp` if it is a successful response with a nonzero TTL, or a
+// negative response (NXDOMAIN, or NOERROR without answers) with an SOA record.
+func (c *CachingTransport) store(key string, resp []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	if msg.Truncated {
+		return
+	}
+	var ttl time.Duration
+	if msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0 {
+		min := msg.Answers[0].Header.TTL
+		for _, a := range msg.Answers[1:] {
+			if a.Header.TTL < min {
+				min = a.Header.TTL
+			}
+		}
+		ttl = time.Duration(min) * time.Second
+	} else if msg.RCode == dnsmessage.RCodeSuccess || msg.RCode == dnsmessage.RCodeNameError {
+		ttl = time.Duration(negativeTTL(&msg)) * time.Second
+		c.mu.Lock()
+		if ttl > c.negTTL {
+			ttl = c.negTTL
+		}
+		c.mu.Unlock()
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := clock.Or(c.clock).Now()
+	e := &cacheEntry{
+		key:     key,
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove evicts `elem`.  The caller must hold c.mu.
+func (c *CachingTransport) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// Stats returns the current size of the cache and its hit and miss counts.
+func (c *CachingTransport) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Size:   c.lru.Len(),
+		Hits:   c.hits,
+		Misses: c.misses,
+	}
+}
+
+// Flush removes all cached responses.
+func (c *CachingTransport) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// ResetStats zeroes the hit and miss counts.
+func (c *CachingTransport) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hits = 0
+	c.misses = 0
+}
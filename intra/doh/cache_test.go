@@ -0,0 +1,266 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/clock"
+)
+
+// answeringTransport answers each A query with a single record.
+type answeringTransport struct {
+	Transport
+	ttl     uint32
+	rcode   dnsmessage.RCode
+	queries int
+	nodata  bool                    // If true, successful responses have no answers.
+	soa     *dnsmessage.SOAResource // If set, added as an authority with TTL `ttl`.
+}
+
+func (t *answeringTransport) Query(q []byte) ([]byte, error) {
+	t.queries++
+	msg := mustUnpack(q)
+	msg.Response = true
+	msg.RCode = t.rcode
+	if t.soa != nil {
+		msg.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("example."),
+				Type:  dnsmessage.TypeSOA,
+				Class: dnsmessage.ClassINET,
+				TTL:   t.ttl,
+			},
+			Body: t.soa,
+		}}
+	}
+	if t.rcode == dnsmessage.RCodeSuccess && !t.nodata {
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  msg.Questions[0].Name,
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   t.ttl,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}}
+	}
+	return mustPack(msg), nil
+}
+
+func (t *answeringTransport) GetURL() string {
+	return "answering"
+}
+
+// Returns a query for `name` with the given ID.
+func makeQuery(name string, qid uint16) []byte {
+	msg := simpleQuery
+	msg.ID = qid
+	msg.Questions = []dnsmessage.Question{{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}}
+	return mustPack(&msg)
+}
+
+func checkStats(t *testing.T, c *CachingTransport, want CacheStats) {
+	if got := c.Stats(); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	base := &answeringTransport{ttl: 60}
+	c := NewCachingTransport(base, 10)
+	if _, err := c.Query(makeQuery("a.example.", 1)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Query(makeQuery("a.example.", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := mustUnpack(resp)
+	if msg.ID != 2 {
+		t.Errorf("Cached response has the wrong ID: %d", msg.ID)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Header.TTL > 60 {
+		t.Errorf("Unexpected answers: %v", msg.Answers)
+	}
+	if base.queries != 1 {
+		t.Errorf("Expected one upstream query, got %d", base.queries)
+	}
+	checkStats(t, c, CacheStats{Size: 1, Hits: 1, Misses: 1})
+	if c.GetURL() != "answering" {
+		t.Errorf("Unexpected URL: %s", c.GetURL())
+	}
+}
+
+func TestCacheFlush(t *testing.T) {
+	base := &answeringTransport{ttl: 60}
+	c := NewCachingTransport(base, 10)
+	c.Query(makeQuery("a.example.", 1))
+	c.Query(makeQuery("a.example.", 2))
+	c.Flush()
+	checkStats(t, c, CacheStats{Size: 0, Hits: 1, Misses: 1})
+	c.ResetStats()
+	checkStats(t, c, CacheStats{})
+	c.Query(makeQuery("a.example.", 3))
+	if base.queries != 2 {
+		t.Errorf("Flushed response should be refreshed: %d queries", base.queries)
+	}
+	checkStats(t, c, CacheStats{Size: 1, Misses: 1})
+}
+
+func TestCacheExpiry(t *testing.T) {
+	base := &answeringTransport{ttl: 60}
+	c := NewCachingTransport(base, 10)
+	fake := clock.NewFake(time.Unix(0, 0))
+	c.clock = fake
+	c.Query(makeQuery("a.example.", 1))
+	fake.Advance(45 * time.Second)
+	resp, err := c.Query(makeQuery("a.example.", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := mustUnpack(resp); msg.Answers[0].Header.TTL != 15 {
+		t.Errorf("Expected a TTL of 15, got %d", msg.Answers[0].Header.TTL)
+	}
+	fake.Advance(16 * time.Second)
+	c.Query(makeQuery("a.example.", 3))
+	if base.queries != 2 {
+		t.Errorf("Expired response should be refreshed: %d queries", base.queries)
+	}
+	checkStats(t, c, CacheStats{Size: 1, Hits: 1, Misses: 2})
+}
+
+func TestCacheEviction(t *testing.T) {
+	base := &answeringTransport{ttl: 60}
+	c := NewCachingTransport(base, 2)
+	c.Query(makeQuery("a.example.", 1))
+	c.Query(makeQuery("b.example.", 2))
+	// Use "a" so that "b" is the least recently used.
+	c.Query(makeQuery("a.example.", 3))
+	// Exceed the cap.
+	c.Query(makeQuery("c.example.", 4))
+	checkStats(t, c, CacheStats{Size: 2, Hits: 1, Misses: 3})
+
+	c.Query(makeQuery("a.example.", 5))
+	c.Query(makeQuery("c.example.", 6))
+	checkStats(t, c, CacheStats{Size: 2, Hits: 3, Misses: 3})
+	// "b" was evicted.
+	c.Query(makeQuery("b.example.", 7))
+	checkStats(t, c, CacheStats{Size: 2, Hits: 3, Misses: 4})
+	if base.queries != 4 {
+		t.Errorf("Expected 4 upstream queries, got %d", base.queries)
+	}
+}
+
+func TestCacheSkipsFailures(t *testing.T) {
+	base := &answeringTransport{ttl: 60, rcode: dnsmessage.RCodeServerFailure}
+	c := NewCachingTransport(base, 10)
+	c.Query(makeQuery("a.example.", 1))
+	c.Query(makeQuery("a.example.", 2))
+	checkStats(t, c, CacheStats{Size: 0, Hits: 0, Misses: 2})
+}
+
+func TestCacheSkipsZeroTTL(t *testing.T) {
+	base := &answeringTransport{ttl: 0}
+	c := NewCachingTransport(base, 10)
+	c.Query(makeQuery("a.example.", 1))
+	c.Query(makeQuery("a.example.", 2))
+	checkStats(t, c, CacheStats{Size: 0, Hits: 0, Misses: 2})
+}
+
+func TestCacheDefaultSize(t *testing.T) {
+	c := NewCachingTransport(&answeringTransport{ttl: 60}, 0)
+	if c.max != DefaultCacheSize {
+		t.Errorf("Unexpected size: %d", c.max)
+	}
+}
+
+func makeSOA(minTTL uint32) *dnsmessage.SOAResource {
+	return &dnsmessage.SOAResource{
+		NS:     dnsmessage.MustNewName("ns.example."),
+		MBox:   dnsmessage.MustNewName("admin.example."),
+		MinTTL: minTTL,
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	for _, base := range []*answeringTransport{
+		{ttl: 300, rcode: dnsmessage.RCodeNameError, soa: makeSOA(30)},
+		{ttl: 300, nodata: true, soa: makeSOA(30)},
+	} {
+		c := NewCachingTransport(base, 10)
+		fake := clock.NewFake(time.Unix(0, 0))
+		c.clock = fake
+		c.Query(makeQuery("a.example.", 1))
+		fake.Advance(10 * time.Second)
+		resp, err := c.Query(makeQuery("a.example.", 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := mustUnpack(resp)
+		if msg.ID != 2 || msg.RCode != base.rcode || len(msg.Answers) != 0 {
+			t.Errorf("Unexpected cached response: %v", msg.Header)
+		}
+		if len(msg.Authorities) != 1 || msg.Authorities[0].Header.TTL != 290 {
+			t.Errorf("Expected the SOA TTL to be reduced: %v", msg.Authorities)
+		}
+		// The SOA's MINIMUM is lower than its TTL, so it limits the TTL.
+		fake.Advance(21 * time.Second)
+		c.Query(makeQuery("a.example.", 3))
+		if base.queries != 2 {
+			t.Errorf("Expired negative response should be refreshed: %d queries", base.queries)
+		}
+		checkStats(t, c, CacheStats{Size: 1, Hits: 1, Misses: 2})
+	}
+}
+
+func TestCacheNegativeWithoutSOA(t *testing.T) {
+	base := &answeringTransport{ttl: 60, rcode: dnsmessage.RCodeNameError}
+	c := NewCachingTransport(base, 10)
+	c.Query(makeQuery("a.example.", 1))
+	c.Query(makeQuery("a.example.", 2))
+	checkStats(t, c, CacheStats{Size: 0, Hits: 0, Misses: 2})
+}
+
+func TestCacheMaxNegativeTTL(t *testing.T) {
+	base := &answeringTransport{ttl: 300, rcode: dnsmessage.RCodeNameError, soa: makeSOA(300)}
+	c := NewCachingTransport(base, 10)
+	if c.negTTL != DefaultMaxNegativeTTL {
+		t.Errorf("Unexpected default: %v", c.negTTL)
+	}
+	fake := clock.NewFake(time.Unix(0, 0))
+	c.clock = fake
+	c.SetMaxNegativeTTL(10 * time.Second)
+	c.Query(makeQuery("a.example.", 1))
+	fake.Advance(9 * time.Second)
+	c.Query(makeQuery("a.example.", 2))
+	fake.Advance(2 * time.Second)
+	c.Query(makeQuery("a.example.", 3))
+	checkStats(t, c, CacheStats{Size: 1, Hits: 1, Misses: 2})
+
+	c.Flush()
+	c.ResetStats()
+	c.SetMaxNegativeTTL(0)
+	c.Query(makeQuery("a.example.", 4))
+	c.Query(makeQuery("a.example.", 5))
+	checkStats(t, c, CacheStats{Size: 0, Hits: 0, Misses: 2})
+}
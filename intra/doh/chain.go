@@ -0,0 +1,126 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// chainTransport sends each query to a sequence of resolvers, moving on to
+// the next resolver if a query fails.
+type chainTransport struct {
+	Transport
+	transports      []Transport
+	servfailRetries int
+}
+
+// NewChainTransport returns a Transport that tries each of `transports` in
+// order.  If a query fails without a response (e.g. a connection failure), it
+// is sent to the next transport.  SERVFAIL responses, which some resolvers
+// return transiently, are also retried on the next transport, but at most
+// `servfailRetries` times per query.  Other responses, including NXDOMAIN,
+// are definitive and are returned immediately.
+func NewChainTransport(transports []Transport, servfailRetries int) (Transport, error) {
+	if len(transports) == 0 {
+		return nil, errors.New("No transports")
+	}
+	if servfailRetries < 0 {
+		servfailRetries = 0
+	}
+	return &chainTransport{
+		transports:      transports,
+		servfailRetries: servfailRetries,
+	}, nil
+}
+
+// isServfail reports whether `response` is a SERVFAIL.
+func isServfail(response []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(response)
+	return err == nil && h.RCode == dnsmessage.RCodeServerFailure
+}
+
+func (t *chainTransport) Query(q []byte) ([]byte, error) {
+	response, _, err := t.query(q, 0)
+	return response, err
+}
+
+// query tries the transports in order, starting at index `start` and wrapping
+// around, and returns the index of the transport that produced the result.
+func (t *chainTransport) query(q []byte, start int) (response []byte, index int, err error) {
+	servfails := 0
+	for i := range t.transports {
+		index = (start + i) % len(t.transports)
+		transport := t.transports[index]
+		response, err = transport.Query(q)
+		last := i == len(t.transports)-1
+		if err != nil {
+			if !last {
+				log.Debugf("Query to %s failed, trying the next resolver: %v", transport.GetURL(), err)
+			}
+			continue
+		}
+		if !isServfail(response) || servfails >= t.servfailRetries {
+			return
+		}
+		servfails++
+		if !last {
+			log.Debugf("SERVFAIL from %s, trying the next resolver", transport.GetURL())
+		}
+	}
+	return
+}
+
+// GetURL returns the URLs of all the transports, separated by commas.
+func (t *chainTransport) GetURL() string {
+	urls := make([]string, len(t.transports))
+	for i, transport := range t.transports {
+		urls[i] = transport.GetURL()
+	}
+	return strings.Join(urls, ",")
+}
+
+// failoverTransport is a chainTransport that starts each query at the
+// transport that last answered.
+type failoverTransport struct {
+	*chainTransport
+	preferred int32 // Index of the transport that last answered.  Accessed atomically.
+}
+
+// NewFailoverTransport is like NewChainTransport, except that each query
+// starts at the transport that answered the last query, and the others are
+// tried in order after it.  If one transport is blocked, e.g. DoT on a
+// network that blocks port 853, only the first query after the block waits for
+// it to fail, and the transports fail back in the same way.
+func NewFailoverTransport(transports []Transport, servfailRetries int) (Transport, error) {
+	chain, err := NewChainTransport(transports, servfailRetries)
+	if err != nil {
+		return nil, err
+	}
+	return &failoverTransport{chainTransport: chain.(*chainTransport)}, nil
+}
+
+func (t *failoverTransport) Query(q []byte) ([]byte, error) {
+	response, index, err := t.query(q, int(atomic.LoadInt32(&t.preferred)))
+	if err == nil && !isServfail(response) {
+		atomic.StoreInt32(&t.preferred, int32(index))
+	}
+	return response, err
+}
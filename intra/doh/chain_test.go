@@ -0,0 +1,161 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// rcodeTransport answers every query with `rcode`, or fails if `err` is set.
+type rcodeTransport struct {
+	Transport
+	rcode   dnsmessage.RCode
+	err     error
+	queries int
+}
+
+func (t *rcodeTransport) Query(q []byte) ([]byte, error) {
+	t.queries++
+	if t.err != nil {
+		return tryServfail(q), t.err
+	}
+	msg := mustUnpack(q)
+	msg.Response = true
+	msg.RCode = t.rcode
+	return mustPack(msg), nil
+}
+
+func (t *rcodeTransport) GetURL() string {
+	return "rcode"
+}
+
+func chainQuery(t *testing.T, servfailRetries int, transports ...Transport) dnsmessage.RCode {
+	chain, err := NewChainTransport(transports, servfailRetries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := chain.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mustUnpack(resp).RCode
+}
+
+func TestChainServfailRetry(t *testing.T) {
+	first := &rcodeTransport{rcode: dnsmessage.RCodeServerFailure}
+	second := &rcodeTransport{rcode: dnsmessage.RCodeSuccess}
+	if rcode := chainQuery(t, 1, first, second); rcode != dnsmessage.RCodeSuccess {
+		t.Errorf("Expected success, got %v", rcode)
+	}
+	if first.queries != 1 || second.queries != 1 {
+		t.Errorf("Unexpected query counts: %d, %d", first.queries, second.queries)
+	}
+}
+
+func TestChainServfailLimit(t *testing.T) {
+	first := &rcodeTransport{rcode: dnsmessage.RCodeServerFailure}
+	second := &rcodeTransport{rcode: dnsmessage.RCodeServerFailure}
+	third := &rcodeTransport{rcode: dnsmessage.RCodeSuccess}
+	if rcode := chainQuery(t, 1, first, second, third); rcode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL after the retry limit, got %v", rcode)
+	}
+	if third.queries != 0 {
+		t.Error("Query should not be sent beyond the retry limit")
+	}
+}
+
+func TestChainServfailDisabled(t *testing.T) {
+	first := &rcodeTransport{rcode: dnsmessage.RCodeServerFailure}
+	second := &rcodeTransport{rcode: dnsmessage.RCodeSuccess}
+	if rcode := chainQuery(t, 0, first, second); rcode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL, got %v", rcode)
+	}
+}
+
+func TestChainNXDomainNotRetried(t *testing.T) {
+	first := &rcodeTransport{rcode: dnsmessage.RCodeNameError}
+	second := &rcodeTransport{rcode: dnsmessage.RCodeSuccess}
+	if rcode := chainQuery(t, 2, first, second); rcode != dnsmessage.RCodeNameError {
+		t.Errorf("Expected NXDOMAIN, got %v", rcode)
+	}
+	if second.queries != 0 {
+		t.Error("NXDOMAIN should not be retried")
+	}
+}
+
+func TestChainConnectionFailure(t *testing.T) {
+	// Connection failures don't count against the SERVFAIL limit.
+	first := &rcodeTransport{err: errors.New("refused")}
+	second := &rcodeTransport{rcode: dnsmessage.RCodeServerFailure}
+	third := &rcodeTransport{rcode: dnsmessage.RCodeSuccess}
+	if rcode := chainQuery(t, 1, first, second, third); rcode != dnsmessage.RCodeSuccess {
+		t.Errorf("Expected success, got %v", rcode)
+	}
+}
+
+func TestChainAllFail(t *testing.T) {
+	chain, _ := NewChainTransport([]Transport{
+		&rcodeTransport{err: errors.New("refused")},
+		&rcodeTransport{err: errors.New("timeout")},
+	}, 1)
+	resp, err := chain.Query(simpleQueryBytes)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if mustUnpack(resp).RCode != dnsmessage.RCodeServerFailure {
+		t.Error("Expected SERVFAIL")
+	}
+}
+
+func TestChainNoTransports(t *testing.T) {
+	if _, err := NewChainTransport(nil, 1); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	first := &rcodeTransport{err: errors.New("blocked")}
+	second := &rcodeTransport{rcode: dnsmessage.RCodeSuccess}
+	failover, err := NewFailoverTransport([]Transport{first, second}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func() {
+		if _, err := failover.Query(simpleQueryBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query()
+	query()
+	// Only the first query waits for the blocked transport.
+	if first.queries != 1 || second.queries != 2 {
+		t.Errorf("Unexpected query counts: %d, %d", first.queries, second.queries)
+	}
+
+	// If the second transport is blocked, the first is preferred again.
+	first.err, second.err = nil, errors.New("blocked")
+	query()
+	query()
+	if first.queries != 3 || second.queries != 3 {
+		t.Errorf("Unexpected query counts after failing back: %d, %d", first.queries, second.queries)
+	}
+
+	if _, err := NewFailoverTransport(nil, 0); err == nil {
+		t.Error("Expected an error without transports")
+	}
+}
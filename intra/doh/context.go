@@ -0,0 +1,57 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import "context"
+
+// ContextTransport is a Transport whose queries can be canceled.  Transports
+// returned by NewTransport and NewCachingTransport implement it.  It is not
+// exported by gobind.
+type ContextTransport interface {
+	Transport
+	// QueryContext is like Query, but returns an error as soon as `ctx` is done.
+	QueryContext(ctx context.Context, q []byte) ([]byte, error)
+}
+
+type queryResult struct {
+	response []byte
+	err      error
+}
+
+// QueryContext sends `q` using `t`, and returns an error as soon as `ctx` is
+// done.  If `t` is a ContextTransport, the query is canceled.  Otherwise, the
+// query continues in the background, and its result is discarded.
+func QueryContext(ctx context.Context, t Transport, q []byte) ([]byte, error) {
+	if ct, ok := t.(ContextTransport); ok {
+		return ct.QueryContext(ctx, q)
+	}
+	if ctx.Done() == nil {
+		return t.Query(q)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := make(chan queryResult, 1)
+	go func() {
+		response, err := t.Query(q)
+		result <- queryResult{response, err}
+	}()
+	select {
+	case r := <-result:
+		return r.response, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -16,6 +16,7 @@ package doh
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
@@ -65,7 +66,23 @@ type Summary struct {
 	Response   []byte
 	Server     string
 	Status     int
-	HTTPStatus int // Zero unless Status is Complete or HTTPError
+	HTTPStatus int    // Zero unless Status is Complete or HTTPError
+	Family     string // FamilyIPv4 or FamilyIPv6, or empty if Server is unknown
+	Fallback   bool   // True if happy eyeballs fell back from the preferred family
+}
+
+// Address families reported in Summary.Family.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// family returns the Summary.Family of `ip`.
+func family(ip net.IP) string {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
 }
 
 // A Token is an opaque handle used to match responses to queries.
@@ -100,8 +117,16 @@ type transport struct {
 	listener           Listener
 	hangoverLock       sync.RWMutex
 	hangoverExpiration time.Time
+	eyeballsLock       sync.RWMutex
+	eyeballs           HappyEyeballs
+	dialLock           sync.RWMutex
+	dialFunc           DialFunc // Nil to dial with split retry using `dialer`.
 }
 
+// DialFunc connects to the DoH server at `addr`.  It receives an IP address, so
+// it never needs to resolve a name.
+type DialFunc func(addr *net.TCPAddr) (split.DuplexConn, error)
+
 // Wait up to three seconds for the TCP handshake to complete.
 const tcpTimeout time.Duration = 3 * time.Second
 
@@ -119,14 +144,21 @@ func (t *transport) dial(network, addr string) (net.Conn, error) {
 	tcpaddr := func(ip net.IP) *net.TCPAddr {
 		return &net.TCPAddr{IP: ip, Port: port}
 	}
+	t.dialLock.RLock()
+	dialFunc := t.dialFunc
+	t.dialLock.RUnlock()
+	if dialFunc == nil {
+		dialFunc = func(addr *net.TCPAddr) (split.DuplexConn, error) {
+			return split.DialWithSplitRetry(t.dialer, addr, nil)
+		}
+	}
 
-	// TODO: Improve IP fallback strategy with parallelism and Happy Eyeballs.
 	var conn net.Conn
 	ips := t.ips.Get(domain)
 	confirmed := ips.Confirmed()
 	if confirmed != nil {
 		log.Debugf("Trying confirmed IP %s for addr %s", confirmed.String(), addr)
-		if conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(confirmed), nil); err == nil {
+		if conn, err = dialFunc(tcpaddr(confirmed)); err == nil {
 			log.Infof("Confirmed IP %s worked", confirmed.String())
 			return conn, nil
 		}
@@ -135,17 +167,65 @@ func (t *transport) dial(network, addr string) (net.Conn, error) {
 	}
 
 	log.Debugf("Trying all IPs")
+	var others []net.IP
 	for _, ip := range ips.GetAll() {
 		if ip.Equal(confirmed) {
 			// Don't try this IP twice.
 			continue
 		}
-		if conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(ip), nil); err == nil {
-			log.Infof("Found working IP: %s", ip.String())
-			return conn, nil
-		}
+		others = append(others, ip)
 	}
-	return nil, err
+	if len(others) == 0 && err != nil {
+		// Only the confirmed IP was available, and it failed.
+		return nil, err
+	}
+	t.eyeballsLock.RLock()
+	eyeballs := t.eyeballs
+	t.eyeballsLock.RUnlock()
+	conn, ip, err := eyeballs.race(others, func(ip net.IP) (net.Conn, error) {
+		return dialFunc(tcpaddr(ip))
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Found working IP: %s", ip.String())
+	return &eyeballsConn{conn.(split.DuplexConn), eyeballs.fellBack(others, ip)}, nil
+}
+
+// eyeballsConn is a connection dialed by racing the server's IPs.
+type eyeballsConn struct {
+	split.DuplexConn
+	fallback bool // True if the preferred address family was available but not used.
+}
+
+// usedFallback reports whether `conn`, as reported by httptrace, was dialed by
+// falling back from the preferred address family.
+func usedFallback(conn net.Conn) bool {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	ec, ok := conn.(*eyeballsConn)
+	return ok && ec.fallback
+}
+
+// SetHappyEyeballs configures how connections to the server's IPs are raced.
+func (t *transport) SetHappyEyeballs(h HappyEyeballs) {
+	t.eyeballsLock.Lock()
+	t.eyeballs = h
+	t.eyeballsLock.Unlock()
+}
+
+// SetDialFunc replaces the function that connects to the server's IPs, e.g. so
+// that the connection uses the same evasion strategy as tunneled traffic.  Nil
+// restores the default, which dials with split retry.  The server's hostname is
+// still resolved with the dialer's Resolver, and never with DoH, so a DialFunc
+// that sends traffic through the tunnel doesn't make the transport depend on
+// itself.  Transports returned by NewTransport implement
+// `interface{ SetDialFunc(DialFunc) }`.
+func (t *transport) SetDialFunc(f DialFunc) {
+	t.dialLock.Lock()
+	t.dialFunc = f
+	t.dialLock.Unlock()
 }
 
 // NewTransport returns a DoH DNSTransport, ready for use.
@@ -242,8 +322,9 @@ func (e *httpError) Error() string {
 // it returns a SERVFAIL response and a qerr with a status value indicating the cause.
 // Independent of the query's success or failure, this function also returns the
 // address of the server on a best-effort basis, or nil if the address could not
-// be determined.
-func (t *transport) doQuery(q []byte) (response []byte, server *net.TCPAddr, qerr *queryError) {
+// be determined, and whether the connection fell back from the preferred
+// address family.
+func (t *transport) doQuery(ctx context.Context, q []byte) (response []byte, server *net.TCPAddr, fallback bool, qerr *queryError) {
 	if len(q) < 2 {
 		qerr = &queryError{BadQuery, fmt.Errorf("Query length is %d", len(q))}
 		return
@@ -268,14 +349,14 @@ func (t *transport) doQuery(q []byte) (response []byte, server *net.TCPAddr, qer
 	// Zero out the query ID.
 	id := binary.BigEndian.Uint16(q)
 	binary.BigEndian.PutUint16(q, 0)
-	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewBuffer(q))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewBuffer(q))
 	if err != nil {
 		qerr = &queryError{InternalError, err}
 		return
 	}
 
 	var hostname string
-	response, hostname, server, qerr = t.sendRequest(id, req)
+	response, hostname, server, fallback, qerr = t.sendRequest(id, req)
 
 	// Restore the query ID.
 	binary.BigEndian.PutUint16(q, id)
@@ -308,7 +389,7 @@ func (t *transport) doQuery(q []byte) (response []byte, server *net.TCPAddr, qer
 	return
 }
 
-func (t *transport) sendRequest(id uint16, req *http.Request) (response []byte, hostname string, server *net.TCPAddr, qerr *queryError) {
+func (t *transport) sendRequest(id uint16, req *http.Request) (response []byte, hostname string, server *net.TCPAddr, fallback bool, qerr *queryError) {
 	hostname = t.hostname
 
 	// The connection used for this request.  If the request fails, we will close
@@ -349,6 +430,7 @@ func (t *transport) sendRequest(id uint16, req *http.Request) (response []byte,
 			conn = info.Conn
 			// info.Conn is a DuplexConn, so RemoteAddr is actually a TCPAddr.
 			server = conn.RemoteAddr().(*net.TCPAddr)
+			fallback = usedFallback(conn)
 		},
 		PutIdleConn: func(err error) {
 			log.Debugf("%d PutIdleConn(%v)", id, err)
@@ -427,13 +509,19 @@ func (t *transport) sendRequest(id uint16, req *http.Request) (response []byte,
 }
 
 func (t *transport) Query(q []byte) ([]byte, error) {
+	return t.QueryContext(context.Background(), q)
+}
+
+// QueryContext cancels the DOH request when `ctx` is done.  The query then
+// fails with status SendFailed.
+func (t *transport) QueryContext(ctx context.Context, q []byte) ([]byte, error) {
 	var token Token
 	if t.listener != nil {
 		token = t.listener.OnQuery(t.url)
 	}
 
 	before := time.Now()
-	response, server, qerr := t.doQuery(q)
+	response, server, fallback, qerr := t.doQuery(ctx, q)
 	after := time.Now()
 
 	var err error
@@ -452,9 +540,10 @@ func (t *transport) Query(q []byte) ([]byte, error) {
 
 	if t.listener != nil {
 		latency := after.Sub(before)
-		var ip string
+		var ip, fam string
 		if server != nil {
 			ip = server.IP.String()
+			fam = family(server.IP)
 		}
 
 		t.listener.OnResponse(token, &Summary{
@@ -464,6 +553,8 @@ func (t *transport) Query(q []byte) ([]byte, error) {
 			Server:     ip,
 			Status:     status,
 			HTTPStatus: httpStatus,
+			Family:     fam,
+			Fallback:   fallback,
 		})
 	}
 	return response, err
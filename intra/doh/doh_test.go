@@ -16,6 +16,7 @@ package doh
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -25,8 +26,11 @@ import (
 	"net/http/httptrace"
 	"net/url"
 	"reflect"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
 	"golang.org/x/net/dns/dnsmessage"
 )
 
@@ -473,6 +477,107 @@ func TestListener(t *testing.T) {
 	if s.Status != Complete {
 		t.Errorf("Wrong status: %d", s.Status)
 	}
+	if s.Family != FamilyIPv4 || s.Fallback {
+		t.Errorf("Wrong family: %s, %t", s.Family, s.Fallback)
+	}
+}
+
+// Check that a broken IPv6 address causes a fallback to IPv4.
+func TestDialFunc(t *testing.T) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	addr := l.Addr().String()
+	// The transport's own dialer can't reach the server.
+	blocked := &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		return errors.New("Blocked")
+	}}
+	doh, err := NewTransport("https://"+addr+"/dns-query", nil, blocked, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := doh.(*transport)
+	if _, err := transport.dial("tcp", addr); err == nil {
+		t.Fatal("The blocked dialer should fail")
+	}
+
+	var dialed []*net.TCPAddr
+	transport.SetDialFunc(func(addr *net.TCPAddr) (split.DuplexConn, error) {
+		dialed = append(dialed, addr)
+		return split.DialWithSplitRetry(&net.Dialer{}, addr, nil)
+	})
+	conn, err := transport.dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(dialed) != 1 || dialed[0].String() != addr {
+		t.Errorf("Unexpected dials: %v", dialed)
+	}
+
+	// Nil restores the default dialer.
+	transport.SetDialFunc(nil)
+	if _, err := transport.dial("tcp", addr); err == nil {
+		t.Error("The default dialer should be restored")
+	}
+}
+
+func TestDialFallback(t *testing.T) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	addr := l.Addr().String()
+	// Nothing listens on the IPv6 loopback address at this port.
+	doh, err := NewTransport("https://"+addr+"/dns-query", []string{"::1"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := doh.(*transport)
+
+	conn, err := transport.dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !usedFallback(conn) {
+		t.Error("IPv4 should be a fallback from IPv6")
+	}
+	if fam := family(conn.RemoteAddr().(*net.TCPAddr).IP); fam != FamilyIPv4 {
+		t.Errorf("Wrong family: %s", fam)
+	}
+
+	// The confirmed IP is dialed directly, without a race.
+	transport.ips.Get(l.Addr().(*net.TCPAddr).IP.String()).Confirm(net.IPv4(127, 0, 0, 1))
+	conn, err = transport.dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if usedFallback(conn) {
+		t.Error("The confirmed IP is not a fallback")
+	}
 }
 
 type socket struct {
@@ -846,3 +951,42 @@ func TestServfail(t *testing.T) {
 	}
 }
 
+// Check that a canceled query fails promptly with SendFailed.
+func TestQueryContextCanceled(t *testing.T) {
+	doh, _ := NewTransport(testURL, ips, nil, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	resp, err := QueryContext(ctx, doh, simpleQueryBytes)
+	var qerr *queryError
+	if !errors.As(err, &qerr) || qerr.status != SendFailed {
+		t.Fatalf("Expected SendFailed, got %v", err)
+	}
+	if msg := mustUnpack(resp); msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected SERVFAIL, got %v", msg.RCode)
+	}
+}
+
+// blockingTransport doesn't respond until `release` is closed.
+type blockingTransport struct {
+	Transport
+	release chan struct{}
+}
+
+func (t *blockingTransport) Query(q []byte) ([]byte, error) {
+	<-t.release
+	return q, nil
+}
+
+// Check that QueryContext returns when canceled, even if the transport
+// doesn't support cancellation.
+func TestQueryContextFallback(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// The caching transport forwards the context to an ordinary transport.
+	cache := NewCachingTransport(&blockingTransport{release: release}, 0)
+	if _, err := QueryContext(ctx, cache, simpleQueryBytes); err != context.DeadlineExceeded {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	// DefaultDoTPort is the port of a DNS-over-TLS server whose address has
+	// none.
+	DefaultDoTPort = "853"
+	// DefaultDoTTimeout is the time limit of each DNS-over-TLS query if none
+	// is specified.
+	DefaultDoTTimeout = 5 * time.Second
+	// Number of idle connections that are kept for reuse.
+	dotMaxIdle = 4
+	// Number of TLS sessions that are kept for resumption.
+	dotSessionCacheSize = 8
+)
+
+// dotTransport sends DNS queries over TLS, as specified in RFC 7858.  Idle
+// connections are reused for later queries, and TLS sessions are resumed when
+// a new connection is needed, so that most queries avoid a full handshake.
+type dotTransport struct {
+	Transport
+	addr     string
+	config   *tls.Config
+	dialer   *net.Dialer
+	timeout  time.Duration
+	listener Listener
+	mu       sync.Mutex
+	idle     []*tls.Conn // Most recently used last.  Guarded by mu.
+}
+
+// NewDoTTransport returns a DNSTransport that sends queries to a DNS-over-TLS
+// server.
+// `addr` is the server's address in "host:port" form.  If it has no port,
+// DefaultDoTPort is used.
+// `config` configures TLS.  If it is nil, or has no ServerName, the server's
+// certificate is verified for the host in `addr`.  If it has no
+// ClientSessionCache, one is added.  It is not modified.
+// `dialer` is used to create connections.
+// `timeout` limits each query, including any connection setup.  Zero means
+// DefaultDoTTimeout.
+// `listener` will receive the status of each DNS query when it is complete.
+func NewDoTTransport(addr string, config *tls.Config, dialer *net.Dialer, timeout time.Duration, listener Listener) (Transport, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(addr, DefaultDoTPort)
+	}
+	if host == "" {
+		return nil, fmt.Errorf("No host in DoT address %q", addr)
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("Bad timeout: %v", timeout)
+	} else if timeout == 0 {
+		timeout = DefaultDoTTimeout
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(dotSessionCacheSize)
+	}
+	if config.MinVersion == 0 {
+		// RFC 8310 requires TLS 1.2 or later.
+		config.MinVersion = tls.VersionTLS12
+	}
+	return &dotTransport{
+		addr:     addr,
+		config:   config,
+		dialer:   dialer,
+		timeout:  timeout,
+		listener: listener,
+	}, nil
+}
+
+// get returns an idle connection, or a new one if there are none.  `reused`
+// is true for an idle connection, which the server may have closed.
+func (t *dotTransport) get(deadline time.Time) (conn *tls.Conn, reused bool, err error) {
+	t.mu.Lock()
+	if n := len(t.idle); n > 0 {
+		conn = t.idle[n-1]
+		t.idle = t.idle[:n-1]
+	}
+	t.mu.Unlock()
+	if conn != nil {
+		return conn, true, nil
+	}
+	d := *t.dialer
+	d.Deadline = deadline
+	conn, err = tls.DialWithDialer(&d, "tcp", t.addr, t.config)
+	return conn, false, err
+}
+
+// put keeps `conn` for reuse, or closes it if enough connections are idle.
+func (t *dotTransport) put(conn *tls.Conn) {
+	conn.SetDeadline(time.Time{})
+	t.mu.Lock()
+	if len(t.idle) < dotMaxIdle {
+		t.idle = append(t.idle, conn)
+		conn = nil
+	}
+	t.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// exchange sends the length-prefixed query `q` on `conn` and reads the
+// response.
+func exchange(conn net.Conn, q []byte, deadline time.Time) ([]byte, error) {
+	if len(q) > math.MaxUint16 {
+		return nil, fmt.Errorf("Oversize query: %d", len(q))
+	}
+	conn.SetDeadline(deadline)
+	// A combined write keeps the length and query in one TLS record.
+	buf := make([]byte, len(q)+2)
+	binary.BigEndian.PutUint16(buf, uint16(len(q)))
+	copy(buf[2:], q)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Sends `q` and waits for the response, retrying once on a new connection if
+// a reused one fails.  On failure, the response is a SERVFAIL if possible.
+func (t *dotTransport) doQuery(q []byte) (response []byte, server net.Addr, qerr *queryError) {
+	defer func() {
+		if qerr != nil {
+			response = tryServfail(q)
+		}
+	}()
+	if len(q) < 2 {
+		qerr = &queryError{BadQuery, fmt.Errorf("Query length is %d", len(q))}
+		return
+	}
+	padded, err := AddEdnsPadding(q)
+	if err != nil {
+		qerr = &queryError{InternalError, err}
+		return
+	}
+	deadline := time.Now().Add(t.timeout)
+	for {
+		conn, reused, err := t.get(deadline)
+		if err != nil {
+			qerr = &queryError{SendFailed, err}
+			return
+		}
+		server = conn.RemoteAddr()
+		response, err = exchange(conn, padded, deadline)
+		if err != nil {
+			conn.Close()
+			if reused && time.Now().Before(deadline) {
+				log.Debugf("Reused DoT connection to %s failed, reconnecting: %v", t.addr, err)
+				continue
+			}
+			qerr = &queryError{SendFailed, err}
+			return
+		}
+		t.put(conn)
+		break
+	}
+	if len(response) < 2 || response[0] != q[0] || response[1] != q[1] {
+		qerr = &queryError{BadResponse, errors.New("Response ID doesn't match the query")}
+	}
+	return
+}
+
+func (t *dotTransport) Query(q []byte) ([]byte, error) {
+	var token Token
+	if t.listener != nil {
+		token = t.listener.OnQuery(t.GetURL())
+	}
+
+	before := time.Now()
+	response, server, qerr := t.doQuery(q)
+	after := time.Now()
+
+	var err error
+	status := Complete
+	if qerr != nil {
+		err = qerr
+		status = qerr.status
+	}
+
+	if t.listener != nil {
+		summary := &Summary{
+			Latency:  after.Sub(before).Seconds(),
+			Query:    q,
+			Response: response,
+			Status:   status,
+		}
+		if tcpaddr, ok := server.(*net.TCPAddr); ok {
+			summary.Server = tcpaddr.IP.String()
+			summary.Family = family(tcpaddr.IP)
+		}
+		t.listener.OnResponse(token, summary)
+	}
+	return response, err
+}
+
+// GetURL returns the server's address with the "tls" scheme.
+func (t *dotTransport) GetURL() string {
+	return "tls://" + t.addr
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dotServer is a DNS-over-TLS server on localhost that answers every query
+// with an empty response.
+type dotServer struct {
+	listener net.Listener
+	roots    *x509.CertPool
+	conns    int32 // Number of connections accepted.  Accessed atomically.
+	resumed  int32 // Number of resumed sessions.  Accessed atomically.
+	// If true, each connection is closed after one response.
+	closeAfterResponse bool
+}
+
+func makeDoTServer(t *testing.T, closeAfterResponse bool) *dotServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dotServer{roots: x509.NewCertPool(), closeAfterResponse: closeAfterResponse}
+	s.roots.AddCert(cert)
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	if s.listener, err = tls.Listen("tcp", "127.0.0.1:0", config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn.(*tls.Conn))
+		}
+	}()
+	return s
+}
+
+func (s *dotServer) serve(conn *tls.Conn) {
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	if conn.ConnectionState().DidResume {
+		atomic.AddInt32(&s.resumed, 1)
+	}
+	for {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		q := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, q); err != nil {
+			return
+		}
+		msg := mustUnpack(q)
+		msg.Response = true
+		response := mustPack(msg)
+		buf := make([]byte, len(response)+2)
+		binary.BigEndian.PutUint16(buf, uint16(len(response)))
+		copy(buf[2:], response)
+		conn.Write(buf)
+		if s.closeAfterResponse {
+			return
+		}
+	}
+}
+
+func (s *dotServer) transport(t *testing.T, listener Listener) Transport {
+	dot, err := NewDoTTransport(s.listener.Addr().String(), &tls.Config{RootCAs: s.roots}, nil, time.Second, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dot
+}
+
+func dotQuery(t *testing.T, dot Transport) {
+	response, err := dot.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := mustUnpack(response); !msg.Response || msg.ID != simpleQuery.ID {
+		t.Errorf("Unexpected response: %v", msg.Header)
+	}
+}
+
+func TestDoTConnectionReuse(t *testing.T) {
+	s := makeDoTServer(t, false)
+	listener := &fakeListener{}
+	dot := s.transport(t, listener)
+	dotQuery(t, dot)
+	dotQuery(t, dot)
+	if n := atomic.LoadInt32(&s.conns); n != 1 {
+		t.Errorf("Expected the connection to be reused, got %d connections", n)
+	}
+	if listener.summary.Status != Complete || listener.summary.Server != "127.0.0.1" || listener.summary.Family != FamilyIPv4 {
+		t.Errorf("Unexpected summary: %+v", *listener.summary)
+	}
+}
+
+func TestDoTSessionResumption(t *testing.T) {
+	s := makeDoTServer(t, true)
+	dot := s.transport(t, nil)
+	dotQuery(t, dot)
+	// The idle connection has been closed by the server, so the next query
+	// reconnects, resuming the session.
+	time.Sleep(50 * time.Millisecond)
+	dotQuery(t, dot)
+	if n := atomic.LoadInt32(&s.conns); n != 2 {
+		t.Errorf("Expected a new connection, got %d connections", n)
+	}
+	if n := atomic.LoadInt32(&s.resumed); n != 1 {
+		t.Errorf("Expected the session to be resumed, got %d", n)
+	}
+}
+
+func TestDoTFailure(t *testing.T) {
+	s := makeDoTServer(t, false)
+	addr := s.listener.Addr().String()
+	s.listener.Close()
+	listener := &fakeListener{}
+	dot, err := NewDoTTransport(addr, nil, nil, time.Second, listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := dot.Query(simpleQueryBytes)
+	if qerr, ok := err.(*queryError); !ok || qerr.status != SendFailed {
+		t.Errorf("Expected SendFailed, got %v", err)
+	}
+	if response == nil || !isServfail(response) {
+		t.Error("Expected a SERVFAIL response")
+	}
+	if listener.summary.Status != SendFailed {
+		t.Errorf("Unexpected status: %d", listener.summary.Status)
+	}
+}
+
+func TestDoTAddress(t *testing.T) {
+	dot, err := NewDoTTransport("dns.example", nil, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url := dot.GetURL(); url != "tls://dns.example:853" {
+		t.Errorf("Unexpected URL: %s", url)
+	}
+	if d := dot.(*dotTransport); d.config.ServerName != "dns.example" || d.timeout != DefaultDoTTimeout || d.config.ClientSessionCache == nil {
+		t.Errorf("Unexpected defaults: %q, %v", d.config.ServerName, d.timeout)
+	}
+	if _, err := NewDoTTransport(":853", nil, nil, 0, nil); err == nil {
+		t.Error("Expected an error without a host")
+	}
+}
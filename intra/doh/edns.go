@@ -0,0 +1,89 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// minUDPPayloadSize is the maximum size of a DNS response over UDP for clients
+// that don't advertise a larger size with EDNS(0), and the smallest size that
+// may be advertised (RFC 6891 Section 6.2.5).
+const minUDPPayloadSize = 512
+
+// udpPayloadSize returns the largest UDP response that the sender of `q`
+// accepts, according to the OPT record in `q`, if any.
+func udpPayloadSize(q []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(q); err != nil {
+		return minUDPPayloadSize
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return minUDPPayloadSize
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return minUDPPayloadSize
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return minUDPPayloadSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return minUDPPayloadSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			// The OPT record's class field holds the payload size.
+			if size := int(h.Class); size > minUDPPayloadSize {
+				return size
+			}
+			return minUDPPayloadSize
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return minUDPPayloadSize
+		}
+	}
+}
+
+// truncated returns a response to `q` with the TC bit set and no records,
+// which tells the client to retry over TCP.
+func truncated(q []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.Truncated = true
+	msg.Answers = nil
+	msg.Authorities = nil
+	msg.Additionals = nil // Strip EDNS
+	return msg.Pack()
+}
+
+// LimitUDPResponse returns `resp`, or a truncated response if `resp` is larger
+// than the UDP payload size advertised in the query `q`, or 512 bytes if `q`
+// has no EDNS(0) OPT record.  It should be applied to responses that are sent
+// to clients over UDP.
+func LimitUDPResponse(q, resp []byte) []byte {
+	if len(resp) <= udpPayloadSize(q) {
+		return resp
+	}
+	tc, err := truncated(q)
+	if err != nil {
+		return resp
+	}
+	return tc
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Returns a query that advertises a UDP payload size of `size` with EDNS(0),
+// or has no OPT record if `size` is zero.
+func makeEDNSQuery(size uint16) []byte {
+	msg := mustUnpack(makeQuery("large.example.", 7))
+	if size > 0 {
+		var h dnsmessage.ResourceHeader
+		if err := h.SetEDNS0(int(size), dnsmessage.RCodeSuccess, false); err != nil {
+			panic(err)
+		}
+		msg.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+	}
+	return mustPack(msg)
+}
+
+// Returns a response to `q` that is exactly `size` bytes long, padded with a
+// TXT record.
+func makeSizedResponse(q []byte, size int) []byte {
+	msg := mustUnpack(q)
+	msg.Response = true
+	msg.Additionals = nil
+	pad := func(n int) []byte {
+		var txt []string
+		for ; n > 255; n -= 256 {
+			txt = append(txt, strings.Repeat("x", 255))
+		}
+		txt = append(txt, strings.Repeat("x", n))
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.TXTResource{TXT: txt},
+		}}
+		return mustPack(msg)
+	}
+	base := len(pad(0))
+	for n := size - base; n >= 0; n-- {
+		if resp := pad(n); len(resp) == size {
+			return resp
+		}
+	}
+	panic(fmt.Sprintf("Can't make a %d-byte response", size))
+}
+
+func TestUDPPayloadSize(t *testing.T) {
+	for _, tc := range []struct {
+		advertised uint16
+		want       int
+	}{{0, 512}, {100, 512}, {1232, 1232}, {4096, 4096}} {
+		if got := udpPayloadSize(makeEDNSQuery(tc.advertised)); got != tc.want {
+			t.Errorf("Advertised %d: got %d, want %d", tc.advertised, got, tc.want)
+		}
+	}
+	if got := udpPayloadSize([]byte{1, 2, 3}); got != 512 {
+		t.Errorf("Malformed query: got %d", got)
+	}
+}
+
+func TestLimitUDPResponse(t *testing.T) {
+	for _, size := range []uint16{0, 1232, 4096} {
+		q := makeEDNSQuery(size)
+		limit := udpPayloadSize(q)
+		fits := makeSizedResponse(q, limit)
+		if got := LimitUDPResponse(q, fits); len(got) != limit {
+			t.Errorf("A %d-byte response should fit in %d bytes", len(fits), limit)
+		}
+		tc := mustUnpack(LimitUDPResponse(q, makeSizedResponse(q, limit+1)))
+		if !tc.Truncated || len(tc.Answers) != 0 || tc.ID != 7 || len(tc.Questions) != 1 {
+			t.Errorf("Expected a truncated response for limit %d: %+v", limit, tc.Header)
+		}
+	}
+}
+
+// sizedUDPServer answers each query with a response of `size` bytes.
+func makeSizedUDPServer(t *testing.T, size int) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(makeSizedResponse(buf[:n], size), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestUDPTransportPayloadSize(t *testing.T) {
+	q := makeEDNSQuery(1232)
+	for _, tc := range []struct {
+		size      int
+		truncated bool
+	}{{1232, false}, {1233, true}, {600, false}} {
+		dns, err := NewUDPTransport(makeSizedUDPServer(t, tc.size), nil, time.Second, 1, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := dns.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := mustUnpack(resp)
+		if msg.Truncated != tc.truncated {
+			t.Errorf("%d-byte response: truncated is %t", tc.size, msg.Truncated)
+		}
+		if !tc.truncated && len(resp) != tc.size {
+			t.Errorf("Response was %d bytes, expected %d", len(resp), tc.size)
+		}
+	}
+
+	// Without EDNS, responses are limited to 512 bytes.
+	dns, _ := NewUDPTransport(makeSizedUDPServer(t, 600), nil, time.Second, 1, 0, nil)
+	resp, err := dns.Query(makeEDNSQuery(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mustUnpack(resp).Truncated {
+		t.Error("Expected a truncated response without EDNS")
+	}
+}
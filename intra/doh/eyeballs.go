@@ -0,0 +1,160 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultAttemptDelay is the Connection Attempt Delay recommended by RFC 8305.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// HappyEyeballs configures how a transport races connections to the server's
+// IP addresses, following RFC 8305.  The zero value uses the RFC defaults.
+//
+// Transports returned by NewTransport implement
+// `interface{ SetHappyEyeballs(HappyEyeballs) }`.
+type HappyEyeballs struct {
+	// AttemptDelay is how long to wait for a connection attempt before starting
+	// the next one.  If an attempt fails sooner, the next one starts
+	// immediately.  Zero means DefaultAttemptDelay.
+	AttemptDelay time.Duration
+	// PreferIPv4 causes IPv4 addresses to be tried first.  By default, IPv6
+	// addresses are tried first.
+	PreferIPv4 bool
+}
+
+func (h HappyEyeballs) attemptDelay() time.Duration {
+	if h.AttemptDelay <= 0 {
+		return DefaultAttemptDelay
+	}
+	return h.AttemptDelay
+}
+
+// sort returns `ips` in the order they should be tried, alternating between
+// address families, starting with the preferred family.
+func (h HappyEyeballs) sort(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if h.PreferIPv4 {
+		first, second = v4, v6
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			sorted = append(sorted, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			sorted = append(sorted, second[0])
+			second = second[1:]
+		}
+	}
+	return sorted
+}
+
+// fellBack reports whether connecting to `used`, one of `ips`, was a fallback
+// from the preferred address family, i.e. whether `ips` included an address of
+// the preferred family and `used` is of the other family.
+func (h HappyEyeballs) fellBack(ips []net.IP, used net.IP) bool {
+	preferV4 := h.PreferIPv4
+	if (used.To4() != nil) == preferV4 {
+		return false
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == preferV4 {
+			return true
+		}
+	}
+	return false
+}
+
+// race dials each of `ips` in turn, staggered by the attempt delay, and returns
+// the first connection that succeeds, along with its IP.  Connections that
+// succeed later are closed.  If every attempt fails, the first error is returned.
+func (h HappyEyeballs) race(ips []net.IP, dial func(net.IP) (net.Conn, error)) (net.Conn, net.IP, error) {
+	type result struct {
+		conn net.Conn
+		ip   net.IP
+		err  error
+	}
+	ips = h.sort(ips)
+	if len(ips) == 0 {
+		return nil, nil, errors.New("No IP addresses")
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ip)
+			results <- result{conn, ip, err}
+		}()
+	}
+	delay := h.attemptDelay()
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		var tick <-chan time.Time
+		if next < len(ips) {
+			tick = timer.C
+		}
+		select {
+		case <-tick:
+			start()
+			timer.Reset(delay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.ip, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				// Don't wait for the delay after a failure.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, nil, firstErr
+}
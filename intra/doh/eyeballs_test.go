@@ -0,0 +1,190 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	v4a = net.ParseIP("192.0.2.1")
+	v4b = net.ParseIP("192.0.2.2")
+	v6a = net.ParseIP("2001:db8::1")
+	v6b = net.ParseIP("2001:db8::2")
+)
+
+// fakeDialer records the time of each attempt.  Attempts to IPs in `fail`
+// fail immediately, attempts to `succeed` succeed after `latency`, and all
+// other attempts hang until `release` is closed.
+type fakeDialer struct {
+	start    time.Time
+	fail     map[string]bool
+	succeed  string
+	latency  time.Duration
+	release  chan struct{}
+	mu       sync.Mutex
+	attempts []time.Duration
+}
+
+func newFakeDialer() *fakeDialer {
+	return &fakeDialer{start: time.Now(), fail: make(map[string]bool), release: make(chan struct{})}
+}
+
+func (d *fakeDialer) dial(ip net.IP) (net.Conn, error) {
+	d.mu.Lock()
+	d.attempts = append(d.attempts, time.Since(d.start))
+	d.mu.Unlock()
+	if d.fail[ip.String()] {
+		return nil, errors.New("refused")
+	}
+	if ip.String() == d.succeed {
+		time.Sleep(d.latency)
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	<-d.release
+	return nil, errors.New("timeout")
+}
+
+func (d *fakeDialer) times() []time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]time.Duration{}, d.attempts...)
+}
+
+func TestEyeballsSort(t *testing.T) {
+	ips := []net.IP{v4a, v4b, v6a, v6b}
+	check := func(h HappyEyeballs, want ...net.IP) {
+		got := h.sort(ips)
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				t.Errorf("Wrong order: %v", got)
+				return
+			}
+		}
+	}
+	check(HappyEyeballs{}, v6a, v4a, v6b, v4b)
+	check(HappyEyeballs{PreferIPv4: true}, v4a, v6a, v4b, v6b)
+}
+
+func TestEyeballsStagger(t *testing.T) {
+	d := newFakeDialer()
+	defer close(d.release)
+	d.succeed = v4b.String()
+	delay := 100 * time.Millisecond
+	h := HappyEyeballs{AttemptDelay: delay, PreferIPv4: true}
+	// The order is v4a, v6a, v4b.  The first two hang.
+	conn, ip, err := h.race([]net.IP{v4a, v4b, v6a}, d.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !ip.Equal(v4b) {
+		t.Errorf("Wrong winner: %v", ip)
+	}
+	times := d.times()
+	if len(times) != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		gap := times[i] - times[i-1]
+		if gap < delay || gap > delay+50*time.Millisecond {
+			t.Errorf("Attempt %d started %v after the previous one", i, gap)
+		}
+	}
+}
+
+func TestEyeballsDefaultDelay(t *testing.T) {
+	d := newFakeDialer()
+	defer close(d.release)
+	d.succeed = v4a.String()
+	conn, _, err := HappyEyeballs{}.race([]net.IP{v6a, v4a}, d.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	times := d.times()
+	if gap := times[1] - times[0]; gap < DefaultAttemptDelay {
+		t.Errorf("Second attempt started after %v", gap)
+	}
+}
+
+func TestEyeballsFailureSkipsDelay(t *testing.T) {
+	d := newFakeDialer()
+	d.fail[v6a.String()] = true
+	d.succeed = v4a.String()
+	conn, ip, err := HappyEyeballs{AttemptDelay: time.Hour}.race([]net.IP{v4a, v6a}, d.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !ip.Equal(v4a) {
+		t.Errorf("Wrong winner: %v", ip)
+	}
+}
+
+func TestEyeballsFirstWins(t *testing.T) {
+	d := newFakeDialer()
+	defer close(d.release)
+	d.succeed = v6a.String()
+	d.latency = 20 * time.Millisecond
+	start := time.Now()
+	conn, ip, err := HappyEyeballs{AttemptDelay: time.Second}.race([]net.IP{v4a, v6a}, d.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !ip.Equal(v6a) {
+		t.Errorf("Wrong winner: %v", ip)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Race took %v", elapsed)
+	}
+	if n := len(d.times()); n != 1 {
+		t.Errorf("Expected one attempt, got %d", n)
+	}
+}
+
+func TestEyeballsAllFail(t *testing.T) {
+	d := newFakeDialer()
+	d.fail[v4a.String()] = true
+	d.fail[v6a.String()] = true
+	if _, _, err := (HappyEyeballs{}).race([]net.IP{v4a, v6a}, d.dial); err == nil {
+		t.Error("Expected an error")
+	}
+	if _, _, err := (HappyEyeballs{}).race(nil, d.dial); err == nil {
+		t.Error("Expected an error with no IPs")
+	}
+}
+
+func TestEyeballsFellBack(t *testing.T) {
+	h := HappyEyeballs{}
+	if !h.fellBack([]net.IP{v6a, v4a}, v4a) {
+		t.Error("IPv4 should be a fallback when IPv6 is available")
+	}
+	if h.fellBack([]net.IP{v4a, v4b}, v4a) {
+		t.Error("IPv4 is not a fallback when IPv6 is unavailable")
+	}
+	if h.fellBack([]net.IP{v6a, v4a}, v6a) {
+		t.Error("The preferred family is not a fallback")
+	}
+	if !(HappyEyeballs{PreferIPv4: true}).fellBack([]net.IP{v6a, v4a}, v6a) {
+		t.Error("IPv6 should be a fallback when IPv4 is preferred")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// LimitStats describes the time that queries to a limited transport have
+// spent waiting for a slot, so that operators can see when the limit is the
+// bottleneck.
+type LimitStats struct {
+	Queued       int64         // Queries that had to wait for a slot.
+	Dropped      int64         // Queued queries that timed out and failed.
+	QueueWait    time.Duration // Total time spent waiting by queued queries.
+	MaxQueueWait time.Duration // Longest time that any query waited.
+}
+
+// limitedTransport bounds the number of concurrent queries to another Transport.
+type limitedTransport struct {
+	Transport
+	slots        chan struct{} // Holds one value for each query in flight.
+	queueTimeout time.Duration
+	mu           sync.Mutex // Protects stats.
+	stats        LimitStats
+}
+
+// NewLimitedTransport returns a Transport that sends at most `maxInFlight`
+// concurrent queries to `t`, to protect the resolver from query floods.
+// Excess queries wait for up to `queueTimeout` for another query to finish,
+// and then fail with a SERVFAIL response.  The returned Transport implements
+// `interface{ Stats() LimitStats }` and `interface{ ResetStats() }`.
+func NewLimitedTransport(t Transport, maxInFlight int, queueTimeout time.Duration) (Transport, error) {
+	if maxInFlight <= 0 {
+		return nil, fmt.Errorf("Bad concurrency limit: %d", maxInFlight)
+	}
+	return &limitedTransport{
+		Transport:    t,
+		slots:        make(chan struct{}, maxInFlight),
+		queueTimeout: queueTimeout,
+	}, nil
+}
+
+func (t *limitedTransport) Query(q []byte) ([]byte, error) {
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		start := time.Now()
+		timer := time.NewTimer(t.queueTimeout)
+		defer timer.Stop()
+		select {
+		case t.slots <- struct{}{}:
+			t.queued(time.Since(start), false)
+		case <-timer.C:
+			t.queued(time.Since(start), true)
+			log.Debugf("Too many DNS queries in flight, dropping query %d", id(q))
+			return tryServfail(q), fmt.Errorf("Too many queries in flight (limit %d)", cap(t.slots))
+		}
+	}
+	defer func() { <-t.slots }()
+	return t.Transport.Query(q)
+}
+
+// queued records a query that waited for `wait`, and whether it was dropped.
+func (t *limitedTransport) queued(wait time.Duration, dropped bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats.Queued++
+	if dropped {
+		t.stats.Dropped++
+	}
+	t.stats.QueueWait += wait
+	if wait > t.stats.MaxQueueWait {
+		t.stats.MaxQueueWait = wait
+	}
+}
+
+// Stats returns the queue-wait statistics of all queries so far.
+func (t *limitedTransport) Stats() LimitStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// ResetStats zeroes the queue-wait statistics.
+func (t *limitedTransport) ResetStats() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats = LimitStats{}
+}
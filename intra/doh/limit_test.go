@@ -0,0 +1,129 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// slowTransport answers each query after `delay`, and records the maximum
+// number of concurrent queries.
+type slowTransport struct {
+	Transport
+	delay    time.Duration
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (t *slowTransport) Query(q []byte) ([]byte, error) {
+	t.mu.Lock()
+	t.inFlight++
+	if t.inFlight > t.peak {
+		t.peak = t.inFlight
+	}
+	t.mu.Unlock()
+	time.Sleep(t.delay)
+	t.mu.Lock()
+	t.inFlight--
+	t.mu.Unlock()
+	msg := mustUnpack(q)
+	msg.Response = true
+	return mustPack(msg), nil
+}
+
+// Sends `n` distinct queries concurrently, and returns the number that failed.
+func flood(t *testing.T, dns Transport, n int) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := dns.Query(makeQuery("a.example.", uint16(i)))
+			if err != nil {
+				if mustUnpack(resp).RCode != dnsmessage.RCodeServerFailure {
+					t.Error("Expected SERVFAIL")
+				}
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return failed
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	base := &slowTransport{delay: 20 * time.Millisecond}
+	dns, err := NewLimitedTransport(base, 3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := flood(t, dns, 20); failed != 0 {
+		t.Errorf("%d queries failed", failed)
+	}
+	if base.peak != 3 {
+		t.Errorf("Expected at most 3 concurrent queries, got %d", base.peak)
+	}
+}
+
+func TestLimitQueueTimeout(t *testing.T) {
+	base := &slowTransport{delay: 200 * time.Millisecond}
+	dns, _ := NewLimitedTransport(base, 2, 10*time.Millisecond)
+	if failed := flood(t, dns, 10); failed != 8 {
+		t.Errorf("Expected 8 queries to time out in the queue, got %d", failed)
+	}
+	if stats := dns.(interface{ Stats() LimitStats }).Stats(); stats.Dropped != 8 {
+		t.Errorf("Expected 8 dropped queries: %+v", stats)
+	}
+	if base.peak > 2 {
+		t.Errorf("Concurrency exceeded the limit: %d", base.peak)
+	}
+}
+
+func TestLimitQueueWait(t *testing.T) {
+	base := &slowTransport{delay: 20 * time.Millisecond}
+	dns, _ := NewLimitedTransport(base, 1, time.Second)
+	if failed := flood(t, dns, 5); failed != 0 {
+		t.Errorf("%d queries failed", failed)
+	}
+	stats := dns.(interface{ Stats() LimitStats }).Stats()
+	if stats.Queued == 0 || stats.QueueWait <= 0 {
+		t.Errorf("Queue wait should be reported: %+v", stats)
+	}
+	if stats.MaxQueueWait < 20*time.Millisecond || stats.MaxQueueWait > stats.QueueWait {
+		t.Errorf("Unexpected maximum queue wait: %+v", stats)
+	}
+	if stats.Dropped != 0 {
+		t.Errorf("No queries should be dropped: %+v", stats)
+	}
+	dns.(interface{ ResetStats() }).ResetStats()
+	if stats := dns.(interface{ Stats() LimitStats }).Stats(); stats != (LimitStats{}) {
+		t.Errorf("Expected zero stats after reset: %+v", stats)
+	}
+}
+
+func TestLimitBadArgs(t *testing.T) {
+	if _, err := NewLimitedTransport(&slowTransport{}, 0, time.Second); err == nil {
+		t.Error("Expected an error for a zero limit")
+	}
+}
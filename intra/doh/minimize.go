@@ -0,0 +1,135 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// minimizingTransport strips each query down to what a recursive resolver
+// needs before forwarding it to another Transport.
+type minimizingTransport struct {
+	Transport
+}
+
+// NewMinimizingTransport returns a Transport that minimizes the information
+// in each query before forwarding it to `t`, for privacy.  The forwarded query
+// has a single question with a lowercase name, only the recursion-desired
+// flag, and no records other than an OPT record.  The OPT
+// record keeps its payload size and DNSSEC OK bit, but only the padding
+// option, so that options such as EDNS Client Subnet and cookies are not
+// sent.  Responses are restored to match the original query, including the
+// case of the name.  Queries that can't be parsed, or that have more than one
+// question, are forwarded unchanged.
+//
+// This is not QNAME minimization (RFC 7816), which only applies to iterative
+// resolution.  Queries sent to `t` are answered by a recursive resolver, which
+// needs the full name.
+func NewMinimizingTransport(t Transport) Transport {
+	return &minimizingTransport{t}
+}
+
+func (t *minimizingTransport) Query(q []byte) ([]byte, error) {
+	var orig dnsmessage.Message
+	if err := orig.Unpack(q); err != nil || len(orig.Questions) != 1 {
+		return t.Transport.Query(q)
+	}
+	min, err := minimize(&orig).Pack()
+	if err != nil {
+		return t.Transport.Query(q)
+	}
+	resp, err := t.Transport.Query(min)
+	if resp == nil {
+		return resp, err
+	}
+	if restored := restore(&orig, resp); restored != nil {
+		resp = restored
+	}
+	return resp, err
+}
+
+// minimize returns the minimized form of the query `q`.
+func minimize(q *dnsmessage.Message) *dnsmessage.Message {
+	question := q.Questions[0]
+	question.Name = lowerName(question.Name)
+	min := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               q.ID,
+			OpCode:           q.OpCode,
+			RecursionDesired: q.RecursionDesired,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	for _, r := range q.Additionals {
+		opt, ok := r.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			continue
+		}
+		var options []dnsmessage.Option
+		for _, o := range opt.Options {
+			if o.Code == OptResourcePaddingCode {
+				options = append(options, o)
+			}
+		}
+		var header dnsmessage.ResourceHeader
+		// The class of an OPT record is the UDP payload size.
+		if err := header.SetEDNS0(int(r.Header.Class), dnsmessage.RCodeSuccess, r.Header.DNSSECAllowed()); err != nil {
+			continue
+		}
+		min.Additionals = append(min.Additionals, dnsmessage.Resource{
+			Header: header,
+			Body:   &dnsmessage.OPTResource{Options: options},
+		})
+		break
+	}
+	return min
+}
+
+// lowerName returns `name` in lowercase.
+func lowerName(name dnsmessage.Name) dnsmessage.Name {
+	lower, err := dnsmessage.NewName(strings.ToLower(name.String()))
+	if err != nil {
+		return name
+	}
+	return lower
+}
+
+// restore rewrites the response `resp` to a minimized query so that it
+// matches the original query `q`.  Records for the minimized name are given
+// the name as the client wrote it.  It returns nil if `resp` can't be parsed.
+func restore(q *dnsmessage.Message, resp []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil
+	}
+	orig := q.Questions[0].Name
+	min := lowerName(orig)
+	msg.ID = q.ID
+	msg.Questions = q.Questions
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			if section[i].Header.Name == min {
+				section[i].Header.Name = orig
+			}
+		}
+	}
+	restored, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return restored
+}
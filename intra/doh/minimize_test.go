@@ -0,0 +1,113 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// recordingTransport records the last query before forwarding it.
+type recordingTransport struct {
+	Transport
+	last []byte
+}
+
+func (t *recordingTransport) Query(q []byte) ([]byte, error) {
+	t.last = q
+	return t.Transport.Query(q)
+}
+
+const optClientSubnet = 8
+
+// Returns a query with more information than the resolver needs.
+func makeVerboseQuery() []byte {
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+		panic(err)
+	}
+	name := dnsmessage.MustNewName("WwW.ExAmPlE.CoM.")
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, RecursionDesired: true, Authoritative: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.AResource{A: [4]byte{198, 51, 100, 1}},
+		}},
+		Additionals: []dnsmessage.Resource{{
+			Header: opt,
+			Body: &dnsmessage.OPTResource{Options: []dnsmessage.Option{
+				{Code: optClientSubnet, Data: []byte{0, 1, 24, 0, 203, 0, 113}},
+				{Code: OptResourcePaddingCode, Data: make([]byte, 8)},
+			}},
+		}},
+	}
+	return mustPack(&msg)
+}
+
+func TestMinimizedQuery(t *testing.T) {
+	rec := &recordingTransport{Transport: &answeringTransport{ttl: 60}}
+	resp, err := NewMinimizingTransport(rec).Query(makeVerboseQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := mustUnpack(rec.last)
+	if sent.ID != 0x1234 || !sent.RecursionDesired || sent.Authoritative {
+		t.Errorf("Unexpected header: %+v", sent.Header)
+	}
+	if len(sent.Questions) != 1 || sent.Questions[0].Name.String() != "www.example.com." {
+		t.Errorf("Unexpected questions: %v", sent.Questions)
+	}
+	if len(sent.Answers) != 0 || len(sent.Authorities) != 0 || len(sent.Additionals) != 1 {
+		t.Fatalf("Unexpected records: %d, %d, %d", len(sent.Answers), len(sent.Authorities), len(sent.Additionals))
+	}
+	opt := sent.Additionals[0]
+	if opt.Header.Class != 4096 || !opt.Header.DNSSECAllowed() {
+		t.Errorf("OPT record lost its flags: %+v", opt.Header)
+	}
+	options := opt.Body.(*dnsmessage.OPTResource).Options
+	if len(options) != 1 || options[0].Code != OptResourcePaddingCode {
+		t.Errorf("Only the padding option should be sent: %v", options)
+	}
+
+	// The response matches the client's query.
+	msg := mustUnpack(resp)
+	if msg.ID != 0x1234 || len(msg.Questions) != 1 || msg.Questions[0].Name.String() != "WwW.ExAmPlE.CoM." {
+		t.Errorf("Response does not match the query: %+v", msg)
+	}
+	if len(msg.Answers) != 1 || msg.Answers[0].Header.Name.String() != "WwW.ExAmPlE.CoM." {
+		t.Errorf("Unexpected answers: %v", msg.Answers)
+	}
+	if a, ok := msg.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{192, 0, 2, 1} {
+		t.Errorf("Unexpected answer: %v", msg.Answers[0].Body)
+	}
+}
+
+func TestMinimizeUnparseable(t *testing.T) {
+	rec := &recordingTransport{Transport: &rcodeTransport{err: errors.New("fail")}}
+	q := []byte{1, 2, 3}
+	NewMinimizingTransport(rec).Query(q)
+	if !bytes.Equal(rec.last, q) {
+		t.Errorf("Unparseable query was modified: %v", rec.last)
+	}
+}
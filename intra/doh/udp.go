@@ -0,0 +1,176 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// udpTransport sends DNS queries in plaintext over UDP.  UDP is lossy, so each
+// query is retransmitted if no response arrives within a timeout.
+type udpTransport struct {
+	Transport
+	addr     string
+	dialer   *net.Dialer
+	timeout  time.Duration
+	backoff  float64
+	retries  int
+	listener Listener
+}
+
+// NewUDPTransport returns a DNSTransport that sends plaintext queries to a
+// DNS server over UDP.
+// `addr` is the server's address in "host:port" form.
+// `dialer` is used to create a new socket for each query.
+// `timeout` is how long to wait for a response before the first retransmission.
+// `backoff` multiplies the timeout after each retransmission.  Values below 1 are
+//   treated as 1.
+// `retries` is the number of retransmissions before the query fails.
+// `listener` will receive the status of each DNS query when it is complete.
+func NewUDPTransport(addr string, dialer *net.Dialer, timeout time.Duration, backoff float64, retries int, listener Listener) (Transport, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("Bad timeout: %v", timeout)
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if backoff < 1 {
+		backoff = 1
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	return &udpTransport{
+		addr:     addr,
+		dialer:   dialer,
+		timeout:  timeout,
+		backoff:  backoff,
+		retries:  retries,
+		listener: listener,
+	}, nil
+}
+
+// Sends `q` and waits for a response with a matching ID, retransmitting on
+// timeout.  On failure, the response is a SERVFAIL if possible.
+func (t *udpTransport) doQuery(q []byte) (response []byte, qerr *queryError) {
+	defer func() {
+		if qerr != nil {
+			response = tryServfail(q)
+		}
+	}()
+	if len(q) < 2 {
+		qerr = &queryError{BadQuery, fmt.Errorf("Query length is %d", len(q))}
+		return
+	}
+	conn, err := t.dialer.Dial("udp", t.addr)
+	if err != nil {
+		qerr = &queryError{SendFailed, err}
+		return
+	}
+	defer conn.Close()
+
+	// A compliant server's response fits in the payload size that the client
+	// advertised.  One more byte detects servers that send larger responses.
+	limit := udpPayloadSize(q)
+	buf := make([]byte, limit+1)
+	timeout := t.timeout
+	for attempt := 0; attempt <= t.retries; attempt++ {
+		if attempt > 0 {
+			log.Debugf("Retransmitting query %d to %s", id(q), t.addr)
+		}
+		if _, err = conn.Write(q); err != nil {
+			qerr = &queryError{SendFailed, err}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			var n int
+			n, err = conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n < 2 || buf[0] != q[0] || buf[1] != q[1] {
+				// Not a response to this query, possibly a late response to
+				// a previous query on a reused port.  Keep waiting.
+				continue
+			}
+			if n > limit {
+				log.Debugf("Response to query %d exceeds %d bytes, truncating", id(q), limit)
+				if response, err = truncated(q); err != nil {
+					qerr = &queryError{BadResponse, err}
+				}
+				return
+			}
+			response = append([]byte{}, buf[:n]...)
+			return
+		}
+		var neterr net.Error
+		if !errors.As(err, &neterr) || !neterr.Timeout() {
+			// Errors other than timeouts (e.g. ICMP port unreachable) are not
+			// worth retrying.
+			qerr = &queryError{SendFailed, err}
+			return
+		}
+		timeout = time.Duration(float64(timeout) * t.backoff)
+	}
+	qerr = &queryError{SendFailed, fmt.Errorf("No response after %d attempts", t.retries+1)}
+	return
+}
+
+func id(q []byte) uint16 {
+	return uint16(q[0])<<8 | uint16(q[1])
+}
+
+func (t *udpTransport) Query(q []byte) ([]byte, error) {
+	var token Token
+	if t.listener != nil {
+		token = t.listener.OnQuery(t.addr)
+	}
+
+	before := time.Now()
+	response, qerr := t.doQuery(q)
+	after := time.Now()
+
+	var err error
+	status := Complete
+	if qerr != nil {
+		err = qerr
+		status = qerr.status
+	}
+
+	if t.listener != nil {
+		host, _, _ := net.SplitHostPort(t.addr)
+		t.listener.OnResponse(token, &Summary{
+			Latency:  after.Sub(before).Seconds(),
+			Query:    q,
+			Response: response,
+			Server:   host,
+			Status:   status,
+		})
+	}
+	return response, err
+}
+
+func (t *udpTransport) GetURL() string {
+	return t.addr
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUDPServer answers DNS queries over UDP after dropping the first `drop`
+// copies of each query.
+type fakeUDPServer struct {
+	conn     *net.UDPConn
+	drop     int
+	mu       sync.Mutex
+	received int
+}
+
+func makeUDPServer(t *testing.T, drop int) *fakeUDPServer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeUDPServer{conn: conn, drop: drop}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeUDPServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received++
+		received := s.received
+		s.mu.Unlock()
+		if received <= s.drop {
+			continue
+		}
+		msg := mustUnpack(buf[:n])
+		msg.Response = true
+		// Send a stray response with the wrong ID first.
+		msg.ID++
+		s.conn.WriteTo(mustPack(msg), addr)
+		msg.ID--
+		s.conn.WriteTo(mustPack(msg), addr)
+	}
+}
+
+func (s *fakeUDPServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+func (s *fakeUDPServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func TestUDPQuery(t *testing.T) {
+	s := makeUDPServer(t, 0)
+	dns, err := NewUDPTransport(s.addr(), nil, time.Second, 2, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := dns.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := mustUnpack(resp)
+	if msg.ID != simpleQuery.ID || !msg.Response {
+		t.Errorf("Unexpected response: %v", msg)
+	}
+	if s.count() != 1 {
+		t.Errorf("Expected one query, got %d", s.count())
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	s := makeUDPServer(t, 2)
+	dns, _ := NewUDPTransport(s.addr(), nil, 20*time.Millisecond, 2, 2, nil)
+	resp, err := dns.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustUnpack(resp).ID != simpleQuery.ID {
+		t.Error("Query ID mismatch")
+	}
+	if s.count() != 3 {
+		t.Errorf("Expected 3 transmissions, got %d", s.count())
+	}
+}
+
+func TestUDPBackoff(t *testing.T) {
+	s := makeUDPServer(t, 3)
+	timeout := 20 * time.Millisecond
+	dns, _ := NewUDPTransport(s.addr(), nil, timeout, 2, 2, nil)
+	before := time.Now()
+	resp, err := dns.Query(simpleQueryBytes)
+	elapsed := time.Since(before)
+	if err == nil {
+		t.Fatal("Expected query to fail")
+	}
+	var qerr *queryError
+	if !errors.As(err, &qerr) || qerr.status != SendFailed {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if mustUnpack(resp).RCode != dnsmessage.RCodeServerFailure {
+		t.Error("Expected SERVFAIL")
+	}
+	if s.count() != 3 {
+		t.Errorf("Expected 3 transmissions, got %d", s.count())
+	}
+	// Timeouts are 20, 40, and 80 ms.
+	if elapsed < 7*timeout {
+		t.Errorf("Backoff was not applied: %v", elapsed)
+	}
+}
+
+func TestUDPBadArgs(t *testing.T) {
+	if _, err := NewUDPTransport("127.0.0.1", nil, time.Second, 1, 1, nil); err == nil {
+		t.Error("Expected error for missing port")
+	}
+	if _, err := NewUDPTransport("127.0.0.1:53", nil, 0, 1, 1, nil); err == nil {
+		t.Error("Expected error for zero timeout")
+	}
+}
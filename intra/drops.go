@@ -0,0 +1,122 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/clock"
+)
+
+// Reasons for dropping a packet or connection, as reported by DropCounts.
+const (
+	DropBlocked       = "blocked"        // The destination is blocked by the filter.
+	DropBlockedPort   = "blocked-port"   // The destination port is blocked by the port policy.
+	DropNoAssociation = "no-association" // A UDP datagram arrived for an unknown association.
+	DropBindFailed    = "bind-failed"    // No upstream socket could be bound.
+	DropSendFailed    = "send-failed"    // The upstream socket could not send, e.g. no route.
+	DropDialFailed    = "dial-failed"    // The upstream dial failed, so the connection was reset.
+	DropDuplicateFlow = "duplicate-flow" // A connection duplicated an active flow, so it was reset.
+	DropLocalIPv6     = "local-ipv6"     // The destination is link-local or unique-local IPv6.
+	DropEvicted       = "evicted"        // A UDP association was closed to stay within the flow limit.
+)
+
+// dropCounter counts drops by reason, and optionally logs them, at most once
+// per interval for each reason.
+type dropCounter struct {
+	mu sync.Mutex // Protects all fields.
+	// Minimum time between logs for each reason.  Zero disables logging.
+	interval   time.Duration
+	counts     map[string]int64
+	lastLog    map[string]time.Time
+	suppressed map[string]int64 // Drops not logged since the last log.
+	// logf is the logging function.  Tests replace it.
+	logf func(format string, args ...interface{})
+	// clock is the source of time for rate limiting.  Nil means clock.Real.
+	clock clock.Clock
+}
+
+// drop records a drop for `reason`.  `format` and `args` describe the dropped
+// packet.
+func (d *dropCounter) drop(reason string, format string, args ...interface{}) {
+	d.mu.Lock()
+	if d.counts == nil {
+		d.counts = make(map[string]int64)
+		d.lastLog = make(map[string]time.Time)
+		d.suppressed = make(map[string]int64)
+	}
+	d.counts[reason]++
+	if d.interval <= 0 {
+		d.mu.Unlock()
+		return
+	}
+	now := clock.Or(d.clock).Now()
+	if last, ok := d.lastLog[reason]; ok && now.Sub(last) < d.interval {
+		d.suppressed[reason]++
+		d.mu.Unlock()
+		return
+	}
+	d.lastLog[reason] = now
+	suppressed := d.suppressed[reason]
+	d.suppressed[reason] = 0
+	logf := d.logf
+	d.mu.Unlock()
+
+	if logf == nil {
+		logf = log.Infof
+	}
+	msg := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		logf("Dropped (%s): %s (%d similar drops not logged)", reason, msg, suppressed)
+	} else {
+		logf("Dropped (%s): %s", reason, msg)
+	}
+}
+
+// snapshot returns a copy of the counts.
+func (d *dropCounter) snapshot() map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := make(map[string]int64, len(d.counts))
+	for reason, n := range d.counts {
+		counts[reason] = n
+	}
+	return counts
+}
+
+func (d *dropCounter) setLogInterval(interval time.Duration) {
+	d.mu.Lock()
+	d.interval = interval
+	d.mu.Unlock()
+}
+
+// reset zeroes the counts, and forgets when each reason was last logged.
+func (d *dropCounter) reset() {
+	d.mu.Lock()
+	d.counts = nil
+	d.lastLog = nil
+	d.suppressed = nil
+	d.mu.Unlock()
+}
+
+func (d *dropCounter) logInterval() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.interval
+}
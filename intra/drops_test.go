@@ -0,0 +1,183 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/clock"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
+)
+
+// logRecorder records log messages.
+type logRecorder struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (r *logRecorder) logf(format string, args ...interface{}) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, fmt.Sprintf(format, args...))
+	r.mu.Unlock()
+}
+
+func (r *logRecorder) messages() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.msgs...)
+}
+
+func TestDropRateLimit(t *testing.T) {
+	var logs logRecorder
+	fake := clock.NewFake(time.Unix(0, 0))
+	d := &dropCounter{logf: logs.logf, clock: fake}
+	d.drop(DropBlocked, "quiet")
+	if len(logs.messages()) != 0 {
+		t.Error("Drops should not be logged by default")
+	}
+
+	interval := time.Minute
+	d.setLogInterval(interval)
+	for i := 0; i < 5; i++ {
+		d.drop(DropBlocked, "packet %d", i)
+	}
+	d.drop(DropSendFailed, "other")
+	msgs := logs.messages()
+	if len(msgs) != 2 || !strings.Contains(msgs[0], "packet 0") || !strings.Contains(msgs[1], DropSendFailed) {
+		t.Fatalf("Unexpected logs: %q", msgs)
+	}
+
+	fake.Advance(interval - time.Second)
+	d.drop(DropBlocked, "too soon")
+	fake.Advance(time.Second)
+	d.drop(DropBlocked, "later")
+	msgs = logs.messages()
+	if len(msgs) != 3 || !strings.Contains(msgs[2], "later") || !strings.Contains(msgs[2], "5 similar") {
+		t.Errorf("Unexpected logs: %q", msgs)
+	}
+
+	counts := d.snapshot()
+	if counts[DropBlocked] != 8 || counts[DropSendFailed] != 1 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+}
+
+func TestTCPDropBlocked(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener()).(*tcpHandler)
+	f := filter.NewFilter(filter.Blocklist)
+	f.AddCIDR("192.0.2.0/24")
+	h.SetFilter(f)
+	var logs logRecorder
+	h.drops.logf = logs.logf
+	h.SetDropLogInterval(time.Minute)
+	for i := 0; i < 3; i++ {
+		_, local := makePair(t)
+		target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}
+		if err := h.Handle(&fakeTCPConn{local}, target); err == nil {
+			t.Fatal("Expected blocked connection to fail")
+		}
+	}
+	if n := h.DropCounts()[DropBlocked]; n != 3 {
+		t.Errorf("Expected 3 blocked connections, got %d", n)
+	}
+	if msgs := logs.messages(); len(msgs) != 1 {
+		t.Errorf("Expected one log message, got %q", msgs)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	f := filter.NewFilter(filter.Blocklist)
+	f.AddCIDR("192.0.2.0/24")
+	h.SetFilter(f)
+	h.SetLearnedSplits(10)
+	server, received := makeEchoServer(t)
+	app, local := makePair(t)
+	if err := h.Handle(&fakeTCPConn{local}, server); err != nil {
+		t.Fatal(err)
+	}
+	_, blocked := makePair(t)
+	h.Handle(&fakeTCPConn{blocked}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80})
+
+	h.FlushCaches()
+	h.ResetStats()
+	if counts := h.DropCounts(); len(counts) != 0 {
+		t.Errorf("Expected no drops after reset: %v", counts)
+	}
+	// The active connection is unaffected.
+	app.Write([]byte("hello"))
+	app.CloseWrite()
+	if reply, err := ioutil.ReadAll(app); err != nil || string(reply) != "hello" {
+		t.Errorf("Got %q, %v", reply, err)
+	}
+	<-received
+
+	h.Handle(&fakeTCPConn{blocked}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80})
+	if n := h.DropCounts()[DropBlocked]; n != 1 {
+		t.Errorf("Drops should be counted after a reset: %d", n)
+	}
+
+	u := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 1))
+	u.ReceiveTo(newFakeUDPConn(), []byte("x"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	u.ResetStats()
+	if counts := u.DropCounts(); len(counts) != 0 {
+		t.Errorf("Expected no UDP drops after reset: %v", counts)
+	}
+}
+
+func TestUDPDropNoAssociation(t *testing.T) {
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 1))
+	var logs logRecorder
+	h.(*udpHandler).drops.logf = logs.logf
+	h.SetDropLogInterval(time.Minute)
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	for i := 0; i < 2; i++ {
+		if err := h.ReceiveTo(newFakeUDPConn(), []byte("x"), server); err == nil {
+			t.Error("Expected an error for an unknown association")
+		}
+	}
+	if n := h.DropCounts()[DropNoAssociation]; n != 2 {
+		t.Errorf("Expected 2 drops, got %d", n)
+	}
+	if msgs := logs.messages(); len(msgs) != 1 || !strings.Contains(msgs[0], DropNoAssociation) {
+		t.Errorf("Unexpected logs: %q", msgs)
+	}
+}
+
+func TestUDPDropBlocked(t *testing.T) {
+	listener := make(fakeUDPListener, 1)
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, listener)
+	f := filter.NewFilter(filter.Blocklist)
+	f.AddCIDR("127.0.0.0/8")
+	h.SetFilter(f)
+	conn := newFakeUDPConn()
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	if err := h.Connect(conn, server); err != nil {
+		t.Fatal(err)
+	}
+	defer h.(*udpHandler).Close(conn)
+	if err := h.ReceiveTo(conn, []byte("x"), server); err == nil {
+		t.Error("Expected blocked datagram to fail")
+	}
+	if counts := h.DropCounts(); counts[DropBlocked] != 1 || len(counts) != 1 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package intra
+
+import "golang.org/x/sys/unix"
+
+// Socket option from the XNU kernel's private TCP header, which x/sys/unix
+// doesn't define, and its values.
+const (
+	tcpECNMode     = 0x111
+	ecnModeEnable  = 1
+	ecnModeDisable = 2
+)
+
+const ecnSupported = true
+
+// setECN enables or disables ECN negotiation on the TCP socket `fd`.
+func setECN(fd int, enable bool) error {
+	mode := ecnModeDisable
+	if enable {
+		mode = ecnModeEnable
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, tcpECNMode, mode)
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin
+// +build darwin
+
+package intra
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+func TestECNMode(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	for _, tc := range []struct {
+		mode string
+		want int
+	}{{ECNEnabled, ecnModeEnable}, {ECNDisabled, ecnModeDisable}} {
+		if err := h.SetECN(tc.mode); err != nil {
+			t.Fatal(err)
+		}
+		conn := dialLocal(t, h.dialer)
+		if got := getsockoptInt(t, conn, unix.IPPROTO_TCP, tcpECNMode); got != tc.want {
+			t.Errorf("%s: got ECN mode %d, want %d", tc.mode, got, tc.want)
+		}
+	}
+
+	// Sockets created by the retrier use the same dialer.
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	retrier, err := split.DialWithSplitRetry(h.dialer, l.Addr().(*net.TCPAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer retrier.Close()
+	raw, err := retrier.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	raw.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, tcpECNMode)
+	})
+	if err != nil || got != ecnModeDisable {
+		t.Errorf("Retrier ECN mode was not set: %d, %v", got, err)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !darwin
+// +build !darwin
+
+package intra
+
+import "errors"
+
+// On Linux, including Android, ECN negotiation is controlled by the
+// net.ipv4.tcp_ecn sysctl, and the kernel ignores the ECN bits of IP_TOS on TCP
+// sockets, so ECN can't be set per socket.
+const ecnSupported = false
+
+func setECN(fd int, enable bool) error {
+	return errors.New("ECN can't be set per socket on this platform")
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ConnEventBuffer is the capacity of the channel returned by Events.
+const ConnEventBuffer = 64
+
+// Types of ConnEvent.
+const (
+	ConnEventOpen  = "open"  // The upstream connection was established.
+	ConnEventClose = "close" // The connection closed.
+)
+
+// ConnEvent describes a change in the lifecycle of a forwarded connection.
+type ConnEvent struct {
+	Type string // One of the ConnEvent constants.
+	// Record has the same data as passed to the TCPCloseHook.  For an open
+	// event, only Client, Target, Start and Strategy are set.
+	Record TCPConnRecord
+	// Missed is the number of events that were dropped since the previous
+	// event was delivered, because the channel was full.
+	Missed int64
+}
+
+// eventStream delivers ConnEvents on a buffered channel, which is created by
+// the first call to events.  Events are never sent before that.  Sending never
+// blocks: if the channel is full, the event is dropped and counted as missed.
+type eventStream struct {
+	once   sync.Once
+	ch     atomic.Value // chan ConnEvent, once created.
+	missed int64        // Accessed atomically.
+}
+
+func (s *eventStream) events() <-chan ConnEvent {
+	s.once.Do(func() { s.ch.Store(make(chan ConnEvent, ConnEventBuffer)) })
+	return s.ch.Load().(chan ConnEvent)
+}
+
+// enabled reports whether anyone has asked for events.
+func (s *eventStream) enabled() bool {
+	return s.ch.Load() != nil
+}
+
+func (s *eventStream) emit(kind string, record TCPConnRecord) {
+	ch, ok := s.ch.Load().(chan ConnEvent)
+	if !ok {
+		return
+	}
+	missed := atomic.SwapInt64(&s.missed, 0)
+	select {
+	case ch <- ConnEvent{Type: kind, Record: record, Missed: missed}:
+	default:
+		atomic.AddInt64(&s.missed, missed+1)
+	}
+}
+
+func (h *tcpHandler) Events() <-chan ConnEvent {
+	return h.events.events()
+}
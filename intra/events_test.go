@@ -0,0 +1,97 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns the next event from `events`, or fails after a timeout.
+func nextEvent(t *testing.T, events <-chan ConnEvent) ConnEvent {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("No event")
+	}
+	return ConnEvent{}
+}
+
+func TestConnEvents(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	events := h.Events()
+	if h.Events() != events {
+		t.Error("Events should return the same channel")
+	}
+	server, _ := makeEchoServer(t)
+	if err := handleEcho(t, h, server); err != nil {
+		t.Fatal(err)
+	}
+
+	open := nextEvent(t, events)
+	if open.Type != ConnEventOpen {
+		t.Fatalf("Expected an open event, got %q", open.Type)
+	}
+	if open.Record.Target.String() != server.String() || open.Record.Strategy != StrategyDirect {
+		t.Errorf("Unexpected open record: %+v", open.Record)
+	}
+	closed := nextEvent(t, events)
+	if closed.Type != ConnEventClose {
+		t.Fatalf("Expected a close event, got %q", closed.Type)
+	}
+	r := closed.Record
+	if r.Client.String() != open.Record.Client.String() || !r.Start.Equal(open.Record.Start) {
+		t.Errorf("The close event should describe the same flow: %+v", r)
+	}
+	if r.Summary.UploadBytes != 5 || r.Summary.DownloadBytes != 5 {
+		t.Errorf("Unexpected summary: %+v", r.Summary)
+	}
+	if open.Missed != 0 || closed.Missed != 0 {
+		t.Error("No events should be missed")
+	}
+}
+
+func TestConnEventsSlowConsumer(t *testing.T) {
+	const conns = ConnEventBuffer
+	listener := &fakeTCPListener{make(chan *TCPSocketSummary, conns+1)}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, listener)
+	events := h.Events()
+	server, _ := makeEchoServer(t)
+	// Nothing reads the events, but every connection still completes.
+	for i := 0; i < conns; i++ {
+		if err := handleEcho(t, h, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForGoroutines(t, h, 0)
+	if len(events) != ConnEventBuffer {
+		t.Fatalf("Expected a full channel, got %d events", len(events))
+	}
+	for len(events) > 0 {
+		<-events
+	}
+	if err := handleEcho(t, h, server); err != nil {
+		t.Fatal(err)
+	}
+	// Each connection produced two events, but only half of them fit.
+	if e := nextEvent(t, events); e.Type != ConnEventOpen || e.Missed != conns {
+		t.Errorf("Expected an open event after %d missed events, got %q after %d", conns, e.Type, e.Missed)
+	}
+	if e := nextEvent(t, events); e.Missed != 0 {
+		t.Errorf("The missed count should be reset: %d", e.Missed)
+	}
+}
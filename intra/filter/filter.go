@@ -0,0 +1,252 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Blocklist : All destinations are permitted except those that are listed.
+	Blocklist = iota
+	// Allowlist : All destinations are blocked except those that are listed.
+	Allowlist
+)
+
+// Filter decides which destinations may be reached through the tunnel.
+// Destinations are listed by domain name or by IP range.  IP addresses
+// returned in DNS responses for a listed domain are treated as listed too,
+// so that connections to IP addresses can be matched against domain rules.
+// A Filter is safe for concurrent use.
+type Filter struct {
+	mu      sync.RWMutex
+	mode    int
+	domains map[string]bool      // Listed domains, without a trailing dot.
+	nets    []*net.IPNet         // Listed IP ranges.
+	learned map[string]time.Time // Listed IPs learned from DNS, and their expiry.
+}
+
+// maxLearned bounds the number of IPs learned from DNS responses.  If it is
+// exceeded, the expired ones are forgotten, and if that isn't enough, all of
+// them are.
+const maxLearned = 10000
+
+// NewFilter returns an empty Filter.  `mode` is Blocklist or Allowlist.
+// An empty Filter in Blocklist mode permits everything.
+func NewFilter(mode int) *Filter {
+	return &Filter{
+		mode:    mode,
+		domains: make(map[string]bool),
+		learned: make(map[string]time.Time),
+	}
+}
+
+// Mode returns the current mode (Blocklist or Allowlist).
+func (f *Filter) Mode() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.mode
+}
+
+// SetMode switches between Blocklist and Allowlist mode.  The listed
+// entries are retained.
+func (f *Filter) SetMode(mode int) {
+	f.mu.Lock()
+	f.mode = mode
+	f.mu.Unlock()
+}
+
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// AddDomain lists `domain` and all of its subdomains.
+func (f *Filter) AddDomain(domain string) {
+	f.mu.Lock()
+	f.domains[normalize(domain)] = true
+	f.mu.Unlock()
+}
+
+// AddCIDR lists an IP range such as "10.0.0.0/8".  A bare IP address is
+// treated as a single-address range.
+func (f *Filter) AddCIDR(cidr string) error {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return fmt.Errorf("Bad IP address: %s", cidr)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		cidr = fmt.Sprintf("%s/%d", ip.String(), bits)
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.nets = append(f.nets, ipnet)
+	f.mu.Unlock()
+	return nil
+}
+
+// Reports whether `name` or one of its parent domains is listed.
+// Must be called under RLock.
+func (f *Filter) listedName(name string) bool {
+	name = normalize(name)
+	for {
+		if f.domains[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// Reports whether `ip` is in a listed range or was learned from DNS, and its
+// TTL has not expired.  Must be called under RLock.
+func (f *Filter) listedIP(ip net.IP) bool {
+	if expiry, ok := f.learned[ip.String()]; ok && time.Now().Before(expiry) {
+		return true
+	}
+	for _, ipnet := range f.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowName reports whether DNS queries for `name` are permitted.
+func (f *Filter) AllowName(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.listedName(name) == (f.mode == Allowlist)
+}
+
+// AllowIP reports whether connections to `ip` are permitted.
+func (f *Filter) AllowIP(ip net.IP) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.listedIP(ip) == (f.mode == Allowlist)
+}
+
+// maxCNAMEDepth is the longest CNAME chain that AllowTargets follows.
+const maxCNAMEDepth = 8
+
+// AllowTargets reports whether the CNAME chain in a DNS response only leads to
+// permitted names, so that a permitted name can't cloak a blocked one.  The
+// chain is followed from each question through the answers.  A name with
+// several CNAME records is followed to all of them.  Loops are followed once,
+// and a chain longer than maxCNAMEDepth is not permitted.  In Allowlist mode,
+// CNAME targets inherit the status of the queried name, as in Observe, so
+// every chain is permitted.
+func (f *Filter) AllowTargets(msg *dnsmessage.Message) bool {
+	targets := make(map[string][]string)
+	for _, answer := range msg.Answers {
+		if body, ok := answer.Body.(*dnsmessage.CNAMEResource); ok {
+			name := normalize(answer.Header.Name.String())
+			targets[name] = append(targets[name], normalize(body.CNAME.String()))
+		}
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.mode == Allowlist {
+		return true
+	}
+	visited := make(map[string]bool)
+	var names []string
+	for _, question := range msg.Questions {
+		name := normalize(question.Name.String())
+		visited[name] = true
+		names = append(names, name)
+	}
+	for depth := 0; len(names) > 0; depth++ {
+		var next []string
+		for _, name := range names {
+			for _, target := range targets[name] {
+				if visited[target] {
+					continue
+				}
+				if depth >= maxCNAMEDepth || f.listedName(target) {
+					return false
+				}
+				visited[target] = true
+				next = append(next, target)
+			}
+		}
+		names = next
+	}
+	return true
+}
+
+// Records `ip` as listed until its TTL expires.  Must be called under Lock.
+func (f *Filter) learn(ip net.IP, ttl uint32, now time.Time) {
+	key := ip.String()
+	if _, ok := f.learned[key]; !ok && len(f.learned) >= maxLearned {
+		for k, expiry := range f.learned {
+			if !now.Before(expiry) {
+				delete(f.learned, k)
+			}
+		}
+		if len(f.learned) >= maxLearned {
+			f.learned = make(map[string]time.Time)
+		}
+	}
+	expiry := now.Add(time.Duration(ttl) * time.Second)
+	if expiry.After(f.learned[key]) {
+		f.learned[key] = expiry
+	}
+}
+
+// Observe records the addresses in a DNS response, so that connections to
+// those addresses are matched against the rules for the queried name until
+// their TTL expires.
+func (f *Filter) Observe(response []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// CNAME targets inherit the status of the queried name.
+	listed := false
+	now := time.Now()
+	for _, question := range msg.Questions {
+		listed = listed || f.listedName(question.Name.String())
+	}
+	for _, answer := range msg.Answers {
+		if !listed && !f.listedName(answer.Header.Name.String()) {
+			continue
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			f.learn(net.IP(body.A[:]), answer.Header.TTL, now)
+		case *dnsmessage.AAAAResource:
+			f.learn(net.IP(body.AAAA[:]), answer.Header.TTL, now)
+		}
+	}
+}
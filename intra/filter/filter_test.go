@@ -0,0 +1,354 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeTransport struct {
+	doh.Transport
+	queries  int
+	response []byte
+}
+
+func (t *fakeTransport) Query(q []byte) ([]byte, error) {
+	t.queries++
+	return t.response, nil
+}
+
+func makeQuery(name string) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0xbeef, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return packed
+}
+
+func makeResponse(name string, ip net.IP) []byte {
+	return makeResponseTTL(name, ip, 60)
+}
+
+func makeResponseTTL(name string, ip net.IP, ttl uint32) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(makeQuery(name)); err != nil {
+		panic(err)
+	}
+	msg.Response = true
+	var a [4]byte
+	copy(a[:], ip.To4())
+	msg.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.AResource{A: a},
+	}}
+	packed, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return packed
+}
+
+func rcode(t *testing.T, response []byte) dnsmessage.RCode {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatal(err)
+	}
+	return msg.RCode
+}
+
+func TestEmptyBlocklist(t *testing.T) {
+	f := NewFilter(Blocklist)
+	if !f.AllowName("www.example.com.") {
+		t.Error("Empty blocklist should allow all names")
+	}
+	if !f.AllowIP(net.ParseIP("192.0.2.1")) {
+		t.Error("Empty blocklist should allow all IPs")
+	}
+}
+
+func TestEmptyAllowlist(t *testing.T) {
+	f := NewFilter(Allowlist)
+	if f.AllowName("www.example.com.") {
+		t.Error("Empty allowlist should block all names")
+	}
+	if f.AllowIP(net.ParseIP("192.0.2.1")) {
+		t.Error("Empty allowlist should block all IPs")
+	}
+}
+
+func TestAllowlistDomains(t *testing.T) {
+	f := NewFilter(Allowlist)
+	f.AddDomain("Example.com")
+	for _, name := range []string{"example.com.", "www.example.com.", "A.B.EXAMPLE.COM"} {
+		if !f.AllowName(name) {
+			t.Errorf("%s should be allowed", name)
+		}
+	}
+	for _, name := range []string{"example.org.", "notexample.com.", "com."} {
+		if f.AllowName(name) {
+			t.Errorf("%s should be blocked", name)
+		}
+	}
+}
+
+func TestAllowlistCIDR(t *testing.T) {
+	f := NewFilter(Allowlist)
+	if err := f.AddCIDR("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddCIDR("2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AddCIDR("bogus"); err == nil {
+		t.Error("Expected an error for a bad CIDR")
+	}
+	if !f.AllowIP(net.ParseIP("10.1.2.3")) {
+		t.Error("Listed range should be allowed")
+	}
+	if !f.AllowIP(net.ParseIP("2001:db8::1")) {
+		t.Error("Listed IP should be allowed")
+	}
+	if f.AllowIP(net.ParseIP("2001:db8::2")) {
+		t.Error("Unlisted IP should be blocked")
+	}
+	if f.AllowIP(net.ParseIP("192.0.2.1")) {
+		t.Error("Unlisted IP should be blocked")
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	f := NewFilter(Blocklist)
+	f.AddDomain("example.com")
+	f.AddCIDR("192.0.2.0/24")
+	if f.AllowName("www.example.com.") {
+		t.Error("Listed name should be blocked")
+	}
+	if !f.AllowName("www.example.org.") {
+		t.Error("Unlisted name should be allowed")
+	}
+	if f.AllowIP(net.ParseIP("192.0.2.1")) {
+		t.Error("Listed IP should be blocked")
+	}
+	if !f.AllowIP(net.ParseIP("198.51.100.1")) {
+		t.Error("Unlisted IP should be allowed")
+	}
+}
+
+func TestSetMode(t *testing.T) {
+	f := NewFilter(Blocklist)
+	f.AddDomain("example.com")
+	f.SetMode(Allowlist)
+	if f.Mode() != Allowlist {
+		t.Errorf("Unexpected mode %d", f.Mode())
+	}
+	if !f.AllowName("example.com.") {
+		t.Error("Listed name should be allowed after switching modes")
+	}
+}
+
+func TestTransportAllowlist(t *testing.T) {
+	f := NewFilter(Allowlist)
+	f.AddDomain("example.com")
+	ip := net.ParseIP("192.0.2.1")
+	base := &fakeTransport{response: makeResponse("www.example.com.", ip)}
+	dns := NewTransport(base, f)
+
+	if f.AllowIP(ip) {
+		t.Error("IP should be blocked before it is resolved")
+	}
+	response, err := dns.Query(makeQuery("www.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.queries != 1 {
+		t.Errorf("Listed query should be forwarded")
+	}
+	if rcode(t, response) != dnsmessage.RCodeSuccess {
+		t.Errorf("Unexpected response code")
+	}
+	if !f.AllowIP(ip) {
+		t.Error("IP from an allowed name should be allowed")
+	}
+
+	response, err = dns.Query(makeQuery("www.example.org."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.queries != 1 {
+		t.Errorf("Unlisted query should not be forwarded")
+	}
+	if rcode(t, response) != dnsmessage.RCodeNameError {
+		t.Errorf("Unlisted query should get NXDOMAIN")
+	}
+}
+
+func TestObserveUnlisted(t *testing.T) {
+	f := NewFilter(Allowlist)
+	f.AddDomain("example.com")
+	ip := net.ParseIP("192.0.2.2")
+	f.Observe(makeResponse("www.example.org.", ip))
+	if f.AllowIP(ip) {
+		t.Error("IP from an unlisted name should not be allowed")
+	}
+}
+
+func TestObserveExpiry(t *testing.T) {
+	f := NewFilter(Allowlist)
+	f.AddDomain("example.com")
+	ip := net.ParseIP("192.0.2.3")
+	f.Observe(makeResponseTTL("www.example.com.", ip, 0))
+	if f.AllowIP(ip) {
+		t.Error("IP should not be allowed after its TTL expires")
+	}
+	f.Observe(makeResponseTTL("www.example.com.", ip, 60))
+	if !f.AllowIP(ip) {
+		t.Error("IP should be allowed again after it is resolved")
+	}
+	f.Observe(makeResponseTTL("www.example.com.", ip, 0))
+	if !f.AllowIP(ip) {
+		t.Error("A shorter TTL should not shorten the expiry")
+	}
+}
+
+func TestObserveBounded(t *testing.T) {
+	f := NewFilter(Allowlist)
+	f.AddDomain("example.com")
+	ip := net.ParseIP("192.0.2.4")
+	f.Observe(makeResponse("www.example.com.", ip))
+	for i := 0; i < maxLearned; i++ {
+		other := net.IPv4(198, 18, byte(i>>8), byte(i))
+		f.Observe(makeResponse("www.example.com.", other))
+	}
+	if len(f.learned) > maxLearned {
+		t.Errorf("Learned %d IPs, more than %d", len(f.learned), maxLearned)
+	}
+	if f.AllowIP(ip) {
+		t.Error("IPs should be forgotten when the limit is exceeded")
+	}
+}
+
+// Returns a response to a query for `chain[0]`, in which each name is a CNAME
+// for the next, and the last name has address `ip`.
+func makeCNAMEResponse(ip net.IP, chain ...string) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(makeResponse(chain[len(chain)-1], ip)); err != nil {
+		panic(err)
+	}
+	msg.Questions[0].Name = dnsmessage.MustNewName(chain[0])
+	var cnames []dnsmessage.Resource
+	for i := 0; i+1 < len(chain); i++ {
+		cnames = append(cnames, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName(chain[i]),
+				Type:  dnsmessage.TypeCNAME,
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			},
+			Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(chain[i+1])},
+		})
+	}
+	msg.Answers = append(cnames, msg.Answers...)
+	packed, err := msg.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return packed
+}
+
+func TestTransportCNAMEChain(t *testing.T) {
+	f := NewFilter(Blocklist)
+	f.AddDomain("tracker.example")
+	ip := net.ParseIP("192.0.2.3")
+	chain := []string{"www.example.com.", "cdn.example.net.", "Edge.Tracker.Example."}
+	base := &fakeTransport{response: makeCNAMEResponse(ip, chain...)}
+	dns := NewTransport(base, f)
+	response, err := dns.Query(makeQuery(chain[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.queries != 1 {
+		t.Error("The benign name should be forwarded")
+	}
+	if rcode(t, response) != dnsmessage.RCodeNameError {
+		t.Error("A chain ending at a blocked name should get NXDOMAIN")
+	}
+
+	// A chain that stays on permitted names is unchanged.
+	base.response = makeCNAMEResponse(ip, "www.example.com.", "cdn.example.net.")
+	response, err = dns.Query(makeQuery("www.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode(t, response) != dnsmessage.RCodeSuccess {
+		t.Error("A permitted chain should succeed")
+	}
+
+	// In Allowlist mode, CNAME targets inherit the status of the queried name.
+	f.SetMode(Allowlist)
+	f.AddDomain("example.com")
+	base.response = makeCNAMEResponse(ip, chain...)
+	response, err = dns.Query(makeQuery(chain[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode(t, response) != dnsmessage.RCodeSuccess || !f.AllowIP(ip) {
+		t.Error("An allowed name's chain should be allowed")
+	}
+}
+
+func TestAllowTargetsLoopsAndDepth(t *testing.T) {
+	f := NewFilter(Blocklist)
+	f.AddDomain("blocked.example")
+	check := func(chain ...string) bool {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(makeCNAMEResponse(net.ParseIP("192.0.2.4"), chain...)); err != nil {
+			t.Fatal(err)
+		}
+		return f.AllowTargets(&msg)
+	}
+	if !check("a.example.", "b.example.", "a.example.") {
+		t.Error("A loop of permitted names should be permitted")
+	}
+	if check("a.example.", "b.example.", "a.example.", "blocked.example.") {
+		t.Error("The loop should not hide later records")
+	}
+	var long []string
+	for i := 0; i <= maxCNAMEDepth+1; i++ {
+		long = append(long, string(rune('a'+i))+".example.")
+	}
+	if check(long...) {
+		t.Errorf("A chain of %d CNAMEs should not be permitted", len(long)-1)
+	}
+	if !check(long[:maxCNAMEDepth+1]...) {
+		t.Errorf("A chain of %d CNAMEs should be permitted", maxCNAMEDepth)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"fmt"
+	"sync"
+)
+
+type portRange struct {
+	min, max int
+}
+
+// PortPolicy decides which destination ports may be reached through the
+// tunnel, by listing inclusive port ranges.  It applies to TCP and UDP alike,
+// and is independent of any Filter: a destination must be permitted by both.
+// A PortPolicy is safe for concurrent use.
+type PortPolicy struct {
+	mu     sync.RWMutex
+	mode   int
+	ranges []portRange
+}
+
+// NewPortPolicy returns an empty PortPolicy.  `mode` is Blocklist or
+// Allowlist.  An empty PortPolicy in Blocklist mode permits every port.
+func NewPortPolicy(mode int) *PortPolicy {
+	return &PortPolicy{mode: mode}
+}
+
+// Mode returns the current mode (Blocklist or Allowlist).
+func (p *PortPolicy) Mode() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.mode
+}
+
+// SetMode switches between Blocklist and Allowlist mode.  The listed ranges
+// are retained.
+func (p *PortPolicy) SetMode(mode int) {
+	p.mu.Lock()
+	p.mode = mode
+	p.mu.Unlock()
+}
+
+// AddRange lists the ports from `min` to `max`, inclusive.  To list a single
+// port, set both to the same value.
+func (p *PortPolicy) AddRange(min, max int) error {
+	if min < 1 || max > 65535 || min > max {
+		return fmt.Errorf("Bad port range: %d-%d", min, max)
+	}
+	p.mu.Lock()
+	p.ranges = append(p.ranges, portRange{min, max})
+	p.mu.Unlock()
+	return nil
+}
+
+// AllowPort reports whether connections to `port` are permitted.
+func (p *PortPolicy) AllowPort(port int) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	listed := false
+	for _, r := range p.ranges {
+		if port >= r.min && port <= r.max {
+			listed = true
+			break
+		}
+	}
+	return listed == (p.mode == Allowlist)
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import "testing"
+
+func TestPortBlocklist(t *testing.T) {
+	p := NewPortPolicy(Blocklist)
+	if !p.AllowPort(25) {
+		t.Error("Empty blocklist should allow all ports")
+	}
+	if err := p.AddRange(25, 25); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddRange(6000, 6100); err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []int{25, 6000, 6050, 6100} {
+		if p.AllowPort(port) {
+			t.Errorf("Port %d should be blocked", port)
+		}
+	}
+	for _, port := range []int{24, 26, 443, 5999, 6101} {
+		if !p.AllowPort(port) {
+			t.Errorf("Port %d should be allowed", port)
+		}
+	}
+}
+
+func TestPortAllowlist(t *testing.T) {
+	p := NewPortPolicy(Allowlist)
+	if p.AllowPort(443) {
+		t.Error("Empty allowlist should block all ports")
+	}
+	p.AddRange(80, 80)
+	p.AddRange(443, 443)
+	if !p.AllowPort(80) || !p.AllowPort(443) {
+		t.Error("Listed ports should be allowed")
+	}
+	if p.AllowPort(25) || p.AllowPort(8080) {
+		t.Error("Unlisted ports should be blocked")
+	}
+
+	p.SetMode(Blocklist)
+	if p.Mode() != Blocklist || p.AllowPort(80) || !p.AllowPort(25) {
+		t.Error("Switching mode should invert the decision")
+	}
+}
+
+func TestPortRangeInvalid(t *testing.T) {
+	p := NewPortPolicy(Blocklist)
+	for _, r := range [][2]int{{0, 10}, {10, 65536}, {20, 10}} {
+		if err := p.AddRange(r[0], r[1]); err == nil {
+			t.Errorf("Range %d-%d should be rejected", r[0], r[1])
+		}
+	}
+	if !p.AllowPort(5) {
+		t.Error("Rejected ranges should not be listed")
+	}
+}
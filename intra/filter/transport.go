@@ -0,0 +1,75 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filter
+
+import (
+	"context"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// transport applies a Filter to DNS queries before they reach the
+// underlying DNS transport.
+type transport struct {
+	doh.Transport
+	filter *Filter
+}
+
+// NewTransport returns a DNS transport that answers queries for disallowed
+// names with NXDOMAIN, and forwards all other queries to `t`.  Responses
+// from `t` whose CNAME chain leads to a disallowed name are also replaced
+// with NXDOMAIN.  Other responses are recorded by `f`, so that connections
+// to the resolved addresses follow the rules for the queried name.
+func NewTransport(t doh.Transport, f *Filter) doh.Transport {
+	return &transport{Transport: t, filter: f}
+}
+
+// Returns an NXDOMAIN response to `msg`.
+func nxdomain(msg *dnsmessage.Message) ([]byte, error) {
+	msg.Response = true
+	msg.RecursionAvailable = true
+	msg.RCode = dnsmessage.RCodeNameError
+	msg.Answers = nil
+	msg.Authorities = nil
+	msg.Additionals = nil // Strip EDNS
+	return msg.Pack()
+}
+
+func (t *transport) Query(q []byte) ([]byte, error) {
+	return t.QueryContext(context.Background(), q)
+}
+
+// QueryContext forwards the cancellation of `ctx` to the underlying transport.
+func (t *transport) QueryContext(ctx context.Context, q []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err == nil {
+		for _, question := range msg.Questions {
+			if !t.filter.AllowName(question.Name.String()) {
+				return nxdomain(&msg)
+			}
+		}
+	}
+	response, err := doh.QueryContext(ctx, t.Transport, q)
+	if err != nil {
+		return response, err
+	}
+	var reply dnsmessage.Message
+	if err := reply.Unpack(response); err == nil && !t.filter.AllowTargets(&reply) {
+		return nxdomain(&reply)
+	}
+	t.filter.Observe(response)
+	return response, nil
+}
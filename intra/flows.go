@@ -0,0 +1,116 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Policies for a new connection whose 4-tuple matches an active flow, as
+// passed to SetDuplicateFlowPolicy.
+const (
+	// DuplicateFlowIgnore resets the new connection, and leaves the active flow
+	// untouched.  This is the default.
+	DuplicateFlowIgnore = "ignore"
+	// DuplicateFlowReplace closes the active flow as stale, and forwards the new
+	// connection in its place.
+	DuplicateFlowReplace = "replace"
+)
+
+// flow is a connection that is being dialed or forwarded.
+type flow struct {
+	mu      sync.Mutex // Protects all fields.
+	conn    net.Conn
+	tracker *tcpTracker // Set once forwarding starts.
+	stale   bool        // True if the flow was replaced.
+}
+
+// forwarding records that `t` forwards the flow.  If the flow was already
+// replaced, `t` is closed.
+func (f *flow) forwarding(t *tcpTracker) {
+	f.mu.Lock()
+	f.tracker = t
+	stale := f.stale
+	f.mu.Unlock()
+	if stale {
+		t.close(CloseReasonDuplicateFlow)
+	}
+}
+
+// replace closes the flow, whether it is still dialing or forwarding.
+func (f *flow) replace() {
+	f.mu.Lock()
+	f.stale = true
+	t := f.tracker
+	f.mu.Unlock()
+	if t != nil {
+		t.close(CloseReasonDuplicateFlow)
+	} else {
+		f.conn.Close()
+	}
+}
+
+// flowTable holds the active flows by flowKey.
+type flowTable struct {
+	mu     sync.Mutex // Protects all fields.
+	flows  map[string]*flow
+	policy string // A DuplicateFlow policy, or "" for DuplicateFlowIgnore.
+}
+
+// claim registers a new flow for `conn` under `key`.  If another flow is active
+// under `key`, it applies the policy: it either returns an error without
+// registering, or replaces the active flow.
+func (t *flowTable) claim(key string, conn net.Conn) (*flow, error) {
+	t.mu.Lock()
+	old := t.flows[key]
+	if old != nil && t.policy != DuplicateFlowReplace {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("Duplicate flow %s", key)
+	}
+	if t.flows == nil {
+		t.flows = make(map[string]*flow)
+	}
+	f := &flow{conn: conn}
+	t.flows[key] = f
+	t.mu.Unlock()
+	if old != nil {
+		old.replace()
+	}
+	return f, nil
+}
+
+// release unregisters `f`, unless it has already been replaced.
+func (t *flowTable) release(key string, f *flow) {
+	t.mu.Lock()
+	if t.flows[key] == f {
+		delete(t.flows, key)
+	}
+	t.mu.Unlock()
+}
+
+// setPolicy sets the policy for future duplicates.
+func (t *flowTable) setPolicy(policy string) error {
+	switch policy {
+	case "", DuplicateFlowIgnore, DuplicateFlowReplace:
+	default:
+		return fmt.Errorf("Unknown duplicate flow policy: %s", policy)
+	}
+	t.mu.Lock()
+	t.policy = policy
+	t.mu.Unlock()
+	return nil
+}
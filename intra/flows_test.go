@@ -0,0 +1,126 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reusedConn is a client connection that claims the 4-tuple of `addr`.
+type reusedConn struct {
+	*fakeTCPConn
+	addr net.Addr
+}
+
+func (c reusedConn) LocalAddr() net.Addr { return c.addr }
+
+// Returns a server that counts the connections it accepts, and holds them
+// open until the client closes them.
+func makeCountingServer(t *testing.T) (*net.TCPAddr, *int32) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var accepted int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				ioutil.ReadAll(c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr), &accepted
+}
+
+func TestDuplicateFlowIgnored(t *testing.T) {
+	server, accepted := makeCountingServer(t)
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener()).(*tcpHandler)
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	_, local1 := makePair(t)
+	_, local2 := makePair(t)
+	if err := h.Handle(reusedConn{&fakeTCPConn{local1}, client}, server); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Handle(reusedConn{&fakeTCPConn{local2}, client}, server); err == nil {
+		t.Error("The duplicate should be reset")
+	}
+	waitForConns(t, h, 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Errorf("Expected one upstream connection, got %d", n)
+	}
+	if n := h.DropCounts()[DropDuplicateFlow]; n != 1 {
+		t.Errorf("Expected one drop, got %d", n)
+	}
+}
+
+func TestDuplicateFlowReplaced(t *testing.T) {
+	server, accepted := makeCountingServer(t)
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener()).(*tcpHandler)
+	if err := h.SetDuplicateFlowPolicy(DuplicateFlowReplace); err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(chan string, 2)
+	h.SetCloseHook(func(r TCPConnRecord) { reasons <- r.CloseReason })
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	app1, local1 := makePair(t)
+	if err := h.Handle(reusedConn{&fakeTCPConn{local1}, client}, server); err != nil {
+		t.Fatal(err)
+	}
+	waitForConns(t, h, 1)
+	_, local2 := makePair(t)
+	if err := h.Handle(reusedConn{&fakeTCPConn{local2}, client}, server); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale flow is closed.
+	app1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(app1); err != nil {
+		t.Errorf("The stale flow should be closed: %v", err)
+	}
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonDuplicateFlow {
+			t.Errorf("Wrong close reason: %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The stale flow wasn't reported")
+	}
+	waitForConns(t, h, 1)
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("Expected two upstream connections, got %d", n)
+	}
+}
+
+func TestDuplicateFlowPolicy(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil)
+	if err := h.SetDuplicateFlowPolicy("bogus"); err == nil {
+		t.Error("Unknown policies should be rejected")
+	}
+	if err := h.SetDuplicateFlowPolicy(DuplicateFlowIgnore); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"sync/atomic"
+)
+
+// goroutineCounter counts the goroutines that a handler starts on behalf of
+// its connections, so that leaks can be detected in long-running tests.
+type goroutineCounter struct {
+	n int32 // Accessed atomically.
+}
+
+// goroutine runs `f` on a new goroutine, and counts it until `f` returns.
+func (c *goroutineCounter) goroutine(f func()) {
+	atomic.AddInt32(&c.n, 1)
+	go func() {
+		defer atomic.AddInt32(&c.n, -1)
+		f()
+	}()
+}
+
+// count returns the number of counted goroutines that have not exited.
+func (c *goroutineCounter) count() int {
+	return int(atomic.LoadInt32(&c.n))
+}
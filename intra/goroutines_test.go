@@ -0,0 +1,82 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Waits for `h` to report `n` connection goroutines.
+func waitForGoroutines(t *testing.T, h TCPHandler, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for h.Goroutines() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connection goroutines, want %d", h.Goroutines(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnGoroutinesReturnToBaseline(t *testing.T) {
+	const conns = 50
+	// The listener must not block, or the forwarding goroutines would leak.
+	listener := &fakeTCPListener{make(chan *TCPSocketSummary, conns)}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, listener)
+	server, _ := makeEchoServer(t)
+
+	var apps []*net.TCPConn
+	for i := 0; i < conns; i++ {
+		app, local := makePair(t)
+		if err := h.Handle(&fakeTCPConn{local}, server); err != nil {
+			t.Fatal(err)
+		}
+		apps = append(apps, app)
+	}
+	// Each connection has a forwarding goroutine and an upload goroutine.
+	waitForGoroutines(t, h, 2*conns)
+
+	for _, app := range apps {
+		app.Write([]byte("ping"))
+		app.CloseWrite()
+		ioutil.ReadAll(app)
+		app.Close()
+	}
+	waitForGoroutines(t, h, 0)
+}
+
+func TestOpenFDs(t *testing.T) {
+	n := openFDs()
+	if runtime.GOOS != "linux" {
+		if n != -1 {
+			t.Errorf("Expected -1 on %s, got %d", runtime.GOOS, n)
+		}
+		return
+	}
+	if n <= 0 {
+		t.Fatalf("Bad fd count %d", n)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := openFDs(); m <= n {
+		t.Errorf("Opening a socket did not increase the fd count: %d, %d", n, m)
+	}
+	l.Close()
+}
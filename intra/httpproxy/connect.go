@@ -0,0 +1,227 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpproxy dials TCP connections through an HTTP CONNECT proxy.
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// ErrAuthRequired matches a StatusError for a 407 (Proxy Authentication Required)
+// response, using errors.Is.
+var ErrAuthRequired = errors.New("Proxy authentication required")
+
+// ErrRefused matches a StatusError for a response that rejects the destination
+// by policy, e.g. 403 (Forbidden), using errors.Is.  It doesn't match 407, or
+// 5xx responses, which report that the proxy couldn't reach the destination.
+var ErrRefused = errors.New("Proxy refused the destination")
+
+// StatusError is returned when the proxy responds to CONNECT with a status
+// other than 200.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Proxy refused CONNECT: %s", e.Status)
+}
+
+// Is reports whether `target` is ErrAuthRequired and this is a 407 response,
+// or `target` is ErrRefused and this is any other 4xx response.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrAuthRequired:
+		return e.StatusCode == http.StatusProxyAuthRequired
+	case ErrRefused:
+		return e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != http.StatusProxyAuthRequired
+	}
+	return false
+}
+
+// Dialer connects to destinations through an HTTP CONNECT proxy.  Its Dial
+// method has the same signature as net.Dialer's, and the resulting connections
+// are split.DuplexConns, so they can be forwarded like direct connections or
+// wrapped with tls.Client.
+type Dialer struct {
+	// Proxy is the proxy's address in "host:port" form.
+	Proxy string
+	// Dialer is used to connect to the proxy.  If nil, a zero net.Dialer is used.
+	// Its Timeout, if any, also bounds the CONNECT exchange.
+	Dialer *net.Dialer
+	// Header holds additional headers for the CONNECT request.
+	Header http.Header
+}
+
+// SetBasicAuth adds a Proxy-Authorization header with the given credentials.
+func (d *Dialer) SetBasicAuth(username, password string) {
+	if d.Header == nil {
+		d.Header = make(http.Header)
+	}
+	creds := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	d.Header.Set("Proxy-Authorization", "Basic "+creds)
+}
+
+// Dial connects to `addr` through the proxy.  `network` must be a TCP network.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %s", network)
+	}
+	return d.DialTCP(addr)
+}
+
+// DialTCP connects to `addr` through the proxy.
+func (d *Dialer) DialTCP(addr string) (split.DuplexConn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to `addr` through the proxy.  If `ctx` is canceled
+// before the CONNECT exchange completes, the proxy connection is closed.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (split.DuplexConn, error) {
+	tcp, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.handshake(ctx, tcp, addr)
+}
+
+func (d *Dialer) netDialer() *net.Dialer {
+	if d.Dialer == nil {
+		return &net.Dialer{}
+	}
+	return d.Dialer
+}
+
+// dialProxy opens a TCP connection to the proxy.
+func (d *Dialer) dialProxy(ctx context.Context) (*net.TCPConn, error) {
+	generic, err := d.netDialer().DialContext(ctx, "tcp", d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := generic.(*net.TCPConn)
+	if !ok {
+		generic.Close()
+		return nil, errors.New("Proxy connection is not TCP")
+	}
+	return tcp, nil
+}
+
+// handshake performs the CONNECT exchange for `addr` on `tcp`, which is closed
+// if the exchange fails or `ctx` is canceled.
+func (d *Dialer) handshake(ctx context.Context, tcp *net.TCPConn, addr string) (split.DuplexConn, error) {
+	if timeout := d.netDialer().Timeout; timeout > 0 {
+		tcp.SetDeadline(time.Now().Add(timeout))
+	}
+	// Interrupt the exchange if the context is canceled.
+	stop := make(chan struct{})
+	canceled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			tcp.SetDeadline(time.Unix(1, 0))
+			canceled <- true
+		case <-stop:
+			canceled <- false
+		}
+	}()
+	c, err := d.connect(tcp, addr)
+	close(stop)
+	if <-canceled {
+		err = ctx.Err()
+	} else {
+		tcp.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Sends the CONNECT request on `tcp` and reads the response.
+func (d *Dialer) connect(tcp *net.TCPConn, addr string) (*conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: d.Header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if err := req.Write(tcp); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(tcp)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{resp.StatusCode, resp.Status}
+	}
+	// Any data after the response headers belongs to the tunnel, and remains in `r`.
+	return &conn{TCPConn: tcp, r: r, source: SourceFresh}, nil
+}
+
+// Sources of a tunneled connection, as reported by ConnSource.
+const (
+	SourcePooled = "pooled" // The CONNECT was sent on an idle connection from a Pool.
+	SourceFresh  = "fresh"  // The proxy connection was dialed for this CONNECT.
+)
+
+// ConnSource returns the source of `c`, a connection returned by a dialer in
+// this package, or "" if `c` isn't tunneled through a proxy.
+func ConnSource(c net.Conn) string {
+	if s, ok := c.(interface{ Source() string }); ok {
+		return s.Source()
+	}
+	return ""
+}
+
+// conn is a tunneled connection.  Reads drain any data buffered while reading
+// the proxy's response before reading from the socket.
+type conn struct {
+	*net.TCPConn
+	r      *bufio.Reader
+	source string // SourcePooled or SourceFresh.
+}
+
+// Source returns SourcePooled or SourceFresh.
+func (c *conn) Source() string {
+	return c.source
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *conn) WriteTo(w io.Writer) (int64, error) {
+	return c.r.WriteTo(w)
+}
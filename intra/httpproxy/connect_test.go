@@ -0,0 +1,241 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProxy is an in-process HTTP CONNECT proxy.
+type fakeProxy struct {
+	l net.Listener
+	// If set, requests must carry this Proxy-Authorization header.
+	auth string
+	// Sent to the client immediately after the 200 response.
+	early string
+	// How long to wait before responding to a CONNECT request.
+	delay time.Duration
+	// Receives a value for each client that disconnected during the delay.
+	canceled chan struct{}
+	// Number of connections accepted, updated atomically.
+	accepted int32
+}
+
+func makeProxy(t *testing.T, auth, early string) *fakeProxy {
+	return startProxy(t, &fakeProxy{auth: auth, early: early})
+}
+
+// Starts `p` on a new listener.
+func startProxy(t *testing.T, p *fakeProxy) *fakeProxy {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.l = l
+	p.canceled = make(chan struct{}, 10)
+	t.Cleanup(func() { l.Close() })
+	go p.serve()
+	return p
+}
+
+func (p *fakeProxy) addr() string {
+	return p.l.Addr().String()
+}
+
+func (p *fakeProxy) serve() {
+	for {
+		c, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&p.accepted, 1)
+		go p.handle(c)
+	}
+}
+
+func (p *fakeProxy) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		fmt.Fprint(c, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	if p.delay > 0 {
+		c.SetReadDeadline(time.Now().Add(p.delay))
+		_, err := r.ReadByte()
+		var neterr net.Error
+		if !errors.As(err, &neterr) || !neterr.Timeout() {
+			p.canceled <- struct{}{}
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+	}
+	if p.auth != "" && req.Header.Get("Proxy-Authorization") != p.auth {
+		fmt.Fprint(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n")
+		return
+	}
+	upstream, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		fmt.Fprint(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+	fmt.Fprint(c, "HTTP/1.1 200 Connection established\r\n\r\n"+p.early)
+	go func() {
+		io.Copy(upstream, r)
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(c, upstream)
+}
+
+// Returns the address of a server that echoes its input, and then closes.
+func makeEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestConnect(t *testing.T) {
+	p := makeProxy(t, "", "early")
+	d := &Dialer{Proxy: p.addr()}
+	c, err := d.Dial("tcp", makeEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	c.(interface{ CloseWrite() error }).CloseWrite()
+	received, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "earlyhello" {
+		t.Errorf("Unexpected data: %q", received)
+	}
+}
+
+func TestConnectAuth(t *testing.T) {
+	d := &Dialer{}
+	d.SetBasicAuth("user", "pass")
+	p := makeProxy(t, d.Header.Get("Proxy-Authorization"), "")
+	d.Proxy = p.addr()
+	c, err := d.Dial("tcp", makeEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestConnectAuthRequired(t *testing.T) {
+	p := makeProxy(t, "Basic secret", "")
+	d := &Dialer{Proxy: p.addr()}
+	_, err := d.Dial("tcp", makeEchoServer(t))
+	if !errors.Is(err, ErrAuthRequired) {
+		t.Fatalf("Expected ErrAuthRequired, got %v", err)
+	}
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	p := makeProxy(t, "", "")
+	d := &Dialer{Proxy: p.addr()}
+	// Nothing is listening on port 1.
+	_, err := d.Dial("tcp", "127.0.0.1:1")
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected 502, got %v", err)
+	}
+	if errors.Is(err, ErrAuthRequired) {
+		t.Error("502 should not match ErrAuthRequired")
+	}
+	if errors.Is(err, ErrRefused) {
+		t.Error("502 is a network failure, not a refusal")
+	}
+	if !errors.Is(&StatusError{http.StatusForbidden, "403 Forbidden"}, ErrRefused) {
+		t.Error("403 should match ErrRefused")
+	}
+	if errors.Is(&StatusError{http.StatusProxyAuthRequired, "407"}, ErrRefused) {
+		t.Error("407 should not match ErrRefused")
+	}
+}
+
+func TestConnectBadNetwork(t *testing.T) {
+	d := &Dialer{Proxy: "127.0.0.1:1"}
+	if _, err := d.Dial("udp", "127.0.0.1:53"); err == nil {
+		t.Error("Expected error for UDP")
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+	p := makeProxy(t, "", "")
+	d := &Dialer{Proxy: p.addr()}
+	c, err := d.DialTCP(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.ServerName = "example.com"
+	tc := tls.Client(c, config)
+	defer tc.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err := req.Write(tc); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tc), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Errorf("Unexpected body: %q", body)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// DefaultCheckInterval is the time between health checks if
+// Monitor.Interval is zero.
+const DefaultCheckInterval = 10 * time.Second
+
+// Monitor is a Dialer that checks the health of its proxy periodically, and
+// tracks the connections dialed through it.  If TearDown is set, those
+// connections are closed as soon as the proxy is found to be unreachable,
+// so that clients reconnect promptly instead of waiting for their own
+// timeouts.  A Monitor is safe for concurrent use.
+type Monitor struct {
+	Dialer *Dialer
+	// Interval is the time between health checks, and the timeout for each
+	// check.  Zero means DefaultCheckInterval.
+	Interval time.Duration
+	// Failures is the number of consecutive failed checks after which the proxy
+	// is unreachable.  Zero means 1.
+	Failures int
+	// TearDown causes tracked connections to be closed when the proxy becomes
+	// unreachable.
+	TearDown bool
+	// OnUnreachable, if non-nil, is called with the last check's error when the
+	// proxy becomes unreachable, after any connections are torn down.  It is
+	// called again only after a check has succeeded.
+	OnUnreachable func(error)
+
+	mu        sync.Mutex // Protects all fields below.
+	conns     map[*trackedConn]struct{}
+	failed    int  // Consecutive failed checks.
+	reported  bool // True if OnUnreachable was called since the last success.
+	stop      chan struct{}
+	stopped   chan struct{}
+	startOnce sync.Once
+}
+
+func (m *Monitor) interval() time.Duration {
+	if m.Interval <= 0 {
+		return DefaultCheckInterval
+	}
+	return m.Interval
+}
+
+// Start begins health checks on a new goroutine.  Only the first call has an
+// effect.
+func (m *Monitor) Start() {
+	m.startOnce.Do(func() {
+		m.mu.Lock()
+		m.stop = make(chan struct{})
+		m.stopped = make(chan struct{})
+		m.mu.Unlock()
+		go m.run()
+	})
+}
+
+// Stop ends health checks, and waits for any check in progress to finish.
+// Tracked connections are left open.
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	stop, stopped := m.stop, m.stopped
+	m.stop = nil
+	m.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-stopped
+}
+
+func (m *Monitor) run() {
+	m.mu.Lock()
+	stop, stopped := m.stop, m.stopped
+	m.mu.Unlock()
+	defer close(stopped)
+	ticker := time.NewTicker(m.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		m.Check(context.Background())
+	}
+}
+
+// Check connects to the proxy once, and applies the failure policy if the
+// proxy is unreachable.  It returns the connection error, if any.  Check is
+// called by the health check goroutine, but may also be called directly.
+func (m *Monitor) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, m.interval())
+	defer cancel()
+	tcp, err := m.Dialer.dialProxy(ctx)
+	if err == nil {
+		tcp.Close()
+	}
+
+	m.mu.Lock()
+	if err == nil {
+		m.failed = 0
+		m.reported = false
+		m.mu.Unlock()
+		return nil
+	}
+	m.failed++
+	threshold := m.Failures
+	if threshold <= 0 {
+		threshold = 1
+	}
+	if m.failed < threshold || m.reported {
+		m.mu.Unlock()
+		return err
+	}
+	m.reported = true
+	var doomed []*trackedConn
+	if m.TearDown {
+		for c := range m.conns {
+			doomed = append(doomed, c)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, c := range doomed {
+		c.Close()
+	}
+	err = fmt.Errorf("Proxy %s is unreachable: %w", m.Dialer.Proxy, err)
+	if m.OnUnreachable != nil {
+		m.OnUnreachable(err)
+	}
+	return err
+}
+
+// Active returns the number of open connections dialed through the Monitor.
+func (m *Monitor) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+// Dial connects to `addr` through the proxy.  `network` must be a TCP network.
+func (m *Monitor) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %s", network)
+	}
+	return m.DialTCP(addr)
+}
+
+// DialTCP connects to `addr` through the proxy.
+func (m *Monitor) DialTCP(addr string) (split.DuplexConn, error) {
+	return m.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to `addr` through the proxy, and tracks the connection
+// until it is closed.
+func (m *Monitor) DialContext(ctx context.Context, addr string) (split.DuplexConn, error) {
+	c, err := m.Dialer.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &trackedConn{DuplexConn: c, m: m}
+	m.mu.Lock()
+	if m.conns == nil {
+		m.conns = make(map[*trackedConn]struct{})
+	}
+	m.conns[t] = struct{}{}
+	m.mu.Unlock()
+	return t, nil
+}
+
+// trackedConn removes itself from its Monitor when it is closed, or when both
+// directions have been shut down, which is how a proxied connection normally
+// finishes.
+type trackedConn struct {
+	split.DuplexConn
+	m          *Monitor
+	readClosed int32 // 1 if CloseRead was called.  Accessed atomically.
+	sendClosed int32 // 1 if CloseWrite was called.  Accessed atomically.
+	closeOnce  sync.Once
+}
+
+func (c *trackedConn) untrack() {
+	c.closeOnce.Do(func() {
+		c.m.mu.Lock()
+		delete(c.m.conns, c)
+		c.m.mu.Unlock()
+	})
+}
+
+func (c *trackedConn) Close() error {
+	c.untrack()
+	return c.DuplexConn.Close()
+}
+
+func (c *trackedConn) CloseRead() error {
+	atomic.StoreInt32(&c.readClosed, 1)
+	if atomic.LoadInt32(&c.sendClosed) != 0 {
+		c.untrack()
+	}
+	return c.DuplexConn.CloseRead()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	atomic.StoreInt32(&c.sendClosed, 1)
+	if atomic.LoadInt32(&c.readClosed) != 0 {
+		c.untrack()
+	}
+	return c.DuplexConn.CloseWrite()
+}
+
+// Source returns the source of the tracked connection.
+func (c *trackedConn) Source() string {
+	return ConnSource(c.DuplexConn)
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitorTearDown(t *testing.T) {
+	p := makeProxy(t, "", "")
+	interval := 50 * time.Millisecond
+	unreachable := make(chan error, 2)
+	m := &Monitor{
+		Dialer:        &Dialer{Proxy: p.addr()},
+		Interval:      interval,
+		TearDown:      true,
+		OnUnreachable: func(err error) { unreachable <- err },
+	}
+	m.Start()
+	defer m.Stop()
+
+	echo := makeEchoServer(t)
+	var conns []io.ReadWriteCloser
+	for i := 0; i < 2; i++ {
+		c, err := m.Dial("tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	if n := m.Active(); n != 2 {
+		t.Fatalf("Expected 2 active connections, got %d", n)
+	}
+	// The healthy proxy passes checks, so the connections stay open.
+	time.Sleep(2 * interval)
+	for _, c := range conns {
+		c.Write([]byte("x"))
+		if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+			t.Fatalf("Connection failed while the proxy was healthy: %v", err)
+		}
+	}
+
+	// Kill the proxy.  Its existing tunnels keep relaying, so only the health
+	// check can detect the failure.
+	p.l.Close()
+	killed := time.Now()
+	for _, c := range conns {
+		c.(interface{ SetReadDeadline(time.Time) error }).SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected the connection to be torn down")
+		}
+	}
+	if elapsed := time.Since(killed); elapsed > 3*interval {
+		t.Errorf("Teardown took %v, with a check interval of %v", elapsed, interval)
+	}
+	if n := m.Active(); n != 0 {
+		t.Errorf("Expected no active connections, got %d", n)
+	}
+	select {
+	case err := <-unreachable:
+		if !strings.Contains(err.Error(), p.addr()) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnUnreachable was not called")
+	}
+	// The hook is not called again while the proxy remains unreachable.
+	time.Sleep(2 * interval)
+	if len(unreachable) != 0 {
+		t.Error("OnUnreachable was called repeatedly")
+	}
+}
+
+func TestMonitorFailureThreshold(t *testing.T) {
+	p := makeProxy(t, "", "")
+	m := &Monitor{Dialer: &Dialer{Proxy: p.addr()}, Failures: 2, TearDown: true}
+	c, err := m.Dial("tcp", makeEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if err := m.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p.l.Close()
+	if err := m.Check(ctx); err == nil {
+		t.Fatal("Expected the check to fail")
+	}
+	if n := m.Active(); n != 1 {
+		t.Fatal("A single failure should not tear down connections")
+	}
+	if err := m.Check(ctx); err == nil {
+		t.Fatal("Expected the check to fail")
+	}
+	if n := m.Active(); n != 0 {
+		t.Errorf("Expected teardown after 2 failures, %d remain", n)
+	}
+}
+
+func TestMonitorWithoutTearDown(t *testing.T) {
+	p := makeProxy(t, "", "")
+	var called error
+	m := &Monitor{Dialer: &Dialer{Proxy: p.addr()}, OnUnreachable: func(err error) { called = err }}
+	c, err := m.Dial("tcp", makeEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.l.Close()
+	m.Check(context.Background())
+	if called == nil {
+		t.Error("OnUnreachable was not called")
+	}
+	// The connection is still usable.
+	c.Write([]byte("x"))
+	if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+		t.Errorf("Connection should not be torn down: %v", err)
+	}
+	c.Close()
+	if n := m.Active(); n != 0 {
+		t.Errorf("Closed connection is still tracked: %d", n)
+	}
+	if _, err := m.Dial("udp", "127.0.0.1:53"); err == nil {
+		t.Error("Expected an error for UDP")
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// DefaultMaxIdle is how long a Pool keeps an idle proxy connection if
+// Pool.MaxIdle is zero.
+const DefaultMaxIdle = 30 * time.Second
+
+// PoolStats counts how the dials of a Pool were served, to help tune its Size.
+type PoolStats struct {
+	Hits   int64 // Dials that used an idle connection.
+	Misses int64 // Dials that connected to the proxy, including after a stale idle connection.
+}
+
+// idleConn is a proxy connection on which no CONNECT request has been sent.
+type idleConn struct {
+	tcp   *net.TCPConn
+	since time.Time
+}
+
+// Pool is a Dialer that keeps idle connections to the proxy, so that a
+// CONNECT request can be sent without waiting for a TCP handshake.
+// Connections are only pooled by WarmUp.  A Pool is safe for concurrent use.
+type Pool struct {
+	Dialer *Dialer
+	// Size is the number of idle connections that WarmUp establishes.
+	Size int
+	// MaxIdle is how long an idle connection is kept before it is discarded.
+	// Zero means DefaultMaxIdle.
+	MaxIdle time.Duration
+
+	mu    sync.Mutex // Protects idle and stats.
+	idle  []idleConn
+	stats PoolStats
+}
+
+func (p *Pool) maxIdle() time.Duration {
+	if p.MaxIdle <= 0 {
+		return DefaultMaxIdle
+	}
+	return p.MaxIdle
+}
+
+// WarmUp connects to the proxy until the pool holds Size idle connections, to
+// reduce the latency of the first dials.  The connections are established
+// concurrently.  If any of them fails, or `ctx` expires first, the first error
+// is returned, but successful connections are still pooled.  Callers that
+// don't want to delay startup should call WarmUp on a separate goroutine with
+// a timeout.
+func (p *Pool) WarmUp(ctx context.Context) error {
+	need := p.Size - p.Idle()
+	if need <= 0 {
+		return nil
+	}
+	errs := make(chan error, need)
+	for i := 0; i < need; i++ {
+		go func() {
+			tcp, err := p.Dialer.dialProxy(ctx)
+			if err == nil {
+				p.put(tcp)
+			}
+			errs <- err
+		}()
+	}
+	var first error
+	for i := 0; i < need; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("Proxy warm-up failed: %w", first)
+	}
+	return nil
+}
+
+// Idle returns the number of idle connections in the pool.
+func (p *Pool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	return len(p.idle)
+}
+
+// put adds `tcp` to the pool, or closes it if the pool is full.
+func (p *Pool) put(tcp *net.TCPConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= p.Size {
+		tcp.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{tcp, time.Now()})
+}
+
+// get removes and returns an idle connection, or nil if there are none.
+func (p *Pool) get() *net.TCPConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	c := p.idle[0]
+	p.idle = p.idle[1:]
+	return c.tcp
+}
+
+// expire closes connections that have been idle too long.  The caller must
+// hold p.mu.
+func (p *Pool) expire() {
+	cutoff := time.Now().Add(-p.maxIdle())
+	for len(p.idle) > 0 && p.idle[0].since.Before(cutoff) {
+		p.idle[0].tcp.Close()
+		p.idle = p.idle[1:]
+	}
+}
+
+// Stats returns the pool's hit and miss counts.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// count records whether a dial used an idle connection.
+func (p *Pool) count(hit bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if hit {
+		p.stats.Hits++
+	} else {
+		p.stats.Misses++
+	}
+}
+
+// Close closes all idle connections.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.idle {
+		c.tcp.Close()
+	}
+	p.idle = nil
+}
+
+// Dial connects to `addr` through the proxy.  `network` must be a TCP network.
+func (p *Pool) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network: %s", network)
+	}
+	return p.DialTCP(addr)
+}
+
+// DialTCP connects to `addr` through the proxy.
+func (p *Pool) DialTCP(addr string) (split.DuplexConn, error) {
+	return p.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to `addr` through the proxy, using an idle connection
+// if one is available.  If the idle connection has been closed by the proxy,
+// a new connection is dialed.  ConnSource reports which happened.
+func (p *Pool) DialContext(ctx context.Context, addr string) (split.DuplexConn, error) {
+	if tcp := p.get(); tcp != nil {
+		c, err := p.Dialer.handshake(ctx, tcp, addr)
+		var statusErr *StatusError
+		if err == nil || errors.As(err, &statusErr) || ctx.Err() != nil {
+			p.count(true)
+			if err == nil {
+				c.(*conn).source = SourcePooled
+			}
+			return c, err
+		}
+		// The idle connection was probably closed by the proxy.  Try a new one.
+	}
+	p.count(false)
+	return p.Dialer.DialContext(ctx, addr)
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmUp(t *testing.T) {
+	p := makeProxy(t, "", "")
+	pool := &Pool{Dialer: &Dialer{Proxy: p.addr()}, Size: 2}
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.WarmUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.Idle(); n != 2 {
+		t.Fatalf("Expected 2 idle connections, got %d", n)
+	}
+	// A second warm-up doesn't add connections.
+	if err := pool.WarmUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := pool.Dial("tcp", makeEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if n := pool.Idle(); n != 1 {
+		t.Errorf("Expected the dial to use a pooled connection, %d remain", n)
+	}
+	if n := atomic.LoadInt32(&p.accepted); n != 2 {
+		t.Errorf("Expected 2 proxy connections, got %d", n)
+	}
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Echo failed: %q, %v", buf, err)
+	}
+}
+
+func TestWarmUpFailure(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	pool := &Pool{Dialer: &Dialer{Proxy: addr}, Size: 2}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.WarmUp(ctx); err == nil {
+		t.Error("Expected warm-up to fail")
+	}
+	if n := pool.Idle(); n != 0 {
+		t.Errorf("Expected an empty pool, got %d", n)
+	}
+}
+
+func TestWarmUpTimeout(t *testing.T) {
+	// 192.0.2.0/24 is reserved for documentation, so the dial hangs.
+	pool := &Pool{Dialer: &Dialer{Proxy: "192.0.2.1:8080"}, Size: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := pool.WarmUp(ctx); err == nil {
+		t.Error("Expected warm-up to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Warm-up took %v", elapsed)
+	}
+}
+
+func TestPoolExpiry(t *testing.T) {
+	p := makeProxy(t, "", "")
+	pool := &Pool{Dialer: &Dialer{Proxy: p.addr()}, Size: 1, MaxIdle: 20 * time.Millisecond}
+	if err := pool.WarmUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := pool.Idle(); n != 0 {
+		t.Errorf("Expected idle connection to expire, got %d", n)
+	}
+	// Without a pooled connection, the dial connects to the proxy again.
+	c, err := pool.DialTCP(makeEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := atomic.LoadInt32(&p.accepted); n != 2 {
+		t.Errorf("Expected 2 proxy connections, got %d", n)
+	}
+}
+
+func TestPoolSource(t *testing.T) {
+	p := makeProxy(t, "", "")
+	pool := &Pool{Dialer: &Dialer{Proxy: p.addr()}, Size: 1}
+	defer pool.Close()
+	if err := pool.WarmUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server := makeEchoServer(t)
+	warm, err := pool.DialTCP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer warm.Close()
+	if s := ConnSource(warm); s != SourcePooled {
+		t.Errorf("Expected a pooled connection, got %q", s)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{Hits: 1}) {
+		t.Errorf("Unexpected stats after reuse: %+v", stats)
+	}
+
+	// The pool is now empty, so the next dial connects to the proxy.
+	fresh, err := pool.DialTCP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if s := ConnSource(fresh); s != SourceFresh {
+		t.Errorf("Expected a fresh connection, got %q", s)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{Hits: 1, Misses: 1}) {
+		t.Errorf("Unexpected stats after a fresh dial: %+v", stats)
+	}
+
+	if s := ConnSource(&net.TCPConn{}); s != "" {
+		t.Errorf("A direct connection has no source: %q", s)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// RaceDialer connects through several proxies in parallel, and uses whichever
+// proxy completes the CONNECT exchange first.  The other attempts are canceled.
+// This selects the fastest working path when some proxies are slow or blocked.
+// Like Dialer, its Dial method has the same signature as net.Dialer's.
+type RaceDialer struct {
+	Dialers []*Dialer
+}
+
+// Dial connects to `addr` through the fastest proxy.  `network` must be a TCP network.
+func (r *RaceDialer) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("Unsupported network: " + network)
+	}
+	return r.DialTCP(addr)
+}
+
+// DialTCP connects to `addr` through the fastest proxy.
+func (r *RaceDialer) DialTCP(addr string) (split.DuplexConn, error) {
+	return r.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to `addr` through the fastest proxy.  If every attempt
+// fails, the error from the first failure is returned.
+func (r *RaceDialer) DialContext(ctx context.Context, addr string) (split.DuplexConn, error) {
+	if len(r.Dialers) == 0 {
+		return nil, errors.New("No proxies configured")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn split.DuplexConn
+		err  error
+	}
+	results := make(chan result, len(r.Dialers))
+	for _, d := range r.Dialers {
+		go func(d *Dialer) {
+			c, err := d.DialContext(ctx, addr)
+			results <- result{c, err}
+		}(d)
+	}
+
+	var firstErr error
+	for pending := len(r.Dialers); pending > 0; pending-- {
+		res := <-results
+		if res.err == nil {
+			cancel()
+			// Attempts that complete despite the cancellation are discarded.
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if res := <-results; res.conn != nil {
+						res.conn.Close()
+					}
+				}
+			}(pending - 1)
+			return res.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+	return nil, firstErr
+}
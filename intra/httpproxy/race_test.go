@@ -0,0 +1,79 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func makeSlowProxy(t *testing.T, delay time.Duration, name string) *fakeProxy {
+	return startProxy(t, &fakeProxy{early: name, delay: delay})
+}
+
+func TestRaceFastest(t *testing.T) {
+	slow1 := makeSlowProxy(t, 2*time.Second, "slow1")
+	fast := makeSlowProxy(t, 50*time.Millisecond, "fast")
+	slow2 := makeSlowProxy(t, 2*time.Second, "slow2")
+	r := &RaceDialer{[]*Dialer{{Proxy: slow1.addr()}, {Proxy: fast.addr()}, {Proxy: slow2.addr()}}}
+	start := time.Now()
+	c, err := r.Dial("tcp", makeEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Dial took %v", elapsed)
+	}
+	name := make([]byte, len("fast"))
+	if _, err := io.ReadFull(c, name); err != nil || string(name) != "fast" {
+		t.Errorf("Expected the fast proxy, got %q (%v)", name, err)
+	}
+	for _, p := range []*fakeProxy{slow1, slow2} {
+		select {
+		case <-p.canceled:
+		case <-time.After(time.Second):
+			t.Error("Slow attempt was not canceled")
+		}
+	}
+}
+
+func TestRaceSkipsFailures(t *testing.T) {
+	refusing := makeProxy(t, "Basic secret", "")
+	working := makeSlowProxy(t, 100*time.Millisecond, "ok")
+	r := &RaceDialer{[]*Dialer{{Proxy: refusing.addr()}, {Proxy: working.addr()}}}
+	c, err := r.DialTCP(makeEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestRaceAllFail(t *testing.T) {
+	p1 := makeProxy(t, "Basic secret", "")
+	p2 := makeProxy(t, "Basic secret", "")
+	r := &RaceDialer{[]*Dialer{{Proxy: p1.addr()}, {Proxy: p2.addr()}}}
+	_, err := r.DialTCP(makeEchoServer(t))
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := (&RaceDialer{}).DialTCP("127.0.0.1:1"); err == nil {
+		t.Error("Expected error with no proxies")
+	}
+}
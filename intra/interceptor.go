@@ -0,0 +1,143 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io"
+	"net"
+)
+
+// Interceptor transforms the bytes of one forwarded TCP connection, e.g. to
+// add an obfuscation layer or framing.  Each method receives the bytes read
+// from one side, and returns the bytes to forward to the other side.  It may
+// return fewer bytes than it received, and buffer the rest until a later call.
+// When a direction's stream ends, its method is called once more with a nil
+// slice, so that buffered bytes can be flushed.  Returning an error ends that
+// direction of the connection.
+//
+// Upload and Download are called from different goroutines, but each is never
+// called concurrently with itself.  The returned slice is only used until the
+// next call in the same direction.
+type Interceptor interface {
+	// Upload transforms bytes sent by the client.
+	Upload(b []byte) ([]byte, error)
+	// Download transforms bytes sent by the server.
+	Download(b []byte) ([]byte, error)
+}
+
+// InterceptorFactory returns the Interceptor for a new connection from
+// `client` to `target`, or nil to leave the connection unmodified.
+type InterceptorFactory func(client, target net.Addr) Interceptor
+
+// transform is the signature of Interceptor.Upload and Interceptor.Download.
+type transform func([]byte) ([]byte, error)
+
+// chain composes `transforms` in order, so that the output of each is the
+// input of the next.  At the end of the stream, each transform first receives
+// the bytes flushed by the transforms before it, and then the nil slice.
+func chain(transforms []transform) transform {
+	return func(b []byte) ([]byte, error) {
+		eof := b == nil
+		for _, apply := range transforms {
+			var out []byte
+			var err error
+			if len(b) > 0 || !eof {
+				if out, err = apply(nonNil(b)); err != nil {
+					return nil, err
+				}
+			}
+			if eof {
+				// `out` is only valid until the next call, so it is copied.
+				out = append([]byte(nil), out...)
+				flushed, err := apply(nil)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, flushed...)
+			}
+			b = nonNil(out)
+		}
+		if eof && len(b) == 0 {
+			return nil, nil
+		}
+		return b, nil
+	}
+}
+
+// nonNil returns `b`, or an empty slice if `b` is nil, so that a transform
+// that buffers all of its input doesn't signal the end of the stream.
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+// interceptors returns the upload and download transforms of the connection
+// from `client` to `target`, or nil if no Interceptor applies.  Interceptors
+// are applied in order on upload, and in reverse order on download, so that
+// the first interceptor is nearest to the client.
+func (h *tcpHandler) interceptors(client, target net.Addr) (upload, download transform) {
+	var up, down []transform
+	for _, factory := range h.interceptorFactories {
+		if i := factory(client, target); i != nil {
+			up = append(up, i.Upload)
+			down = append([]transform{i.Download}, down...)
+		}
+	}
+	if len(up) == 0 {
+		return nil, nil
+	}
+	return chain(up), chain(down)
+}
+
+// interceptReader applies `transform` to the bytes read from `r`.
+type interceptReader struct {
+	r         io.Reader
+	transform transform
+	pending   []byte // Transformed bytes not yet returned by Read.
+	err       error  // The error to return once pending is drained.
+	flushed   bool   // True if transform has been called with nil.
+}
+
+func (r *interceptReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err == io.EOF && !r.flushed {
+			r.flushed = true
+			var err error
+			if r.pending, err = r.transform(nil); err != nil {
+				r.err = err
+			}
+			continue
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.r.Read(b)
+		if n > 0 {
+			var terr error
+			if r.pending, terr = r.transform(b[:n]); terr != nil {
+				r.err = terr
+				return 0, terr
+			}
+		}
+		if err != nil {
+			r.err = err
+		}
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
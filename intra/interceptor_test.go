@@ -0,0 +1,131 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// xorInterceptor obfuscates both directions by XORing each byte with `key`.
+type xorInterceptor struct {
+	key byte
+}
+
+func (x xorInterceptor) xor(b []byte) ([]byte, error) {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ x.key
+	}
+	return out, nil
+}
+
+func (x xorInterceptor) Upload(b []byte) ([]byte, error)   { return x.xor(b) }
+func (x xorInterceptor) Download(b []byte) ([]byte, error) { return x.xor(b) }
+
+// Returns a server that echoes its input, and a channel that receives the
+// bytes it read from a connection, if the channel is empty.
+func makeEchoServer(t *testing.T) (*net.TCPAddr, chan []byte) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b, _ := ioutil.ReadAll(c)
+				c.Write(b)
+				c.Close()
+				select {
+				case received <- b:
+				default:
+				}
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr), received
+}
+
+func TestXORInterceptor(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.Intercept(func(client, target net.Addr) Interceptor {
+		return xorInterceptor{0x5a}
+	})
+	server, received := makeEchoServer(t)
+
+	app, local := makePair(t)
+	if err := h.Handle(&fakeTCPConn{local}, server); err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello, obfuscated world")
+	app.Write(msg)
+	app.CloseWrite()
+	reply, err := ioutil.ReadAll(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, msg) {
+		t.Errorf("Round trip mismatch: %q", reply)
+	}
+	want, _ := xorInterceptor{0x5a}.xor(msg)
+	if got := <-received; !bytes.Equal(got, want) {
+		t.Errorf("Server received %q, want %q", got, want)
+	}
+}
+
+// holdInterceptor buffers everything it uploads until the end of the stream.
+type holdInterceptor struct {
+	held []byte
+}
+
+func (h *holdInterceptor) Upload(b []byte) ([]byte, error) {
+	if b == nil {
+		return h.held, nil
+	}
+	h.held = append(h.held, b...)
+	return nil, nil
+}
+
+func (h *holdInterceptor) Download(b []byte) ([]byte, error) { return b, nil }
+
+func TestInterceptorFlush(t *testing.T) {
+	hold := &holdInterceptor{}
+	x := xorInterceptor{0x01}
+	upload := chain([]transform{hold.Upload, x.Upload})
+	r := &interceptReader{r: bytes.NewReader([]byte("abc")), transform: upload}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "`cb"; string(got) != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestNoInterceptor(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	h.Intercept(func(client, target net.Addr) Interceptor { return nil })
+	if up, down := h.interceptors(nil, nil); up != nil || down != nil {
+		t.Error("Connections without interceptors should not be transformed")
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+)
+
+// TCPHandlerFunc handles a new TCP connection from the TUN device, with the same
+// contract as core.TCPConnHandler.Handle: returning an error resets the connection,
+// and returning nil transfers ownership of `conn` to the handler.
+type TCPHandlerFunc func(conn net.Conn, target *net.TCPAddr) error
+
+// TCPMiddleware wraps a TCPHandlerFunc with one concern, such as filtering or
+// logging.  A middleware can handle the connection itself, reject it by returning
+// an error, or pass it on by calling `next`.
+type TCPMiddleware func(next TCPHandlerFunc) TCPHandlerFunc
+
+// ChainTCP composes `middlewares` around `handler`.  The first middleware is the
+// outermost, so it sees each connection first.
+func ChainTCP(handler TCPHandlerFunc, middlewares ...TCPMiddleware) TCPHandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
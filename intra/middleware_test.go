@@ -0,0 +1,97 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// Returns a middleware that appends "name>" to `log` before calling next,
+// and "<name" afterward.
+func recorder(name string, log *[]string) TCPMiddleware {
+	return func(next TCPHandlerFunc) TCPHandlerFunc {
+		return func(conn net.Conn, target *net.TCPAddr) error {
+			*log = append(*log, name+">")
+			err := next(conn, target)
+			*log = append(*log, "<"+name)
+			return err
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var log []string
+	handler := func(conn net.Conn, target *net.TCPAddr) error {
+		log = append(log, "core")
+		return nil
+	}
+	chain := ChainTCP(handler, recorder("a", &log), recorder("b", &log))
+	if err := chain(nil, &net.TCPAddr{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a>", "b>", "core", "<b", "<a"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Errorf("Unexpected order: %v", log)
+	}
+}
+
+func TestChainShortCircuit(t *testing.T) {
+	var log []string
+	reject := func(next TCPHandlerFunc) TCPHandlerFunc {
+		return func(conn net.Conn, target *net.TCPAddr) error {
+			return errors.New("rejected")
+		}
+	}
+	handler := func(conn net.Conn, target *net.TCPAddr) error {
+		t.Error("Core handler should not run")
+		return nil
+	}
+	chain := ChainTCP(handler, recorder("a", &log), reject)
+	if err := chain(nil, &net.TCPAddr{}); err == nil {
+		t.Error("Expected an error")
+	}
+	expected := []string{"a>", "<a"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Errorf("Unexpected order: %v", log)
+	}
+}
+
+func TestUseWrapsBridge(t *testing.T) {
+	server, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var log []string
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.Use(recorder("a", &log), recorder("b", &log))
+	_, local := makePair(t)
+	if err := h.Handle(&fakeTCPConn{local}, server.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Close()
+	expected := []string{"a>", "b>", "<b", "<a"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Errorf("Unexpected order: %v", log)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of SYNs whose options are remembered at once.
+	synTableLimit = 1024
+	// How long observed options are kept if no connection claims them, e.g.
+	// because lwIP dropped the SYN.
+	synEntryTTL = 30 * time.Second
+	// TCP option kinds.
+	tcpOptEnd    = 0
+	tcpOptNOP    = 1
+	tcpOptMSS    = 2
+	tcpOptWScale = 3
+	// Largest window scale shift allowed by RFC 7323.
+	maxWScale = 14
+)
+
+// synOptions describes the window and options that a client advertised in its
+// SYN, and the TTL of the packet.  SACK and timestamps are not recorded, because
+// they can't be set per socket.
+type synOptions struct {
+	mss    int // Zero if there is no MSS option.
+	window int // The unscaled window field.
+	wscale int // The window scale shift, or -1 if there is no window scale option.
+	ttl    int // The IPv4 TTL or IPv6 hop limit.
+}
+
+// receiveBuffer returns the client's receive window, scaled by its window scale
+// option, or zero if the client advertised a zero window.
+func (o synOptions) receiveBuffer() int {
+	if o.wscale <= 0 {
+		return o.window
+	}
+	shift := o.wscale
+	if shift > maxWScale {
+		shift = maxWScale
+	}
+	return o.window << shift
+}
+
+type synEntry struct {
+	opts synOptions
+	seen time.Time
+}
+
+// synTable records the options of SYNs from the TUN device, until the
+// corresponding connection reaches the handler.  This is necessary because
+// lwIP doesn't expose the options or the TTL that the client used.
+type synTable struct {
+	mu      sync.Mutex // Protects entries.
+	entries map[string]synEntry
+}
+
+func flowKey(client, target net.Addr) string {
+	return client.String() + ">" + target.String()
+}
+
+// observe records the options of `pkt`, if it is an IPv4 or IPv6 TCP SYN.
+// Other packets are ignored.
+func (m *synTable) observe(pkt []byte) {
+	client, target, opts, ok := parseSYN(pkt)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries == nil {
+		m.entries = make(map[string]synEntry)
+	}
+	if len(m.entries) >= synTableLimit {
+		for k, e := range m.entries {
+			if now.Sub(e.seen) > synEntryTTL {
+				delete(m.entries, k)
+			}
+		}
+		if len(m.entries) >= synTableLimit {
+			return
+		}
+	}
+	m.entries[flowKey(client, target)] = synEntry{opts, now}
+}
+
+// take returns and forgets the options advertised by `client` when it connected
+// to `target`, if they were observed.
+func (m *synTable) take(client, target net.Addr) (synOptions, bool) {
+	key := flowKey(client, target)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return synOptions{}, false
+	}
+	delete(m.entries, key)
+	if time.Since(e.seen) > synEntryTTL {
+		return synOptions{}, false
+	}
+	return e.opts, true
+}
+
+// parseSYN returns the addresses, window, options and TTL of a TCP SYN (without
+// ACK) in an IPv4 or IPv6 packet.  SYNs with malformed options are ignored.
+// IPv6 extension headers are not supported.
+func parseSYN(pkt []byte) (client, target *net.TCPAddr, opts synOptions, ok bool) {
+	if len(pkt) < 1 {
+		return
+	}
+	var src, dst net.IP
+	var tcp []byte
+	var ttl int
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 {
+			return
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return
+		}
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		tcp = pkt[ihl:]
+		ttl = int(pkt[8])
+	case 6:
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return
+		}
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		tcp = pkt[40:]
+		ttl = int(pkt[7])
+	default:
+		return
+	}
+	if len(tcp) < 20 || tcp[13]&0x12 != 0x02 { // SYN set, ACK clear.
+		return
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || len(tcp) < offset {
+		return
+	}
+	opts = synOptions{window: int(binary.BigEndian.Uint16(tcp[14:])), wscale: -1, ttl: ttl}
+options:
+	for b := tcp[20:offset]; len(b) > 0; {
+		switch b[0] {
+		case tcpOptEnd:
+			break options
+		case tcpOptNOP:
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || b[1] < 2 || len(b) < int(b[1]) {
+			return nil, nil, synOptions{}, false
+		}
+		switch {
+		case b[0] == tcpOptMSS && b[1] == 4:
+			opts.mss = int(binary.BigEndian.Uint16(b[2:]))
+		case b[0] == tcpOptWScale && b[1] == 3:
+			opts.wscale = int(b[2])
+		}
+		b = b[b[1]:]
+	}
+	client = &net.TCPAddr{IP: append(net.IP{}, src...), Port: int(binary.BigEndian.Uint16(tcp[0:]))}
+	target = &net.TCPAddr{IP: append(net.IP{}, dst...), Port: int(binary.BigEndian.Uint16(tcp[2:]))}
+	return client, target, opts, true
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// Returns a packet containing a TCP segment from `src` to `dst` with `flags`
+// and TCP options `opts`, whose length must be a multiple of 4.  Checksums are
+// not computed.
+func makeSegment(src, dst *net.TCPAddr, flags byte, opts []byte) []byte {
+	tcp := make([]byte, 20+len(opts))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	tcp[12] = byte(len(tcp)/4) << 4
+	tcp[13] = flags
+	copy(tcp[20:], opts)
+	if src4 := src.IP.To4(); src4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst.IP.To4())
+		return append(ip, tcp...)
+	}
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	ip[6] = 6
+	ip[7] = 64
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+	return append(ip, tcp...)
+}
+
+// Returns a SYN from `src` to `dst` that advertises `window` and `opts`.
+func makeSYN(src, dst *net.TCPAddr, window uint16, opts []byte) []byte {
+	pkt := makeSegment(src, dst, 0x02, opts)
+	ihl := 40
+	if src.IP.To4() != nil {
+		ihl = 20
+	}
+	binary.BigEndian.PutUint16(pkt[ihl+14:], window)
+	return pkt
+}
+
+func TestParseSYN(t *testing.T) {
+	app4 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	dst4 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	app6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 40000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	// NOP, window scale, then MSS 1200.
+	opts := []byte{1, 3, 3, 7, 2, 4, 0x04, 0xb0}
+
+	for _, tc := range []struct {
+		src, dst *net.TCPAddr
+	}{{app4, dst4}, {app6, dst6}} {
+		client, target, syn, ok := parseSYN(makeSYN(tc.src, tc.dst, 4096, opts))
+		if !ok || syn.mss != 1200 || syn.wscale != 7 || syn.window != 4096 || syn.ttl != 64 {
+			t.Errorf("Bad options from %v: %+v, %t", tc.src, syn, ok)
+			continue
+		}
+		if client.String() != tc.src.String() || target.String() != tc.dst.String() {
+			t.Errorf("Bad addresses: %v, %v", client, target)
+		}
+	}
+
+	if _, _, _, ok := parseSYN(makeSegment(app4, dst4, 0x12, opts)); ok {
+		t.Error("SYN-ACKs should be ignored")
+	}
+	if _, _, syn, ok := parseSYN(makeSegment(app4, dst4, 0x02, nil)); !ok || syn.mss != 0 || syn.wscale != -1 {
+		t.Errorf("Bad SYN without options: %+v, %t", syn, ok)
+	}
+	// Truncated option.
+	if _, _, _, ok := parseSYN(makeSegment(app4, dst4, 0x02, []byte{1, 1, 2, 8})); ok {
+		t.Error("Malformed options should be ignored")
+	}
+	if _, _, _, ok := parseSYN([]byte{0x45}); ok {
+		t.Error("Short packets should be ignored")
+	}
+}
+
+// clientConn is a connection from `addr`, which go-tun2socks reports as the
+// local address.
+type clientConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c clientConn) LocalAddr() net.Addr { return c.addr }
+
+func TestClientMSSDialer(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	app := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	conn := clientConn{addr: app}
+	syn := makeSegment(app, target, 0x02, []byte{2, 4, 0x02, 0x00}) // MSS 512.
+
+	h.ObservePacket(syn)
+	if _, ok := h.clientSYN.take(app, target); ok {
+		t.Error("Packets should not be observed unless mirroring is enabled")
+	}
+
+	h.SetClientMSSMirroring(true)
+	h.ObservePacket(syn)
+	if d := h.dialerFor(conn, target); d == h.dialer {
+		t.Error("The client's MSS should be applied")
+	}
+	if d := h.dialerFor(conn, target); d != h.dialer {
+		t.Error("Each observed MSS should only be used once")
+	}
+
+	// A lower clamp takes precedence over the client's MSS.
+	h.SetMSSClamp(500)
+	h.ObservePacket(syn)
+	if d := h.dialerFor(conn, target); d != h.dialer {
+		t.Error("The lower clamp should be used")
+	}
+}
+
+func TestReceiveBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		opts synOptions
+		want int
+	}{
+		{synOptions{window: 8192, wscale: -1}, 8192},
+		{synOptions{window: 8192, wscale: 0}, 8192},
+		{synOptions{window: 65535, wscale: 2}, 65535 << 2},
+		// Shifts above 14 are treated as 14.
+		{synOptions{window: 1, wscale: 15}, 1 << 14},
+	} {
+		if got := tc.opts.receiveBuffer(); got != tc.want {
+			t.Errorf("%+v: got %d, want %d", tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestClientOptionDialer(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	app := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	conn := clientConn{addr: app}
+	syn := makeSYN(app, target, 8192, []byte{2, 4, 0x02, 0x00}) // MSS 512.
+
+	h.SetClientOptionMirroring(true)
+	h.ObservePacket(syn)
+	if d := h.dialerFor(conn, target); d == h.dialer {
+		t.Error("The client's window should be applied")
+	}
+	if d := h.dialerFor(conn, target); d != h.dialer {
+		t.Error("Each observed SYN should only be used once")
+	}
+
+	// A zero window leaves the default buffer, and the MSS isn't mirrored.
+	h.ObservePacket(makeSYN(app, target, 0, []byte{2, 4, 0x02, 0x00}))
+	if d := h.dialerFor(conn, target); d != h.dialer {
+		t.Error("Only the window should be mirrored")
+	}
+}
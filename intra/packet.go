@@ -0,0 +1,196 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// Policies for checking packets from the TUN device before they reach the
+// network stack.  lwIP is built without statistics or checksum verification,
+// so without a check, bad packets are dropped or misparsed silently.
+const (
+	PacketCheckOff   = "off"   // Packets are not checked.  This is the default.
+	PacketCheckCount = "count" // Bad packets are counted, and still passed to the stack.
+	PacketCheckDrop  = "drop"  // Bad packets are counted and dropped.
+)
+
+// Errors found by the packet check.
+const (
+	PacketMalformed   = "malformed" // The IP, TCP or UDP header is truncated or inconsistent.
+	PacketBadChecksum = "checksum"  // The IPv4 header, TCP or UDP checksum is wrong.
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// packetChecker checks packets according to its policy, and counts errors.
+type packetChecker struct {
+	drop        int32 // 1 if bad packets are dropped.  Accessed atomically.
+	enabled     int32 // 1 if packets are checked.  Accessed atomically.
+	malformed   int64 // Accessed atomically.
+	badChecksum int64 // Accessed atomically.
+}
+
+func (c *packetChecker) setPolicy(policy string) error {
+	var enabled, drop int32
+	switch policy {
+	case PacketCheckOff:
+	case PacketCheckCount:
+		enabled = 1
+	case PacketCheckDrop:
+		enabled, drop = 1, 1
+	default:
+		return fmt.Errorf("Unknown packet check policy: %s", policy)
+	}
+	atomic.StoreInt32(&c.drop, drop)
+	atomic.StoreInt32(&c.enabled, enabled)
+	return nil
+}
+
+// allow checks `pkt` if checking is enabled, and reports whether it should be
+// passed to the stack.
+func (c *packetChecker) allow(pkt []byte) bool {
+	if atomic.LoadInt32(&c.enabled) == 0 {
+		return true
+	}
+	switch checkPacket(pkt) {
+	case "":
+		return true
+	case PacketMalformed:
+		atomic.AddInt64(&c.malformed, 1)
+	case PacketBadChecksum:
+		atomic.AddInt64(&c.badChecksum, 1)
+	}
+	return atomic.LoadInt32(&c.drop) == 0
+}
+
+func (c *packetChecker) policy() string {
+	if atomic.LoadInt32(&c.enabled) == 0 {
+		return PacketCheckOff
+	}
+	if atomic.LoadInt32(&c.drop) != 0 {
+		return PacketCheckDrop
+	}
+	return PacketCheckCount
+}
+
+func (c *packetChecker) reset() {
+	atomic.StoreInt64(&c.malformed, 0)
+	atomic.StoreInt64(&c.badChecksum, 0)
+}
+
+// checkPacket returns PacketMalformed or PacketBadChecksum if `pkt` has that
+// error, or "" if it appears valid.  The transport header is only checked in
+// unfragmented TCP and UDP packets without IPv6 extension headers.
+func checkPacket(pkt []byte) string {
+	if len(pkt) < 1 {
+		return PacketMalformed
+	}
+	var pseudo uint32 // Checksum of the pseudo-header, excluding the length.
+	var proto byte
+	var payload []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return PacketMalformed
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:]))
+		if ihl < 20 || total < ihl || total > len(pkt) {
+			return PacketMalformed
+		}
+		if fold(sum(0, pkt[:ihl])) != 0xffff {
+			return PacketBadChecksum
+		}
+		if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			// A fragment.  The transport header can't be checked.
+			return ""
+		}
+		proto = pkt[9]
+		pseudo = sum(uint32(proto), pkt[12:20])
+		payload = pkt[ihl:total]
+	case 6:
+		if len(pkt) < 40 {
+			return PacketMalformed
+		}
+		length := int(binary.BigEndian.Uint16(pkt[4:]))
+		if 40+length > len(pkt) {
+			return PacketMalformed
+		}
+		proto = pkt[6]
+		pseudo = sum(uint32(proto), pkt[8:40])
+		payload = pkt[40 : 40+length]
+	default:
+		return PacketMalformed
+	}
+
+	switch proto {
+	case protoTCP:
+		if len(payload) < 20 {
+			return PacketMalformed
+		}
+		if offset := int(payload[12]>>4) * 4; offset < 20 || offset > len(payload) {
+			return PacketMalformed
+		}
+	case protoUDP:
+		if len(payload) < 8 {
+			return PacketMalformed
+		}
+		length := int(binary.BigEndian.Uint16(payload[4:]))
+		if length < 8 || length > len(payload) {
+			return PacketMalformed
+		}
+		payload = payload[:length]
+		if binary.BigEndian.Uint16(payload[6:]) == 0 {
+			if pkt[0]>>4 == 4 {
+				// The checksum is optional in IPv4.
+				return ""
+			}
+			return PacketBadChecksum
+		}
+	default:
+		return ""
+	}
+	if fold(sum(pseudo+uint32(len(payload)), payload)) != 0xffff {
+		return PacketBadChecksum
+	}
+	return ""
+}
+
+// sum adds the 16-bit big-endian words of `b` to `s`.  An odd final byte is
+// padded with zero.
+func sum(s uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+// fold reduces `s` to a 16-bit ones' complement sum.
+func fold(s uint32) uint16 {
+	for s > 0xffff {
+		s = (s >> 16) + (s & 0xffff)
+	}
+	return uint16(s)
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel"
+)
+
+// Sets the lengths and checksums of `pkt`, a packet from makeSegment.
+func fixChecksums(pkt []byte) []byte {
+	var tcp []byte
+	var pseudo uint32
+	if pkt[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[10:], ^fold(sum(0, pkt[:20])))
+		tcp = pkt[20:]
+		pseudo = sum(protoTCP, pkt[12:20])
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		tcp = pkt[40:]
+		pseudo = sum(protoTCP, pkt[8:40])
+	}
+	binary.BigEndian.PutUint16(tcp[16:], ^fold(sum(pseudo+uint32(len(tcp)), tcp)))
+	return pkt
+}
+
+func makeTestPackets() (v4, v6 []byte) {
+	app4 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	dst4 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	app6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 40000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	// An odd-length option list exercises the checksum padding.
+	opts := []byte{1, 1, 1, 0}
+	v4 = fixChecksums(append(makeSegment(app4, dst4, 0x02, opts), 'x'))
+	v6 = fixChecksums(append(makeSegment(app6, dst6, 0x02, opts), 'x'))
+	return
+}
+
+func TestCheckPacket(t *testing.T) {
+	v4, v6 := makeTestPackets()
+	for _, pkt := range [][]byte{v4, v6} {
+		if err := checkPacket(pkt); err != "" {
+			t.Errorf("Valid packet failed the check: %s", err)
+		}
+		corrupt := append([]byte{}, pkt...)
+		corrupt[len(corrupt)-1] ^= 0xff
+		if err := checkPacket(corrupt); err != PacketBadChecksum {
+			t.Errorf("Expected a checksum error, got %q", err)
+		}
+		if err := checkPacket(pkt[:len(pkt)-2]); err != PacketMalformed {
+			t.Errorf("Truncated packet should be malformed, got %q", err)
+		}
+	}
+	header := append([]byte{}, v4...)
+	header[8]-- // The TTL.
+	if err := checkPacket(header); err != PacketBadChecksum {
+		t.Errorf("Expected an IPv4 header checksum error, got %q", err)
+	}
+	// A UDP checksum of zero means no checksum in IPv4, but not in IPv6.
+	udp4 := append(append([]byte{}, v4[:20]...), 0, 53, 0, 53, 0, 9, 0, 0, 'x')
+	udp4[9] = protoUDP
+	binary.BigEndian.PutUint16(udp4[2:], uint16(len(udp4)))
+	binary.BigEndian.PutUint16(udp4[10:], 0)
+	binary.BigEndian.PutUint16(udp4[10:], ^fold(sum(0, udp4[:20])))
+	if err := checkPacket(udp4); err != "" {
+		t.Errorf("UDP without a checksum should be valid in IPv4: %q", err)
+	}
+	udp6 := append(append([]byte{}, v6[:40]...), 0, 53, 0, 53, 0, 9, 0, 0, 'x')
+	udp6[6] = protoUDP
+	binary.BigEndian.PutUint16(udp6[4:], 9)
+	if err := checkPacket(udp6); err != PacketBadChecksum {
+		t.Errorf("UDP without a checksum should fail in IPv6: %q", err)
+	}
+	udp6[45] = 4 // A UDP length shorter than the header.
+	if err := checkPacket(udp6); err != PacketMalformed {
+		t.Errorf("Bad UDP length should be malformed: %q", err)
+	}
+	for _, pkt := range [][]byte{nil, {0x50}, v4[:19]} {
+		if err := checkPacket(pkt); err != PacketMalformed {
+			t.Errorf("%x should be malformed, got %q", pkt, err)
+		}
+	}
+}
+
+// fakeTunnel records the packets written to the network stack.
+type fakeTunnel struct {
+	tunnel.Tunnel
+	written [][]byte
+}
+
+func (t *fakeTunnel) Write(data []byte) (int, error) {
+	t.written = append(t.written, data)
+	return len(data), nil
+}
+
+func TestPacketCheckPolicy(t *testing.T) {
+	stack := &fakeTunnel{}
+	tun := &intratunnel{
+		Tunnel: stack,
+		tcp:    NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener()),
+		udp:    NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 1)),
+		filter: filter.NewFilter(filter.Blocklist),
+	}
+	v4, _ := makeTestPackets()
+	malformed := v4[:len(v4)-2]
+
+	// By default, packets aren't checked.
+	tun.Write(malformed)
+	if n := tun.GetMalformedPacketCount(); n != 0 || len(stack.written) != 1 {
+		t.Errorf("Packets should not be checked: %d, %d written", n, len(stack.written))
+	}
+
+	if err := tun.SetPacketCheckPolicy(PacketCheckDrop); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tun.Write(malformed); err != nil || n != len(malformed) {
+		t.Errorf("Dropped packet should not fail the write: %d, %v", n, err)
+	}
+	tun.Write(v4)
+	if n := tun.GetMalformedPacketCount(); n != 1 {
+		t.Errorf("Expected 1 malformed packet, got %d", n)
+	}
+	if len(stack.written) != 2 || len(stack.written[1]) != len(v4) {
+		t.Errorf("Only the valid packet should reach the stack: %d written", len(stack.written))
+	}
+
+	// With PacketCheckCount, bad packets still reach the stack.
+	tun.SetPacketCheckPolicy(PacketCheckCount)
+	corrupt := append([]byte{}, v4...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	tun.Write(corrupt)
+	if n := tun.GetBadChecksumCount(); n != 1 || len(stack.written) != 3 {
+		t.Errorf("Expected 1 checksum error, got %d, %d written", n, len(stack.written))
+	}
+
+	tun.ResetStats()
+	if tun.GetMalformedPacketCount() != 0 || tun.GetBadChecksumCount() != 0 {
+		t.Error("Counts should be zero after a reset")
+	}
+	if err := tun.SetPacketCheckPolicy("strict"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// PathQuality is a measurement of an upstream TCP connection, taken from the
+// kernel's TCP_INFO.
+type PathQuality struct {
+	RTT         time.Duration // Smoothed round-trip time.
+	Retransmits uint32        // Total number of retransmitted segments.
+}
+
+// DegradationHook is called when an upstream connection's path quality
+// exceeds the configured limits.  `target` is the connection's destination.
+// Higher layers can use this to migrate the flow to an alternate path.
+// The hook is called at most once per connection, on its own goroutine.
+type DegradationHook func(target net.Addr, quality PathQuality)
+
+// DegradationPolicy controls path quality monitoring for upstream connections.
+type DegradationPolicy struct {
+	// How often to measure each connection.  Zero disables monitoring.
+	Interval time.Duration
+	// The path is degraded if the RTT exceeds this value.  Zero means no limit.
+	MaxRTT time.Duration
+	// The path is degraded if more than this many segments are retransmitted
+	// in one Interval.  Zero means no limit.
+	MaxRetransmits uint32
+	// Called when the path is degraded.
+	Hook DegradationHook
+	// Measures a connection.  If nil, TCP_INFO is used.  Tests replace this
+	// to simulate degraded paths.
+	measure func(net.Conn) (PathQuality, error)
+}
+
+var errPathQualityUnsupported = errors.New("path quality is not available on this platform")
+
+// degraded reports whether `q` is outside the limits, given the previous measurement.
+func (p *DegradationPolicy) degraded(q, prev PathQuality) bool {
+	if p.MaxRTT > 0 && q.RTT > p.MaxRTT {
+		return true
+	}
+	return p.MaxRetransmits > 0 && q.Retransmits-prev.Retransmits > p.MaxRetransmits
+}
+
+// monitor measures `conn` periodically until `done` is closed, and calls the
+// hook if the path becomes degraded.
+func (p DegradationPolicy) monitor(conn net.Conn, done <-chan struct{}) {
+	if p.measure == nil {
+		p.measure = readPathQuality
+	}
+	prev, err := p.measure(conn)
+	if err != nil {
+		log.Debugf("Path quality monitoring is unavailable: %v", err)
+		return
+	}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		q, err := p.measure(conn)
+		if err != nil {
+			log.Debugf("Path quality monitoring stopped: %v", err)
+			return
+		}
+		if p.degraded(q, prev) {
+			log.Infof("Path to %v is degraded: %+v", conn.RemoteAddr(), q)
+			p.Hook(conn.RemoteAddr(), q)
+			return
+		}
+		prev = q
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func readPathQuality(conn net.Conn) (PathQuality, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return PathQuality{}, errPathQualityUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return PathQuality{}, err
+	}
+	var info *unix.TCPInfo
+	var infoErr error
+	if err := raw.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil {
+		return PathQuality{}, err
+	}
+	if infoErr != nil {
+		return PathQuality{}, infoErr
+	}
+	return PathQuality{
+		RTT:         time.Duration(info.Rtt) * time.Microsecond,
+		Retransmits: info.Total_retrans,
+	}, nil
+}
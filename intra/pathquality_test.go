@@ -0,0 +1,106 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns a measurement function that returns `samples` in order,
+// repeating the last one.
+func fakePathQuality(samples ...PathQuality) func(net.Conn) (PathQuality, error) {
+	var mu sync.Mutex
+	i := 0
+	return func(conn net.Conn) (PathQuality, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := samples[i]
+		if i < len(samples)-1 {
+			i++
+		}
+		return q, nil
+	}
+}
+
+type degradation struct {
+	target  net.Addr
+	quality PathQuality
+}
+
+func monitorWith(t *testing.T, policy DegradationPolicy) (*forwardSetup, chan degradation) {
+	c := make(chan degradation, 1)
+	policy.Hook = func(target net.Addr, q PathQuality) {
+		c <- degradation{target, q}
+	}
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetDegradationPolicy(policy)
+	})
+	return s, c
+}
+
+func TestDegradedRTT(t *testing.T) {
+	s, c := monitorWith(t, DegradationPolicy{
+		Interval: 10 * time.Millisecond,
+		MaxRTT:   time.Second,
+		measure: fakePathQuality(
+			PathQuality{RTT: 10 * time.Millisecond},
+			PathQuality{RTT: 2 * time.Second}),
+	})
+	select {
+	case d := <-c:
+		if d.quality.RTT != 2*time.Second {
+			t.Errorf("Unexpected RTT: %v", d.quality.RTT)
+		}
+		if d.target.String() != s.upstream.LocalAddr().String() {
+			t.Errorf("Unexpected target: %v", d.target)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Hook was not called")
+	}
+}
+
+func TestDegradedRetransmits(t *testing.T) {
+	_, c := monitorWith(t, DegradationPolicy{
+		Interval:       10 * time.Millisecond,
+		MaxRetransmits: 5,
+		measure: fakePathQuality(
+			PathQuality{Retransmits: 100},
+			PathQuality{Retransmits: 102},
+			PathQuality{Retransmits: 110}),
+	})
+	select {
+	case d := <-c:
+		if d.quality.Retransmits != 110 {
+			t.Errorf("Unexpected measurement: %+v", d.quality)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Hook was not called")
+	}
+}
+
+func TestHealthyPath(t *testing.T) {
+	_, c := monitorWith(t, DegradationPolicy{
+		Interval: 10 * time.Millisecond,
+		MaxRTT:   time.Second,
+	})
+	select {
+	case d := <-c:
+		t.Errorf("Loopback path should not be degraded: %+v", d.quality)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Preface configures fixed bytes that frame each upstream connection, such as
+// the magic bytes or token of a lightweight custom transport.  The zero
+// Preface adds nothing.
+type Preface struct {
+	// UpstreamPreface is sent on each upstream connection before any of the
+	// client's data.  On direct and proxied connections, it is written as soon
+	// as the connection is established.  When a split strategy applies, it is sent
+	// with the client's first bytes instead, so that the preface and the hello
+	// form the first flight that is split and retried.
+	UpstreamPreface []byte
+	// ServerPreface, if set, must be the first bytes that each server sends.
+	// It is consumed, and not forwarded to the client.  If the server sends
+	// anything else, the download direction fails.
+	ServerPreface []byte
+}
+
+var errServerPreface = errors.New("Server preface mismatch")
+
+// prefaceWriter prepends `preface` to the first bytes it transforms.
+type prefaceWriter struct {
+	preface []byte // Nil once it has been sent.
+}
+
+func (p *prefaceWriter) upload(b []byte) ([]byte, error) {
+	if p.preface == nil {
+		return b, nil
+	}
+	out := append(append([]byte{}, p.preface...), b...)
+	p.preface = nil
+	return out, nil
+}
+
+// prefaceReader consumes `want` from the start of the stream.
+type prefaceReader struct {
+	want []byte // The part of the preface not yet received.
+}
+
+func (p *prefaceReader) download(b []byte) ([]byte, error) {
+	if len(p.want) == 0 {
+		return b, nil
+	}
+	if b == nil {
+		// The stream ended before the preface was complete.
+		return nil, errServerPreface
+	}
+	n := len(b)
+	if n > len(p.want) {
+		n = len(p.want)
+	}
+	if !bytes.Equal(b[:n], p.want[:n]) {
+		return nil, errServerPreface
+	}
+	p.want = p.want[n:]
+	return b[n:], nil
+}
+
+// wrap adds the preface transforms to the interceptor transforms `upload` and
+// `download`, which may be nil, nearest to the server.  If `written` is true,
+// the upstream preface has already been sent.
+func (p Preface) wrap(upload, download transform, written bool) (transform, transform) {
+	if len(p.UpstreamPreface) > 0 && !written {
+		w := &prefaceWriter{append([]byte{}, p.UpstreamPreface...)}
+		if upload == nil {
+			upload = w.upload
+		} else {
+			upload = chain([]transform{upload, w.upload})
+		}
+	}
+	if len(p.ServerPreface) > 0 {
+		r := &prefaceReader{append([]byte{}, p.ServerPreface...)}
+		if download == nil {
+			download = r.download
+		} else {
+			download = chain([]transform{r.download, download})
+		}
+	}
+	return upload, download
+}
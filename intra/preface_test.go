@@ -0,0 +1,132 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/httpproxy"
+)
+
+func TestPrefaceDirect(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	// The echo server returns the upstream preface, which is also the
+	// server preface.
+	h.SetPreface(Preface{UpstreamPreface: []byte("MAGIC"), ServerPreface: []byte("MAGIC")})
+	server, received := makeEchoServer(t)
+
+	app, local := makePair(t)
+	if err := h.Handle(&fakeTCPConn{local}, server); err != nil {
+		t.Fatal(err)
+	}
+	app.Write([]byte("hello"))
+	app.CloseWrite()
+	reply, err := ioutil.ReadAll(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "hello" {
+		t.Errorf("The server preface should be consumed: %q", reply)
+	}
+	if got := <-received; string(got) != "MAGIChello" {
+		t.Errorf("Server received %q", got)
+	}
+}
+
+// The preface is sent through the proxy before the client sends anything.
+func TestPrefaceProxy(t *testing.T) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			received <- ""
+			return
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, len("MAGIC"))
+		n, _ := io.ReadFull(c, buf)
+		received <- string(buf[:n])
+	}()
+
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.SetProxy(&httpproxy.Dialer{Proxy: makeConnectProxy(t)})
+	h.SetPreface(Preface{UpstreamPreface: []byte("MAGIC")})
+	app, local := makePair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, l.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != "MAGIC" {
+		t.Errorf("Server received %q", got)
+	}
+}
+
+func TestPrefaceFirstFlight(t *testing.T) {
+	x := xorInterceptor{0x01}
+	upload, _ := Preface{UpstreamPreface: []byte("MAGIC")}.wrap(x.Upload, nil, false)
+	r := &interceptReader{r: bytes.NewReader([]byte("abc")), transform: upload}
+	buf := make([]byte, 100)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The preface is added after the interceptor, in the same read as the
+	// client's first bytes, so a split strategy sees them as one hello.
+	if got := string(buf[:n]); got != "MAGIC`cb" {
+		t.Errorf("Got first flight %q", got)
+	}
+	if rest, _ := ioutil.ReadAll(r); len(rest) != 0 {
+		t.Errorf("The preface should be sent once: %q", rest)
+	}
+
+	// The preface is sent even if the client sends nothing.
+	upload, _ = Preface{UpstreamPreface: []byte("MAGIC")}.wrap(nil, nil, false)
+	r = &interceptReader{r: bytes.NewReader(nil), transform: upload}
+	if got, _ := ioutil.ReadAll(r); string(got) != "MAGIC" {
+		t.Errorf("Got %q without client data", got)
+	}
+}
+
+func TestServerPreface(t *testing.T) {
+	read := func(stream string) (string, error) {
+		_, download := Preface{ServerPreface: []byte("MAGIC")}.wrap(nil, nil, false)
+		// Deliver the stream one byte at a time.
+		r := &interceptReader{r: iotest.OneByteReader(strings.NewReader(stream)), transform: download}
+		b, err := ioutil.ReadAll(r)
+		return string(b), err
+	}
+	if got, err := read("MAGICdata"); err != nil || got != "data" {
+		t.Errorf("Got %q, %v", got, err)
+	}
+	if _, err := read("MAGXCdata"); err != errServerPreface {
+		t.Errorf("A mismatched preface should fail: %v", err)
+	}
+	if _, err := read("MAG"); err != errServerPreface {
+		t.Errorf("A truncated preface should fail: %v", err)
+	}
+}
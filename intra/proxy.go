@@ -0,0 +1,118 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/httpproxy"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// ProxyDialer connects to destinations through a proxy.  httpproxy.Dialer,
+// Pool, RaceDialer and Monitor all satisfy it.
+type ProxyDialer interface {
+	DialTCP(addr string) (split.DuplexConn, error)
+}
+
+// Policies for a destination that the proxy refuses, as passed to
+// SetProxyFallback.  Only refusals that match httpproxy.ErrRefused, such as a
+// 403 response, cause a fallback.  Transport errors, and failures of the proxy
+// to reach the destination, always reset the client's connection.
+const (
+	// ProxyFallbackOff resets the client's connection.  This is the default.
+	ProxyFallbackOff = "off"
+	// ProxyFallbackDirect dials the destination directly, using the HTTPS
+	// strategy on port 443.
+	ProxyFallbackDirect = "direct"
+	// ProxyFallbackRemember is like ProxyFallbackDirect, and also remembers the
+	// destination, so that later connections to it skip the proxy.
+	ProxyFallbackRemember = "remember"
+)
+
+// maxProxyBypass bounds the number of destinations remembered by
+// ProxyFallbackRemember.  If it is exceeded, all of them are forgotten.
+const maxProxyBypass = 1000
+
+// proxyBypass is the set of destinations that are dialed directly, because the
+// proxy refused them.  It is safe for concurrent use.
+type proxyBypass struct {
+	sync.Mutex
+	direct map[string]bool
+}
+
+func (b *proxyBypass) has(addr string) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.direct[addr]
+}
+
+func (b *proxyBypass) add(addr string) {
+	b.Lock()
+	defer b.Unlock()
+	if b.direct == nil || len(b.direct) >= maxProxyBypass {
+		b.direct = make(map[string]bool)
+	}
+	b.direct[addr] = true
+}
+
+func (b *proxyBypass) len() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.direct)
+}
+
+func (h *tcpHandler) SetProxy(d ProxyDialer) {
+	h.proxy = d
+}
+
+func (h *tcpHandler) SetProxyFallback(policy string) error {
+	switch policy {
+	case ProxyFallbackOff, ProxyFallbackDirect, ProxyFallbackRemember:
+		h.proxyFallback = policy
+		return nil
+	}
+	return fmt.Errorf("Unknown proxy fallback policy: %s", policy)
+}
+
+func (h *tcpHandler) ProxyBypassed() int {
+	return h.bypass.len()
+}
+
+// dialProxy connects to `target` through the proxy.  It returns a nil conn and
+// error if there is no proxy, or if `target` should be dialed directly instead.
+func (h *tcpHandler) dialProxy(target *net.TCPAddr) (split.DuplexConn, error) {
+	addr := target.String()
+	if h.proxy == nil || h.bypass.has(addr) {
+		return nil, nil
+	}
+	c, err := h.proxy.DialTCP(addr)
+	if err == nil || !errors.Is(err, httpproxy.ErrRefused) {
+		return c, err
+	}
+	switch h.proxyFallback {
+	case ProxyFallbackDirect:
+	case ProxyFallbackRemember:
+		h.bypass.add(addr)
+	default:
+		return nil, err
+	}
+	log.Infof("Proxy refused %s, connecting directly: %v", addr, err)
+	return nil, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/httpproxy"
+)
+
+// Returns the address of a CONNECT proxy that responds to every request with
+// `status`, and a count of the requests it has received.
+func makeRefusingProxy(t *testing.T, status string) (string, *int32) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var requests int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := http.ReadRequest(bufio.NewReader(c)); err == nil {
+				atomic.AddInt32(&requests, 1)
+				fmt.Fprintf(c, "HTTP/1.1 %s\r\n\r\n", status)
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().String(), &requests
+}
+
+// Returns the address of a CONNECT proxy that tunnels each request to its
+// destination, propagating half-closes in both directions.
+func makeTunnelingProxy(t *testing.T) string {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp4", req.Host)
+				if err != nil {
+					fmt.Fprint(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				fmt.Fprint(c, "HTTP/1.1 200 OK\r\n\r\n")
+				done := make(chan struct{})
+				go func() {
+					io.Copy(target, r)
+					target.(*net.TCPConn).CloseWrite()
+					close(done)
+				}()
+				io.Copy(c, target)
+				c.(*net.TCPConn).CloseWrite()
+				<-done
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Sends "hello" through `h` to `target`, and returns the error from Handle.
+func handleEcho(t *testing.T, h TCPHandler, target *net.TCPAddr) error {
+	app, local := makePair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+		return err
+	}
+	app.Write([]byte("hello"))
+	app.CloseWrite()
+	if reply, err := ioutil.ReadAll(app); err != nil || string(reply) != "hello" {
+		t.Errorf("Unexpected reply %q, %v", reply, err)
+	}
+	return nil
+}
+
+func TestProxyFallback(t *testing.T) {
+	server, _ := makeEchoServer(t)
+	proxy, requests := makeRefusingProxy(t, "403 Forbidden")
+	for _, policy := range []string{ProxyFallbackOff, ProxyFallbackDirect, ProxyFallbackRemember} {
+		atomic.StoreInt32(requests, 0)
+		h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+		h.SetProxy(&httpproxy.Dialer{Proxy: proxy})
+		if err := h.SetProxyFallback(policy); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			err := handleEcho(t, h, server)
+			if policy == ProxyFallbackOff && err == nil {
+				t.Error("A refusal should fail without a fallback")
+			} else if policy != ProxyFallbackOff && err != nil {
+				t.Errorf("%s: expected a direct connection: %v", policy, err)
+			}
+		}
+		want, bypassed := int32(2), 0
+		if policy == ProxyFallbackRemember {
+			want, bypassed = 1, 1
+		}
+		if n := atomic.LoadInt32(requests); n != want {
+			t.Errorf("%s: expected %d proxy requests, got %d", policy, want, n)
+		}
+		if n := h.ProxyBypassed(); n != bypassed {
+			t.Errorf("%s: expected %d bypassed destinations, got %d", policy, bypassed, n)
+		}
+	}
+
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	if err := h.SetProxyFallback("bogus"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestProxyMonitorUntracksFinishedConns(t *testing.T) {
+	server, _ := makeEchoServer(t)
+	m := &httpproxy.Monitor{Dialer: &httpproxy.Dialer{Proxy: makeTunnelingProxy(t)}}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.SetProxy(m)
+	for i := 0; i < 3; i++ {
+		if err := handleEcho(t, h, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The bridge shuts down each direction separately, and never calls Close
+	// on a connection that finishes normally.
+	deadline := time.Now().Add(time.Second)
+	for m.Active() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.Active(); n != 0 {
+		t.Errorf("Expected finished connections to be untracked, got %d", n)
+	}
+}
+
+func TestProxyFallbackNetworkFailure(t *testing.T) {
+	server, _ := makeEchoServer(t)
+	// A 502 means that the proxy couldn't reach the destination, so a direct
+	// connection is not attempted.
+	proxy, _ := makeRefusingProxy(t, "502 Bad Gateway")
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	h.SetProxy(&httpproxy.Dialer{Proxy: proxy})
+	h.SetProxyFallback(ProxyFallbackRemember)
+	if err := handleEcho(t, h, server); err == nil {
+		t.Error("A transport failure should not fall back")
+	}
+	if n := h.ProxyBypassed(); n != 0 {
+		t.Errorf("Unexpected bypassed destinations: %d", n)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"fmt"
+	"net"
+)
+
+// Policies for IPv6 destinations that are only reachable on the local network,
+// as passed to SetLocalIPv6Policy.  Over the tunnel, such destinations usually
+// indicate a misconfiguration, and a dial would fail obscurely.
+const (
+	LocalIPv6Drop  = "drop"  // Drop with DropLocalIPv6.  This is the default.
+	LocalIPv6Allow = "allow" // Forward like any other destination.
+)
+
+// localIPv6Scope returns "link-local" if `ip` is in fe80::/10, "unique-local"
+// if it is in fc00::/7, or "" otherwise.  IPv4 addresses always return "".
+func localIPv6Scope(ip net.IP) string {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return ""
+	}
+	if ip.IsLinkLocalUnicast() {
+		return "link-local"
+	}
+	if ip[0]&0xfe == 0xfc {
+		return "unique-local"
+	}
+	return ""
+}
+
+// checkLocalIPv6 returns an error if `policy` drops `ip` because of its scope.
+func checkLocalIPv6(policy string, ip net.IP) error {
+	if policy == LocalIPv6Allow {
+		return nil
+	}
+	if scope := localIPv6Scope(ip); scope != "" {
+		return fmt.Errorf("destination %s is %s", ip, scope)
+	}
+	return nil
+}
+
+func checkLocalIPv6Policy(policy string) error {
+	switch policy {
+	case LocalIPv6Drop, LocalIPv6Allow:
+		return nil
+	}
+	return fmt.Errorf("Unknown local IPv6 policy: %s", policy)
+}
+
+func (h *tcpHandler) SetLocalIPv6Policy(policy string) error {
+	if err := checkLocalIPv6Policy(policy); err != nil {
+		return err
+	}
+	h.localIPv6 = policy
+	return nil
+}
+
+func (h *udpHandler) SetLocalIPv6Policy(policy string) error {
+	if err := checkLocalIPv6Policy(policy); err != nil {
+		return err
+	}
+	h.scope = policy
+	return nil
+}
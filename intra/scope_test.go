@@ -0,0 +1,105 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalIPv6Scope(t *testing.T) {
+	for addr, want := range map[string]string{
+		"fe80::1":     "link-local",
+		"febf::1":     "link-local",
+		"fc00::1":     "unique-local",
+		"fd12:3456::": "unique-local",
+		"fec0::1":     "",
+		"2001:db8::1": "",
+		"::1":         "",
+		"169.254.0.1": "",
+		"10.0.0.1":    "",
+	} {
+		if got := localIPv6Scope(net.ParseIP(addr)); got != want {
+			t.Errorf("%s: expected %q, got %q", addr, want, got)
+		}
+	}
+}
+
+func TestTCPLocalIPv6(t *testing.T) {
+	var logs logRecorder
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{Timeout: time.Second}, newFakeTCPListener()).(*tcpHandler)
+	h.drops.logf = logs.logf
+	h.SetDropLogInterval(time.Minute)
+	targets := []*net.TCPAddr{
+		{IP: net.ParseIP("fe80::1"), Port: 80},
+		{IP: net.ParseIP("fd00::1"), Port: 80},
+	}
+	for _, target := range targets {
+		_, local := makePair(t)
+		if err := h.Handle(&fakeTCPConn{local}, target); err == nil {
+			t.Errorf("Connection to %s should be dropped", target)
+		}
+	}
+	if n := h.DropCounts()[DropLocalIPv6]; n != 2 {
+		t.Errorf("Expected 2 drops, got %d", n)
+	}
+	if msgs := logs.messages(); len(msgs) != 1 || !strings.Contains(msgs[0], DropLocalIPv6) {
+		t.Errorf("Expected a logged drop reason, got %v", msgs)
+	}
+
+	if err := h.SetLocalIPv6Policy(LocalIPv6Allow); err != nil {
+		t.Fatal(err)
+	}
+	// The dial is attempted, and probably fails for lack of a route.
+	_, local := makePair(t)
+	h.Handle(&fakeTCPConn{local}, targets[1])
+	if n := h.DropCounts()[DropLocalIPv6]; n != 2 {
+		t.Errorf("Allowed destination was dropped: %d", n)
+	}
+	if err := h.SetLocalIPv6Policy("bogus"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestUDPLocalIPv6(t *testing.T) {
+	var logs logRecorder
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 1)).(*udpHandler)
+	h.drops.logf = logs.logf
+	h.SetDropLogInterval(time.Minute)
+	conn := newFakeUDPConn()
+	if err := h.Connect(conn, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 53}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(conn)
+	for _, ip := range []string{"fe80::1", "fd00::1"} {
+		if err := h.ReceiveTo(conn, []byte("hello"), &net.UDPAddr{IP: net.ParseIP(ip), Port: 53}); err == nil {
+			t.Errorf("Datagram to %s should be dropped", ip)
+		}
+	}
+	if n := h.DropCounts()[DropLocalIPv6]; n != 2 {
+		t.Errorf("Expected 2 drops, got %d", n)
+	}
+	if msgs := logs.messages(); len(msgs) != 1 || !strings.Contains(msgs[0], "UDP datagram to [fe80::1]:53") {
+		t.Errorf("Expected a logged drop reason, got %v", msgs)
+	}
+
+	h.SetLocalIPv6Policy(LocalIPv6Allow)
+	h.ReceiveTo(conn, []byte("hello"), &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 53})
+	if n := h.DropCounts()[DropLocalIPv6]; n != 2 {
+		t.Errorf("Allowed destination was dropped: %d", n)
+	}
+}
@@ -83,7 +83,7 @@ func (r *tcpSNIReporter) Configure(file io.ReadWriter, suffix, country string) (
 
 // Report converts `summary` into a Choir report and queues it for delivery.
 func (r *tcpSNIReporter) Report(summary TCPSocketSummary) {
-	if summary.Retry.Split == 0 {
+	if !summary.Retry.Retried {
 		return // Nothing to report
 	}
 
@@ -78,7 +78,8 @@ func TestSuccessClosed(t *testing.T) {
 		UploadBytes:   5000,
 		Retry: &split.RetryStats{
 			Timeout: false,              // Socket was explicitly closed
-			Split:   48,                 // >0 indicates a split was attempted
+			Retried: true,               // A retry occurred
+			Split:   48,                 // The split of the replayed hello
 			SNI:     "user.domain.test", // SNI of the socket
 		},
 	}
@@ -108,7 +109,8 @@ func TestTimeout(t *testing.T) {
 		UploadBytes:   5000,
 		Retry: &split.RetryStats{
 			Timeout: true,               // Socket timed out
-			Split:   54,                 // >0 indicates a split was attempted
+			Retried: true,               // A retry occurred
+			Split:   54,                 // The split of the replayed hello
 			SNI:     "user.domain.test", // SNI of the socket
 		},
 	}
@@ -125,7 +127,8 @@ func TestFail(t *testing.T) {
 		UploadBytes:   500,
 		Retry: &split.RetryStats{
 			Timeout: true,               // Socket timed out
-			Split:   36,                 // >0 indicates a split was attempted
+			Retried: true,               // A retry occurred
+			Split:   36,                 // The split of the replayed hello
 			SNI:     "user.domain.test", // SNI of the socket
 		},
 	}
@@ -145,6 +148,7 @@ func TestError(t *testing.T) {
 		UploadBytes:   500,
 		Retry: &split.RetryStats{
 			Timeout: true,
+			Retried: true,
 			Split:   36,
 			SNI:     "user.domain.test",
 		},
@@ -181,6 +185,7 @@ func TestUnconfigured(t *testing.T) {
 		UploadBytes:   500,
 		Retry: &split.RetryStats{
 			Timeout: true,
+			Retried: true,
 			Split:   45,
 			SNI:     "user.domain.test",
 		},
@@ -200,6 +205,7 @@ func TestNoDNS(t *testing.T) {
 		UploadBytes:   500,
 		Retry: &split.RetryStats{
 			Timeout: true,
+			Retried: true,
 			Split:   45,
 			SNI:     "user.domain.test",
 		},
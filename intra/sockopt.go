@@ -0,0 +1,221 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/sys/unix"
+)
+
+// ECN modes for upstream TCP sockets, as passed to SetECN.
+const (
+	// ECNDefault leaves ECN negotiation to the system configuration.
+	ECNDefault = ""
+	// ECNEnabled requests ECN on each upstream connection.
+	ECNEnabled = "enabled"
+	// ECNDisabled prevents ECN on each upstream connection.
+	ECNDisabled = "disabled"
+)
+
+// sockopts holds socket options that are applied to upstream sockets.
+// The zero value leaves all options at their system defaults.
+type sockopts struct {
+	// IP TTL (or IPv6 hop limit) for upstream packets.  lwIP does not retain the
+	// TTL of the client's packets, so client TTL mirroring recovers it from the
+	// SYN passed to ObservePacket, and overrides this value in dialerFor.
+	ttl int
+	// Local ports for upstream TCP sockets.
+	ports portRange
+	// Maximum TCP segment size for upstream sockets.  Clamping the MSS avoids
+	// black-holed connections on paths where encapsulation reduces the MTU.
+	mss int
+	// Linger timeout for upstream TCP sockets.  If positive, closing a socket
+	// waits up to this long for buffered data to be sent.  Zero leaves the
+	// system default, a graceful close in the background.
+	linger time.Duration
+	// Receive buffer size for upstream TCP sockets.  Because it is set before
+	// the socket connects, it also bounds the window scale that the socket
+	// advertises.  Zero leaves the system default, which is autotuned.
+	rcvbuf int
+	// ECN mode for upstream TCP sockets.  Other modes than ECNDefault are only
+	// applied where ECN can be set per socket.
+	ecn string
+	// How long data sent on an upstream TCP socket may remain unacknowledged
+	// before the connection is declared dead.  Zero leaves the system default.
+	// Only applied where TCP_USER_TIMEOUT is supported.
+	userTimeout time.Duration
+}
+
+func isIPv6(network string) bool {
+	return strings.HasSuffix(network, "6")
+}
+
+// portRange is an inclusive range of local ports for upstream sockets.
+// The zero value leaves port selection to the system.
+type portRange struct {
+	min, max int
+}
+
+// makePortRange validates a port range.  If `min` and `max` are both zero,
+// the result is the zero range.
+func makePortRange(min, max int) (portRange, error) {
+	if min == 0 && max == 0 {
+		return portRange{}, nil
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return portRange{}, fmt.Errorf("Bad port range: %d-%d", min, max)
+	}
+	return portRange{min, max}, nil
+}
+
+func (p portRange) isSet() bool {
+	return p.min > 0
+}
+
+// each calls `try` with ports in the range, starting at a random offset so
+// that concurrent sockets don't all contend for the lowest port, until `try`
+// returns true.  It reports whether any call returned true.
+func (p portRange) each(try func(port int) bool) bool {
+	n := p.max - p.min + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		if try(p.min + (start+i)%n) {
+			return true
+		}
+	}
+	return false
+}
+
+// bind binds `fd` to a port in the range.  If every port is in use, the socket
+// is left unbound, so the system will assign an ephemeral port.
+func (p portRange) bind(network string, fd int) {
+	bound := p.each(func(port int) bool {
+		var sa unix.Sockaddr = &unix.SockaddrInet4{Port: port}
+		if isIPv6(network) {
+			sa = &unix.SockaddrInet6{Port: port}
+		}
+		return unix.Bind(fd, sa) == nil
+	})
+	if !bound {
+		log.Warnf("No free %s port in %d-%d, using an ephemeral port", network, p.min, p.max)
+	}
+}
+
+// listenPacket binds a UDP socket to a port in the range using `config`,
+// falling back to an ephemeral port if every port is in use.
+func (p portRange) listenPacket(config *net.ListenConfig) (conn net.PacketConn, err error) {
+	if p.isSet() {
+		bound := p.each(func(port int) bool {
+			conn, err = config.ListenPacket(context.TODO(), "udp", fmt.Sprintf(":%d", port))
+			return err == nil
+		})
+		if bound {
+			return
+		}
+		log.Warnf("No free udp port in %d-%d, using an ephemeral port", p.min, p.max)
+	}
+	return config.ListenPacket(context.TODO(), "udp", ":0")
+}
+
+// Applies the options to the socket `fd`.  Options that the platform doesn't
+// support are logged and skipped.
+func (o sockopts) apply(network string, fd int) {
+	if o.ttl > 0 {
+		var err error
+		if isIPv6(network) {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, o.ttl)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, o.ttl)
+		}
+		if err != nil {
+			log.Warnf("Failed to set TTL on %s socket: %v", network, err)
+		}
+	}
+	if o.mss > 0 && strings.HasPrefix(network, "tcp") {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG, o.mss); err != nil {
+			log.Warnf("Failed to set MSS on %s socket: %v", network, err)
+		}
+	}
+	if o.linger > 0 && strings.HasPrefix(network, "tcp") {
+		// SO_LINGER has a resolution of seconds, so round up.
+		l := &unix.Linger{Onoff: 1, Linger: int32((o.linger + time.Second - 1) / time.Second)}
+		if err := unix.SetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER, l); err != nil {
+			log.Warnf("Failed to set linger on %s socket: %v", network, err)
+		}
+	}
+	if o.rcvbuf > 0 && strings.HasPrefix(network, "tcp") {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, o.rcvbuf); err != nil {
+			log.Warnf("Failed to set receive buffer on %s socket: %v", network, err)
+		}
+	}
+	if o.ecn != ECNDefault && ecnSupported && strings.HasPrefix(network, "tcp") {
+		if err := setECN(fd, o.ecn == ECNEnabled); err != nil {
+			log.Warnf("Failed to set ECN on %s socket: %v", network, err)
+		}
+	}
+	if o.userTimeout > 0 && userTimeoutSupported && strings.HasPrefix(network, "tcp") {
+		if err := setUserTimeout(fd, o.userTimeout); err != nil {
+			log.Warnf("Failed to set user timeout on %s socket: %v", network, err)
+		}
+	}
+	if o.ports.isSet() && strings.HasPrefix(network, "tcp") {
+		o.ports.bind(network, fd)
+	}
+}
+
+// ControlFunc has the signature of net.Dialer.Control and
+// net.ListenConfig.Control.  It is called with each new upstream socket before
+// it connects or binds, so it can set any socket option that the platform
+// supports.
+type ControlFunc func(network, address string, c syscall.RawConn) error
+
+// chainControl returns a ControlFunc that calls each non-nil function in turn,
+// stopping at the first error.
+func chainControl(funcs ...ControlFunc) ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		for _, f := range funcs {
+			if f == nil {
+				continue
+			}
+			if err := f(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// control is a ControlFunc that applies the options.
+func (o sockopts) control(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		o.apply(network, int(fd))
+	})
+}
+
+// dialer returns a copy of `d` that applies the options, and then `hook` (if
+// non-nil), to every socket it creates.  The hook can override the options.
+func (o sockopts) dialer(d *net.Dialer, hook ControlFunc) *net.Dialer {
+	c := *d
+	c.Control = chainControl(d.Control, o.control, hook)
+	return &c
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package intra
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+func TestMSSClamp(t *testing.T) {
+	const mss = 1000
+	base := dialLocal(t, &net.Dialer{})
+	if def := getsockoptInt(t, base, unix.IPPROTO_TCP, unix.TCP_MAXSEG); def <= mss {
+		t.Skipf("Default loopback MSS is only %d", def)
+	}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	h.SetMSSClamp(mss)
+	conn := dialLocal(t, h.dialer)
+	if got := getsockoptInt(t, conn, unix.IPPROTO_TCP, unix.TCP_MAXSEG); got <= 0 || got > mss {
+		t.Errorf("MSS was not clamped: %d", got)
+	}
+
+	// Sockets created by the retrier use the same dialer.
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	retrier, err := split.DialWithSplitRetry(h.dialer, l.Addr().(*net.TCPAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer retrier.Close()
+	raw, err := retrier.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	}).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	raw.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	})
+	if err != nil || got <= 0 || got > mss {
+		t.Errorf("Retrier MSS was not clamped: %d, %v", got, err)
+	}
+
+	h.SetMSSClamp(0)
+	conn = dialLocal(t, h.dialer)
+	if got := getsockoptInt(t, conn, unix.IPPROTO_TCP, unix.TCP_MAXSEG); got <= mss {
+		t.Errorf("MSS should be restored: %d", got)
+	}
+}
+
+func TestUpstreamLinger(t *testing.T) {
+	getLinger := func(conn *net.TCPConn) *unix.Linger {
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var l *unix.Linger
+		raw.Control(func(fd uintptr) {
+			l, err = unix.GetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	if l := getLinger(dialLocal(t, h.dialer)); l.Onoff != 0 {
+		t.Errorf("Linger should be off by default: %+v", l)
+	}
+	// The timeout is rounded up to whole seconds.
+	h.SetUpstreamLinger(2500 * time.Millisecond)
+	if l := getLinger(dialLocal(t, h.dialer)); l.Onoff == 0 || l.Linger != 3 {
+		t.Errorf("Wrong linger: %+v", l)
+	}
+	h.SetUpstreamLinger(0)
+	if l := getLinger(dialLocal(t, h.dialer)); l.Onoff != 0 {
+		t.Errorf("Linger should be restored: %+v", l)
+	}
+}
+
+func TestUpstreamUserTimeout(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	if got := getsockoptInt(t, dialLocal(t, h.dialer), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT); got != 0 {
+		t.Errorf("User timeout should be unset by default: %d", got)
+	}
+	h.SetUpstreamUserTimeout(1500 * time.Millisecond)
+	if got := getsockoptInt(t, dialLocal(t, h.dialer), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT); got != 1500 {
+		t.Errorf("Wrong user timeout: %d", got)
+	}
+
+	// Sockets created by the retrier, including the retried socket, use the
+	// same dialer.
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	retrier, err := split.DialWithSplitRetry(h.dialer, l.Addr().(*net.TCPAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer retrier.Close()
+	raw, err := retrier.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	raw.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+	})
+	if err != nil || got != 1500 {
+		t.Errorf("Wrong retrier user timeout: %d, %v", got, err)
+	}
+
+	h.SetUpstreamUserTimeout(0)
+	if got := getsockoptInt(t, dialLocal(t, h.dialer), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT); got != 0 {
+		t.Errorf("User timeout should be restored: %d", got)
+	}
+}
+
+func TestClientTTLMirroring(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	h.SetUpstreamTTL(42)
+	h.SetClientTTLMirroring(true)
+	app := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	syn := makeSYN(app, target, 8192, nil)
+	syn[8] = 37
+	h.ObservePacket(syn)
+	conn := dialLocal(t, h.dialerFor(clientConn{addr: app}, target))
+	if got := getsockoptInt(t, conn, unix.IPPROTO_IP, unix.IP_TTL); got != 37 {
+		t.Errorf("TTL should match the client's: %d", got)
+	}
+
+	// Without an observed SYN, the configured TTL is used.
+	conn = dialLocal(t, h.dialerFor(clientConn{addr: app}, target))
+	if got := getsockoptInt(t, conn, unix.IPPROTO_IP, unix.IP_TTL); got != 42 {
+		t.Errorf("TTL should fall back to the configured value: %d", got)
+	}
+}
+
+func TestClientWindowMirroring(t *testing.T) {
+	const window = 16384
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	def := getsockoptInt(t, dialLocal(t, h.dialer), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	if def <= 2*window {
+		t.Skipf("Default receive buffer is only %d", def)
+	}
+	h.SetClientOptionMirroring(true)
+	app := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	target := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	h.ObservePacket(makeSYN(app, target, window, nil))
+	conn := dialLocal(t, h.dialerFor(clientConn{addr: app}, target))
+	// Linux doubles the requested size to allow for bookkeeping overhead.
+	if got := getsockoptInt(t, conn, unix.SOL_SOCKET, unix.SO_RCVBUF); got < window || got > 2*window {
+		t.Errorf("Receive buffer was not sized to the client's window: %d", got)
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// Dials a local listener using `d` and returns the client socket.
+func dialLocal(t *testing.T, d *net.Dialer) *net.TCPConn {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	conn, err := d.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*net.TCPConn)
+}
+
+func getsockoptInt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		value, sockErr = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value
+}
+
+func TestDefaultSockopts(t *testing.T) {
+	base := dialLocal(t, &net.Dialer{})
+	conn := dialLocal(t, sockopts{}.dialer(&net.Dialer{}, nil))
+	want := getsockoptInt(t, base, unix.IPPROTO_IP, unix.IP_TTL)
+	if ttl := getsockoptInt(t, conn, unix.IPPROTO_IP, unix.IP_TTL); ttl != want {
+		t.Errorf("TTL should be unchanged: %d != %d", ttl, want)
+	}
+}
+
+func TestUpstreamTTL(t *testing.T) {
+	baseCalled := false
+	base := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			baseCalled = true
+			return nil
+		},
+	}
+	h := NewTCPHandler(net.TCPAddr{}, base, nil).(*tcpHandler)
+	h.SetUpstreamTTL(42)
+	conn := dialLocal(t, h.dialer)
+	if ttl := getsockoptInt(t, conn, unix.IPPROTO_IP, unix.IP_TTL); ttl != 42 {
+		t.Errorf("Unexpected TTL: %d", ttl)
+	}
+	if !baseCalled {
+		t.Error("Base Control function was not called")
+	}
+}
+
+// Returns a port that is currently free.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func inRange(addr net.Addr, min, max int) bool {
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		port = a.Port
+	case *net.UDPAddr:
+		port = a.Port
+	}
+	return port >= min && port <= max
+}
+
+func TestPortRange(t *testing.T) {
+	min := freePort(t)
+	max := min + 9
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	if err := h.SetPortRange(min, max); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		conn := dialLocal(t, h.dialer)
+		if !inRange(conn.LocalAddr(), min, max) {
+			t.Errorf("Local address %v is not in %d-%d", conn.LocalAddr(), min, max)
+		}
+	}
+
+	// The retrier uses the same dialer.
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := split.DialWithSplitRetry(h.dialer, l.Addr().(*net.TCPAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !inRange(conn.LocalAddr(), min, max) {
+		t.Errorf("Retrier address %v is not in %d-%d", conn.LocalAddr(), min, max)
+	}
+
+	udp := NewUDPHandler(net.UDPAddr{}, 0, &net.ListenConfig{}, nil).(*udpHandler)
+	if err := udp.SetPortRange(min, max); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := udp.ports.listenPacket(udp.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if !inRange(pc.LocalAddr(), min, max) {
+		t.Errorf("UDP address %v is not in %d-%d", pc.LocalAddr(), min, max)
+	}
+}
+
+func TestPortRangeExhausted(t *testing.T) {
+	l, err := net.Listen("tcp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	h.SetPortRange(port, port)
+	conn := dialLocal(t, h.dialer)
+	if inRange(conn.LocalAddr(), port, port) {
+		t.Errorf("Port %d should be in use", port)
+	}
+}
+
+func TestBadPortRange(t *testing.T) {
+	for _, r := range [][2]int{{-1, 10}, {0, 10}, {10, 5}, {1, 65536}} {
+		if _, err := makePortRange(r[0], r[1]); err == nil {
+			t.Errorf("Expected error for %d-%d", r[0], r[1])
+		}
+	}
+	if p, err := makePortRange(0, 0); err != nil || p.isSet() {
+		t.Errorf("Zero range should be unset: %v, %v", p, err)
+	}
+}
+
+func TestSetECN(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	if err := h.SetECN("bogus"); err == nil {
+		t.Error("Unknown modes should be rejected")
+	}
+	// Where ECN can't be set per socket, the mode has no effect on dialing.
+	if err := h.SetECN(ECNEnabled); err != nil {
+		t.Fatal(err)
+	}
+	dialLocal(t, h.dialer)
+	if err := h.SetECN(ECNDefault); err != nil || h.sockopts.ecn != ECNDefault {
+		t.Errorf("The default should be restored: %v", err)
+	}
+}
+
+// tosHook is a Control hook that sets IP_TOS, and records the TTL that was
+// already set on each socket.
+type tosHook struct {
+	mu   sync.Mutex
+	ttls []int
+	err  error
+}
+
+func (h *tosHook) control(network, address string, c syscall.RawConn) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return h.err
+	}
+	var sockErr error
+	c.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, 0x20); sockErr != nil {
+			return
+		}
+		var ttl int
+		ttl, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL)
+		h.ttls = append(h.ttls, ttl)
+	})
+	return sockErr
+}
+
+func (h *tosHook) calls() []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]int{}, h.ttls...)
+}
+
+func TestControlHookRetry(t *testing.T) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// Close the first connection after the hello, forcing a retry, and echo
+		// the replayed hello on the second.
+		for i := 0; i < 2; i++ {
+			c, err := l.AcceptTCP()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 5)
+			io.ReadFull(c, buf)
+			if i == 1 {
+				c.Write(buf)
+			}
+			c.Close()
+		}
+	}()
+
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil)
+	h.SetUpstreamTTL(42)
+	hook := &tosHook{}
+	h.SetControl(hook.control)
+	conn, err := h.Dial(l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// The hook ran on the initial and the retried socket, after the TTL was set.
+	if ttls := hook.calls(); len(ttls) != 2 || ttls[0] != 42 || ttls[1] != 42 {
+		t.Errorf("Unexpected hook calls: %v", ttls)
+	}
+
+	hook.err = errors.New("injected hook failure")
+	if _, err := h.Dial(l.Addr().(*net.TCPAddr)); err == nil {
+		t.Error("A failing hook should fail the dial")
+	}
+}
+
+func TestUDPControlHook(t *testing.T) {
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 1)).(*udpHandler)
+	hook := &tosHook{}
+	h.SetControl(hook.control)
+	conn := newFakeUDPConn()
+	if err := h.Connect(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); err != nil {
+		t.Fatal(err)
+	}
+	h.Close(conn)
+	if n := len(hook.calls()); n != 1 {
+		t.Errorf("Expected 1 hook call, got %d", n)
+	}
+
+	hook.err = errors.New("injected hook failure")
+	if err := h.Connect(newFakeUDPConn(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); err == nil {
+		t.Error("A failing hook should fail the association")
+	}
+}
+
+// Run with -race to check that socket options can be changed while
+// connections are being dialed.
+func TestSockoptsDuringHandle(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	server, _ := makeEchoServer(t)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			h.SetUpstreamTTL(64 + i%2)
+			h.SetMSSClamp(1200 + i%2)
+			h.SetPortRange(0, 0)
+			h.SetUpstreamLinger(time.Duration(i%2) * time.Second)
+			h.SetControl(nil)
+			h.EffectiveConfig()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := handleEcho(t, h, server); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// corkRecorder records cork changes and writes, and checks that TCP_CORK is
+// actually set during each write.
+type corkRecorder struct {
+	*net.TCPConn
+	t      *testing.T
+	events []string
+}
+
+func (c *corkRecorder) Write(b []byte) (int, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		v, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_CORK)
+		if err != nil {
+			c.t.Error(err)
+		}
+		c.events = append(c.events, fmt.Sprintf("write %d (cork=%d)", len(b), v))
+	})
+	return c.TCPConn.Write(b)
+}
+
+// Returns a connected loopback socket, and a channel that receives all the
+// bytes sent on it.
+func dialLoopback(t *testing.T) (*net.TCPConn, chan []byte) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		b, _ := ioutil.ReadAll(c)
+		c.Close()
+		received <- b
+	}()
+	c, err := net.DialTCP("tcp4", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, received
+}
+
+func TestCorkSequence(t *testing.T) {
+	c, received := dialLoopback(t)
+	r := &corkRecorder{TCPConn: c, t: t}
+	base := setCork
+	defer func() { setCork = base }()
+	setCork = func(fd int, cork bool) error {
+		if cork {
+			r.events = append(r.events, "cork")
+		} else {
+			r.events = append(r.events, "uncork")
+		}
+		return base(fd, cork)
+	}
+
+	n, err := writeSegments(r, [][]byte{[]byte("abc"), []byte("defgh")}, true)
+	if err != nil || n != 8 {
+		t.Fatalf("Write failed: %d, %v", n, err)
+	}
+	expected := []string{"cork", "write 3 (cork=1)", "uncork", "cork", "write 5 (cork=1)", "uncork"}
+	if !reflect.DeepEqual(r.events, expected) {
+		t.Errorf("Unexpected sequence %q", r.events)
+	}
+
+	// By default, and for a single segment, the socket is never corked.
+	r.events = nil
+	writeSegments(r, [][]byte{[]byte("ij"), []byte("k")}, false)
+	writeSegments(r, [][]byte{[]byte("lmn")}, true)
+	expected = []string{"write 2 (cork=0)", "write 1 (cork=0)", "write 3 (cork=0)"}
+	if !reflect.DeepEqual(r.events, expected) {
+		t.Errorf("Unexpected sequence without corking %q", r.events)
+	}
+
+	c.CloseWrite()
+	if b := <-received; string(b) != "abcdefghijklmn" {
+		t.Errorf("Server received %q", b)
+	}
+}
+
+func TestForceSeparatePacketsRetry(t *testing.T) {
+	corks := 0
+	base := setCork
+	defer func() { setCork = base }()
+	setCork = func(fd int, cork bool) error {
+		if cork {
+			corks++
+		}
+		return base(fd, cork)
+	}
+
+	options := &RetryOptions{SplitClientHello: true, ForceSeparatePackets: true}
+	s := makeSetupWithOptions(t, options)
+	defer s.close()
+	hello := captureClientHello(t, "www.example")
+	if _, err := s.clientSide.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s.serverSide, make([]byte, len(hello))); err != nil {
+		t.Fatal(err)
+	}
+	if corks != 2 {
+		t.Errorf("Expected each of the 2 segments to be corked, got %d", corks)
+	}
+}
@@ -17,6 +17,7 @@ package split
 import (
 	"io"
 	"net"
+	"syscall"
 )
 
 // DuplexConn represents a bidirectional stream socket.
@@ -27,21 +28,74 @@ type DuplexConn interface {
 	CloseRead() error
 }
 
+// Network returns "tcp4" or "tcp6" to match the family of `addr`, so that
+// IPv4 destinations (including IPv4-mapped IPv6 addresses) are dialed as IPv4.
+func Network(addr *net.TCPAddr) string {
+	if addr.IP.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
 type splitter struct {
 	*net.TCPConn
-	used bool // Initially false.  Becomes true after the first write.
+	used    bool // Initially false.  Becomes true after the first write.
+	options RetryOptions
+	synData int // Bytes to send in the SYN, if Fast Open is enabled.
 }
 
 // DialWithSplit returns a TCP connection that always splits the initial upstream segment.
 // Like net.Conn, it is intended for two-threaded use, with one thread calling
 // Read and CloseRead, and another calling Write, ReadFrom, and CloseWrite.
 func DialWithSplit(d *net.Dialer, addr *net.TCPAddr) (DuplexConn, error) {
-	conn, err := d.Dial(addr.Network(), addr.String())
+	return DialWithSplitOptions(d, addr, nil)
+}
+
+// DialWithSplitOptions is like DialWithSplit, but `options` (if non-nil)
+// controls how the initial segment is split.  If options.SYNDataSize is
+// positive and Fast Open can be enabled, Dial returns without waiting for the
+// handshake, so connection errors are reported by the first write.
+func DialWithSplitOptions(d *net.Dialer, addr *net.TCPAddr, options *RetryOptions) (DuplexConn, error) {
+	s := &splitter{}
+	if options != nil {
+		s.options = *options
+	}
+	if s.options.SYNDataSize > 0 {
+		c := *d
+		base := d.Control
+		c.Control = func(network, address string, raw syscall.RawConn) error {
+			if base != nil {
+				if err := base(network, address, raw); err != nil {
+					return err
+				}
+			}
+			return raw.Control(func(fd uintptr) {
+				if enableFastOpen(int(fd)) == nil {
+					s.synData = s.options.SYNDataSize
+				}
+			})
+		}
+		d = &c
+	}
+	conn, err := d.Dial(Network(addr), addr.String())
 	if err != nil {
 		return nil, err
 	}
+	s.TCPConn = conn.(*net.TCPConn)
+	return s, nil
+}
 
-	return &splitter{TCPConn: conn.(*net.TCPConn)}, nil
+// segments returns the segments of the first write `b`.  If Fast Open is
+// enabled, the first segment is the SYN data.
+func (s *splitter) segments(b []byte) [][]byte {
+	if s.synData <= 0 {
+		return splitHello(b, &s.options, nil)
+	}
+	n := s.synData
+	if n > len(b) {
+		n = len(b)
+	}
+	return append([][]byte{b[:n]}, splitHello(b[n:], &s.options, nil)...)
 }
 
 // Write-related functions
@@ -54,13 +108,7 @@ func (s *splitter) Write(b []byte) (int, error) {
 
 	// Setting `used` to true ensures that this code only runs once per socket.
 	s.used = true
-	b1, b2 := splitHello(b)
-	n1, err := conn.Write(b1)
-	if err != nil {
-		return n1, err
-	}
-	n2, err := conn.Write(b2)
-	return n1 + n2, err
+	return writeSegments(conn, s.segments(b), s.options.ForceSeparatePackets)
 }
 
 func (s *splitter) ReadFrom(reader io.Reader) (bytes int64, err error) {
@@ -69,6 +117,9 @@ func (s *splitter) ReadFrom(reader io.Reader) (bytes int64, err error) {
 		// Use copyOnce(), which calls Write(), to get Write's splitting behavior for
 		// the first segment.
 		if bytes, err = copyOnce(s, reader); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
 			return
 		}
 	}
@@ -0,0 +1,47 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSYNDataSegments(t *testing.T) {
+	hello := makeBuffer()
+	s := &splitter{synData: 10}
+	segments := s.segments(hello)
+	if len(segments) != 3 || len(segments[0]) != 10 {
+		t.Fatalf("Unexpected segments: %d, first is %d bytes", len(segments), len(segments[0]))
+	}
+	if split := len(segments[1]); split < 32 || split > 64 {
+		t.Errorf("Remainder was not split normally: %d", split)
+	}
+	if !bytes.Equal(bytes.Join(segments, nil), hello) {
+		t.Error("Segments don't match the hello")
+	}
+
+	// The SYN data is clamped to the length of the hello.
+	s = &splitter{synData: 1000}
+	if segments := s.segments(hello); len(segments[0]) != len(hello) {
+		t.Errorf("SYN data was not clamped: %d", len(segments[0]))
+	}
+
+	// Without Fast Open, the hello is split normally.
+	s = &splitter{}
+	if segments := s.segments(hello); len(segments) != 2 || len(segments[0]) > 64 {
+		t.Errorf("Unexpected default split: %d", len(segments[0]))
+	}
+}
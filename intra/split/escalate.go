@@ -0,0 +1,138 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"io"
+	"syscall"
+	"time"
+)
+
+// Retry strategies, which RetryOptions.RetryStrategies lists in the order that
+// successive retries apply them.
+const (
+	// RetryReconnect replays the hello unsplit, for failures that weren't
+	// caused by inspection of the hello.
+	RetryReconnect = "reconnect"
+	// RetrySplit replays the hello split as configured.  This is the default.
+	RetrySplit = "split"
+	// RetrySplitDelay is like RetrySplit, but pauses for
+	// RetryOptions.SegmentDelay between segments, so that a middlebox that
+	// only reassembles segments that arrive close together misses the hello.
+	RetrySplitDelay = "split-delay"
+	// RetryLowTTL is like RetrySplit, but sends the first segment with
+	// RetryOptions.FirstSegmentTTL, so that it expires before reaching the
+	// server.  The kernel retransmits it with the normal TTL after the rest of
+	// the hello, so that middleboxes see the segments out of order.  Where the
+	// TTL can't be changed, it is like RetrySplit.
+	RetryLowTTL = "low-ttl"
+)
+
+// DefaultSegmentDelay is the pause between segments with RetrySplitDelay if
+// RetryOptions.SegmentDelay is zero.
+const DefaultSegmentDelay = 200 * time.Millisecond
+
+// maxRetries returns the number of new connections that may be made.
+func (r *retrier) maxRetries() int {
+	if max := r.options.MaxRetries; max > 0 {
+		return max
+	}
+	if n := len(r.options.RetryStrategies); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// retryStrategy returns the strategy of the current retry.
+func (r *retrier) retryStrategy() string {
+	strategies := r.options.RetryStrategies
+	if len(strategies) == 0 {
+		return RetrySplit
+	}
+	if r.retries > len(strategies) {
+		return strategies[len(strategies)-1]
+	}
+	return strategies[r.retries-1]
+}
+
+// replay writes the hello to the new connection using `strategy`, and records
+// the split.  Unknown strategies are treated as RetrySplit.  The caller must
+// hold r.mutex.
+func (r *retrier) replay(strategy string) error {
+	if strategy == RetryReconnect {
+		// Nothing is split, so nothing should be learned.
+		r.split = 0
+		r.stats.Split = int16(len(r.hello))
+		_, err := writeFull(r.conn, r.hello)
+		return err
+	}
+	if strategy != RetrySplitDelay && strategy != RetryLowTTL {
+		_, err := r.writeHello(r.hello)
+		r.stats.Split = int16(r.split)
+		return err
+	}
+	segments, _ := r.helloSegments(r.hello)
+	r.stats.Split = int16(r.split)
+	if strategy == RetryLowTTL {
+		ttl := r.options.FirstSegmentTTL
+		if ttl <= 0 {
+			ttl = 1
+		}
+		return writeLowTTL(r.conn, segments, ttl, r.addr.IP.To4() == nil, r.options.ForceSeparatePackets)
+	}
+	delay := r.options.SegmentDelay
+	if delay <= 0 {
+		delay = DefaultSegmentDelay
+	}
+	for i, segment := range segments {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := writeFull(r.conn, segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLowTTL writes the first of `segments` to `conn` with the IP TTL, or
+// IPv6 hop limit if `ipv6` is true, set to `ttl`, and then restores it and
+// writes the rest.  If the TTL can't be changed, the segments are written
+// normally.
+func writeLowTTL(conn io.Writer, segments [][]byte, ttl int, ipv6, separate bool) error {
+	var raw syscall.RawConn
+	if s, ok := conn.(syscall.Conn); ok {
+		raw, _ = s.SyscallConn()
+	}
+	old, lowered := 0, false
+	if raw != nil {
+		raw.Control(func(fd uintptr) {
+			var err error
+			old, err = swapTTL(int(fd), ipv6, ttl)
+			lowered = err == nil
+		})
+	}
+	_, err := writeFull(conn, segments[0])
+	if lowered {
+		raw.Control(func(fd uintptr) {
+			swapTTL(int(fd), ipv6, old)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	_, err = writeSegments(conn, segments[1:], separate)
+	return err
+}
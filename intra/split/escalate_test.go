@@ -0,0 +1,116 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryStrategyOrder(t *testing.T) {
+	r := &retrier{}
+	if r.maxRetries() != 1 || func() string { r.retries = 1; return r.retryStrategy() }() != RetrySplit {
+		t.Error("By default, there is one split retry")
+	}
+	r.options.RetryStrategies = []string{RetryReconnect, RetrySplit, RetryLowTTL}
+	if n := r.maxRetries(); n != 3 {
+		t.Errorf("Each strategy should be tried once, got %d", n)
+	}
+	r.options.MaxRetries = 5
+	if n := r.maxRetries(); n != 5 {
+		t.Errorf("MaxRetries should apply, got %d", n)
+	}
+	var got []string
+	for r.retries = 1; r.retries <= 5; r.retries++ {
+		got = append(got, r.retryStrategy())
+	}
+	// The last strategy is repeated.
+	want := []string{RetryReconnect, RetrySplit, RetryLowTTL, RetryLowTTL, RetryLowTTL}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+// Forces a retry with `options`, and returns the sizes of the writes of the
+// replay, and how long it took.
+func replayWrites(t *testing.T, options *RetryOptions) (*setup, []int, time.Duration) {
+	s := makeSetupWithOptions(t, options)
+	r := s.clientSide.(*retrier)
+	var rec *recordingConn
+	r.dial = func() (DuplexConn, error) {
+		c, err := r.redial()
+		if err != nil {
+			return nil, err
+		}
+		rec = &recordingConn{DuplexConn: c}
+		return rec, nil
+	}
+	s.sendUp()
+	s.serverSide.Close()
+	start := time.Now()
+	s.confirmRetry()
+	s.close()
+	return s, rec.writes, time.Since(start)
+}
+
+func TestRetryReconnect(t *testing.T) {
+	s, writes, _ := replayWrites(t, &RetryOptions{RetryStrategies: []string{RetryReconnect}})
+	if !reflect.DeepEqual(writes, []int{BUFSIZE}) {
+		t.Errorf("The replay should not be split: %v", writes)
+	}
+	if s.stats.Split != BUFSIZE || s.stats.RetryStrategy != RetryReconnect {
+		t.Errorf("Unexpected stats: %+v", *s.stats)
+	}
+}
+
+func TestRetrySplitDelay(t *testing.T) {
+	delay := 50 * time.Millisecond
+	s, writes, elapsed := replayWrites(t, &RetryOptions{RetryStrategies: []string{RetrySplitDelay}, SegmentDelay: delay})
+	if len(writes) != 2 || writes[0] != int(s.stats.Split) {
+		t.Errorf("The replay should be split: %v", writes)
+	}
+	if elapsed < delay {
+		t.Errorf("The segments should be delayed: %v", elapsed)
+	}
+	if s.stats.RetryStrategy != RetrySplitDelay {
+		t.Errorf("Unexpected strategy: %s", s.stats.RetryStrategy)
+	}
+}
+
+// Each retry uses the next strategy.
+func TestRetryStrategyChain(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{RetryStrategies: []string{RetryReconnect, RetrySplit}})
+	defer s.close()
+	s.sendUp()
+	s.serverSide.Close()
+	reply := make(chan error)
+	go func() {
+		_, err := io.ReadFull(s.clientSide, make([]byte, len(s.serverReceived)))
+		reply <- err
+	}()
+	rejectReplay(t, s.server, s.serverReceived)
+	s.serverSide = acceptReplay(t, s.server, s.serverReceived)
+	if err := <-reply; err != nil {
+		t.Fatal(err)
+	}
+	if s.stats.Retries != 2 || s.stats.RetryStrategy != RetrySplit {
+		t.Errorf("Unexpected stats: %+v", *s.stats)
+	}
+	if s.stats.Split < 32 || s.stats.Split > 64 {
+		t.Errorf("The second retry should be split: %d", s.stats.Split)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Skips the test unless the kernel allows Fast Open for clients and servers.
+func requireFastOpen(t *testing.T) {
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		t.Skip(err)
+	}
+	if mode, _ := strconv.Atoi(strings.TrimSpace(string(b))); mode&3 != 3 {
+		t.Skipf("Fast Open is not fully enabled (tcp_fastopen = %d)", mode)
+	}
+}
+
+// Returns a listener with Fast Open enabled.
+func listenFastOpen(t *testing.T) *net.TCPListener {
+	config := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, 16)
+			})
+			return err
+		},
+	}
+	l, err := config.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l.(*net.TCPListener)
+}
+
+// capture records IPv4 packets on the loopback interface.
+type capture struct {
+	fd int
+}
+
+// Returns a capture, or skips the test if packet capture is not permitted.
+func startCapture(t *testing.T) *capture {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_IP)))
+	if err != nil {
+		t.Skipf("Packet capture is not available: %v", err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_IP), Ifindex: lo.Index}); err != nil {
+		t.Skip(err)
+	}
+	tv := unix.Timeval{Sec: 1}
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	return &capture{fd}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// synPayload returns the payload length of the first SYN sent from `port`.
+func (c *capture) synPayload(t *testing.T, port int) int {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			t.Fatalf("No SYN from port %d: %v", port, err)
+		}
+		pkt := buf[:n]
+		if n < 20 || pkt[0]>>4 != 4 || pkt[9] != unix.IPPROTO_TCP {
+			continue
+		}
+		ihl := int(pkt[0]&0xf) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:]))
+		tcp := pkt[ihl:total]
+		const SYN, ACK = 0x02, 0x10
+		if int(binary.BigEndian.Uint16(tcp)) != port || tcp[13]&(SYN|ACK) != SYN {
+			continue
+		}
+		return len(tcp) - int(tcp[12]>>4)*4
+	}
+}
+
+// Writes `hello` on a new connection, checks that the server receives it, and
+// returns the SYN payload size and the client socket.
+func sendSYNData(t *testing.T, l *net.TCPListener, hello []byte, size int) (int, *net.TCPConn) {
+	capture := startCapture(t)
+	c, err := DialWithSplitOptions(&net.Dialer{}, l.Addr().(*net.TCPAddr), &RetryOptions{SYNDataSize: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	buf := make([]byte, len(hello))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, hello) {
+		t.Error("Hello was corrupted")
+	}
+	port := c.LocalAddr().(*net.TCPAddr).Port
+	return capture.synPayload(t, port), c.(*splitter).TCPConn
+}
+
+func TestSYNData(t *testing.T) {
+	requireFastOpen(t)
+	l := listenFastOpen(t)
+	hello := makeBuffer()
+	// If no Fast Open cookie is cached, the first SYN carries no data, but it
+	// obtains a cookie for the next connection.
+	n, client := sendSYNData(t, l, hello, 20)
+	if n == 0 {
+		n, client = sendSYNData(t, l, hello, 20)
+	}
+	if n != 20 {
+		t.Errorf("Expected 20 bytes of SYN data, got %d", n)
+	}
+	raw, err := client.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info *unix.TCPInfo
+	raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const TCPI_OPT_SYN_DATA = 32
+	if info.Options&TCPI_OPT_SYN_DATA == 0 {
+		t.Error("SYN data was not acknowledged")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxLearnedSplits is the number of destinations remembered by a
+// SplitCache if no limit is specified.
+const DefaultMaxLearnedSplits = 1000
+
+type learnedSplit struct {
+	key     string
+	offset  int
+	learned time.Time // When the split last led to a successful connection.
+}
+
+// SplitCache remembers the split offset of the last hello that led to a
+// successful connection to each destination, so that later connections can
+// reuse it instead of choosing a random offset.  Destinations are identified
+// by SNI, or by address if the hello has no SNI.  Only the most recently used
+// destinations are kept, so memory use is bounded.  It is safe for concurrent
+// use.
+type SplitCache struct {
+	mu      sync.Mutex // Protects all fields.
+	max     int
+	lru     *list.List // Front is the most recently used.  Values are *learnedSplit.
+	entries map[string]*list.Element
+}
+
+// NewSplitCache returns a SplitCache that remembers at most `maxDestinations`
+// destinations.  If `maxDestinations` is not positive, DefaultMaxLearnedSplits
+// is used.
+func NewSplitCache(maxDestinations int) *SplitCache {
+	if maxDestinations <= 0 {
+		maxDestinations = DefaultMaxLearnedSplits
+	}
+	return &SplitCache{
+		max:     maxDestinations,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Max returns the maximum number of destinations that are remembered.
+func (c *SplitCache) Max() int {
+	return c.max
+}
+
+// Len returns the number of destinations whose split is remembered.
+func (c *SplitCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Flush forgets all learned splits.
+func (c *SplitCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// get returns the learned offset for `key`, if any.
+func (c *SplitCache) get(key string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*learnedSplit).offset, true
+}
+
+// put records that splitting at `offset` succeeded for `key`, evicting the
+// least recently used destination if necessary.
+func (c *SplitCache) put(key string, offset int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insert(&learnedSplit{key, offset, time.Now()})
+}
+
+// insert adds `s` as the most recently used destination, replacing any entry
+// for the same key, and evicts the least recently used destination if
+// necessary.  The caller must hold mu.
+func (c *SplitCache) insert(s *learnedSplit) {
+	if elem, ok := c.entries[s.key]; ok {
+		elem.Value = s
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[s.key] = c.lru.PushFront(s)
+	if c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*learnedSplit).key)
+	}
+}
+
+// splitCacheVersion is the version of the format written by Dump.
+const splitCacheVersion = 1
+
+type dumpedSplit struct {
+	Key     string
+	Offset  int
+	Learned time.Time
+}
+
+type dumpedCache struct {
+	Version int
+	Entries []dumpedSplit // Most recently used first.
+}
+
+// Dump serializes the learned splits, so that they can be restored by Load,
+// e.g. after the process restarts.  The format is versioned JSON.
+func (c *SplitCache) Dump() ([]byte, error) {
+	c.mu.Lock()
+	d := dumpedCache{Version: splitCacheVersion, Entries: make([]dumpedSplit, 0, c.lru.Len())}
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		s := elem.Value.(*learnedSplit)
+		d.Entries = append(d.Entries, dumpedSplit{s.key, s.offset, s.learned})
+	}
+	c.mu.Unlock()
+	return json.Marshal(d)
+}
+
+// Load restores splits written by Dump, and returns the number that were
+// restored.  Splits learned more than `maxAge` ago are dropped, because the
+// network may have changed since.  Zero `maxAge` keeps splits of any age.
+// Restored splits are more recently used than the existing ones, and the
+// cache's limit still applies.
+func (c *SplitCache) Load(data []byte, maxAge time.Duration) (int, error) {
+	var d dumpedCache
+	if err := json.Unmarshal(data, &d); err != nil {
+		return 0, err
+	}
+	if d.Version != splitCacheVersion {
+		return 0, fmt.Errorf("Unsupported split cache version: %d", d.Version)
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	// Insert the least recently used first, so that the order is preserved.
+	for i := len(d.Entries) - 1; i >= 0; i-- {
+		e := d.Entries[i]
+		if e.Key == "" || e.Offset <= 0 || (maxAge > 0 && now.Sub(e.Learned) > maxAge) {
+			continue
+		}
+		c.insert(&learnedSplit{e.Key, e.Offset, e.Learned})
+		n++
+	}
+	if n > c.max {
+		n = c.max
+	}
+	return n, nil
+}
+
+// learnedSplitKey returns the SplitCache key for a hello with `sni` to `addr`.
+func learnedSplitKey(sni, addr string) string {
+	if sni != "" {
+		return strings.TrimSuffix(strings.ToLower(sni), ".")
+	}
+	return addr
+}
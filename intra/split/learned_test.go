@@ -0,0 +1,187 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// Writes `hello` on `s`, forces a retry, and returns the split of the replay.
+func retrySplit(s *setup, hello []byte) int16 {
+	if _, err := s.clientSide.Write(hello); err != nil {
+		s.t.Fatal(err)
+	}
+	s.serverReceived = hello
+	if _, err := io.ReadFull(s.serverSide, make([]byte, len(hello))); err != nil {
+		s.t.Fatal(err)
+	}
+	s.serverSide.Close()
+	s.confirmRetry()
+	return s.stats.Split
+}
+
+func TestLearnedSplitReused(t *testing.T) {
+	cache := NewSplitCache(10)
+	options := &RetryOptions{LearnedSplits: cache}
+	hello := captureClientHello(t, "www.example")
+
+	s := makeSetupWithOptions(t, options)
+	learned := retrySplit(s, hello)
+	s.close()
+	if s.stats.LearnedSplit {
+		t.Error("Nothing should be learned yet")
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("The successful split should be learned: %d", cache.Len())
+	}
+
+	// Each server has a different address, so the split is found by SNI.
+	for i := 0; i < 5; i++ {
+		s := makeSetupWithOptions(t, options)
+		if split := retrySplit(s, hello); split != learned {
+			t.Errorf("Expected the learned split %d, got %d", learned, split)
+		}
+		if !s.stats.LearnedSplit {
+			t.Error("The learned split should be reported")
+		}
+		s.close()
+	}
+
+	// The learned split also seeds the first flight.
+	options.SplitClientHello = true
+	if writes := firstFlightWrites(t, options, hello); len(writes) != 2 || writes[0] != int(learned) {
+		t.Errorf("Expected the first flight to be split at %d: %v", learned, writes)
+	}
+}
+
+func TestLearnedSplitFirstFlight(t *testing.T) {
+	cache := NewSplitCache(10)
+	s := makeSetupWithOptions(t, &RetryOptions{SplitClientHello: true, LearnedSplits: cache})
+	defer s.close()
+	hello := captureClientHello(t, "www.example")
+	if _, err := s.clientSide.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s.serverSide, make([]byte, len(hello))); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Len() != 0 {
+		t.Error("The split should not be learned before a reply")
+	}
+	s.serverSide.Write([]byte{1})
+	if _, err := s.clientSide.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	split := s.clientSide.(*retrier).split
+	if offset, ok := cache.get("www.example"); !ok || offset != split {
+		t.Errorf("Expected split %d to be learned, got %d, %t", split, offset, ok)
+	}
+}
+
+func TestLearnedSplitStrategies(t *testing.T) {
+	cache := NewSplitCache(10)
+	options := &RetryOptions{HostStrategies: testStrategies, LearnedSplits: cache}
+	s := makeSetupWithOptions(t, options)
+	defer s.close()
+	if split := retrySplit(s, captureClientHello(t, "record.example")); split != 5 {
+		t.Errorf("Unexpected split: %d", split)
+	}
+	if cache.Len() != 0 {
+		t.Error("Only random splits should be learned")
+	}
+}
+
+func TestSplitCacheBounded(t *testing.T) {
+	c := NewSplitCache(2)
+	c.put("a.example", 1)
+	c.put("b.example", 2)
+	c.get("a.example")
+	c.put("c.example", 3)
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", c.Len())
+	}
+	if _, ok := c.get("b.example"); ok {
+		t.Error("The least recently used entry should be evicted")
+	}
+	if offset, ok := c.get("a.example"); !ok || offset != 1 {
+		t.Errorf("Recently used entry is missing: %d, %t", offset, ok)
+	}
+
+	c.Flush()
+	if c.Len() != 0 {
+		t.Errorf("Expected no entries after flush, got %d", c.Len())
+	}
+	if _, ok := c.get("a.example"); ok {
+		t.Error("Flushed entry is still present")
+	}
+	c.put("d.example", 4)
+	if c.Len() != 1 {
+		t.Errorf("The cache should be usable after a flush: %d", c.Len())
+	}
+
+	if key := learnedSplitKey("WWW.Example.", "192.0.2.1:443"); key != "www.example" {
+		t.Errorf("Unexpected key for SNI: %s", key)
+	}
+	if key := learnedSplitKey("", "192.0.2.1:443"); key != "192.0.2.1:443" {
+		t.Errorf("Unexpected key without SNI: %s", key)
+	}
+}
+
+func TestSplitCacheDumpLoad(t *testing.T) {
+	c := NewSplitCache(10)
+	c.put("old.example", 1)
+	c.put("a.example", 2)
+	c.put("b.example", 3)
+	c.entries["old.example"].Value.(*learnedSplit).learned = time.Now().Add(-2 * time.Hour)
+	data, err := c.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewSplitCache(10)
+	if n, err := restored.Load(data, time.Hour); err != nil || n != 2 {
+		t.Fatalf("Expected 2 restored splits, got %d, %v", n, err)
+	}
+	if _, ok := restored.get("old.example"); ok {
+		t.Error("The stale split should be dropped")
+	}
+	for key, want := range map[string]int{"a.example": 2, "b.example": 3} {
+		if offset, ok := restored.get(key); !ok || offset != want {
+			t.Errorf("%s: expected %d, got %d, %t", key, want, offset, ok)
+		}
+	}
+	// Zero keeps splits of any age.
+	if n, _ := NewSplitCache(10).Load(data, 0); n != 3 {
+		t.Errorf("Expected 3 restored splits, got %d", n)
+	}
+
+	// The order of use is preserved, so a smaller cache keeps the most recent.
+	small := NewSplitCache(1)
+	if n, err := small.Load(data, 0); err != nil || n != 1 {
+		t.Fatalf("Expected 1 restored split, got %d, %v", n, err)
+	}
+	if _, ok := small.get("b.example"); !ok {
+		t.Error("The most recently used split should be kept")
+	}
+
+	if _, err := restored.Load([]byte(`{"Version":2,"Entries":[]}`), 0); err == nil {
+		t.Error("An unknown version should fail")
+	}
+	if _, err := restored.Load([]byte("garbage"), 0); err == nil {
+		t.Error("A corrupt dump should fail")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import "bytes"
+
+// ProtocolSplit splits first flights that begin with Prefix at Offset, for
+// protocols other than TLS whose first bytes are recognizable, such as the
+// "SSH-2.0-" banner or an XMPP stream header.
+type ProtocolSplit struct {
+	Prefix []byte
+	// Offset is the length of the first segment.  It may fall inside or after
+	// the prefix.  The rule doesn't apply to first flights that aren't longer
+	// than Offset.
+	Offset int
+}
+
+// protocolSplit returns `hello` split at the offset of the first rule in
+// `rules` that matches it, or nil if none does.
+func protocolSplit(hello []byte, rules []ProtocolSplit) [][]byte {
+	for _, rule := range rules {
+		if len(rule.Prefix) == 0 || !bytes.HasPrefix(hello, rule.Prefix) {
+			continue
+		}
+		if rule.Offset <= 0 || rule.Offset >= len(hello) {
+			return nil
+		}
+		return [][]byte{hello[:rule.Offset], hello[rule.Offset:]}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"reflect"
+	"testing"
+)
+
+var (
+	sshBanner = []byte("SSH-2.0-OpenSSH_8.9p1 Ubuntu-3\r\n")
+	sshSplits = []ProtocolSplit{
+		{Prefix: []byte("<?xml"), Offset: 10},
+		{Prefix: []byte("SSH-"), Offset: 6},
+	}
+)
+
+func TestProtocolSplit(t *testing.T) {
+	options := &RetryOptions{ProtocolSplits: sshSplits, SegmentSizes: []int{1, 1}, MinFirstSegment: 20}
+	if got := segmentLengths(sshBanner, options); !reflect.DeepEqual(got, []int{6, len(sshBanner) - 6}) {
+		t.Errorf("Expected the SSH rule's offset: %v", got)
+	}
+	// Hellos that match no rule are split as usual.
+	if got := segmentLengths([]byte("GET / HTTP/1.1\r\nHost: www.example\r\n\r\n"), options); got[0] != 20 {
+		t.Errorf("Unmatched hello should use the usual split: %v", got)
+	}
+	// A rule doesn't apply if the hello isn't longer than its offset.
+	if segments := protocolSplit([]byte("SSH-2"), sshSplits); segments != nil {
+		t.Errorf("Short hello should not match: %q", segments)
+	}
+	if segments := protocolSplit(sshBanner, []ProtocolSplit{{Offset: 3}}); segments != nil {
+		t.Errorf("Empty prefix should not match: %q", segments)
+	}
+}
+
+func TestProtocolSplitRetry(t *testing.T) {
+	cache := NewSplitCache(10)
+	s := makeSetupWithOptions(t, &RetryOptions{ProtocolSplits: sshSplits, LearnedSplits: cache})
+	defer s.close()
+	if split := retrySplit(s, sshBanner); split != 6 {
+		t.Errorf("Expected the SSH banner to be split at 6, got %d", split)
+	}
+	if cache.Len() != 0 {
+		t.Error("Protocol splits should not be learned")
+	}
+}
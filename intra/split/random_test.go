@@ -0,0 +1,69 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Returns the first split points chosen by `r` for a long hello.
+func splitPoints(r *lockedRand) []int {
+	saved := splitRand
+	defer func() { splitRand = saved }()
+	splitRand = r
+	hello := make([]byte, 1000)
+	var points []int
+	for i := 0; i < 20; i++ {
+		points = append(points, len(splitHello(hello, nil, nil)[0]))
+	}
+	return points
+}
+
+func equalPoints(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Independently seeded sources, like those of separate processes, choose
+// different split points.
+func TestSplitPointsUnpredictable(t *testing.T) {
+	a, b := splitPoints(newRand()), splitPoints(newRand())
+	if equalPoints(a, b) {
+		t.Errorf("Two seeded sources chose the same split points: %v", a)
+	}
+	for _, s := range a {
+		if s < 32 || s > 64 {
+			t.Errorf("Split point %d out of range", s)
+		}
+	}
+}
+
+// An injected source makes split points reproducible.
+func TestSplitPointsInjected(t *testing.T) {
+	seeded := func() *lockedRand {
+		return &lockedRand{r: rand.New(rand.NewSource(1))}
+	}
+	if a, b := splitPoints(seeded()), splitPoints(seeded()); !equalPoints(a, b) {
+		t.Errorf("Same seed chose different split points: %v, %v", a, b)
+	}
+}
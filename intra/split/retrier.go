@@ -15,14 +15,16 @@
 package split
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
-	"math/rand"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"github.com/Jigsaw-Code/getsni"
 )
 
 type RetryStats struct {
@@ -31,6 +33,199 @@ type RetryStats struct {
 	Chunks  int16  // Number of writes before the retry.
 	Split   int16  // Number of bytes in the first retried segment.
 	Timeout bool   // True if the retry was caused by a timeout.
+	Retried bool   // True if a retry occurred, even if it replayed nothing.
+	Retries int16  // Number of new connections made, if RetryOptions.MaxRetries allows more than one.
+	// ExperimentTag is copied from RetryOptions.ExperimentTag when the
+	// connection is dialed.
+	ExperimentTag string
+	// NoRetry is the reason that no retry occurred, or empty if a retry
+	// occurred or the decision has not been made.
+	NoRetry string
+	// SplitWarning is one of the SplitWarning constants if a TLS ClientHello
+	// was split, but the split is unlikely to hide its SNI.
+	SplitWarning string
+	// LearnedSplit is true if the hello was split at an offset from
+	// RetryOptions.LearnedSplits, instead of a random offset.
+	LearnedSplit bool
+	// SplitClamp lists the SplitClamp constants, separated by commas, that
+	// explain how the segments of the last split hello differ from the
+	// requested configuration, or is empty if they don't.
+	SplitClamp string
+	// Overhead is the latency added by the retry, in milliseconds: the time
+	// from the first write on the provisional socket until the hello was
+	// replayed on the new one.  This is the time to first byte, minus the time
+	// the replay took to get a response, which estimates the baseline.  It is
+	// zero if no hello was replayed.
+	Overhead int32
+	// RTT is the time taken to establish the provisional connection, in
+	// milliseconds, which estimates the round-trip time to the server.  The
+	// retry timeout is derived from it.
+	RTT int32
+	// Succeeded is true if a retry occurred and the replayed hello received a
+	// reply.  A retry triggered by Write is decided before any reply, so it
+	// is not reported as successful.
+	Succeeded bool
+	// RetryStrategy is the RetryStrategies entry used by the last replay of
+	// the hello, or empty if the hello was never replayed.
+	RetryStrategy string
+}
+
+// RetryListener is notified when the retry decision of a connection is made.
+type RetryListener interface {
+	// OnRetryComplete is called with a copy of the connection's RetryStats.
+	// It is called on the thread that made the decision, after the decision is
+	// made and without any of the connection's locks held, so it may use the
+	// connection.
+	OnRetryComplete(*RetryStats)
+}
+
+// Reasons that the split of a hello differed from its RetryOptions, as
+// reported in RetryStats.SplitClamp.
+const (
+	// SplitClampHalfLength means that a random split offset was capped at half
+	// of the hello.
+	SplitClampHalfLength = "half-length"
+	// SplitClampMinSegment means that a segment was raised to MinSegmentSize,
+	// or that a split was skipped because a segment couldn't reach it.
+	SplitClampMinSegment = "min-segment"
+	// SplitClampMinFirst means that the first segment was raised to
+	// MinFirstSegment, or as close to it as the hello or strategy allowed.
+	SplitClampMinFirst = "min-first-segment"
+	// SplitClampShortHello means that the hello ended before all of the
+	// SegmentSizes targets were used.
+	SplitClampShortHello = "short-hello"
+)
+
+// splitClamps collects the SplitClamp causes of one split, without
+// duplicates.  A nil *splitClamps discards them.
+type splitClamps []string
+
+func (c *splitClamps) add(cause string) {
+	if c == nil {
+		return
+	}
+	for _, existing := range *c {
+		if existing == cause {
+			return
+		}
+	}
+	*c = append(*c, cause)
+}
+
+// Reasons that a retry did not occur, as reported in RetryStats.NoRetry.
+const (
+	// NoRetrySucceeded means that the first read succeeded, so no retry was needed.
+	NoRetrySucceeded = "succeeded"
+	// NoRetryHelloTooLarge means that more than RetryOptions.MaxHelloSize bytes
+	// were written before the first read, so the hello could not be replayed.
+	NoRetryHelloTooLarge = "hello-too-large"
+)
+
+// RetryOptions configures how the initial upstream segment is split.
+// The zero value selects the default behavior.
+type RetryOptions struct {
+	// SegmentSizes, if non-empty, lists the target size of each leading segment
+	// of a split hello.  The rest of the hello is sent as a final segment.
+	// Segments are not padded, so a hello that is too short to reach the targets
+	// produces fewer or shorter segments.  If empty, the hello is split into two
+	// segments at a random offset.
+	SegmentSizes []int
+	// MinSegmentSize is the smallest segment that SegmentSizes or a random split
+	// may produce.  Smaller targets are raised to it, and targets that would
+	// leave a smaller remainder are dropped, so a hello of n bytes is split into
+	// at most n/MinSegmentSize segments.  A hello shorter than twice the minimum
+	// is not split.  Zero means no minimum.
+	MinSegmentSize int
+	// MinFirstSegment is the smallest first segment of a split hello, so that
+	// the leading packet isn't trivially small.  Segments that end before it
+	// are merged into the first segment.  With HelloSplitSNI, the first segment
+	// still ends inside the SNI, and HelloSplitRecordHeader is unaffected.  It
+	// is clamped to the length of the hello.  Zero means no minimum.
+	MinFirstSegment int
+	// SYNDataSize is the number of bytes of the hello to send in the SYN using
+	// TCP Fast Open, when proactively splitting with DialWithSplitOptions.  The
+	// rest of the hello is split as usual.  Zero disables Fast Open.  This has
+	// no effect where Fast Open is unavailable, or before the server has
+	// issued a Fast Open cookie, in which case the SYN carries no data.
+	SYNDataSize int
+	// ExperimentTag is an opaque label that is echoed in the RetryStats, so
+	// that measurements can group connection outcomes by experiment arm.
+	ExperimentTag string
+	// MaxHelloSize limits the number of bytes that are buffered for replay
+	// before the first read.  If a write would exceed it, retry is disabled for
+	// the connection.  Zero means no limit.
+	MaxHelloSize int
+	// SplitClientHello causes DialWithSplitRetryOptions to split the first write
+	// before any retry, as DialWithSplit would, but only if it begins with a TLS
+	// ClientHello.  Other protocols are sent normally, and are only split if a
+	// retry occurs.
+	SplitClientHello bool
+	// HostStrategies assigns hello strategies, such as HelloSplitSNI, to
+	// hostnames and their subdomains.  The SNI is extracted once, and its
+	// strategy applies to both the initial split and any retry.  Hostnames
+	// that aren't listed use HelloDefault.
+	HostStrategies map[string]string
+	// LearnedSplits, if non-nil, records the split offset of each hello that
+	// receives a reply, and seeds the split of later hellos to the same
+	// destination with it, instead of a random offset.  It only applies to
+	// HelloDefault splits when SegmentSizes is empty and no ProtocolSplit
+	// matches.
+	LearnedSplits *SplitCache
+	// ProtocolSplits assigns split offsets to first flights of other protocols
+	// than TLS, recognized by their first bytes.  The first rule that matches
+	// the hello applies instead of SegmentSizes or a random split, and isn't
+	// adjusted by MinSegmentSize or MinFirstSegment.  Hellos that match no
+	// rule are split as usual.
+	ProtocolSplits []ProtocolSplit
+	// WriteTimeout limits how long each write to the upstream socket may block,
+	// e.g. because the server stopped reading, so that a wedged write fails
+	// instead of hanging.  It applies to writes of the hello, its replay after a
+	// retry, and all later writes, and is separate from the retry timeout.  If
+	// the caller also sets a write deadline, the earlier of the two applies.
+	// Zero disables the timeout.
+	WriteTimeout time.Duration
+	// RandomSplitMin and RandomSplitMax bound the offset of a random split, in
+	// bytes.  The offset is still capped at half of the hello, and raised to
+	// MinSegmentSize.  Zero selects the defaults of 32 and 64.  If
+	// RandomSplitMax is less than RandomSplitMin, the offset is always
+	// RandomSplitMin.
+	RandomSplitMin int
+	RandomSplitMax int
+	// MaxRetries is the number of new connections that may be made, one after
+	// another, if each replayed hello also fails without a reply.  Each replay
+	// is split afresh, and has the same timeout as the provisional socket.
+	// Only retries triggered by Read continue past the first, since a retry
+	// triggered by Write has no reply to wait for.  Zero means one retry, or
+	// one per entry of RetryStrategies.
+	MaxRetries int
+	// RetryStrategies lists how each successive retry replays the hello, as
+	// RetryReconnect, RetrySplit, RetrySplitDelay or RetryLowTTL, so that
+	// connections blocked by more aggressive inspection get further chances.
+	// If MaxRetries allows more retries than are listed, the last strategy is
+	// repeated.  If empty, every retry uses RetrySplit.
+	RetryStrategies []string
+	// SegmentDelay is the pause between the segments of a hello replayed with
+	// RetrySplitDelay.  Zero means DefaultSegmentDelay.
+	SegmentDelay time.Duration
+	// FirstSegmentTTL is the IP TTL, or IPv6 hop limit, of the first segment
+	// of a hello replayed with RetryLowTTL.  Zero means 1.
+	FirstSegmentTTL int
+	// TimeoutMultiplier scales the time to wait for a reply to the hello
+	// before retrying, e.g. to tolerate a slow network.  The default timeout is
+	// 1.2 seconds plus twice the connection's round-trip time.  Zero or
+	// negative means 1.
+	TimeoutMultiplier float64
+	// ForceSeparatePackets makes a best effort to send each segment of a split
+	// hello in its own packet, even if earlier data is still queued in the
+	// socket.  On Linux, each segment is written with TCP_CORK set, and then
+	// flushed by clearing it.  Other platforms have no equivalent that flushes
+	// on demand (TCP_NOPUSH on BSD and macOS doesn't), so there the segments
+	// rely on TCP_NODELAY and separate writes, which is also the default.
+	ForceSeparatePackets bool
+	// Listener, if non-nil, is notified once the retry decision is made, i.e.
+	// when the first reply arrives, the retry finishes, or retry is ruled out.
+	// It isn't notified if the connection closes before any decision.
+	Listener RetryListener
 }
 
 // retrier implements the DuplexConn interface.
@@ -43,13 +238,19 @@ type retrier struct {
 	dialer  *net.Dialer
 	network string
 	addr    *net.TCPAddr
-	// conn is the current underlying connection.  It is only modified by the reader
-	// thread, so the reader functions may access it without acquiring a lock.
-	conn *net.TCPConn
+	// conn is the current underlying connection.  It is replaced by the retry,
+	// which runs on whichever thread first sees the provisional socket fail.
+	// Once retryCompleteFlag is closed, it may be accessed without the lock.
+	conn DuplexConn
+	// dial creates the replacement connection during a retry.
+	dial func() (DuplexConn, error)
 	// External read and write deadlines.  These need to be stored here so that
 	// they can be re-applied in the event of a retry.
 	readDeadline  time.Time
 	writeDeadline time.Time
+	// retryDeadline is when the provisional socket times out, if it has been
+	// written, or zero.
+	retryDeadline time.Time
 	// Time to wait between the first write and the first read before triggering a
 	// retry.
 	timeout time.Duration
@@ -62,6 +263,20 @@ type retrier struct {
 	readCloseFlag  chan struct{}
 	writeCloseFlag chan struct{}
 	stats          *RetryStats
+	options        RetryOptions
+	// retrying is set atomically to 1 when a retry begins.
+	retrying int32
+	// retries is the number of new connections made so far.
+	retries int
+	// peek is the result of inspecting the hello, once its SNI is known.
+	peek helloPeek
+	// split is the length of the first segment of the last split hello, or 0.
+	split int
+	// firstWrite is when the hello was first written, or zero.
+	firstWrite time.Time
+	// completed is the copy of stats for the listener, set by finalize until
+	// unlock delivers it.
+	completed *RetryStats
 }
 
 // Helper functions for reading flags.
@@ -95,15 +310,55 @@ func (r *retrier) retryCompleted() bool {
 	return closed(r.retryCompleteFlag)
 }
 
+// Phases reported by Phase.
+const (
+	// PhaseProvisional means that no reply has been received yet, so a retry
+	// may still occur.
+	PhaseProvisional = "provisional"
+	// PhaseRetrying means that a retry is in progress.
+	PhaseRetrying = "retrying"
+	// PhaseSettled means that the first read has completed, with or without a
+	// retry, so the connection will not change again.
+	PhaseSettled = "settled"
+)
+
+// Phase returns the current phase of the retrier, for debugging.  It is safe
+// to call concurrently with other methods.  The DuplexConn returned by
+// DialWithSplitRetry implements `interface{ Phase() string }`.
+func (r *retrier) Phase() string {
+	if r.retryCompleted() {
+		return PhaseSettled
+	}
+	if atomic.LoadInt32(&r.retrying) != 0 {
+		return PhaseRetrying
+	}
+	return PhaseProvisional
+}
+
+// HelloLen returns the number of bytes written before the first read, which
+// are buffered for replay.  It returns 0 once the retry decision has been
+// made.  It is safe to call concurrently with other methods.  The DuplexConn
+// returned by DialWithSplitRetry implements `interface{ HelloLen() int }`.
+func (r *retrier) HelloLen() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.hello)
+}
+
 // Given timestamps immediately before and after a successful socket connection
 // (i.e. the time the SYN was sent and the time the SYNACK was received), this
 // function returns a reasonable timeout for replies to a hello sent on this socket.
-func timeout(before, after time.Time) time.Duration {
+// The result is scaled by `multiplier`, if it is positive.
+func timeout(before, after time.Time, multiplier float64) time.Duration {
 	// These values were chosen to have a <1% false positive rate based on test data.
 	// False positives trigger an unnecessary retry, which can make connections slower, so they are
 	// worth avoiding.  However, overly long timeouts make retry slower and less useful.
 	rtt := after.Sub(before)
-	return 1200*time.Millisecond + 2*rtt
+	t := 1200*time.Millisecond + 2*rtt
+	if multiplier > 0 {
+		t = time.Duration(float64(t) * multiplier)
+	}
+	return t
 }
 
 // DefaultTimeout is the value that will cause DialWithSplitRetry to use the system's
@@ -114,12 +369,22 @@ const DefaultTimeout time.Duration = 0
 // splitting the initial upstream segment if the socket closes without receiving a
 // reply.  Like net.Conn, it is intended for two-threaded use, with one thread calling
 // Read and CloseRead, and another calling Write, ReadFrom, and CloseWrite.
+// Callers that only write are also supported: if a write fails before the
+// first read, the writer performs the retry itself, instead of waiting for a
+// Read that may never come.
 // `dialer` will be used to establish the connection.
 // `addr` is the destination.
 // If `stats` is non-nil, it will be populated with retry-related information.
 func DialWithSplitRetry(dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats) (DuplexConn, error) {
+	return DialWithSplitRetryOptions(dialer, addr, nil, stats)
+}
+
+// DialWithSplitRetryOptions is like DialWithSplitRetry, but `options` controls
+// how the hello is split if a retry occurs, and whether a ClientHello is split
+// before that.  If `options` is nil, the default behavior is used.
+func DialWithSplitRetryOptions(dialer *net.Dialer, addr *net.TCPAddr, options *RetryOptions, stats *RetryStats) (DuplexConn, error) {
 	before := time.Now()
-	conn, err := dialer.Dial(addr.Network(), addr.String())
+	conn, err := dialer.Dial(Network(addr), addr.String())
 	if err != nil {
 		return nil, err
 	}
@@ -130,61 +395,304 @@ func DialWithSplitRetry(dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats
 		// is to avoid the need for nil checks at each point where stats are updated.
 		stats = &RetryStats{}
 	}
+	stats.RTT = int32(after.Sub(before) / time.Millisecond)
 
 	r := &retrier{
 		dialer:            dialer,
 		addr:              addr,
 		conn:              conn.(*net.TCPConn),
-		timeout:           timeout(before, after),
+		timeout:           timeout(before, after, 0),
 		retryCompleteFlag: make(chan struct{}),
 		readCloseFlag:     make(chan struct{}),
 		writeCloseFlag:    make(chan struct{}),
 		stats:             stats,
 	}
+	if options != nil {
+		r.options = *options
+		r.timeout = timeout(before, after, options.TimeoutMultiplier)
+		stats.ExperimentTag = options.ExperimentTag
+	}
+	r.dial = r.redial
 
 	return r, nil
 }
 
+// Resolver resolves hostnames for DialWithSplitRetryHost.  *net.Resolver
+// implements this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DialWithSplitRetryHost is like DialWithSplitRetryOptions, but the destination
+// is a "host:port" string.  The host is resolved using `resolver`, so that the
+// name can be resolved through the tunnel's own DNS transport instead of
+// leaking to the system resolver.  If `resolver` is nil, the system resolver
+// is used.  Resolution is bounded by the dialer's Timeout and Deadline.  The
+// resolved addresses are tried in order until one connects.
+func DialWithSplitRetryHost(dialer *net.Dialer, hostport string, resolver Resolver, options *RetryOptions, stats *RetryStats) (DuplexConn, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := lookupContext(dialer)
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No addresses for %s", host)
+	}
+	for _, addr := range addrs {
+		var conn DuplexConn
+		tcpaddr := &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}
+		if conn, err = DialWithSplitRetryOptions(dialer, tcpaddr, options, stats); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// lookupContext returns a context for resolving a name before dialing with
+// `dialer`, which expires at the earlier of its Timeout and Deadline, if either
+// is set.
+func lookupContext(dialer *net.Dialer) (context.Context, context.CancelFunc) {
+	deadline := dialer.Deadline
+	if dialer.Timeout > 0 {
+		if d := time.Now().Add(dialer.Timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
 // Read-related functions.
 func (r *retrier) Read(buf []byte) (n int, err error) {
-	n, err = r.conn.Read(buf)
+	if len(buf) == 0 {
+		// A zero-length read provides no evidence about whether the server
+		// accepted the hello, so it must not finalize or trigger a retry.
+		return 0, nil
+	}
+	conn := r.currentConn()
+	n, err = conn.Read(buf)
 	if n == 0 && err == nil {
 		// If no data was read, a nil error doesn't rule out the need for a retry.
 		return
 	}
 	if !r.retryCompleted() {
 		r.mutex.Lock()
-		if err != nil {
-			var neterr net.Error
-			if errors.As(err, &neterr) {
-				r.stats.Timeout = neterr.Timeout()
+		// Write might have made the decision while this thread was reading.
+		if !r.retryCompleted() {
+			if err != nil {
+				if r.callerTimeout(err) {
+					// The caller's deadline expired first.  The retry decision is
+					// still pending, so the caller can read again.
+					r.mutex.Unlock()
+					return
+				}
+				r.recordFailure(err)
+				// Read failed.  Retry.
+				n, err = r.retry(buf)
+				r.stats.Succeeded = n > 0
+			} else {
+				r.stats.NoRetry = NoRetrySucceeded
+			}
+			if n > 0 {
+				r.learn()
 			}
-			// Read failed.  Retry.
-			n, err = r.retry(buf)
+			r.finalize()
+			r.unlock()
+			return
 		}
-		close(r.retryCompleteFlag)
-		// Unset read deadline.
-		r.conn.SetReadDeadline(time.Time{})
-		r.hello = nil
 		r.mutex.Unlock()
 	}
+	if conn != r.conn {
+		// Write performed the retry while this thread was reading from the old
+		// socket, which was closed.  The result of that read is discarded, and
+		// the response to the replayed hello is read instead.
+		return r.conn.Read(buf)
+	}
 	return
 }
 
+// currentConn returns the current underlying connection.
+func (r *retrier) currentConn() DuplexConn {
+	if r.retryCompleted() {
+		return r.conn
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.conn
+}
+
+// recordFailure records that the provisional socket failed with `err`, and
+// that a retry is beginning.  The caller must hold r.mutex.
+func (r *retrier) recordFailure(err error) {
+	var neterr net.Error
+	if errors.As(err, &neterr) {
+		r.stats.Timeout = neterr.Timeout()
+	}
+	atomic.StoreInt32(&r.retrying, 1)
+}
+
+// finalize records that the retry decision has been made.  The caller must
+// hold r.mutex, and release it with unlock, which notifies the listener.
+func (r *retrier) finalize() {
+	close(r.retryCompleteFlag)
+	// Replace the retry deadline with the caller's deadline.
+	r.applyReadDeadline()
+	r.hello = nil
+	if r.options.Listener != nil {
+		stats := *r.stats
+		r.completed = &stats
+	}
+}
+
+// unlock releases r.mutex, and then notifies the listener if finalize was
+// called.  The listener may be slow, e.g. a call into Java on Android, or may
+// use the connection, so it must not be called with the lock held.
+func (r *retrier) unlock() {
+	stats := r.completed
+	r.completed = nil
+	r.mutex.Unlock()
+	if stats != nil {
+		r.options.Listener.OnRetryComplete(stats)
+	}
+}
+
+// applyReadDeadline sets the read deadline of the current socket.  Until the
+// retry decision is made, it is the earlier of the caller's deadline and the
+// retry deadline, so that neither overrides the other.  Afterwards, it is the
+// caller's deadline.  The caller must hold r.mutex.
+func (r *retrier) applyReadDeadline() error {
+	d := r.readDeadline
+	if !r.retryCompleted() && !r.retryDeadline.IsZero() && (d.IsZero() || r.retryDeadline.Before(d)) {
+		d = r.retryDeadline
+	}
+	return r.conn.SetReadDeadline(d)
+}
+
+// callerTimeout reports whether `err` was caused by the caller's read deadline,
+// rather than by the retry deadline.  The caller must hold r.mutex.
+func (r *retrier) callerTimeout(err error) bool {
+	var neterr net.Error
+	if !errors.As(err, &neterr) || !neterr.Timeout() || r.readDeadline.IsZero() {
+		return false
+	}
+	if !r.retryDeadline.IsZero() && r.retryDeadline.Before(r.readDeadline) {
+		return false
+	}
+	return !time.Now().Before(r.readDeadline)
+}
+
+// learnsSplits reports whether the split offset of `hello` is learned, which is
+// only the case for random offsets.
+func (r *retrier) learnsSplits(hello []byte) bool {
+	return r.options.LearnedSplits != nil && r.peek.strategy == HelloDefault && len(r.options.SegmentSizes) == 0 &&
+		protocolSplit(hello, r.options.ProtocolSplits) == nil
+}
+
+// segments divides `hello` into segments according to the peeked strategy.  If
+// an offset was learned for this destination, the hello is split there
+// instead of at a random offset.  The caller must hold r.mutex.
+func (r *retrier) segments(hello []byte) [][]byte {
+	var segments [][]byte
+	if r.learnsSplits(hello) {
+		key := learnedSplitKey(r.peek.sni, r.addr.String())
+		if offset, ok := r.options.LearnedSplits.get(key); ok && offset < len(hello) {
+			r.stats.LearnedSplit = true
+			segments = [][]byte{hello[:offset], hello[offset:]}
+		}
+	}
+	var clamps splitClamps
+	if segments == nil {
+		segments = r.peek.segments(hello, &r.options, &clamps)
+	}
+	r.stats.SplitClamp = strings.Join(clamps, ",")
+	r.split = len(segments[0])
+	return segments
+}
+
+// learn records the split of a hello that received a reply.  The caller must
+// hold r.mutex.
+func (r *retrier) learn() {
+	if r.split > 0 && r.learnsSplits(r.hello) {
+		r.options.LearnedSplits.put(learnedSplitKey(r.peek.sni, r.addr.String()), r.split)
+	}
+}
+
+// redial establishes a new connection to the destination.
+func (r *retrier) redial() (DuplexConn, error) {
+	conn, err := r.dialer.Dial(Network(r.addr), r.addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// retry replaces the current connection with a new one, replays the hello,
+// and reads the first response into `buf`.  If the replay also fails without
+// a reply, it is retried again, up to RetryOptions.MaxRetries connections in
+// total.  The caller must hold r.mutex.
 func (r *retrier) retry(buf []byte) (n int, err error) {
-	r.conn.Close()
-	var newConn net.Conn
-	if newConn, err = r.dialer.Dial(r.addr.Network(), r.addr.String()); err != nil {
-		return
+	max := r.maxRetries()
+	for attempt := 1; ; attempt++ {
+		if max > 1 {
+			r.stats.Retries = int16(attempt)
+		}
+		// Only a replayed hello can fail for want of a reply.
+		retryAgain := attempt < max && len(r.hello) > 0
+		if err = r.reconnect(retryAgain); err != nil {
+			return
+		}
+		n, err = r.conn.Read(buf)
+		if n > 0 || err == nil || !retryAgain || r.callerTimeout(err) {
+			return
+		}
+		r.recordFailure(err)
 	}
-	r.conn = newConn.(*net.TCPConn)
-	first, second := splitHello(r.hello)
-	r.stats.Split = int16(len(first))
-	if _, err = r.conn.Write(first); err != nil {
+}
+
+// reconnect replaces the current connection with a new one and replays the hello.
+// If nothing was written before the failure, e.g. because the server closed
+// the connection before the client spoke, the new connection is established
+// without writing anything, and RetryStats.Split is zero, but
+// RetryStats.Retried is still set.
+// If `provisional` is true, the new connection times out like the first one,
+// so that it can be retried again.  Otherwise, it is final.
+// If this attempt fails, the error is returned and the connection is left
+// closed, so that any blocked writers fail promptly once the caller marks the
+// retry as complete.
+func (r *retrier) reconnect(provisional bool) (err error) {
+	r.retries++
+	r.stats.Retried = true
+	r.conn.Close()
+	var newConn DuplexConn
+	if newConn, err = r.dial(); err != nil {
 		return
 	}
-	if _, err = r.conn.Write(second); err != nil {
-		return
+	r.conn = newConn
+	if len(r.hello) > 0 {
+		r.armWriteDeadline()
+		r.stats.RetryStrategy = r.retryStrategy()
+		err = r.replay(r.stats.RetryStrategy)
+		r.stats.SplitWarning = r.peek.splitWarning(r.hello)
+		if err != nil {
+			// Don't leave a half-replayed socket open.
+			r.conn.Close()
+			return
+		}
+		r.stats.Overhead = int32(time.Since(r.firstWrite) / time.Millisecond)
 	}
 	// While we were creating the new socket, the caller might have called CloseRead
 	// or CloseWrite on the old socket.  Copy that state to the new socket.
@@ -196,10 +704,15 @@ func (r *retrier) retry(buf []byte) (n int, err error) {
 	if r.writeClosed() {
 		r.conn.CloseWrite()
 	}
-	// The caller might have set read or write deadlines before the retry.
-	r.conn.SetReadDeadline(r.readDeadline)
+	// The caller might have set read or write deadlines before the retry.  The
+	// new socket has no retry deadline, unless it may be retried again.
+	r.retryDeadline = time.Time{}
+	if provisional {
+		r.retryDeadline = time.Now().Add(r.timeout)
+	}
+	r.applyReadDeadline()
 	r.conn.SetWriteDeadline(r.writeDeadline)
-	return r.conn.Read(buf)
+	return nil
 }
 
 func (r *retrier) CloseRead() error {
@@ -211,22 +724,214 @@ func (r *retrier) CloseRead() error {
 	return r.conn.CloseRead()
 }
 
-func splitHello(hello []byte) ([]byte, []byte) {
+// splitHello divides `hello` into the segments that should be written
+// separately.  The result always contains at least two segments, which
+// may be empty.  Any differences from the requested split are added to
+// `clamps`.
+func splitHello(hello []byte, options *RetryOptions, clamps *splitClamps) [][]byte {
 	if len(hello) == 0 {
-		return hello, hello
+		return [][]byte{hello, hello}
+	}
+	minSize, minFirst := 0, 0
+	if options != nil {
+		if segments := protocolSplit(hello, options.ProtocolSplits); segments != nil {
+			return segments
+		}
+		minSize, minFirst = options.MinSegmentSize, options.MinFirstSegment
+	}
+	if options != nil && len(options.SegmentSizes) > 0 {
+		return raiseFirstSegment(hello, splitBySize(hello, options.SegmentSizes, minSize, clamps), minFirst, len(hello), clamps)
+	}
+	minSplit, maxSplit := 32, 64
+	if options != nil {
+		if options.RandomSplitMin > 0 {
+			minSplit = options.RandomSplitMin
+		}
+		if options.RandomSplitMax > 0 {
+			maxSplit = options.RandomSplitMax
+		}
+		if maxSplit < minSplit {
+			maxSplit = minSplit
+		}
 	}
-	const (
-		MIN_SPLIT int = 32
-		MAX_SPLIT int = 64
-	)
 
-	// Random number in the range [MIN_SPLIT, MAX_SPLIT]
-	s := MIN_SPLIT + rand.Intn(MAX_SPLIT+1-MIN_SPLIT)
+	// Random number in the range [minSplit, maxSplit]
+	s := minSplit + splitRand.Intn(maxSplit+1-minSplit)
 	limit := len(hello) / 2
 	if s > limit {
 		s = limit
+		clamps.add(SplitClampHalfLength)
+	}
+	if s < minSize {
+		clamps.add(SplitClampMinSegment)
+		if len(hello) < 2*minSize {
+			// Both segments can't reach the minimum.
+			s = len(hello)
+		} else {
+			s = minSize
+		}
 	}
-	return hello[:s], hello[s:]
+	return raiseFirstSegment(hello, [][]byte{hello[:s], hello[s:]}, minFirst, len(hello), clamps)
+}
+
+// raiseFirstSegment extends the first of `segments`, which reassemble `hello`,
+// to at least `floor` bytes, but no more than `limit`.  Segments that end
+// before the new boundary are merged into the first.  Like splitHello, it
+// returns at least two segments.  If the first segment is raised, that is
+// added to `clamps`.
+func raiseFirstSegment(hello []byte, segments [][]byte, floor, limit int, clamps *splitClamps) [][]byte {
+	if floor > limit {
+		floor = limit
+	}
+	if len(segments[0]) >= floor {
+		return segments
+	}
+	clamps.add(SplitClampMinFirst)
+	raised := [][]byte{hello[:floor]}
+	end := 0
+	for _, segment := range segments {
+		start := end
+		end += len(segment)
+		if end <= floor {
+			continue
+		}
+		if start < floor {
+			start = floor
+		}
+		raised = append(raised, hello[start:end])
+	}
+	if len(raised) == 1 {
+		raised = append(raised, hello[floor:])
+	}
+	return raised
+}
+
+// splitBySize cuts `hello` into segments of the target `sizes`, followed by
+// a segment containing the remainder.  Targets that are not positive are
+// skipped, and targets below `minSize` are raised to it.  A target is dropped,
+// along with the rest, if it would leave a remainder shorter than `minSize`.
+// If the hello runs out before the targets do, the last segment is shorter
+// than its target.  Each of these adjustments is added to `clamps`.
+func splitBySize(hello []byte, sizes []int, minSize int, clamps *splitClamps) [][]byte {
+	var segments [][]byte
+	for _, size := range sizes {
+		if size <= 0 {
+			continue
+		}
+		if size < minSize {
+			size = minSize
+			clamps.add(SplitClampMinSegment)
+		}
+		if size >= len(hello) {
+			clamps.add(SplitClampShortHello)
+			break
+		}
+		if len(hello)-size < minSize {
+			clamps.add(SplitClampMinSegment)
+			break
+		}
+		segments = append(segments, hello[:size])
+		hello = hello[size:]
+	}
+	segments = append(segments, hello)
+	if len(segments) == 1 {
+		// Nothing was split off.  Preserve the two-segment invariant.
+		segments = append(segments, hello[len(hello):])
+	}
+	return segments
+}
+
+// isClientHello reports whether `b` begins with a TLS handshake record
+// containing a ClientHello.
+func isClientHello(b []byte) bool {
+	const (
+		recordTypeHandshake = 0x16
+		typeClientHello     = 0x01
+	)
+	// Record type, version (3, x), length, then the handshake message type.
+	return len(b) > 5 && b[0] == recordTypeHandshake && b[1] == 3 && b[5] == typeClientHello
+}
+
+// writeHello splits `hello` and writes it to the current connection, and
+// returns the number of bytes of `hello` that were written.  With
+// HelloSplitTLSRecord, the record layer is rewritten, so a failed write
+// reports that nothing was written, and the whole hello is replayed.  The
+// caller must hold r.mutex.
+func (r *retrier) writeHello(hello []byte) (int, error) {
+	segments, rewritten := r.helloSegments(hello)
+	n, err := writeSegments(r.conn, segments, r.options.ForceSeparatePackets)
+	if rewritten {
+		if err != nil {
+			return 0, err
+		}
+		return len(hello), nil
+	}
+	return n, err
+}
+
+// helloSegments returns the segments to write for `hello`.  `rewritten` is
+// true if the segments are rewritten TLS records, rather than slices of
+// `hello`.  The caller must hold r.mutex.
+func (r *retrier) helloSegments(hello []byte) (segments [][]byte, rewritten bool) {
+	segments = r.segments(hello)
+	if r.peek.strategy == HelloSplitTLSRecord {
+		if records := fragmentRecord(hello, len(segments[0])); records != nil {
+			return records, true
+		}
+	}
+	return segments, false
+}
+
+// writeSegments writes each segment to `conn` in turn, and returns the total
+// number of bytes written.  Each segment is written in full, even if `conn`
+// accepts it in several short writes, before the next one begins.  If `separate` is true and `conn` is a socket that
+// supports corking, each segment is corked while it is written and then
+// flushed.
+func writeSegments(conn io.Writer, segments [][]byte, separate bool) (int, error) {
+	var raw syscall.RawConn
+	if s, ok := conn.(syscall.Conn); ok && separate && len(segments) > 1 {
+		raw, _ = s.SyscallConn()
+	}
+	n := 0
+	for _, segment := range segments {
+		corked := raw != nil && cork(raw, true)
+		m, err := writeFull(conn, segment)
+		if corked {
+			cork(raw, false)
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writeFull writes all of `b` to `conn`, continuing after short writes.
+func writeFull(conn io.Writer, b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := conn.Write(b[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// cork sets or clears TCP_CORK on `raw`, and reports whether it succeeded.
+func cork(raw syscall.RawConn, on bool) bool {
+	var err error
+	if cerr := raw.Control(func(fd uintptr) {
+		err = setCork(int(fd), on)
+	}); cerr != nil {
+		return false
+	}
+	return err == nil
 }
 
 // Write-related functions
@@ -239,62 +944,138 @@ func (r *retrier) Write(b []byte) (int, error) {
 		var err error
 		attempted := false
 		r.mutex.Lock()
+		if max := r.options.MaxHelloSize; max > 0 && !r.retryCompleted() && len(r.hello)+len(b) > max {
+			// The hello is too large to buffer, so it can't be replayed.  Write
+			// `b` to the final socket below.
+			r.stats.NoRetry = NoRetryHelloTooLarge
+			r.finalize()
+		}
+		if !r.retryCompleted() && r.stats.SNI == "" {
+			// Peek at the hello, including `b`, until the SNI is found.
+			r.peek = peekHello(append(r.hello[:len(r.hello):len(r.hello)], b...), r.options.HostStrategies)
+			r.stats.SNI = r.peek.sni
+			if r.peek.strategy == HelloBlock {
+				r.stats.NoRetry = NoRetryBlocked
+				r.finalize()
+				r.conn.Close()
+				r.unlock()
+				return 0, ErrBlocked
+			}
+		}
 		if !r.retryCompleted() {
-			n, err = r.conn.Write(b)
+			r.armWriteDeadline()
+			if r.firstWrite.IsZero() {
+				r.firstWrite = time.Now()
+			}
+			if r.options.SplitClientHello && len(r.hello) == 0 && isClientHello(b) {
+				r.stats.SplitWarning = r.peek.splitWarning(b)
+				n, err = r.writeHello(b)
+			} else {
+				n, err = r.conn.Write(b)
+			}
 			attempted = true
 			r.hello = append(r.hello, b[:n]...)
 
 			r.stats.Chunks++
 			r.stats.Bytes = int32(len(r.hello))
-			if r.stats.SNI == "" {
-				r.stats.SNI, _ = getsni.GetSNI(r.hello)
-			}
 
 			// We require a response or another write within the specified timeout.
-			r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+			r.retryDeadline = time.Now().Add(r.timeout)
+			r.applyReadDeadline()
 		}
-		r.mutex.Unlock()
+		r.unlock()
 		if attempted {
 			if err == nil {
 				return n, nil
 			}
-			// A write error occurred on the provisional socket.  This should be handled
-			// by the retry procedure.  Block until we have a final socket (which will
-			// already have replayed b[:n]), and retry.
-			<-r.retryCompleteFlag
+			// A write error occurred on the provisional socket.  If Read hasn't
+			// already retried, retry here, so that callers that never read don't
+			// block forever.  Either way, the final socket has already replayed
+			// b[:n], so only the rest of `b` is written to it.
 			r.mutex.Lock()
-			r.mutex.Unlock()
-			m, err := r.conn.Write(b[n:])
+			if !r.retryCompleted() {
+				r.recordFailure(err)
+				r.reconnect(false)
+				r.finalize()
+			}
+			r.unlock()
+			m, err := r.writeFinal(b[n:])
 			return n + m, err
 		}
 	}
 
+	return r.writeFinal(b)
+}
+
+// writeFinal writes `b` to the final socket, after the retry decision.
+func (r *retrier) writeFinal(b []byte) (int, error) {
+	if r.options.WriteTimeout > 0 {
+		r.mutex.Lock()
+		r.armWriteDeadline()
+		r.mutex.Unlock()
+	}
 	// retryCompleted() is true, so r.conn is final and doesn't need locking.
 	return r.conn.Write(b)
 }
 
-// Copy one buffer from src to dst, using dst.Write.
+// armWriteDeadline sets the write deadline of the current socket for a write
+// that starts now: the caller's deadline, or the write timeout if that is
+// sooner.  The caller must hold r.mutex.
+func (r *retrier) armWriteDeadline() {
+	if r.options.WriteTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(r.options.WriteTimeout)
+	if !r.writeDeadline.IsZero() && r.writeDeadline.Before(deadline) {
+		deadline = r.writeDeadline
+	}
+	r.conn.SetWriteDeadline(deadline)
+}
+
+// Copy one buffer from src to dst, using dst.Write.  Data returned along with
+// a read error is written before the error is returned.
 func copyOnce(dst io.Writer, src io.Reader) (int64, error) {
 	// This buffer is large enough to hold any ordinary first write
 	// without introducing extra splitting.
 	buf := make([]byte, 2048)
 	n, err := src.Read(buf)
-	if err != nil {
-		return 0, err
+	if n > 0 {
+		var werr error
+		n, werr = dst.Write(buf[:n])
+		if werr != nil {
+			err = werr
+		}
 	}
-	n, err = dst.Write(buf[:n])
 	return int64(n), err
 }
 
+// ReadFrom copies data from `reader` until EOF or an error.  Until the retry
+// decision is made, data is copied one buffer at a time using Write, so each
+// buffer is recorded for replay.  The retry timeout is armed by each of these
+// writes, not by ReadFrom itself: while `reader` has not yet produced the
+// hello, nothing has been sent that could be blocked, so there is nothing to
+// time out.  If the server sends data first, the retry decision is made by
+// Read, and the next buffer from `reader` is forwarded without replay.
 func (r *retrier) ReadFrom(reader io.Reader) (bytes int64, err error) {
 	for !r.retryCompleted() {
-		if bytes, err = copyOnce(r, reader); err != nil {
+		var n int64
+		n, err = copyOnce(r, reader)
+		bytes += n
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
 			return
 		}
 	}
 
 	var b int64
-	b, err = r.conn.ReadFrom(reader)
+	if r.options.WriteTimeout > 0 {
+		// Copy through Write, so that each write is bounded by the timeout.
+		b, err = io.Copy(struct{ io.Writer }{r}, reader)
+	} else {
+		b, err = r.conn.ReadFrom(reader)
+	}
 	bytes += b
 	return
 }
@@ -328,17 +1109,24 @@ func (r *retrier) RemoteAddr() net.Addr {
 	return r.addr
 }
 
+// SyscallConn provides access to the current underlying socket.  Like
+// LocalAddr, the result may change as a result of a retry.
+func (r *retrier) SyscallConn() (syscall.RawConn, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sc, ok := r.conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("socket does not support SyscallConn")
+	}
+	return sc.SyscallConn()
+}
+
 func (r *retrier) SetReadDeadline(t time.Time) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.readDeadline = t
-	// Don't enforce read deadlines until after the retry
-	// is complete.  Retry relies on setting its own read
-	// deadline, and we don't want this to interfere.
-	if r.retryCompleted() {
-		return r.conn.SetReadDeadline(t)
-	}
-	return nil
+	// Until the retry decision is made, the retry deadline also applies.
+	return r.applyReadDeadline()
 }
 
 func (r *retrier) SetWriteDeadline(t time.Time) error {
@@ -16,8 +16,16 @@ package split
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -32,6 +40,10 @@ type setup struct {
 }
 
 func makeSetup(t *testing.T) *setup {
+	return makeSetupWithOptions(t, nil)
+}
+
+func makeSetupWithOptions(t *testing.T, options *RetryOptions) *setup {
 	addr, err := net.ResolveTCPAddr("tcp", ":0")
 	if err != nil {
 		t.Error(err)
@@ -46,7 +58,7 @@ func makeSetup(t *testing.T) *setup {
 		t.Error("Server isn't TCP?")
 	}
 	var stats RetryStats
-	clientSide, err := DialWithSplitRetry(&net.Dialer{}, serverAddr, &stats)
+	clientSide, err := DialWithSplitRetryOptions(&net.Dialer{}, serverAddr, options, &stats)
 	if err != nil {
 		t.Error(err)
 	}
@@ -233,6 +245,28 @@ func TestTimeoutRetry(t *testing.T) {
 	s.checkStats(BUFSIZE, 1, true)
 }
 
+func TestRetryOverhead(t *testing.T) {
+	s := makeSetup(t)
+	s.sendUp()
+	s.sendDown()
+	s.close()
+	if s.stats.Overhead != 0 {
+		t.Errorf("No overhead without a retry: %d", s.stats.Overhead)
+	}
+
+	s = makeSetup(t)
+	s.sendUp()
+	delay := 100 * time.Millisecond
+	time.Sleep(delay)
+	s.serverSide.Close()
+	s.confirmRetry()
+	s.close()
+	// The overhead includes the delay before the failure and the redial.
+	if ms := s.stats.Overhead; ms < int32(delay/time.Millisecond) || ms > 1000 {
+		t.Errorf("Implausible retry overhead: %d ms", ms)
+	}
+}
+
 func TestTwoWriteRetry(t *testing.T) {
 	s := makeSetup(t)
 	s.sendUp()
@@ -305,3 +339,1161 @@ func TestIdle(t *testing.T) {
 	s.close()
 	s.checkNoSplit()
 }
+
+func TestSplitBySize(t *testing.T) {
+	hello := makeBuffer()
+	check := func(sizes []int, expected []int) {
+		segments := splitHello(hello, &RetryOptions{SegmentSizes: sizes}, nil)
+		if len(segments) != len(expected) {
+			t.Fatalf("%v: expected %d segments, got %d", sizes, len(expected), len(segments))
+		}
+		var joined []byte
+		for i, segment := range segments {
+			if len(segment) != expected[i] {
+				t.Errorf("%v: segment %d has length %d, expected %d", sizes, i, len(segment), expected[i])
+			}
+			joined = append(joined, segment...)
+		}
+		if !bytes.Equal(joined, hello) {
+			t.Errorf("%v: segments don't reassemble the hello", sizes)
+		}
+	}
+	check([]int{10}, []int{10, BUFSIZE - 10})
+	check([]int{10, 100}, []int{10, 100, BUFSIZE - 110})
+	check([]int{0, 20}, []int{20, BUFSIZE - 20})
+	// Targets that don't fit in the hello are dropped.
+	check([]int{200, 100}, []int{200, BUFSIZE - 200})
+	check([]int{BUFSIZE}, []int{BUFSIZE, 0})
+}
+
+// Returns the lengths of the segments that `options` produces for `hello`.
+func segmentLengths(hello []byte, options *RetryOptions) []int {
+	var lengths []int
+	for _, segment := range splitHello(hello, options, nil) {
+		lengths = append(lengths, len(segment))
+	}
+	return lengths
+}
+
+func TestMinSegmentSize(t *testing.T) {
+	ones := []int{1, 1, 1, 1, 1, 1, 1, 1}
+	hello := make([]byte, 10)
+	// Without a minimum, a tiny hello is cut into 1-byte segments.
+	if got := segmentLengths(hello, &RetryOptions{SegmentSizes: ones}); len(got) != 9 {
+		t.Errorf("Expected 9 segments, got %v", got)
+	}
+	for _, tc := range []struct {
+		min  int
+		want []int
+	}{
+		{3, []int{3, 3, 4}},
+		{4, []int{4, 6}},
+		{5, []int{5, 5}},
+		// The hello is too short for two segments.
+		{6, []int{10, 0}},
+	} {
+		got := segmentLengths(hello, &RetryOptions{SegmentSizes: ones, MinSegmentSize: tc.min})
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("Minimum %d: expected %v, got %v", tc.min, tc.want, got)
+		}
+	}
+
+	// Random splits also respect the minimum.
+	for n := 1; n < 200; n++ {
+		got := segmentLengths(make([]byte, n), &RetryOptions{MinSegmentSize: 40})
+		if n < 80 {
+			if got[0] != n {
+				t.Errorf("%d-byte hello should not be split: %v", n, got)
+			}
+		} else if got[0] < 40 || got[1] < 40 {
+			t.Errorf("%d-byte hello was split into %v", n, got)
+		}
+	}
+}
+
+func TestMinFirstSegment(t *testing.T) {
+	for _, n := range []int{1, 10, 49, 50, 51, 100, 1000} {
+		hello := make([]byte, n)
+		for _, options := range []*RetryOptions{
+			{MinFirstSegment: 50},
+			{MinFirstSegment: 50, SegmentSizes: []int{5, 10, 20}},
+		} {
+			got := segmentLengths(hello, options)
+			floor := 50
+			if n < floor {
+				floor = n
+			}
+			if len(got) < 2 || got[0] < floor {
+				t.Errorf("%d bytes, %+v: first segment is too short: %v", n, options, got)
+			}
+			total := 0
+			for _, l := range got {
+				total += l
+			}
+			if total != n {
+				t.Errorf("%d bytes: segments %v don't reassemble the hello", n, got)
+			}
+		}
+	}
+	// Boundaries past the floor are kept.
+	got := segmentLengths(make([]byte, 100), &RetryOptions{MinFirstSegment: 12, SegmentSizes: []int{5, 10, 20}})
+	if fmt.Sprint(got) != "[12 3 20 65]" {
+		t.Errorf("Unexpected segments: %v", got)
+	}
+}
+
+func TestSplitClamp(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		size    int
+		options *RetryOptions
+		want    []string
+	}{
+		{"unclamped", 200, &RetryOptions{}, nil},
+		{"half length", 40, &RetryOptions{}, []string{SplitClampHalfLength}},
+		{"random below minimum", 200, &RetryOptions{MinSegmentSize: 80}, []string{SplitClampMinSegment}},
+		{"too short for minimum", 60, &RetryOptions{MinSegmentSize: 40}, []string{SplitClampHalfLength, SplitClampMinSegment}},
+		{"first segment raised", 200, &RetryOptions{MinFirstSegment: 100}, []string{SplitClampMinFirst}},
+		{"sizes fit", 200, &RetryOptions{SegmentSizes: []int{50, 100}}, nil},
+		{"short hello", 120, &RetryOptions{SegmentSizes: []int{50, 100, 200}}, []string{SplitClampShortHello}},
+		{"size raised", 100, &RetryOptions{SegmentSizes: []int{10}, MinSegmentSize: 20}, []string{SplitClampMinSegment}},
+		{"size dropped", 100, &RetryOptions{SegmentSizes: []int{90}, MinSegmentSize: 20}, []string{SplitClampMinSegment}},
+		{"sizes merged", 100, &RetryOptions{SegmentSizes: []int{5, 10}, MinFirstSegment: 30}, []string{SplitClampMinFirst}},
+	} {
+		var clamps splitClamps
+		splitHello(make([]byte, tc.size), tc.options, &clamps)
+		if fmt.Sprint([]string(clamps)) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, clamps)
+		}
+	}
+
+	// The SNI strategy caps the first segment at the end of the SNI.
+	hello := captureClientHello(t, "www.example")
+	peek := peekHello(hello, map[string]string{"www.example": HelloSplitSNI})
+	var clamps splitClamps
+	peek.segments(hello, &RetryOptions{MinFirstSegment: len(hello)}, &clamps)
+	if fmt.Sprint([]string(clamps)) != fmt.Sprint([]string{SplitClampMinFirst}) {
+		t.Errorf("SNI split: unexpected clamps %v", clamps)
+	}
+}
+
+func TestSplitClampStats(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{MinFirstSegment: 100})
+	s.sendUp()
+	s.serverSide.Close()
+	s.confirmRetry()
+	s.close()
+	if s.stats.Split != 100 || s.stats.SplitClamp != SplitClampMinFirst {
+		t.Errorf("Expected a raised split, got %d, %q", s.stats.Split, s.stats.SplitClamp)
+	}
+
+	s = makeSetup(t)
+	s.sendUp()
+	s.serverSide.Close()
+	s.confirmRetry()
+	s.close()
+	if s.stats.SplitClamp != "" {
+		t.Errorf("A default split of a long hello is not clamped: %q", s.stats.SplitClamp)
+	}
+}
+
+func TestSegmentSizesRetry(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{SegmentSizes: []int{5, 50}})
+	s.sendUp()
+	s.serverSide.Close()
+	s.confirmRetry()
+	s.sendDown()
+	s.close()
+	if s.stats.Split != 5 {
+		t.Errorf("Unexpected split: %d", s.stats.Split)
+	}
+}
+
+// failingConn is a connection whose writes always fail.
+type failingConn struct {
+	DuplexConn
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	return 0, errors.New("injected write failure")
+}
+
+func (c *failingConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.DuplexConn.Close()
+}
+
+func (c *failingConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// shortConn is a connection that writes at most `max` bytes per call, and
+// records each write.
+type shortConn struct {
+	DuplexConn
+	max    int
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *shortConn) Write(b []byte) (int, error) {
+	if len(b) > c.max {
+		b = b[:c.max]
+	}
+	n, err := c.DuplexConn.Write(b)
+	c.mu.Lock()
+	c.writes = append(c.writes, append([]byte{}, b[:n]...))
+	c.mu.Unlock()
+	return n, err
+}
+
+// bufferConn is a connection whose writes are stored in `buf`.
+type bufferConn struct {
+	DuplexConn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func TestShortWriteSegments(t *testing.T) {
+	dest := &bufferConn{}
+	c := &shortConn{DuplexConn: dest, max: 3}
+	n, err := writeSegments(c, [][]byte{[]byte("abcdefg"), []byte("hijk")}, false)
+	if err != nil || n != 11 || dest.buf.String() != "abcdefghijk" {
+		t.Fatalf("Got %d, %v, %q", n, err, dest.buf.String())
+	}
+	var lengths []int
+	for _, w := range c.writes {
+		lengths = append(lengths, len(w))
+	}
+	// The second segment starts in a new write.
+	if !reflect.DeepEqual(lengths, []int{3, 3, 1, 3, 1}) {
+		t.Errorf("Unexpected writes: %v", lengths)
+	}
+}
+
+func TestShortWriteReplay(t *testing.T) {
+	s := makeSetup(t)
+	r := s.clientSide.(*retrier)
+	var replacement *shortConn
+	r.dial = func() (DuplexConn, error) {
+		conn, err := r.redial()
+		if err != nil {
+			return nil, err
+		}
+		replacement = &shortConn{DuplexConn: conn, max: 10}
+		return replacement, nil
+	}
+	s.sendUp()
+	s.serverSide.Close()
+	// confirmRetry checks that the whole hello is replayed in order.
+	s.confirmRetry()
+	s.close()
+	s.checkStats(BUFSIZE, 1, false)
+
+	var replayed []byte
+	boundary := false
+	for _, w := range replacement.writes {
+		replayed = append(replayed, w...)
+		boundary = boundary || len(replayed) == int(s.stats.Split)
+	}
+	if !bytes.Equal(replayed, s.serverReceived) {
+		t.Error("Replay was corrupted")
+	}
+	if !boundary {
+		t.Errorf("The split at %d should end a write", s.stats.Split)
+	}
+}
+
+func TestFailedReplay(t *testing.T) {
+	before := runtime.NumGoroutine()
+	s := makeSetup(t)
+	r := s.clientSide.(*retrier)
+	var replacement *failingConn
+	r.dial = func() (DuplexConn, error) {
+		conn, err := r.redial()
+		if err != nil {
+			return nil, err
+		}
+		replacement = &failingConn{DuplexConn: conn}
+		return replacement, nil
+	}
+	s.sendUp()
+	s.serverSide.Close()
+
+	// Block a second writer until the retry completes.
+	writeDone := make(chan error)
+	go func() {
+		// Wait for the provisional socket to fail.
+		time.Sleep(100 * time.Millisecond)
+		_, err := s.clientSide.Write([]byte{1, 2, 3})
+		writeDone <- err
+	}()
+
+	n, err := s.clientSide.Read(make([]byte, 1))
+	if n != 0 || err == nil {
+		t.Error("Read should fail when the replay fails")
+	}
+	if replacement == nil || !replacement.isClosed() {
+		t.Error("Replacement socket should be closed after a failed replay")
+	}
+	select {
+	case err := <-writeDone:
+		if err == nil {
+			t.Error("Write should fail after a failed replay")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Writer is deadlocked")
+	}
+
+	// The server should see the replacement socket close.
+	serverSide, err := s.server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverSide.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF on the replacement socket, got %v", err)
+	}
+	serverSide.Close()
+	s.clientSide.Close()
+	s.close()
+
+	time.Sleep(100 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Goroutine leak: %d before, %d after", before, after)
+	}
+}
+
+func TestZeroLengthRead(t *testing.T) {
+	s := makeSetup(t)
+	s.sendUp()
+	for _, buf := range [][]byte{nil, {}} {
+		n, err := s.clientSide.Read(buf)
+		if n != 0 || err != nil {
+			t.Errorf("Zero-length read returned %d, %v", n, err)
+		}
+	}
+	if s.clientSide.(*retrier).retryCompleted() {
+		t.Error("Zero-length read should not finalize the retry")
+	}
+	// A retry is still possible.
+	s.serverSide.Close()
+	s.confirmRetry()
+	s.sendDown()
+	s.close()
+	s.checkStats(BUFSIZE, 1, false)
+}
+
+func TestOneByteRead(t *testing.T) {
+	s := makeSetup(t)
+	s.sendUp()
+	s.serverSide.Write([]byte{1, 2})
+	buf := make([]byte, 1)
+	if n, err := s.clientSide.Read(buf); n != 1 || err != nil || buf[0] != 1 {
+		t.Errorf("First read returned %d, %v", n, err)
+	}
+	if !s.clientSide.(*retrier).retryCompleted() {
+		t.Error("One-byte read should finalize the retry")
+	}
+	if n, err := s.clientSide.Read(buf); n != 1 || err != nil || buf[0] != 2 {
+		t.Errorf("Second read returned %d, %v", n, err)
+	}
+	s.close()
+	s.checkNoSplit()
+}
+
+func TestOneByteReadRetry(t *testing.T) {
+	s := makeSetup(t)
+	s.sendUp()
+	s.serverSide.Close()
+
+	done := make(chan []byte)
+	go func() {
+		var received []byte
+		buf := make([]byte, 1)
+		for len(received) < len(s.serverReceived) {
+			n, err := s.clientSide.Read(buf)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			received = append(received, buf[:n]...)
+		}
+		done <- received
+	}()
+
+	var err error
+	if s.serverSide, err = s.server.AcceptTCP(); err != nil {
+		t.Fatal(err)
+	}
+	replay := make([]byte, len(s.serverReceived))
+	if _, err = io.ReadFull(s.serverSide, replay); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(replay, s.serverReceived) {
+		t.Error("Replay was corrupted")
+	}
+	s.serverSide.Write(replay)
+	if received := <-done; !bytes.Equal(received, replay) {
+		t.Error("Echo was corrupted")
+	}
+	s.close()
+	s.checkStats(BUFSIZE, 1, false)
+}
+
+func TestExperimentTag(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{ExperimentTag: "split-arm"})
+	s.sendUp()
+	s.serverSide.Close()
+	s.confirmRetry()
+	s.close()
+	if s.stats.ExperimentTag != "split-arm" {
+		t.Errorf("Unexpected tag: %q", s.stats.ExperimentTag)
+	}
+
+	s = makeSetup(t)
+	s.sendUp()
+	s.sendDown()
+	s.close()
+	if s.stats.ExperimentTag != "" {
+		t.Errorf("Default tag should be empty: %q", s.stats.ExperimentTag)
+	}
+}
+
+// slowReader returns `data` after `delay`, and then blocks until `done` is closed.
+type slowReader struct {
+	delay time.Duration
+	data  []byte
+	done  chan struct{}
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		<-r.done
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReadFromSlowHello(t *testing.T) {
+	s := makeSetup(t)
+	reader := &slowReader{2 * time.Second, makeBuffer(), make(chan struct{})}
+	uploaded := make(chan int64)
+	go func() {
+		n, err := s.clientSide.ReadFrom(reader)
+		if err != nil {
+			t.Error(err)
+		}
+		uploaded <- n
+	}()
+	// The delay before the hello is longer than the retry timeout, but no
+	// retry occurs because nothing has been sent.
+	hello := make([]byte, BUFSIZE)
+	if _, err := io.ReadFull(s.serverSide, hello); err != nil {
+		t.Fatal(err)
+	}
+	s.serverReceived = hello
+	// The timeout is armed once the hello is written, so the silent server
+	// triggers a retry.
+	s.confirmRetry()
+	close(reader.done)
+	if n := <-uploaded; n != BUFSIZE {
+		t.Errorf("Expected %d bytes, got %d", BUFSIZE, n)
+	}
+	s.close()
+	s.checkStats(BUFSIZE, 1, true)
+}
+
+func TestReadFromCountsHello(t *testing.T) {
+	s := makeSetup(t)
+	// Two reads of the hello, then EOF, all before the server responds.
+	reader := &slowReader{0, makeBuffer(), make(chan struct{})}
+	close(reader.done)
+	small := io.LimitReader(reader, BUFSIZE/2)
+	n, err := s.clientSide.ReadFrom(io.MultiReader(small, reader))
+	if err != nil {
+		t.Error(err)
+	}
+	if n != BUFSIZE {
+		t.Errorf("Expected %d bytes, got %d", BUFSIZE, n)
+	}
+	s.close()
+}
+
+func TestPhase(t *testing.T) {
+	s := makeSetup(t)
+	r := s.clientSide.(*retrier)
+	var during string
+	r.dial = func() (DuplexConn, error) {
+		during = r.Phase()
+		return r.redial()
+	}
+	if p := r.Phase(); p != PhaseProvisional {
+		t.Errorf("Expected %s before the first read, got %s", PhaseProvisional, p)
+	}
+	s.sendUp()
+	s.serverSide.Close()
+	s.confirmRetry()
+	if during != PhaseRetrying {
+		t.Errorf("Expected %s during the retry, got %s", PhaseRetrying, during)
+	}
+	if p := r.Phase(); p != PhaseSettled {
+		t.Errorf("Expected %s after the retry, got %s", PhaseSettled, p)
+	}
+	s.sendDown()
+	s.close()
+}
+
+func TestPhaseWithoutRetry(t *testing.T) {
+	s := makeSetup(t)
+	r := s.clientSide.(*retrier)
+	s.sendUp()
+	s.sendDown()
+	if p := r.Phase(); p != PhaseSettled {
+		t.Errorf("Expected %s after the first read, got %s", PhaseSettled, p)
+	}
+	s.checkNoSplit()
+	s.close()
+}
+
+// fakeResolver resolves every name to `ips`, and records the names.
+type fakeResolver struct {
+	ips   []net.IPAddr
+	names []string
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.names = append(r.names, host)
+	return r.ips, nil
+}
+
+func TestDialWithResolver(t *testing.T) {
+	server, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	port := server.Addr().(*net.TCPAddr).Port
+	resolver := &fakeResolver{ips: []net.IPAddr{
+		// Nothing listens on this address, so the next address is tried.
+		{IP: net.IPv4(127, 0, 0, 2)},
+		{IP: net.IPv4(127, 0, 0, 1)},
+	}}
+	hostport := net.JoinHostPort("tunnel.invalid", strconv.Itoa(port))
+	conn, err := DialWithSplitRetryHost(&net.Dialer{}, hostport, resolver, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(resolver.names) != 1 || resolver.names[0] != "tunnel.invalid" {
+		t.Errorf("Resolver was not used: %v", resolver.names)
+	}
+	if addr := conn.(*retrier).addr; !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port != port {
+		t.Errorf("Connected to the wrong address: %v", addr)
+	}
+}
+
+// hungResolver blocks until the lookup is canceled.
+type hungResolver struct{}
+
+func (hungResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDialWithResolverTimeout(t *testing.T) {
+	done := make(chan error, 1)
+	go func() {
+		dialer := &net.Dialer{Timeout: 50 * time.Millisecond}
+		_, err := DialWithSplitRetryHost(dialer, "tunnel.invalid:443", hungResolver{}, nil, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The dialer's timeout should bound resolution")
+	}
+}
+
+func TestDialWithResolverServicePort(t *testing.T) {
+	resolver := &fakeResolver{}
+	// The lookup fails because there are no addresses, but the port is parsed.
+	DialWithSplitRetryHost(&net.Dialer{}, "tunnel.invalid:https", resolver, nil, nil)
+	if len(resolver.names) != 1 {
+		t.Error("A service name should be accepted as the port")
+	}
+}
+
+func TestDialWithResolverNoAddresses(t *testing.T) {
+	resolver := &fakeResolver{}
+	if _, err := DialWithSplitRetryHost(&net.Dialer{}, "tunnel.invalid:443", resolver, nil, nil); err == nil {
+		t.Error("Expected an error")
+	}
+	if _, err := DialWithSplitRetryHost(&net.Dialer{}, "tunnel.invalid", resolver, nil, nil); err == nil {
+		t.Error("Expected an error for a missing port")
+	}
+}
+
+func TestNoRetrySucceeded(t *testing.T) {
+	s := makeSetup(t)
+	if s.stats.NoRetry != "" {
+		t.Errorf("Reason should be empty before the decision: %s", s.stats.NoRetry)
+	}
+	s.sendUp()
+	s.sendDown()
+	s.close()
+	if s.stats.NoRetry != NoRetrySucceeded {
+		t.Errorf("Expected %s, got %q", NoRetrySucceeded, s.stats.NoRetry)
+	}
+}
+
+func TestNoRetryAfterRetry(t *testing.T) {
+	s := makeSetup(t)
+	s.sendUp()
+	s.serverSide.Close()
+	s.confirmRetry()
+	s.close()
+	if s.stats.NoRetry != "" {
+		t.Errorf("Reason should be empty after a retry: %s", s.stats.NoRetry)
+	}
+}
+
+func TestNoRetryHelloTooLarge(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{MaxHelloSize: BUFSIZE - 1})
+	s.sendUp()
+	if s.stats.NoRetry != NoRetryHelloTooLarge {
+		t.Errorf("Expected %s, got %q", NoRetryHelloTooLarge, s.stats.NoRetry)
+	}
+	if s.clientSide.(*retrier).Phase() != PhaseSettled {
+		t.Error("Retry decision should be final")
+	}
+	s.serverSide.Close()
+	// Without a retry, the server's close is reported to the reader.
+	if _, err := s.clientSide.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected an error from the closed socket")
+	}
+	s.checkNoSplit()
+	s.close()
+}
+
+func TestMaxHelloSizeAllowsRetry(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{MaxHelloSize: BUFSIZE})
+	s.sendUp()
+	s.serverSide.Close()
+	s.confirmRetry()
+	s.close()
+	s.checkStats(BUFSIZE, 1, false)
+}
+
+// recordingConn records the size of each write.
+type recordingConn struct {
+	DuplexConn
+	writes []int
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, len(b))
+	return c.DuplexConn.Write(b)
+}
+
+// Returns a first flight of `n` bytes that starts like a TLS ClientHello.
+func makeClientHello(n int) []byte {
+	hello := make([]byte, n)
+	copy(hello, []byte{0x16, 0x03, 0x01, byte((n - 5) >> 8), byte(n - 5), 0x01})
+	return hello
+}
+
+// Writes `hello` on a new retrier with `options`, and returns the sizes of the
+// writes on the provisional socket.
+func firstFlightWrites(t *testing.T, options *RetryOptions, hello []byte) []int {
+	s := makeSetupWithOptions(t, options)
+	defer s.close()
+	r := s.clientSide.(*retrier)
+	rec := &recordingConn{DuplexConn: r.conn}
+	r.conn = rec
+	if n, err := s.clientSide.Write(hello); err != nil || n != len(hello) {
+		t.Fatalf("Write failed: %d, %v", n, err)
+	}
+	buf := make([]byte, len(hello))
+	if _, err := io.ReadFull(s.serverSide, buf); err != nil || !bytes.Equal(buf, hello) {
+		t.Errorf("Server received the wrong data: %v", err)
+	}
+	return rec.writes
+}
+
+func TestSplitClientHello(t *testing.T) {
+	options := &RetryOptions{SplitClientHello: true, SegmentSizes: []int{10}}
+	if writes := firstFlightWrites(t, options, makeClientHello(100)); len(writes) != 2 || writes[0] != 10 || writes[1] != 90 {
+		t.Errorf("ClientHello should be split: %v", writes)
+	}
+	plain := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if writes := firstFlightWrites(t, options, plain); len(writes) != 1 {
+		t.Errorf("Plaintext should not be split: %v", writes)
+	}
+	// Without the option, nothing is split before a retry.
+	options.SplitClientHello = false
+	if writes := firstFlightWrites(t, options, makeClientHello(100)); len(writes) != 1 {
+		t.Errorf("ClientHello should not be split by default: %v", writes)
+	}
+}
+
+func TestIsClientHello(t *testing.T) {
+	if !isClientHello(makeClientHello(50)) {
+		t.Error("ClientHello not detected")
+	}
+	serverHello := makeClientHello(50)
+	serverHello[5] = 0x02
+	for _, b := range [][]byte{serverHello, makeClientHello(50)[:5], []byte("SSH-2.0-OpenSSH\r\n"), nil} {
+		if isClientHello(b) {
+			t.Errorf("%q is not a ClientHello", b)
+		}
+	}
+}
+
+// A retry before anything was written establishes a new connection without
+// writing to it, and still applies an earlier CloseWrite.
+func TestEmptyHelloRetry(t *testing.T) {
+	s := makeSetup(t)
+	r := s.clientSide.(*retrier)
+	var replacement *recordingConn
+	r.dial = func() (DuplexConn, error) {
+		conn, err := r.redial()
+		if err != nil {
+			return nil, err
+		}
+		replacement = &recordingConn{DuplexConn: conn}
+		return replacement, nil
+	}
+	s.clientSide.CloseWrite()
+	s.serverSide.Close()
+
+	readDone := make(chan []byte)
+	go func() {
+		b, err := ioutil.ReadAll(s.clientSide)
+		if err != nil {
+			t.Error(err)
+		}
+		readDone <- b
+	}()
+	serverSide, err := s.server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverSide.Close()
+	// The client's CloseWrite was transferred to the new socket.
+	if b, err := ioutil.ReadAll(serverSide); err != nil || len(b) != 0 {
+		t.Errorf("Server received %d bytes, %v", len(b), err)
+	}
+	serverSide.Write([]byte("reply"))
+	serverSide.CloseWrite()
+	if got := <-readDone; string(got) != "reply" {
+		t.Errorf("Client read %q", got)
+	}
+	if len(replacement.writes) != 0 {
+		t.Errorf("Spurious writes on the new socket: %v", replacement.writes)
+	}
+	if s.stats.Split != 0 || s.stats.Bytes != 0 || s.stats.Chunks != 0 || !s.stats.Retried {
+		t.Errorf("Unexpected stats: %+v", *s.stats)
+	}
+	s.clientSide.Close()
+	s.server.Close()
+}
+
+func TestHelloLen(t *testing.T) {
+	s := makeSetup(t)
+	r := s.clientSide.(*retrier)
+	for i, want := range []int{3, 7, 12} {
+		chunk := make([]byte, want-r.HelloLen())
+		if _, err := s.clientSide.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.HelloLen(); got != want {
+			t.Errorf("Write %d: HelloLen is %d, want %d", i, got, want)
+		}
+	}
+	if _, err := io.ReadFull(s.serverSide, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+	s.sendDown()
+	if got := r.HelloLen(); got != 0 {
+		t.Errorf("HelloLen should be cleared by the first read, got %d", got)
+	}
+	s.close()
+}
+
+// A caller that only writes still gets a retry when a write fails, instead of
+// blocking forever on a Read that never happens.
+func TestWriteOnlyRetry(t *testing.T) {
+	s := makeSetup(t)
+	hello := []byte("hello")
+	if _, err := s.clientSide.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s.serverSide, make([]byte, len(hello))); err != nil {
+		t.Fatal(err)
+	}
+	// Reset the provisional socket, so that the next write fails.
+	s.serverSide.SetLinger(0)
+	s.serverSide.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	writeDone := make(chan error)
+	go func() {
+		_, err := s.clientSide.Write([]byte(" world"))
+		writeDone <- err
+	}()
+	replacement, err := s.server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replacement.Close()
+	select {
+	case err := <-writeDone:
+		if err != nil {
+			t.Errorf("Write failed after retry: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Writer is deadlocked")
+	}
+	s.clientSide.CloseWrite()
+	if b, err := ioutil.ReadAll(replacement); err != nil || string(b) != "hello world" {
+		t.Errorf("Replacement received %q, %v", b, err)
+	}
+	if r := s.clientSide.(*retrier); r.Phase() != PhaseSettled {
+		t.Errorf("Unexpected phase %s", r.Phase())
+	}
+	s.clientSide.Close()
+	s.server.Close()
+}
+
+func isTimeout(err error) bool {
+	var neterr net.Error
+	return errors.As(err, &neterr) && neterr.Timeout()
+}
+
+// A caller deadline that is shorter than the retry timeout expires without
+// causing a retry, and retry detection continues afterwards.
+func TestCallerDeadlineShorter(t *testing.T) {
+	s := makeSetup(t)
+	r := s.clientSide.(*retrier)
+	r.timeout = 500 * time.Millisecond
+	s.sendUp()
+	start := time.Now()
+	s.clientSide.SetReadDeadline(start.Add(100 * time.Millisecond))
+	if _, err := s.clientSide.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("Expected the caller's timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("The caller's deadline expired after %v", elapsed)
+	}
+	if r.retryCompleted() || s.stats.Retried {
+		t.Fatal("The caller's deadline should not cause a retry")
+	}
+
+	// Without a caller deadline, the retry timeout still applies.
+	s.clientSide.SetReadDeadline(time.Time{})
+	s.confirmRetry()
+	s.sendDown()
+	s.close()
+	s.checkStats(BUFSIZE, 1, true)
+}
+
+// A caller deadline that is longer than the retry timeout doesn't delay the
+// retry, and applies to the connection after the retry.
+func TestCallerDeadlineLonger(t *testing.T) {
+	s := makeSetup(t)
+	s.clientSide.(*retrier).timeout = 100 * time.Millisecond
+	deadline := time.Now().Add(time.Second)
+	s.clientSide.SetReadDeadline(deadline)
+	s.sendUp()
+	s.confirmRetry()
+	if time.Now().After(deadline) {
+		t.Fatal("The retry should not wait for the caller's deadline")
+	}
+	s.checkStats(BUFSIZE, 1, true)
+
+	// The server is silent, so the next read ends at the caller's deadline.
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.clientSide.Read(make([]byte, 1))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if !isTimeout(err) {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+		if early := deadline.Sub(time.Now()); early > 50*time.Millisecond {
+			t.Errorf("Read timed out %v before the caller's deadline", early)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("The caller's deadline was not applied after the retry")
+		s.clientSide.Close()
+	}
+	s.close()
+}
+
+// endlessReader returns zeros forever.
+type endlessReader struct{}
+
+func (endlessReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// Writes to a server that has stopped reading fail once the write timeout
+// expires, through both Write and ReadFrom.
+func TestWriteTimeout(t *testing.T) {
+	for _, readFrom := range []bool{false, true} {
+		s := makeSetupWithOptions(t, &RetryOptions{WriteTimeout: 100 * time.Millisecond})
+		s.sendUp()
+		s.sendDown()
+		// The server never reads again, so writes block once the buffers fill.
+		done := make(chan error, 1)
+		go func() {
+			if readFrom {
+				_, err := s.clientSide.ReadFrom(endlessReader{})
+				done <- err
+				return
+			}
+			buf := make([]byte, 1<<16)
+			for {
+				if _, err := s.clientSide.Write(buf); err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+		select {
+		case err := <-done:
+			if !isTimeout(err) {
+				t.Errorf("Expected a timeout (ReadFrom: %t), got %v", readFrom, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("The write never timed out (ReadFrom: %t)", readFrom)
+		}
+		s.close()
+	}
+}
+
+// A caller's deadline that is earlier than the write timeout still applies.
+func TestWriteTimeoutCallerDeadline(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{WriteTimeout: time.Hour})
+	defer s.close()
+	s.sendUp()
+	s.sendDown()
+	s.sendUp()
+	s.clientSide.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := s.clientSide.Write([]byte{1}); !isTimeout(err) {
+		t.Errorf("The caller's deadline should apply: %v", err)
+	}
+}
+
+func TestRandomSplitRange(t *testing.T) {
+	hello := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		if s := segmentLengths(hello, &RetryOptions{RandomSplitMin: 100, RandomSplitMax: 120})[0]; s < 100 || s > 120 {
+			t.Errorf("Split %d out of range", s)
+		}
+	}
+	// A minimum above the default maximum, or an inverted range, is a fixed offset.
+	if s := segmentLengths(hello, &RetryOptions{RandomSplitMin: 80})[0]; s != 80 {
+		t.Errorf("Expected split 80, got %d", s)
+	}
+	if s := segmentLengths(hello, &RetryOptions{RandomSplitMin: 20, RandomSplitMax: 10})[0]; s != 20 {
+		t.Errorf("Expected split 20, got %d", s)
+	}
+	// The offset is still capped at half of the hello.
+	if s := segmentLengths(make([]byte, 100), &RetryOptions{RandomSplitMin: 80})[0]; s != 50 {
+		t.Errorf("Expected split 50, got %d", s)
+	}
+}
+
+func TestTimeoutMultiplier(t *testing.T) {
+	before := time.Now()
+	after := before.Add(100 * time.Millisecond)
+	if d := timeout(before, after, 0); d != 1400*time.Millisecond {
+		t.Errorf("Unexpected default timeout: %v", d)
+	}
+	if d := timeout(before, after, 2.5); d != 3500*time.Millisecond {
+		t.Errorf("Unexpected scaled timeout: %v", d)
+	}
+
+	s := makeSetupWithOptions(t, &RetryOptions{TimeoutMultiplier: 3})
+	defer s.close()
+	if d := s.clientSide.(*retrier).timeout; d < 3600*time.Millisecond {
+		t.Errorf("The multiplier should apply to the connection: %v", d)
+	}
+}
+
+// Accepts a replay of `hello` on `server`, and closes it without replying.
+func rejectReplay(t *testing.T, server *net.TCPListener, hello []byte) {
+	conn, err := server.AcceptTCP()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(hello))); err != nil {
+		t.Error(err)
+	}
+	conn.Close()
+}
+
+// Accepts a replay of `hello` on `server`, and echoes it.
+func acceptReplay(t *testing.T, server *net.TCPListener, hello []byte) *net.TCPConn {
+	conn, err := server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(hello))
+	if _, err := io.ReadFull(conn, echo); err != nil || !bytes.Equal(echo, hello) {
+		t.Fatalf("Replay was corrupted: %v", err)
+	}
+	conn.Write(echo)
+	return conn
+}
+
+func TestMaxRetries(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{MaxRetries: 3})
+	defer s.close()
+	s.sendUp()
+	s.serverSide.Close()
+	reply := make(chan error)
+	go func() {
+		_, err := io.ReadFull(s.clientSide, make([]byte, len(s.serverReceived)))
+		reply <- err
+	}()
+	// The first replay also fails, so the hello is replayed again.
+	rejectReplay(t, s.server, s.serverReceived)
+	s.serverSide = acceptReplay(t, s.server, s.serverReceived)
+	if err := <-reply; err != nil {
+		t.Fatal(err)
+	}
+	if s.stats.Retries != 2 {
+		t.Errorf("Expected 2 retries, got %d", s.stats.Retries)
+	}
+	if s.clientSide.(*retrier).Phase() != PhaseSettled {
+		t.Error("Retry decision should be final")
+	}
+	s.sendDown()
+}
+
+func TestMaxRetriesExhausted(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{MaxRetries: 2})
+	defer s.close()
+	s.sendUp()
+	s.serverSide.Close()
+	done := make(chan struct{})
+	go func() {
+		rejectReplay(t, s.server, s.serverReceived)
+		rejectReplay(t, s.server, s.serverReceived)
+		close(done)
+	}()
+	if _, err := s.clientSide.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected an error after the last retry")
+	}
+	<-done
+	if s.stats.Retries != 2 {
+		t.Errorf("Expected 2 retries, got %d", s.stats.Retries)
+	}
+}
+
+type retryRecorder chan *RetryStats
+
+func (r retryRecorder) OnRetryComplete(stats *RetryStats) {
+	r <- stats
+}
+
+func TestRetryListener(t *testing.T) {
+	retries := make(retryRecorder, 1)
+	s := makeSetupWithOptions(t, &RetryOptions{Listener: retries})
+	defer s.close()
+	s.sendUp()
+	s.serverSide.Close()
+	select {
+	case <-retries:
+		t.Fatal("The listener should not be notified before the decision")
+	default:
+	}
+	s.confirmRetry()
+	stats := <-retries
+	if !stats.Succeeded || stats.Split == 0 || stats.Bytes != BUFSIZE {
+		t.Errorf("Unexpected stats: %+v", *stats)
+	}
+	if stats == s.stats {
+		t.Error("The listener should get a copy")
+	}
+	if stats.RTT < 0 || stats.RTT > 1000 {
+		t.Errorf("Implausible RTT: %d ms", stats.RTT)
+	}
+
+	// Without a retry, the listener still learns the decision.
+	s = makeSetupWithOptions(t, &RetryOptions{Listener: retries})
+	defer s.close()
+	s.sendUp()
+	s.sendDown()
+	if stats := <-retries; stats.NoRetry != NoRetrySucceeded || stats.Succeeded {
+		t.Errorf("Unexpected stats without a retry: %+v", *stats)
+	}
+}
+
+// connListener calls a function with the connection when it is notified.
+type connListener struct {
+	conn   func() DuplexConn
+	called chan struct{}
+}
+
+func (l *connListener) OnRetryComplete(*RetryStats) {
+	// This would deadlock if the listener were called with the lock held.
+	l.conn().SetReadDeadline(time.Time{})
+	close(l.called)
+}
+
+func TestRetryListenerUnlocked(t *testing.T) {
+	var s *setup
+	l := &connListener{conn: func() DuplexConn { return s.clientSide }, called: make(chan struct{})}
+	s = makeSetupWithOptions(t, &RetryOptions{Listener: l})
+	defer s.close()
+	s.sendUp()
+	done := make(chan struct{})
+	go func() {
+		s.sendDown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The listener blocked the connection")
+	}
+	<-l.called
+}
+
+func TestRetryNotSucceeded(t *testing.T) {
+	s := makeSetup(t)
+	s.sendUp()
+	// The server is gone, so the retry can't connect.
+	s.close()
+	s.serverSide.Close()
+	if _, err := s.clientSide.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the retry to fail")
+	}
+	if s.stats.Succeeded {
+		t.Error("A failed retry should not succeed")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/Jigsaw-Code/getsni"
+)
+
+// Hello strategies, which RetryOptions.HostStrategies assigns to hostnames.
+const (
+	// HelloDefault splits as configured by RetryOptions.SegmentSizes, or at a
+	// random offset.
+	HelloDefault = ""
+	// HelloSplitSNI splits the hello in the middle of the SNI hostname, so that
+	// neither segment contains the whole name.
+	HelloSplitSNI = "sni"
+	// HelloSplitRecordHeader splits the hello after the 5-byte TLS record
+	// header.
+	HelloSplitRecordHeader = "record-header"
+	// HelloSplitTLSRecord fragments a ClientHello into two TLS records, divided
+	// in the middle of the SNI hostname, and sends each record in its own
+	// segment, so that a middlebox must reassemble both TCP and TLS records to
+	// see the name.  Without an SNI, the record is divided at the default
+	// split.  A hello whose first record isn't complete in the write is split
+	// like HelloSplitSNI instead.
+	HelloSplitTLSRecord = "tls-record"
+	// HelloNoSplit never splits the hello, even when it is replayed.
+	HelloNoSplit = "none"
+	// HelloBlock closes the connection without sending the hello.
+	HelloBlock = "block"
+)
+
+// NoRetryBlocked means that the hello's SNI was assigned HelloBlock, so the
+// connection was closed.
+const NoRetryBlocked = "blocked"
+
+// ErrBlocked is returned by Write when the hello's SNI is assigned HelloBlock.
+var ErrBlocked = errors.New("Hostname is blocked")
+
+// Warnings that a split ClientHello still exposes its SNI, as reported in
+// RetryStats.SplitWarning.  Censors that match the SNI are likely to see it
+// anyway, so the split probably won't help.
+const (
+	// SplitWarningNoSNI means that the ClientHello didn't contain an SNI, e.g.
+	// because the server was dialed by IP address.
+	SplitWarningNoSNI = "no-sni"
+	// SplitWarningShortSNI means that the SNI was too short to straddle the
+	// split.
+	SplitWarningShortSNI = "short-sni"
+)
+
+// helloPeek is the result of inspecting the hello once, on the first write
+// that contains the SNI.
+type helloPeek struct {
+	sni      string
+	strategy string
+	// offset is the position of the SNI hostname in the hello, or -1.
+	offset int
+}
+
+// peekHello extracts the SNI from `hello` and looks up its strategy in
+// `strategies`.  The zero helloPeek is returned if there is no SNI.
+func peekHello(hello []byte, strategies map[string]string) helloPeek {
+	sni, err := getsni.GetSNI(hello)
+	if err != nil || sni == "" {
+		return helloPeek{}
+	}
+	return helloPeek{
+		sni:      sni,
+		strategy: strategyFor(sni, strategies),
+		offset:   bytes.Index(hello, []byte(sni)),
+	}
+}
+
+// strategyFor returns the strategy for `host` or its nearest listed parent
+// domain.
+func strategyFor(host string, strategies map[string]string) string {
+	if len(strategies) == 0 {
+		return HelloDefault
+	}
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	for {
+		if s, ok := strategies[name]; ok {
+			return s
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return HelloDefault
+		}
+		name = name[i+1:]
+	}
+}
+
+// segments divides `hello` into segments according to the peeked strategy.
+// Like splitHello, it returns at least two segments, unless the strategy is
+// HelloNoSplit.
+func (p helloPeek) segments(hello []byte, options *RetryOptions, clamps *splitClamps) [][]byte {
+	switch p.strategy {
+	case HelloNoSplit:
+		return [][]byte{hello}
+	case HelloSplitRecordHeader:
+		if len(hello) > 5 {
+			return [][]byte{hello[:5], hello[5:]}
+		}
+	case HelloSplitSNI, HelloSplitTLSRecord:
+		if p.offset >= 0 && p.offset+len(p.sni) <= len(hello) {
+			mid := p.offset + len(p.sni)/2
+			// The first segment can grow, but must still end inside the SNI.
+			return raiseFirstSegment(hello, [][]byte{hello[:mid], hello[mid:]}, options.MinFirstSegment, p.offset+len(p.sni)-1, clamps)
+		}
+	}
+	return splitHello(hello, options, clamps)
+}
+
+// splitWarning returns a SplitWarning if `hello` is a ClientHello whose split
+// can't divide the SNI hostname, or "" otherwise.
+func (p helloPeek) splitWarning(hello []byte) string {
+	if p.strategy == HelloNoSplit || !isClientHello(hello) {
+		return ""
+	}
+	if p.sni == "" || p.offset < 0 {
+		return SplitWarningNoSNI
+	}
+	if len(p.sni) < 2 {
+		return SplitWarningShortSNI
+	}
+	return ""
+}
+
+// fragmentRecord rewrites `hello`, which must begin with a complete TLS
+// handshake record, as two records whose payloads divide the original one at
+// offset `at` of the hello.  It returns the two records, followed by any data
+// after the original record, or nil if `hello` can't be fragmented at `at`.
+func fragmentRecord(hello []byte, at int) [][]byte {
+	if !isClientHello(hello) {
+		return nil
+	}
+	end := 5 + int(binary.BigEndian.Uint16(hello[3:]))
+	if at <= 5 || at >= end || end > len(hello) {
+		return nil
+	}
+	// Each record keeps the original type and version, with its own length.
+	first := append(append([]byte{}, hello[:5]...), hello[5:at]...)
+	binary.BigEndian.PutUint16(first[3:], uint16(at-5))
+	second := append(append([]byte{}, hello[:5]...), hello[at:end]...)
+	binary.BigEndian.PutUint16(second[3:], uint16(end-at))
+	records := [][]byte{first, second}
+	if end < len(hello) {
+		records = append(records, hello[end:])
+	}
+	return records
+}
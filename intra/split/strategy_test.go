@@ -0,0 +1,308 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// Returns the first TLS record sent by a client connecting to `host`.
+func captureClientHello(t *testing.T, host string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	// Without a ServerName, the hello has no SNI.
+	go tls.Client(client, &tls.Config{ServerName: host, InsecureSkipVerify: host == ""}).Handshake()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+var testStrategies = map[string]string{
+	"sni.example":    HelloSplitSNI,
+	"record.example": HelloSplitRecordHeader,
+	"whole.example":  HelloNoSplit,
+	"blocked.test":   HelloBlock,
+}
+
+func TestStrategyFor(t *testing.T) {
+	for host, want := range map[string]string{
+		"sni.example":        HelloSplitSNI,
+		"www.SNI.example.":   HelloSplitSNI,
+		"record.example":     HelloSplitRecordHeader,
+		"a.b.blocked.test":   HelloBlock,
+		"example":            HelloDefault,
+		"notsni.example":     HelloDefault,
+		"sni.example.evil":   HelloDefault,
+		"unrelated.hostname": HelloDefault,
+	} {
+		if got := strategyFor(host, testStrategies); got != want {
+			t.Errorf("%s: got %q, want %q", host, got, want)
+		}
+	}
+	if got := strategyFor("sni.example", nil); got != HelloDefault {
+		t.Errorf("No strategies: got %q", got)
+	}
+}
+
+func TestHostStrategies(t *testing.T) {
+	options := &RetryOptions{SplitClientHello: true, SegmentSizes: []int{10}, HostStrategies: testStrategies}
+
+	hello := captureClientHello(t, "www.sni.example")
+	writes := firstFlightWrites(t, options, hello)
+	offset := bytes.Index(hello, []byte("www.sni.example"))
+	if len(writes) != 2 || writes[0] != offset+len("www.sni.example")/2 {
+		t.Errorf("Hello should be split within the SNI at %d: %v", offset, writes)
+	}
+
+	if writes := firstFlightWrites(t, options, captureClientHello(t, "record.example")); len(writes) != 2 || writes[0] != 5 {
+		t.Errorf("Hello should be split after the record header: %v", writes)
+	}
+	if writes := firstFlightWrites(t, options, captureClientHello(t, "whole.example")); len(writes) != 1 {
+		t.Errorf("Hello should not be split: %v", writes)
+	}
+	if writes := firstFlightWrites(t, options, captureClientHello(t, "other.example")); len(writes) != 2 || writes[0] != 10 {
+		t.Errorf("Unlisted hosts should use the default split: %v", writes)
+	}
+}
+
+func TestHostStrategyBlock(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{HostStrategies: testStrategies})
+	defer s.close()
+	if n, err := s.clientSide.Write(captureClientHello(t, "blocked.test")); n != 0 || err != ErrBlocked {
+		t.Errorf("Expected ErrBlocked, got %d, %v", n, err)
+	}
+	if s.stats.SNI != "blocked.test" || s.stats.NoRetry != NoRetryBlocked {
+		t.Errorf("Unexpected stats: %+v", *s.stats)
+	}
+	// The server sees the connection close without any data.
+	if n, _ := s.serverSide.Read(make([]byte, 1)); n != 0 {
+		t.Error("The hello should not be sent")
+	}
+}
+
+// The first segment floor still leaves the SNI split.
+func TestHostStrategyMinFirstSegment(t *testing.T) {
+	hello := captureClientHello(t, "sni.example")
+	peek := peekHello(hello, testStrategies)
+	end := peek.offset + len(peek.sni)
+	for _, floor := range []int{0, peek.offset, len(hello)} {
+		segments := peek.segments(hello, &RetryOptions{MinFirstSegment: floor}, nil)
+		first := len(segments[0])
+		if first <= peek.offset || first >= end {
+			t.Errorf("Floor %d: the split at %d doesn't divide the SNI at %d-%d", floor, first, peek.offset, end)
+		}
+		if first < floor && first != end-1 {
+			t.Errorf("Floor %d: the first segment should be raised, got %d", floor, first)
+		}
+	}
+}
+
+// The strategy chosen on the first write also applies to the retry.
+func TestHostStrategyRetry(t *testing.T) {
+	s := makeSetupWithOptions(t, &RetryOptions{HostStrategies: testStrategies})
+	hello := captureClientHello(t, "record.example")
+	if _, err := s.clientSide.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	s.serverSide.Close()
+	readDone := make(chan error)
+	go func() {
+		_, err := s.clientSide.Read(make([]byte, 1))
+		readDone <- err
+	}()
+	replacement, err := s.server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replacement.Close()
+	if _, err := io.ReadFull(replacement, make([]byte, len(hello))); err != nil {
+		t.Fatal(err)
+	}
+	replacement.Write([]byte{1})
+	if err := <-readDone; err != nil {
+		t.Fatal(err)
+	}
+	if s.stats.Split != 5 {
+		t.Errorf("Retry should split after the record header, got %d", s.stats.Split)
+	}
+	s.clientSide.Close()
+	s.server.Close()
+}
+
+// Returns the SplitWarning for writing `hello` with `options`.
+func splitWarning(t *testing.T, options *RetryOptions, hello []byte) string {
+	s := makeSetupWithOptions(t, options)
+	defer s.close()
+	if _, err := s.clientSide.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	return s.stats.SplitWarning
+}
+
+func TestSplitWarning(t *testing.T) {
+	options := &RetryOptions{SplitClientHello: true}
+	if w := splitWarning(t, options, captureClientHello(t, "")); w != SplitWarningNoSNI {
+		t.Errorf("Expected a warning without SNI, got %q", w)
+	}
+	if w := splitWarning(t, options, captureClientHello(t, "a")); w != SplitWarningShortSNI {
+		t.Errorf("Expected a warning for a 1-character SNI, got %q", w)
+	}
+	if w := splitWarning(t, options, captureClientHello(t, "www.example")); w != "" {
+		t.Errorf("Unexpected warning: %q", w)
+	}
+	// Unsplit hellos and other protocols don't need a warning.
+	if w := splitWarning(t, nil, captureClientHello(t, "")); w != "" {
+		t.Errorf("Unexpected warning without a split: %q", w)
+	}
+	if w := splitWarning(t, options, []byte("GET / HTTP/1.1\r\n")); w != "" {
+		t.Errorf("Unexpected warning for HTTP: %q", w)
+	}
+}
+
+func TestSplitWarningRetry(t *testing.T) {
+	s := makeSetup(t)
+	defer s.close()
+	hello := captureClientHello(t, "")
+	if _, err := s.clientSide.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	s.serverReceived = hello
+	if _, err := io.ReadFull(s.serverSide, make([]byte, len(hello))); err != nil {
+		t.Fatal(err)
+	}
+	s.serverSide.Close()
+	s.confirmRetry()
+	if s.stats.SplitWarning != SplitWarningNoSNI {
+		t.Errorf("Expected a warning for the replayed hello, got %q", s.stats.SplitWarning)
+	}
+}
+
+// Reads two TLS records from `r`, and returns the length of the first
+// record's payload and the two payloads joined.
+func readRecords(t *testing.T, r io.Reader) (int, []byte) {
+	var payloads []byte
+	first := 0
+	for i := 0; i < 2; i++ {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			t.Fatal(err)
+		}
+		if header[0] != 0x16 || header[1] != 3 {
+			t.Errorf("Unexpected record header: %v", header)
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = len(payload)
+		}
+		payloads = append(payloads, payload...)
+	}
+	return first, payloads
+}
+
+func TestFragmentRecord(t *testing.T) {
+	hello := captureClientHello(t, "www.example")
+	at := len(hello) / 2
+	records := fragmentRecord(hello, at)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	first, payloads := readRecords(t, bytes.NewReader(append(append([]byte{}, records[0]...), records[1]...)))
+	if first != at-5 || !bytes.Equal(payloads, hello[5:]) {
+		t.Errorf("The records don't divide the payload at %d: %d", at, first)
+	}
+	if hello[5] != 0x01 {
+		t.Error("The hello was modified")
+	}
+
+	// Data after the record is sent unchanged.
+	records = fragmentRecord(append(append([]byte{}, hello...), "extra"...), at)
+	if len(records) != 3 || string(records[2]) != "extra" {
+		t.Errorf("Unexpected trailing data: %q", records[len(records)-1])
+	}
+
+	for _, at := range []int{0, 5, len(hello)} {
+		if records := fragmentRecord(hello, at); records != nil {
+			t.Errorf("Offset %d should not fragment", at)
+		}
+	}
+	if records := fragmentRecord(hello[:len(hello)-1], at); records != nil {
+		t.Error("An incomplete record should not be fragmented")
+	}
+	if records := fragmentRecord([]byte("GET / HTTP/1.1\r\n"), 5); records != nil {
+		t.Error("Other protocols should not be fragmented")
+	}
+}
+
+func TestHostStrategyTLSRecord(t *testing.T) {
+	strategies := map[string]string{"tls.example": HelloSplitTLSRecord}
+	s := makeSetupWithOptions(t, &RetryOptions{SplitClientHello: true, HostStrategies: strategies})
+	defer s.close()
+	r := s.clientSide.(*retrier)
+	rec := &recordingConn{DuplexConn: r.conn}
+	r.conn = rec
+	hello := captureClientHello(t, "www.tls.example")
+	if n, err := s.clientSide.Write(hello); err != nil || n != len(hello) {
+		t.Fatalf("Write failed: %d, %v", n, err)
+	}
+	offset := bytes.Index(hello, []byte("www.tls.example"))
+	first, payloads := readRecords(t, s.serverSide)
+	if !bytes.Equal(payloads, hello[5:]) {
+		t.Error("The records don't contain the hello")
+	}
+	if end := first + 5; end <= offset || end >= offset+len("www.tls.example") {
+		t.Errorf("The first record ends at %d, outside the SNI at %d", end, offset)
+	}
+	// Each record is a separate segment.
+	if len(rec.writes) != 2 || rec.writes[0] != first+5 || rec.writes[1] != len(hello)+5-rec.writes[0] {
+		t.Errorf("Unexpected writes: %v", rec.writes)
+	}
+
+	// The replay is also fragmented.
+	s.serverSide.Close()
+	readDone := make(chan error)
+	go func() {
+		_, err := s.clientSide.Read(make([]byte, 1))
+		readDone <- err
+	}()
+	replacement, err := s.server.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replacement.Close()
+	if _, payloads := readRecords(t, replacement); !bytes.Equal(payloads, hello[5:]) {
+		t.Error("The replayed records don't contain the hello")
+	}
+	replacement.Write([]byte{1})
+	if err := <-readDone; err != nil {
+		t.Fatal(err)
+	}
+	if int(s.stats.Split) != first+5 {
+		t.Errorf("Expected split %d, got %d", first+5, s.stats.Split)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import "golang.org/x/sys/unix"
+
+// swapTTL sets the IP TTL, or the IPv6 hop limit if `ipv6` is true, of the
+// socket `fd` to `ttl`, and returns the previous value.  It is a variable so
+// that tests can observe it.
+var swapTTL = func(fd int, ipv6 bool, ttl int) (int, error) {
+	level, opt := unix.IPPROTO_IP, unix.IP_TTL
+	if ipv6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS
+	}
+	old, err := unix.GetsockoptInt(fd, level, opt)
+	if err != nil {
+		return 0, err
+	}
+	return old, unix.SetsockoptInt(fd, level, opt, ttl)
+}
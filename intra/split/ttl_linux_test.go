@@ -0,0 +1,66 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// ttlRecorder records the TTL of the socket during each write.
+type ttlRecorder struct {
+	corkRecorder
+}
+
+func (c *ttlRecorder) Write(b []byte) (int, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		v, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL)
+		if err != nil {
+			c.t.Error(err)
+		}
+		c.events = append(c.events, fmt.Sprintf("write %d (ttl=%d)", len(b), v))
+	})
+	return c.TCPConn.Write(b)
+}
+
+func TestWriteLowTTL(t *testing.T) {
+	c, received := dialLoopback(t)
+	r := &ttlRecorder{corkRecorder{TCPConn: c, t: t}}
+	var ttl int
+	raw, _ := c.SyscallConn()
+	raw.Control(func(fd uintptr) {
+		ttl, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL)
+	})
+
+	if err := writeLowTTL(r, [][]byte{[]byte("abc"), []byte("defgh")}, 3, false, false); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first segment has the low TTL.  Loopback delivers it anyway.
+	expected := []string{"write 3 (ttl=3)", fmt.Sprintf("write 5 (ttl=%d)", ttl)}
+	if !reflect.DeepEqual(r.events, expected) {
+		t.Errorf("Unexpected sequence %q", r.events)
+	}
+	c.CloseWrite()
+	if b := <-received; string(b) != "abcdefgh" {
+		t.Errorf("Server received %q", b)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package split
+
+import "errors"
+
+// swapTTL is not implemented on this platform, so RetryLowTTL sends the first
+// segment with the normal TTL.
+var swapTTL = func(fd int, ipv6 bool, ttl int) (int, error) {
+	return 0, errors.New("Changing the TTL is not supported on this platform")
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// DefaultStackWriteRetries is the number of times a write to the network stack
+// is retried after a transient error, unless configured otherwise.
+const DefaultStackWriteRetries = 3
+
+// Delay before the first retry of a write to the network stack.  Each
+// subsequent retry doubles the delay.
+const stackRetryBackoff = 5 * time.Millisecond
+
+// lwIP error codes that indicate a temporary shortage of stack resources.
+const (
+	lwipErrMem        = -1
+	lwipErrBuf        = -2
+	lwipErrWouldBlock = -7
+)
+
+// isTransientStackError reports whether `err`, returned by a write to the
+// core, reflects temporary backpressure rather than a failed connection.
+// go-tun2socks reports failures of tcp_write as "tcp_write failed (code)",
+// with the lwIP error code.  It already waits for buffer space instead of
+// returning ERR_MEM from TCP writes, but other resource errors are returned.
+func isTransientStackError(err error) bool {
+	var code int
+	if _, scanErr := fmt.Sscanf(err.Error(), "tcp_write failed (%d)", &code); scanErr != nil {
+		return false
+	}
+	switch code {
+	case lwipErrMem, lwipErrBuf, lwipErrWouldBlock:
+		return true
+	}
+	return false
+}
+
+// retryStackWrite calls `write` until it succeeds, fails with an error that is
+// not transient, or has been retried `retries` times, with exponential backoff.
+// It returns the last error.
+func retryStackWrite(retries int, write func() error) error {
+	backoff := stackRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || attempt >= retries || !isTransientStackError(err) {
+			return err
+		}
+		log.Debugf("Retrying write to the network stack in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// stackWriter retries writes to a core connection after transient errors.
+type stackWriter struct {
+	io.Writer
+	retries int
+}
+
+func (w stackWriter) Write(b []byte) (int, error) {
+	written := 0
+	err := retryStackWrite(w.retries, func() error {
+		n, err := w.Writer.Write(b[written:])
+		written += n
+		return err
+	})
+	return written, err
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// flakyWriter fails writes with `err` after writing `partial` bytes, `failures`
+// times, and then writes normally.
+type flakyWriter struct {
+	bytes.Buffer
+	err      error
+	failures int
+	partial  int
+	calls    int
+}
+
+func (w *flakyWriter) Write(b []byte) (int, error) {
+	w.calls++
+	if w.failures > 0 {
+		w.failures--
+		n, _ := w.Buffer.Write(b[:w.partial])
+		return n, w.err
+	}
+	return w.Buffer.Write(b)
+}
+
+func lwipError(code int) error {
+	return fmt.Errorf("tcp_write failed (%d)", code)
+}
+
+func TestTransientStackError(t *testing.T) {
+	for _, code := range []int{lwipErrMem, lwipErrBuf, lwipErrWouldBlock} {
+		if !isTransientStackError(lwipError(code)) {
+			t.Errorf("Code %d should be transient", code)
+		}
+	}
+	for _, err := range []error{lwipError(-11), lwipError(-13), errors.New("connection was closed")} {
+		if isTransientStackError(err) {
+			t.Errorf("%v should not be transient", err)
+		}
+	}
+}
+
+func TestStackWriteRetried(t *testing.T) {
+	w := &flakyWriter{err: lwipError(lwipErrBuf), failures: 2, partial: 2}
+	n, err := stackWriter{w, DefaultStackWriteRetries}.Write([]byte("hello"))
+	if err != nil || n != 5 {
+		t.Fatalf("Write failed after retries: %d, %v", n, err)
+	}
+	if w.calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", w.calls)
+	}
+	// Partial writes are not repeated.
+	if got := w.String(); got != "hello" {
+		t.Errorf("Unexpected data: %q", got)
+	}
+}
+
+func TestStackWriteRetriesExhausted(t *testing.T) {
+	w := &flakyWriter{err: lwipError(lwipErrMem), failures: 10}
+	if _, err := (stackWriter{w, 2}).Write([]byte("x")); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	if w.calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", w.calls)
+	}
+}
+
+func TestStackWritePermanentError(t *testing.T) {
+	w := &flakyWriter{err: lwipError(-14), failures: 1}
+	if _, err := (stackWriter{w, DefaultStackWriteRetries}).Write([]byte("x")); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	if w.calls != 1 {
+		t.Errorf("Permanent errors should not be retried: %d attempts", w.calls)
+	}
+}
+
+func TestStackWriteRetriesDisabled(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, nil).(*tcpHandler)
+	h.SetStackWriteRetries(0)
+	w := &flakyWriter{err: lwipError(lwipErrBuf), failures: 1}
+	if _, err := (stackWriter{w, h.stackRetries}).Write([]byte("x")); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	if w.calls != 1 {
+		t.Errorf("Expected 1 attempt, got %d", w.calls)
+	}
+}
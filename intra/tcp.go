@@ -17,14 +17,21 @@
 package intra
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 
 	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
 )
 
@@ -32,18 +39,317 @@ import (
 type TCPHandler interface {
 	core.TCPConnHandler
 	SetDNS(doh.Transport)
+	// SetAlwaysSplitHTTPS splits the first flight of every HTTPS connection.
+	// Unless SetMinimalSplit is also set, these connections are never retried,
+	// so host strategies and learned splits don't apply to them.
 	SetAlwaysSplitHTTPS(bool)
+	// SetSYNDataSize sets the number of bytes of the TLS hello to send in the
+	// SYN using TCP Fast Open, when always splitting HTTPS.  The rest of the
+	// hello is split as usual.  Zero disables Fast Open.  It must be called
+	// before the handler is registered.
+	SetSYNDataSize(int)
+	// SetMinimalSplit limits the splitting enabled by SetAlwaysSplitHTTPS to
+	// first flights that are TLS ClientHellos.  Other first flights are sent
+	// normally, and are only split if a retry is needed.  It must be called
+	// before the handler is registered.
+	SetMinimalSplit(bool)
+	// SetForceSeparatePackets makes a best effort to send each segment of a
+	// split hello in its own packet, using TCP_CORK where the platform supports
+	// it.  By default, the segments rely on TCP_NODELAY and separate writes.
+	// It must be called before the handler is registered.
+	SetForceSeparatePackets(bool)
+	// SetHostStrategies assigns split strategies, such as split.HelloSplitSNI,
+	// to hostnames and their subdomains.  Each connection that may be retried
+	// applies the strategy of the SNI in its hello.  It must be called before
+	// the handler is registered.
+	SetHostStrategies(map[string]string)
+	// SetLearnedSplits enables reuse of the hello split that last led to a
+	// successful connection to each destination, for connections that may be
+	// retried, instead of choosing a new random split each time.  At most
+	// `maxDestinations` splits are remembered.  Zero disables reuse.  It must be
+	// called before the handler is registered.
+	SetLearnedSplits(maxDestinations int)
+	// SetRetryListener sets a listener that is notified when the retry decision
+	// of each connection that may be retried is made, so that retry
+	// effectiveness can be reported before the connection closes.  Nil
+	// disables it.  It may be called at any time, and applies to connections
+	// dialed afterwards.  The listener is called without any of the
+	// connection's locks held.
+	SetRetryListener(split.RetryListener)
+	// Dial connects to `target` directly, using the split and retry strategy of
+	// tunneled HTTPS connections, regardless of the port.  Unlike tunneled
+	// connections, it never uses the proxy, and the DialRetryPolicy doesn't
+	// apply.  It is a doh.DialFunc.
+	Dial(target *net.TCPAddr) (split.DuplexConn, error)
+	// SetFilter sets the destination filter.  It must be called before the
+	// handler is registered.  A nil filter permits all destinations.
+	SetFilter(*filter.Filter)
+	// SetPortPolicy sets the destination port policy.  It must be called before
+	// the handler is registered.  A nil policy permits all ports.
+	SetPortPolicy(*filter.PortPolicy)
+	// SetLocalIPv6Policy sets how connections to link-local (fe80::/10) and
+	// unique-local (fc00::/7) IPv6 destinations are handled.  `policy` is
+	// LocalIPv6Drop (the default) or LocalIPv6Allow.  It must be called before
+	// the handler is registered.
+	SetLocalIPv6Policy(policy string) error
+	// SetBlockResponse sets how the client sees a connection whose destination
+	// is blocked by the filter, the port policy or the local IPv6 policy.
+	// `policy` is BlockResponseRefuse (the default), BlockResponseDrop, or
+	// BlockResponseClose.  It must be called before the handler is registered.
+	SetBlockResponse(policy string) error
+	// SetControl sets a hook that is called with each new upstream socket,
+	// including the replacement socket of a retry, before it connects.  It runs
+	// after the typed options such as SetUpstreamTTL, so it can set any other
+	// socket option, or override them.  If it returns an error, the dial fails.
+	// nil removes the hook.  It must be called before the handler is registered.
+	SetControl(ControlFunc)
+	// SetProxy sends new connections through `d`, instead of dialing them
+	// directly.  nil disables the proxy.  It must be called before the handler
+	// is registered.
+	SetProxy(d ProxyDialer)
+	// SetProxyFallback sets how a connection is handled if the proxy refuses its
+	// destination.  `policy` is ProxyFallbackOff (the default),
+	// ProxyFallbackDirect, or ProxyFallbackRemember.  A direct fallback uses the
+	// usual strategies, including split-retry for HTTPS.  It must be called
+	// before the handler is registered.
+	SetProxyFallback(policy string) error
+	// ProxyBypassed returns the number of destinations that are remembered as
+	// refused by the proxy, and dialed directly.
+	ProxyBypassed() int
+	// SetUpstreamTTL sets the IP TTL (or IPv6 hop limit) of new upstream sockets.
+	// Zero restores the system default.  Client TTL mirroring takes precedence
+	// over this value when the client's TTL is known.
+	SetUpstreamTTL(int)
+	// SetPortRange restricts the local ports of new upstream sockets to the
+	// inclusive range `min`-`max`.  If every port is in use, an ephemeral port
+	// is used instead.  Zero for both disables the restriction.
+	SetPortRange(min, max int) error
+	// SetMSSClamp sets the maximum TCP segment size of new upstream sockets,
+	// including sockets created by a retry.  Zero restores the system default.
+	SetMSSClamp(mss int)
+	// SetUpstreamLinger makes each new upstream socket linger on close for up to
+	// `timeout`, rounded up to a whole second, so that data still in its send
+	// buffer is delivered before Close returns.  Zero restores the default
+	// graceful close, in which Close returns immediately and the system sends
+	// buffered data in the background.
+	SetUpstreamLinger(timeout time.Duration)
+	// SetUpstreamUserTimeout limits how long data sent on each new upstream
+	// socket, including sockets created by a retry, may remain unacknowledged
+	// before the connection is declared dead, using TCP_USER_TIMEOUT.  This
+	// detects dead connections on flaky links sooner than the system default.
+	// It has no effect where TCP_USER_TIMEOUT is unsupported.  Zero restores the
+	// system default.
+	SetUpstreamUserTimeout(timeout time.Duration)
+	// SetUpstreamWriteTimeout limits how long each write to a new upstream
+	// connection may block, e.g. because the server stopped reading.  When it
+	// expires, the connection is closed with CloseReasonWriteTimeout.  With split
+	// retry, it also bounds the hello and its replay.  Zero disables the timeout.
+	// It must be called before the handler is registered.
+	SetUpstreamWriteTimeout(timeout time.Duration)
+	// SetECN sets the ECN mode of new upstream sockets, including sockets created
+	// by a retry, to ECNDefault, ECNEnabled or ECNDisabled.  Where ECN can't be
+	// set per socket, such as on Linux, other modes than ECNDefault have no
+	// effect.
+	SetECN(mode string) error
+	// SetClientMSSMirroring clamps the MSS of each new upstream socket to the MSS
+	// that the client advertised in its SYN, if that is known and smaller than
+	// the SetMSSClamp value.  The client's MSS is only known if the SYN was
+	// passed to ObservePacket.
+	SetClientMSSMirroring(bool)
+	// SetClientOptionMirroring sizes the receive buffer of each new upstream
+	// socket to the window that the client advertised in its SYN, scaled by its
+	// window scale option, so that the upstream socket advertises a similar
+	// window scale.  This is best effort: the buffer is limited by the system
+	// maximum, and SACK and timestamps always follow the system settings.  Like
+	// MSS mirroring, it requires the SYN to be passed to ObservePacket.
+	SetClientOptionMirroring(bool)
+	// SetClientTTLMirroring sets the IP TTL (or IPv6 hop limit) of each new
+	// upstream socket to the TTL of the client's SYN, so that upstream packets
+	// leave with the TTL that the client used.  Like MSS mirroring, it requires
+	// the SYN to be passed to ObservePacket.  Otherwise, the SetUpstreamTTL
+	// value is used.
+	SetClientTTLMirroring(bool)
+	// ObservePacket inspects a packet from the TUN device before it is written
+	// to the core, to record the options and TTL of TCP SYNs, which lwIP doesn't
+	// expose.  It does nothing unless client MSS, option or TTL mirroring is
+	// enabled.
+	ObservePacket(packet []byte)
+	// SetHalfOpenPolicy configures detection of half-open connections, which have
+	// forwarded no data for at least `threshold`.  If `reap` is true, such
+	// connections are closed.  A zero threshold disables detection.
+	SetHalfOpenPolicy(threshold time.Duration, reap bool)
+	// SetIdleTimeout closes connections that have forwarded no data in either
+	// direction for `timeout`.  Unlike the half-open threshold, this applies to
+	// connections that have forwarded data in the past.  Zero disables the timeout.
+	SetIdleTimeout(timeout time.Duration)
+	// SetMaxConnLifetime closes new connections once they have been open for
+	// `lifetime`, even if they are active, e.g. so that they are recycled through
+	// a new proxy.  Zero disables the limit.
+	SetMaxConnLifetime(lifetime time.Duration)
+	// SetHalfCloseGrace sets how long to wait, after the client half-closes a
+	// connection and the FIN is forwarded upstream, for the server to finish
+	// its response and close its side.  If it doesn't, the connection is closed
+	// completely.  Zero disables the grace period, so half-closed connections
+	// stay open until the server closes them.
+	SetHalfCloseGrace(grace time.Duration)
+	// SetByteBudget limits the bytes that each new connection may transfer.
+	// Bytes are counted as they are read from the client and the server.  The
+	// zero ByteBudget is unlimited.  It must be called before the handler is
+	// registered.
+	SetByteBudget(ByteBudget)
+	// SetThroughputLimit caps the aggregate throughput of all connections,
+	// including those that are already being forwarded.  The zero
+	// ThroughputLimit is unlimited.
+	SetThroughputLimit(ThroughputLimit)
+	// Throughput returns the recent aggregate throughput of all connections.
+	Throughput() ThroughputStats
+	// SetDuplicateFlowPolicy sets how a new connection is handled if its 4-tuple
+	// matches a connection that is still being dialed or forwarded, e.g. after a
+	// retransmitted SYN or quick reuse of the 4-tuple.  `policy` is
+	// DuplicateFlowIgnore (the default) or DuplicateFlowReplace.  Either way,
+	// at most one upstream connection is active for each 4-tuple.
+	SetDuplicateFlowPolicy(policy string) error
+	// SetImmediateClosePolicy sets how the client is told that the server closed
+	// or reset a connection before any data was forwarded, e.g. because it
+	// rejected the connection.  `policy` is ImmediateCloseHalfClose (the
+	// default), ImmediateCloseFull, or ImmediateCloseReset.  It must be called
+	// before the handler is registered.
+	SetImmediateClosePolicy(policy string) error
+	// SetPreface configures the bytes that frame each new upstream connection.
+	// The zero Preface disables framing.  It must be called before the handler
+	// is registered.
+	SetPreface(Preface)
+	// SetDegradationPolicy enables path quality monitoring for new upstream
+	// connections, where the platform supports it.  It must be called before the
+	// handler is registered.
+	SetDegradationPolicy(DegradationPolicy)
+	// SetDialRetryPolicy sets how many times a failed dial is re-attempted,
+	// including the proxy and the HTTPS strategy, before the client's
+	// connection is reset.  The zero DialRetryPolicy disables retries.  It must
+	// be called before the handler is registered.
+	SetDialRetryPolicy(DialRetryPolicy)
+	// SetDialFailureHook sets a hook that is called when an upstream dial fails.
+	// It must be called before the handler is registered.
+	SetDialFailureHook(DialFailureHook)
+	// SetCloseHook sets a hook that is called when a forwarded connection closes,
+	// after the TCPListener.  It must be called before the handler is registered.
+	SetCloseHook(TCPCloseHook)
+	// Events returns a channel of open and close events for forwarded
+	// connections, for consumers that prefer a channel to hooks.  Events are
+	// only sent once Events has been called.  The channel has a capacity of
+	// ConnEventBuffer.  If it is full, new events are dropped rather than
+	// blocking the connection, and the next delivered event reports how many
+	// were missed.  Every call returns the same channel.
+	Events() <-chan ConnEvent
+	// SetASNLookup sets a function that tags each TCPConnRecord with the ASN of
+	// its target when the connection closes.  Nil disables the lookup.  It must
+	// be called before the handler is registered.
+	SetASNLookup(ASNLookup)
+	// SetExperimentTagger sets the tagger that assigns an experiment tag to each
+	// new connection.  Nil disables tagging.  It may be called at any time, and
+	// applies to connections dialed afterwards.
+	SetExperimentTagger(ExperimentTagger)
+	// Use adds middlewares that run, in order, on each new connection before it
+	// reaches the bridge.  It must be called before the handler is registered.
+	Use(middlewares ...TCPMiddleware)
+	// Intercept adds interceptor factories.  Each forwarded connection's bytes
+	// pass through the interceptors that the factories return, in order on
+	// upload and in reverse order on download.  It must be called before the
+	// handler is registered.
+	Intercept(factories ...InterceptorFactory)
+	// EffectiveConfig returns the handler's current configuration, with defaults
+	// applied.
+	EffectiveConfig() TCPConfig
+	// HalfOpen returns the number of connections that are currently half-open.
+	HalfOpen() int
+	// Connections returns a snapshot of the active forwarded connections, in no
+	// particular order.
+	Connections() []ConnInfo
+	// Goroutines returns the number of goroutines running on behalf of
+	// connections.  It returns to zero once every connection has closed.
+	Goroutines() int
+	// DropCounts returns the number of connections dropped so far, by reason.
+	DropCounts() map[string]int64
+	// FlushCaches forgets the learned splits.  Active connections are
+	// unaffected.
+	FlushCaches()
+	// DumpSplitCache serializes the learned splits, so that they can be
+	// restored after a restart.  It fails if learned splits are disabled.
+	DumpSplitCache() ([]byte, error)
+	// LoadSplitCache restores learned splits written by DumpSplitCache,
+	// dropping splits that were learned more than `maxAge` ago.  Zero `maxAge`
+	// keeps splits of any age.  It fails if learned splits are disabled.
+	LoadSplitCache(data []byte, maxAge time.Duration) error
+	// ResetStats zeroes the drop counts.  Active connections are unaffected.
+	ResetStats()
+	// SetDropLogInterval enables logging of dropped connections, at most once per
+	// `interval` for each reason.  Zero disables logging.
+	SetDropLogInterval(interval time.Duration)
+	// SetStackWriteRetries sets the number of times a write to the TUN device is
+	// retried after a transient network stack error, with exponential backoff.
+	// Zero disables retries, so the connection is closed on any write error.
+	// The default is DefaultStackWriteRetries.
+	SetStackWriteRetries(n int)
+	// Shutdown cancels the backoff of dials that are waiting to be retried, so
+	// that they fail promptly with their last error.  Dials that fail after
+	// Shutdown are not retried.
+	Shutdown()
 	EnableSNIReporter(file io.ReadWriter, suffix, country string) error
 }
 
 type tcpHandler struct {
 	TCPHandler
-	fakedns          net.TCPAddr
-	dns              doh.Atomic
-	alwaysSplitHTTPS bool
-	dialer           *net.Dialer
-	listener         TCPListener
-	sniReporter      tcpSNIReporter
+	fakedns              net.TCPAddr
+	dns                  doh.Atomic
+	alwaysSplitHTTPS     bool
+	synDataSize          int
+	minimalSplit         bool
+	forceSeparate        bool
+	hostStrategies       map[string]string
+	learnedSplits        *split.SplitCache
+	baseDialer           *net.Dialer // Dialer provided by the caller.
+	dialer               *net.Dialer // baseDialer, with sockopts and control applied.
+	sockopts             sockopts
+	control              ControlFunc
+	dialMu               sync.RWMutex // Protects dialer, sockopts, control, retryListener and tagger.
+	proxy                ProxyDialer
+	proxyFallback        string // A ProxyFallback policy, or "" for the default.
+	bypass               proxyBypass
+	mirrorMSS            int32 // 1 if client MSS mirroring is enabled.  Accessed atomically.
+	mirrorOptions        int32 // 1 if client option mirroring is enabled.  Accessed atomically.
+	mirrorTTL            int32 // 1 if client TTL mirroring is enabled.  Accessed atomically.
+	clientSYN            synTable
+	listener             TCPListener
+	sniReporter          tcpSNIReporter
+	filter               *filter.Filter
+	portPolicy           *filter.PortPolicy
+	localIPv6            string // A LocalIPv6 policy, or "" for the default.
+	blockResponse        string // A BlockResponse policy, or "" for the default.
+	blockHold            time.Duration
+	conns                tcpRegistry
+	flows                flowTable
+	immediateClose       string // An ImmediateClose policy, or "" for the default.
+	degradation          DegradationPolicy
+	dialRetry            DialRetryPolicy
+	dialFailureHook      DialFailureHook
+	closeHook            TCPCloseHook
+	retryListener        split.RetryListener
+	tagger               ExperimentTagger
+	events               eventStream
+	asnLookup            ASNLookup
+	drops                dropCounter
+	goroutines           goroutineCounter
+	byteBudget           ByteBudget
+	throughput           throughput
+	writeTimeout         time.Duration // Bounds each upstream write, or zero.
+	preface              Preface
+	stackRetries         int                  // Retries after transient errors writing to the stack.
+	middlewares          []TCPMiddleware      // Added by Use.
+	interceptorFactories []InterceptorFactory // Added by Intercept.
+	handle               TCPHandlerFunc       // The composed middleware chain.
+	// ctx is the context of dial retries, which Shutdown cancels.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // TCPSocketSummary provides information about each TCP socket, reported when it is closed.
@@ -53,10 +359,108 @@ type TCPSocketSummary struct {
 	Duration      int32 // Duration in seconds.
 	ServerPort    int16 // The server port.  All values except 80, 443, and 0 are set to -1.
 	Synack        int32 // TCP handshake latency (ms)
-	// Retry is non-nil if retry was possible.  Retry.Split is non-zero if a retry occurred.
+	// Retry is non-nil if retry was possible.  Retry.Retried is true if a retry occurred.
 	Retry *split.RetryStats
+	// ExperimentTag is the tag assigned by the ExperimentTagger, if any.
+	ExperimentTag string
 }
 
+var errNoLearnedSplits = errors.New("Learned splits are disabled")
+
+// DialFailure describes a failed upstream dial.
+//
+// Whenever the dial fails, Handle returns an error, which causes the core to
+// reset the client's connection.  Clients therefore see a refusal rather than
+// a silent drop, whether the dial was refused or timed out.
+type DialFailure struct {
+	Target  *net.TCPAddr
+	Err     error
+	Timeout bool // True if the dial timed out.
+}
+
+// DialFailureHook is called when an upstream dial fails, before the client's
+// connection is reset.
+type DialFailureHook func(DialFailure)
+
+// Strategies used to dial upstream connections, as reported in TCPConnRecord.
+const (
+	StrategyDirect     = "direct"      // Plain TCP.
+	StrategySplit      = "split"       // The first segment is always split.
+	StrategySplitRetry = "split-retry" // The first segment is split on retry.
+	StrategyProxy      = "proxy"       // Through the proxy set by SetProxy.
+)
+
+// TCPConnRecord describes a forwarded connection in more detail than
+// TCPSocketSummary, for Go clients.  It is reported when the connection closes.
+type TCPConnRecord struct {
+	Client   net.Addr // The app's address, as seen on the TUN device.
+	Target   net.Addr // The upstream destination.
+	Start    time.Time
+	Strategy string
+	// Hostname is the TLS SNI, if it was observed.
+	Hostname string
+	// CloseReason is one of the CloseReason constants if the bridge closed the
+	// connection, or empty if either endpoint closed it.
+	CloseReason string
+	// ExperimentTag is the tag assigned by the ExperimentTagger, if any.
+	ExperimentTag string
+	// ASN is the target's autonomous system number, as reported by the
+	// ASNLookup, or 0 if it is unknown or there is no lookup.
+	ASN     uint32
+	Summary TCPSocketSummary
+}
+
+// Reasons that the bridge closed a connection, as reported in TCPConnRecord.
+const (
+	CloseReasonHalfOpen       = "half-open"        // No data was forwarded before the threshold.
+	CloseReasonIdle           = "idle"             // No data was forwarded for the idle timeout.
+	CloseReasonHalfCloseGrace = "half-close-grace" // The server didn't close after the client did.
+	CloseReasonByteBudget     = "byte-budget"      // The ByteBudget was exhausted.
+	CloseReasonDuplicateFlow  = "duplicate-flow"   // A new connection replaced this one.
+	CloseReasonPreface        = "preface"          // The upstream preface couldn't be written.
+	CloseReasonMaxLifetime    = "max-lifetime"     // The connection reached its maximum lifetime.
+	CloseReasonDeadPeer       = "dead-peer"        // The upstream socket timed out, e.g. keepalive probes failed.
+	CloseReasonWriteTimeout   = "write-timeout"    // An upstream write blocked for the write timeout.
+	CloseReasonImmediateClose = "immediate-close"  // The server closed before any data was forwarded.
+)
+
+// States of a forwarded connection, as reported in ConnInfo.  lwIP doesn't
+// expose the TCP state of the client's connection, so these describe the
+// bridge.
+const (
+	ConnStateEstablished  = "established"   // Data is forwarded in both directions.
+	ConnStateClientClosed = "client-closed" // The client's FIN was forwarded; the server is still sending.
+	ConnStateServerClosed = "server-closed" // The server's FIN was forwarded; the client is still sending.
+	ConnStateClosing      = "closing"       // Both directions have finished.
+)
+
+// ConnInfo describes an active forwarded connection, for debugging.
+type ConnInfo struct {
+	Client        net.Addr // The app's address, as seen on the TUN device.
+	Target        net.Addr // The upstream destination.
+	Start         time.Time
+	State         string // One of the ConnState constants.
+	UploadBytes   int64
+	DownloadBytes int64
+}
+
+// TCPCloseHook is called when a forwarded connection closes.
+type TCPCloseHook func(TCPConnRecord)
+
+// ExperimentTagger assigns an opaque tag to each new connection, so that
+// measurements can group outcomes by experiment arm, e.g. connections dialed
+// with and without splitting.  `client` and `target` are the connection's
+// addresses.  The tag is echoed in the RetryStats, the TCPSocketSummary and
+// the TCPConnRecord.
+type ExperimentTagger interface {
+	ExperimentTag(client, target string) string
+}
+
+// ASNLookup returns the autonomous system number that announces `ip`, or 0 if
+// it is unknown.  This package doesn't include an ASN database, so the caller
+// must supply one.
+type ASNLookup func(ip net.IP) uint32
+
 // TCPListener is notified when a socket closes.
 type TCPListener interface {
 	OnTCPSocketClosed(*TCPSocketSummary)
@@ -67,39 +471,186 @@ type TCPListener interface {
 // All other traffic is forwarded using `dialer`.
 // `listener` is provided with a summary of each socket when it is closed.
 func NewTCPHandler(fakedns net.TCPAddr, dialer *net.Dialer, listener TCPListener) TCPHandler {
-	return &tcpHandler{
-		fakedns:  fakedns,
-		dialer:   dialer,
-		listener: listener,
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &tcpHandler{
+		fakedns:    fakedns,
+		baseDialer: dialer,
+		dialer:     dialer,
+		listener:   listener,
+
+		stackRetries: DefaultStackWriteRetries,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
+	h.buildChain()
+	return h
 }
 
 // TODO: Propagate TCP RST using local.Abort(), on appropriate errors.
-func (h *tcpHandler) handleUpload(local core.TCPConn, remote split.DuplexConn, upload chan int64) {
-	bytes, _ := remote.ReadFrom(local)
-	local.CloseRead()
-	remote.CloseWrite()
+func (h *tcpHandler) handleUpload(t *tcpTracker, upload chan int64) {
+	var r io.Reader = t.local
+	if b := t.budget; b != nil {
+		r = budgetReader{r, b, &b.upload, b.limits.MaxUploadBytes, t.exhausted}
+	}
+	r = countingReader{r, &t.upload, &t.lastActive, t.clock}
+	r = h.throughput.reader(r, &h.throughput.up, t.closed)
+	if t.uploadTransform != nil {
+		r = &interceptReader{r: r, transform: t.uploadTransform}
+	}
+	var bytes int64
+	var err error
+	if t.writeTimeout > 0 {
+		bytes, err = io.Copy(timeoutWriter{t.remote, t.writeTimeout}, r)
+	} else {
+		bytes, err = t.remote.ReadFrom(r)
+	}
+	var neterr net.Error
+	if isDeadPeer(err) {
+		t.close(CloseReasonDeadPeer)
+	} else if h.writeTimeout > 0 && errors.As(err, &neterr) && neterr.Timeout() {
+		t.close(CloseReasonWriteTimeout)
+	}
+	t.local.CloseRead()
+	t.remote.CloseWrite()
+	t.finished(true)
+	h.conns.halfClosed(t)
 	upload <- bytes
 }
 
-func (h *tcpHandler) handleDownload(local core.TCPConn, remote split.DuplexConn) (bytes int64, err error) {
-	bytes, err = io.Copy(local, remote)
-	local.CloseWrite()
-	remote.CloseRead()
+func (h *tcpHandler) handleDownload(t *tcpTracker) (bytes int64, err error) {
+	var r io.Reader = t.remote
+	if b := t.budget; b != nil {
+		r = budgetReader{r, b, &b.download, b.limits.MaxDownloadBytes, t.exhausted}
+	}
+	r = h.throughput.reader(r, &h.throughput.down, t.closed)
+	if t.downloadTransform != nil {
+		r = &interceptReader{r: r, transform: t.downloadTransform}
+	}
+	bytes, err = io.Copy(countingWriter{stackWriter{t.local, h.stackRetries}, &t.download, &t.lastActive, t.clock}, r)
+	if isDeadPeer(err) {
+		t.close(CloseReasonDeadPeer)
+	} else if t.rejected() {
+		switch h.immediateClose {
+		case ImmediateCloseReset:
+			t.local.Abort()
+			t.close(CloseReasonImmediateClose)
+		case ImmediateCloseFull:
+			t.close(CloseReasonImmediateClose)
+		}
+	}
+	t.local.CloseWrite()
+	t.remote.CloseRead()
+	t.finished(false)
 	return
 }
 
-func (h *tcpHandler) forward(local net.Conn, remote split.DuplexConn, summary *TCPSocketSummary) {
+// Policies for a connection that the server closes or resets before any data
+// is forwarded, as passed to SetImmediateClosePolicy.
+const (
+	// ImmediateCloseHalfClose forwards the server's FIN, and keeps forwarding
+	// anything the client sends until it closes too.  A reset is also reported
+	// as a FIN.  This is the default.
+	ImmediateCloseHalfClose = "half-close"
+	// ImmediateCloseFull sends a FIN and stops reading from the client, so the
+	// connection is torn down without waiting for the client to close.
+	ImmediateCloseFull = "close"
+	// ImmediateCloseReset resets the client's connection.
+	ImmediateCloseReset = "reset"
+)
+
+// timeoutWriter bounds each write to `conn` by `timeout`.
+type timeoutWriter struct {
+	conn    split.DuplexConn
+	timeout time.Duration
+}
+
+func (w timeoutWriter) Write(b []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(b)
+}
+
+// isDeadPeer reports whether `err`, from reading or writing an upstream socket,
+// means that the server stopped responding, as when keepalive probes or
+// retransmissions go unacknowledged.  The system reports both as ETIMEDOUT.
+// Deadlines set by the bridge are not ETIMEDOUT, so they don't qualify.
+func isDeadPeer(err error) bool {
+	return errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// forward copies data between `local` and `remote` until both are closed.  `f`
+// is the flow that `local` belongs to, or nil if it isn't in the flow table.
+func (h *tcpHandler) forward(local net.Conn, remote split.DuplexConn, strategy string, summary *TCPSocketSummary, f *flow) {
 	localtcp := local.(core.TCPConn)
+	t := h.conns.add(localtcp, remote)
+	if f != nil {
+		f.forwarding(t)
+	}
+	h.events.emit(ConnEventOpen, TCPConnRecord{
+		Client:   local.LocalAddr(),
+		Target:   remote.RemoteAddr(),
+		Start:    t.start,
+		Strategy: strategy,
+	})
+	if strategy != StrategySplitRetry {
+		// The retrier applies the write timeout itself.
+		t.writeTimeout = h.writeTimeout
+	}
+	up, down := h.interceptors(local.LocalAddr(), remote.RemoteAddr())
+	// Split strategies need the preface in the first flight, with the hello.
+	// Direct and proxied connections send it eagerly, for protocols in which
+	// the server speaks first.
+	written := false
+	if p := h.preface.UpstreamPreface; len(p) > 0 && (strategy == StrategyDirect || strategy == StrategyProxy) {
+		var w io.Writer = remote
+		if t.writeTimeout > 0 {
+			w = timeoutWriter{remote, t.writeTimeout}
+		}
+		if _, err := w.Write(p); err != nil {
+			log.Warnf("Failed to write upstream preface: %v", err)
+			t.close(CloseReasonPreface)
+		}
+		written = true
+	}
+	t.uploadTransform, t.downloadTransform = h.preface.wrap(up, down, written)
+	if !h.byteBudget.unlimited() {
+		t.budget = &connBudget{limits: h.byteBudget}
+	}
+	if p := h.degradation; p.Interval > 0 && p.Hook != nil {
+		h.goroutines.goroutine(func() { p.monitor(remote, t.done) })
+	}
 	upload := make(chan int64)
-	start := time.Now()
-	go h.handleUpload(localtcp, remote, upload)
-	download, _ := h.handleDownload(localtcp, remote)
+	h.goroutines.goroutine(func() { h.handleUpload(t, upload) })
+	download, _ := h.handleDownload(t)
 	summary.DownloadBytes = download
 	summary.UploadBytes = <-upload
-	summary.Duration = int32(time.Since(start).Seconds())
+	summary.Duration = int32(t.clock.Now().Sub(t.start).Seconds())
+	h.conns.remove(t)
 	h.listener.OnTCPSocketClosed(summary)
+	if h.closeHook != nil || h.events.enabled() {
+		record := TCPConnRecord{
+			Client:      local.LocalAddr(),
+			Target:      remote.RemoteAddr(),
+			Start:       t.start,
+			Strategy:    strategy,
+			CloseReason: t.reason(),
+			Summary:     *summary,
+		}
+		record.ExperimentTag = summary.ExperimentTag
+		if summary.Retry != nil {
+			record.Hostname = summary.Retry.SNI
+		}
+		if addr, ok := record.Target.(*net.TCPAddr); ok && h.asnLookup != nil {
+			record.ASN = h.asnLookup(addr.IP)
+		}
+		if h.closeHook != nil {
+			h.closeHook(record)
+		}
+		h.events.emit(ConnEventClose, record)
+	}
 	if summary.Retry != nil {
+		if w := summary.Retry.SplitWarning; w != "" {
+			log.Infof("Split of the hello to %v was likely ineffective: %s", remote.RemoteAddr(), w)
+		}
 		h.sniReporter.Report(*summary)
 	}
 }
@@ -123,41 +674,217 @@ func filteredPort(addr net.Addr) int16 {
 
 // TODO: Request upstream to make `conn` a `core.TCPConn` so we can avoid a type assertion.
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	// DNS override
-	if target.IP.Equal(h.fakedns.IP) && target.Port == h.fakedns.Port {
-		dns := h.dns.Load()
-		go doh.Accept(dns, conn)
-		return nil
+	return h.handle(conn, normalizeTCPAddr(target))
+}
+
+// buildChain composes the handler's middlewares around the bridge.
+// The built-in middlewares run first, followed by those added with Use.
+func (h *tcpHandler) buildChain() {
+	middlewares := append([]TCPMiddleware{h.dnsOverride, h.filterTargets}, h.middlewares...)
+	h.handle = ChainTCP(h.bridge, middlewares...)
+}
+
+// dnsOverride redirects connections to `fakedns` to DOH.
+func (h *tcpHandler) dnsOverride(next TCPHandlerFunc) TCPHandlerFunc {
+	return func(conn net.Conn, target *net.TCPAddr) error {
+		if target.IP.Equal(h.fakedns.IP) && target.Port == h.fakedns.Port {
+			dns := h.dns.Load()
+			if h.filter != nil {
+				dns = filter.NewTransport(dns, h.filter)
+			}
+			h.goroutines.goroutine(func() { doh.Accept(dns, conn) })
+			return nil
+		}
+		return next(conn, target)
+	}
+}
+
+// filterTargets blocks connections to destinations that the filter, the
+// port policy or the local IPv6 policy blocks, using the block response.
+func (h *tcpHandler) filterTargets(next TCPHandlerFunc) TCPHandlerFunc {
+	return func(conn net.Conn, target *net.TCPAddr) error {
+		if err := checkLocalIPv6(h.localIPv6, target.IP); err != nil {
+			log.Infof("Blocked TCP connection to %s: %v", target, err)
+			h.drops.drop(DropLocalIPv6, "TCP connection to %s", target)
+			return h.block(conn, err)
+		}
+		if h.portPolicy != nil && !h.portPolicy.AllowPort(target.Port) {
+			log.Infof("Blocked TCP connection to port %d", target.Port)
+			h.drops.drop(DropBlockedPort, "TCP connection to %s", target)
+			return h.block(conn, fmt.Errorf("destination port %d is blocked", target.Port))
+		}
+		if h.filter != nil && !h.filter.AllowIP(target.IP) {
+			log.Infof("Blocked TCP connection to %s", target.String())
+			h.drops.drop(DropBlocked, "TCP connection to %s", target)
+			return h.block(conn, fmt.Errorf("destination %s is blocked", target.String()))
+		}
+		return next(conn, target)
+	}
+}
+
+// bridge dials `target` and forwards `conn` to it.
+func (h *tcpHandler) bridge(conn net.Conn, target *net.TCPAddr) error {
+	// go-tun2socks reports the app's address as the local address.
+	key := flowKey(conn.LocalAddr(), target)
+	f, err := h.flows.claim(key, conn)
+	if err != nil {
+		// Returning an error causes the duplicate connection to be reset.
+		h.drops.drop(DropDuplicateFlow, "TCP connection to %s: %v", target, err)
+		return err
 	}
 	var summary TCPSocketSummary
 	summary.ServerPort = filteredPort(target)
+	h.dialMu.RLock()
+	tagger := h.tagger
+	h.dialMu.RUnlock()
+	if tagger != nil {
+		summary.ExperimentTag = tagger.ExperimentTag(conn.LocalAddr().String(), target.String())
+	}
 	start := time.Now()
-	var c split.DuplexConn
-	var err error
 	// TODO: Cancel dialing if c is closed.
-	if summary.ServerPort == 443 {
-		if h.alwaysSplitHTTPS {
-			c, err = split.DialWithSplit(h.dialer, target)
-		} else {
-			summary.Retry = &split.RetryStats{}
-			c, err = split.DialWithSplitRetry(h.dialer, target, summary.Retry)
-		}
-	} else {
-		var generic net.Conn
-		generic, err = h.dialer.Dial(target.Network(), target.String())
-		if generic != nil {
-			c = generic.(*net.TCPConn)
-		}
-	}
+	c, strategy, err := h.dial(conn, target, &summary)
 	if err != nil {
+		h.flows.release(key, f)
+		h.dialFailed(target, err)
 		return err
 	}
 	summary.Synack = int32(time.Since(start).Seconds() * 1000)
-	go h.forward(conn, c, &summary)
+	// Data that the client sent during the dial was refused by lwIP, which holds
+	// it (and withholds the ACK) until Handle returns.  It is then delivered to
+	// the upload loop started here, so no early data is lost.
+	h.goroutines.goroutine(func() {
+		h.forward(conn, c, strategy, &summary, f)
+		h.flows.release(key, f)
+	})
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
 
+// dialOnce makes one attempt to connect to `target` for `conn`, through the
+// proxy if there is one, and otherwise directly, using the HTTPS strategy on
+// port 443.  It returns the strategy that was used.
+func (h *tcpHandler) dialOnce(conn net.Conn, target *net.TCPAddr, summary *TCPSocketSummary) (split.DuplexConn, string, error) {
+	c, err := h.dialProxy(target)
+	if c != nil || err != nil {
+		return c, StrategyProxy, err
+	}
+	dialer := h.dialerFor(conn, target)
+	if summary.ServerPort == 443 {
+		return h.dialHTTPS(dialer, target, summary)
+	}
+	generic, err := dialer.Dial(split.Network(target), target.String())
+	if err != nil {
+		return nil, StrategyDirect, err
+	}
+	return generic.(*net.TCPConn), StrategyDirect, nil
+}
+
+// dialHTTPS dials `target` with `dialer`, using the configured HTTPS strategy,
+// which it returns.  If the strategy may retry, summary.Retry is set.
+func (h *tcpHandler) dialHTTPS(dialer *net.Dialer, target *net.TCPAddr, summary *TCPSocketSummary) (split.DuplexConn, string, error) {
+	options := h.retryOptions()
+	options.ExperimentTag = summary.ExperimentTag
+	if h.alwaysSplitHTTPS && !h.minimalSplit {
+		c, err := split.DialWithSplitOptions(dialer, target, options)
+		return c, StrategySplit, err
+	}
+	summary.Retry = &split.RetryStats{}
+	c, err := split.DialWithSplitRetryOptions(dialer, target, options, summary.Retry)
+	return c, StrategySplitRetry, err
+}
+
+// retryOptions returns the split options for a new HTTPS connection.  A
+// connection that always splits without retrying never inspects its hello,
+// so it ignores the host strategies, learned splits and listener.
+func (h *tcpHandler) retryOptions() *split.RetryOptions {
+	h.dialMu.RLock()
+	listener := h.retryListener
+	h.dialMu.RUnlock()
+	return &split.RetryOptions{
+		SplitClientHello:     h.alwaysSplitHTTPS && h.minimalSplit,
+		SYNDataSize:          h.synDataSize,
+		HostStrategies:       h.hostStrategies,
+		LearnedSplits:        h.learnedSplits,
+		WriteTimeout:         h.writeTimeout,
+		ForceSeparatePackets: h.forceSeparate,
+		Listener:             listener,
+	}
+}
+
+// Dial connects to `target` directly using the HTTPS strategy, regardless of its
+// port.
+func (h *tcpHandler) Dial(target *net.TCPAddr) (split.DuplexConn, error) {
+	c, _, err := h.dialHTTPS(h.currentDialer(), target, &TCPSocketSummary{})
+	return c, err
+}
+
+// currentDialer returns the dialer with the current socket options.
+func (h *tcpHandler) currentDialer() *net.Dialer {
+	h.dialMu.RLock()
+	defer h.dialMu.RUnlock()
+	return h.dialer
+}
+
+// setSockopts applies `update` to the socket options, and rebuilds the dialer.
+// Connections that are already being dialed keep the previous dialer.
+func (h *tcpHandler) setSockopts(update func(*sockopts)) {
+	h.dialMu.Lock()
+	defer h.dialMu.Unlock()
+	update(&h.sockopts)
+	h.dialer = h.sockopts.dialer(h.baseDialer, h.control)
+}
+
+// dialerFor returns the dialer for upstream connections from `conn` to
+// `target`.  If the client's SYN was observed, the dialer's MSS clamp is
+// lowered to match the client's MSS if client MSS mirroring is enabled, its
+// receive buffer matches the client's window if client option mirroring is
+// enabled, and its TTL matches the client's if client TTL mirroring is enabled.
+// Otherwise, it is h.dialer.
+func (h *tcpHandler) dialerFor(conn net.Conn, target *net.TCPAddr) *net.Dialer {
+	h.dialMu.RLock()
+	dialer, opts, control := h.dialer, h.sockopts, h.control
+	h.dialMu.RUnlock()
+	mirrorMSS := atomic.LoadInt32(&h.mirrorMSS) != 0
+	mirrorOptions := atomic.LoadInt32(&h.mirrorOptions) != 0
+	mirrorTTL := atomic.LoadInt32(&h.mirrorTTL) != 0
+	if !mirrorMSS && !mirrorOptions && !mirrorTTL {
+		return dialer
+	}
+	// go-tun2socks reports the app's address as the local address.
+	syn, ok := h.clientSYN.take(conn.LocalAddr(), target)
+	if !ok {
+		return dialer
+	}
+	base := opts
+	if mirrorMSS && syn.mss > 0 && (opts.mss == 0 || syn.mss < opts.mss) {
+		opts.mss = syn.mss
+	}
+	if mirrorOptions {
+		opts.rcvbuf = syn.receiveBuffer()
+	}
+	if mirrorTTL && syn.ttl > 0 {
+		opts.ttl = syn.ttl
+	}
+	if opts == base {
+		return dialer
+	}
+	return opts.dialer(h.baseDialer, control)
+}
+
+// dialFailed logs and reports a failed dial to `target`.
+func (h *tcpHandler) dialFailed(target *net.TCPAddr, err error) {
+	failure := DialFailure{Target: target, Err: err}
+	var neterr net.Error
+	if errors.As(err, &neterr) {
+		failure.Timeout = neterr.Timeout()
+	}
+	log.Infof("Dial to %s failed (timeout: %t), resetting: %v", target.String(), failure.Timeout, err)
+	h.drops.drop(DropDialFailed, "TCP connection to %s: %v", target, err)
+	if h.dialFailureHook != nil {
+		h.dialFailureHook(failure)
+	}
+}
+
 func (h *tcpHandler) SetDNS(dns doh.Transport) {
 	h.dns.Store(dns)
 	h.sniReporter.SetDNS(dns)
@@ -167,6 +894,261 @@ func (h *tcpHandler) SetAlwaysSplitHTTPS(s bool) {
 	h.alwaysSplitHTTPS = s
 }
 
+func (h *tcpHandler) SetSYNDataSize(n int) {
+	h.synDataSize = n
+}
+
+func (h *tcpHandler) SetMinimalSplit(minimal bool) {
+	h.minimalSplit = minimal
+}
+
+func (h *tcpHandler) SetForceSeparatePackets(force bool) {
+	h.forceSeparate = force
+}
+
+func (h *tcpHandler) SetHostStrategies(strategies map[string]string) {
+	h.hostStrategies = strategies
+}
+
+func (h *tcpHandler) SetLearnedSplits(maxDestinations int) {
+	if maxDestinations <= 0 {
+		h.learnedSplits = nil
+		return
+	}
+	h.learnedSplits = split.NewSplitCache(maxDestinations)
+}
+
+func (h *tcpHandler) SetRetryListener(l split.RetryListener) {
+	h.dialMu.Lock()
+	h.retryListener = l
+	h.dialMu.Unlock()
+}
+
+func (h *tcpHandler) SetFilter(f *filter.Filter) {
+	h.filter = f
+}
+
+func (h *tcpHandler) SetPortPolicy(p *filter.PortPolicy) {
+	h.portPolicy = p
+}
+
+func (h *tcpHandler) SetControl(f ControlFunc) {
+	h.dialMu.Lock()
+	defer h.dialMu.Unlock()
+	h.control = f
+	h.dialer = h.sockopts.dialer(h.baseDialer, h.control)
+}
+
+func (h *tcpHandler) SetUpstreamTTL(ttl int) {
+	h.setSockopts(func(o *sockopts) { o.ttl = ttl })
+}
+
+func (h *tcpHandler) SetPortRange(min, max int) error {
+	ports, err := makePortRange(min, max)
+	if err != nil {
+		return err
+	}
+	h.setSockopts(func(o *sockopts) { o.ports = ports })
+	return nil
+}
+
+func (h *tcpHandler) SetMSSClamp(mss int) {
+	h.setSockopts(func(o *sockopts) { o.mss = mss })
+}
+
+func (h *tcpHandler) SetUpstreamLinger(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	h.setSockopts(func(o *sockopts) { o.linger = timeout })
+}
+
+func (h *tcpHandler) SetUpstreamUserTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	h.setSockopts(func(o *sockopts) { o.userTimeout = timeout })
+}
+
+func (h *tcpHandler) SetUpstreamWriteTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	h.writeTimeout = timeout
+}
+
+func (h *tcpHandler) SetECN(mode string) error {
+	switch mode {
+	case ECNDefault, ECNEnabled, ECNDisabled:
+	default:
+		return fmt.Errorf("Unknown ECN mode: %s", mode)
+	}
+	if mode != ECNDefault && !ecnSupported {
+		log.Warnf("ECN can't be set per socket on this platform, ignoring mode %s", mode)
+	}
+	h.setSockopts(func(o *sockopts) { o.ecn = mode })
+	return nil
+}
+
+func (h *tcpHandler) SetClientMSSMirroring(mirror bool) {
+	var v int32
+	if mirror {
+		v = 1
+	}
+	atomic.StoreInt32(&h.mirrorMSS, v)
+}
+
+func (h *tcpHandler) SetClientOptionMirroring(mirror bool) {
+	var v int32
+	if mirror {
+		v = 1
+	}
+	atomic.StoreInt32(&h.mirrorOptions, v)
+}
+
+func (h *tcpHandler) SetClientTTLMirroring(mirror bool) {
+	var v int32
+	if mirror {
+		v = 1
+	}
+	atomic.StoreInt32(&h.mirrorTTL, v)
+}
+
+func (h *tcpHandler) ObservePacket(packet []byte) {
+	if atomic.LoadInt32(&h.mirrorMSS) != 0 || atomic.LoadInt32(&h.mirrorOptions) != 0 ||
+		atomic.LoadInt32(&h.mirrorTTL) != 0 {
+		h.clientSYN.observe(packet)
+	}
+}
+
+func (h *tcpHandler) SetHalfOpenPolicy(threshold time.Duration, reap bool) {
+	h.conns.setHalfOpenPolicy(threshold, reap)
+}
+
+func (h *tcpHandler) SetIdleTimeout(timeout time.Duration) {
+	h.conns.setIdleTimeout(timeout)
+}
+
+func (h *tcpHandler) SetMaxConnLifetime(lifetime time.Duration) {
+	h.conns.setMaxLifetime(lifetime)
+}
+
+func (h *tcpHandler) SetHalfCloseGrace(grace time.Duration) {
+	h.conns.setHalfCloseGrace(grace)
+}
+
+func (h *tcpHandler) SetByteBudget(b ByteBudget) {
+	h.byteBudget = b
+}
+
+func (h *tcpHandler) HalfOpen() int {
+	return h.conns.halfOpen()
+}
+
+func (h *tcpHandler) Connections() []ConnInfo {
+	return h.conns.snapshot()
+}
+
+func (h *tcpHandler) Goroutines() int {
+	return h.goroutines.count()
+}
+
+func (h *tcpHandler) SetDuplicateFlowPolicy(policy string) error {
+	return h.flows.setPolicy(policy)
+}
+
+func (h *tcpHandler) SetImmediateClosePolicy(policy string) error {
+	switch policy {
+	case ImmediateCloseHalfClose, ImmediateCloseFull, ImmediateCloseReset:
+		h.immediateClose = policy
+		return nil
+	}
+	return fmt.Errorf("Unknown immediate close policy: %s", policy)
+}
+
+func (h *tcpHandler) SetPreface(p Preface) {
+	h.preface = p
+}
+
+func (h *tcpHandler) SetDegradationPolicy(p DegradationPolicy) {
+	h.degradation = p
+}
+
+func (h *tcpHandler) SetDialFailureHook(hook DialFailureHook) {
+	h.dialFailureHook = hook
+}
+
+func (h *tcpHandler) DropCounts() map[string]int64 {
+	return h.drops.snapshot()
+}
+
+func (h *tcpHandler) FlushCaches() {
+	if h.learnedSplits != nil {
+		h.learnedSplits.Flush()
+	}
+}
+
+func (h *tcpHandler) DumpSplitCache() ([]byte, error) {
+	if h.learnedSplits == nil {
+		return nil, errNoLearnedSplits
+	}
+	return h.learnedSplits.Dump()
+}
+
+func (h *tcpHandler) LoadSplitCache(data []byte, maxAge time.Duration) error {
+	if h.learnedSplits == nil {
+		return errNoLearnedSplits
+	}
+	n, err := h.learnedSplits.Load(data, maxAge)
+	if err != nil {
+		return err
+	}
+	log.Infof("Restored %d learned splits", n)
+	return nil
+}
+
+func (h *tcpHandler) ResetStats() {
+	h.drops.reset()
+}
+
+func (h *tcpHandler) SetDropLogInterval(interval time.Duration) {
+	h.drops.setLogInterval(interval)
+}
+
+func (h *tcpHandler) SetStackWriteRetries(n int) {
+	if n < 0 {
+		n = 0
+	}
+	h.stackRetries = n
+}
+
+func (h *tcpHandler) Shutdown() {
+	h.cancel()
+}
+
+func (h *tcpHandler) SetCloseHook(hook TCPCloseHook) {
+	h.closeHook = hook
+}
+
+func (h *tcpHandler) SetASNLookup(lookup ASNLookup) {
+	h.asnLookup = lookup
+}
+
+func (h *tcpHandler) SetExperimentTagger(tagger ExperimentTagger) {
+	h.dialMu.Lock()
+	h.tagger = tagger
+	h.dialMu.Unlock()
+}
+
+func (h *tcpHandler) Use(middlewares ...TCPMiddleware) {
+	h.middlewares = append(h.middlewares, middlewares...)
+	h.buildChain()
+}
+
+func (h *tcpHandler) Intercept(factories ...InterceptorFactory) {
+	h.interceptorFactories = append(h.interceptorFactories, factories...)
+}
+
 func (h *tcpHandler) EnableSNIReporter(file io.ReadWriter, suffix, country string) error {
 	return h.sniReporter.Configure(file, suffix, country)
 }
@@ -0,0 +1,752 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/clock"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// fakeTCPConn implements core.TCPConn using a real socket, standing in for
+// a connection from the TUN device.
+type fakeTCPConn struct {
+	*net.TCPConn
+}
+
+func (c *fakeTCPConn) Sent(len uint16) error     { return nil }
+func (c *fakeTCPConn) Receive(data []byte) error { return nil }
+func (c *fakeTCPConn) Err(err error)             {}
+func (c *fakeTCPConn) LocalClosed() error        { return nil }
+func (c *fakeTCPConn) Poll() error               { return nil }
+func (c *fakeTCPConn) Abort() {
+	c.SetLinger(0)
+	c.Close()
+}
+
+// fakeTCPListener reports each summary on a channel.
+type fakeTCPListener struct {
+	summaries chan *TCPSocketSummary
+}
+
+func newFakeTCPListener() *fakeTCPListener {
+	return &fakeTCPListener{make(chan *TCPSocketSummary, 10)}
+}
+
+func (l *fakeTCPListener) OnTCPSocketClosed(s *TCPSocketSummary) {
+	l.summaries <- s
+}
+
+// Returns both ends of a loopback TCP connection.
+func makePair(t *testing.T) (client, server *net.TCPConn) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err = net.DialTCP("tcp4", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+// forwardSetup connects an app socket to an upstream socket through a tcpHandler.
+type forwardSetup struct {
+	h        *tcpHandler
+	listener *fakeTCPListener
+	app      *net.TCPConn // The app's end of the TUN connection.
+	upstream *net.TCPConn // The server's end of the upstream connection.
+}
+
+func makeForwardSetup(t *testing.T, configure func(h *tcpHandler)) *forwardSetup {
+	listener := newFakeTCPListener()
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, listener).(*tcpHandler)
+	if configure != nil {
+		configure(h)
+	}
+	app, local := makePair(t)
+	remote, upstream := makePair(t)
+	go h.forward(&fakeTCPConn{local}, remote, StrategyDirect, &TCPSocketSummary{}, nil)
+	return &forwardSetup{h, listener, app, upstream}
+}
+
+func (s *forwardSetup) waitForSummary(t *testing.T, timeout time.Duration) *TCPSocketSummary {
+	select {
+	case summary := <-s.listener.summaries:
+		return summary
+	case <-time.After(timeout):
+		t.Fatal("Connection was not closed")
+	}
+	return nil
+}
+
+// Waits until the registry reports `n` active connections.
+func waitForConns(t *testing.T, h *tcpHandler, n int) {
+	for i := 0; i < 100; i++ {
+		h.conns.mu.Lock()
+		count := len(h.conns.conns)
+		h.conns.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d active connections", n)
+}
+
+func TestForward(t *testing.T) {
+	s := makeForwardSetup(t, nil)
+	s.app.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s.upstream, buf); err != nil {
+		t.Fatal(err)
+	}
+	s.upstream.Write([]byte("world!"))
+	s.upstream.Close()
+	s.app.CloseWrite()
+	summary := s.waitForSummary(t, time.Second)
+	if summary.UploadBytes != 5 || summary.DownloadBytes != 6 {
+		t.Errorf("Unexpected byte counts: %d up, %d down", summary.UploadBytes, summary.DownloadBytes)
+	}
+}
+
+func TestHalfOpenCount(t *testing.T) {
+	threshold := 50 * time.Millisecond
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetHalfOpenPolicy(threshold, false)
+	})
+	waitForConns(t, s.h, 1)
+	time.Sleep(2 * threshold)
+	if n := s.h.HalfOpen(); n != 1 {
+		t.Errorf("Expected one half-open connection, got %d", n)
+	}
+	// Without reaping, the connection is still usable.
+	s.app.Write([]byte("x"))
+	if _, err := io.ReadFull(s.upstream, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.h.HalfOpen(); n != 0 {
+		t.Errorf("Connection with data should not be half-open, got %d", n)
+	}
+}
+
+func TestHalfOpenReap(t *testing.T) {
+	threshold := 50 * time.Millisecond
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetHalfOpenPolicy(threshold, true)
+	})
+	summary := s.waitForSummary(t, time.Second)
+	if summary.UploadBytes != 0 || summary.DownloadBytes != 0 {
+		t.Errorf("Unexpected byte counts: %d up, %d down", summary.UploadBytes, summary.DownloadBytes)
+	}
+	if n := s.h.HalfOpen(); n != 0 {
+		t.Errorf("Reaped connection should not be counted, got %d", n)
+	}
+}
+
+func TestHalfOpenNotReapedWithData(t *testing.T) {
+	threshold := 50 * time.Millisecond
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetHalfOpenPolicy(threshold, true)
+	})
+	s.app.Write([]byte("x"))
+	if _, err := io.ReadFull(s.upstream, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * threshold)
+	select {
+	case <-s.listener.summaries:
+		t.Error("Active connection should not be reaped")
+	default:
+	}
+}
+
+func TestHandleIPv4Mapped(t *testing.T) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	networks := make(chan string, 1)
+	dialer := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			networks <- network
+			return nil
+		},
+	}
+	h := NewTCPHandler(net.TCPAddr{}, dialer, newFakeTCPListener())
+	_, local := makePair(t)
+	port := l.Addr().(*net.TCPAddr).Port
+	target := &net.TCPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: port}
+	if err := h.Handle(&fakeTCPConn{local}, target); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-networks; n != "tcp4" {
+		t.Errorf("Expected a tcp4 dial, got %s", n)
+	}
+	upstream, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	if remote := upstream.RemoteAddr().(*net.TCPAddr); remote.IP.To4() == nil {
+		t.Errorf("Expected an IPv4 upstream connection, got %v", remote)
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	mapped := net.ParseIP("::ffff:192.0.2.1")
+	if ip := normalizeIP(mapped); len(ip) != net.IPv4len || !ip.Equal(mapped) {
+		t.Errorf("Mapped address was not normalized: %v", []byte(ip))
+	}
+	v6 := net.ParseIP("2001:db8::1")
+	if ip := normalizeIP(v6); len(ip) != net.IPv6len {
+		t.Errorf("IPv6 address should be unchanged: %v", ip)
+	}
+	addr := normalizeUDPAddr(&net.UDPAddr{IP: mapped, Port: 53})
+	if len(addr.IP) != net.IPv4len || addr.Port != 53 {
+		t.Errorf("Bad UDP address: %v", addr)
+	}
+	if n := split.Network(&net.TCPAddr{IP: mapped}); n != "tcp4" {
+		t.Errorf("Expected tcp4, got %s", n)
+	}
+	if n := split.Network(&net.TCPAddr{IP: v6}); n != "tcp6" {
+		t.Errorf("Expected tcp6, got %s", n)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	timeout := 200 * time.Millisecond
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetHalfOpenPolicy(50*time.Millisecond, true)
+		h.SetIdleTimeout(timeout)
+	})
+	// Keep the connection active for longer than the idle timeout.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		s.app.Write([]byte("x"))
+		if _, err := io.ReadFull(s.upstream, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(timeout / 2)
+	}
+	lastActive := time.Since(start) - timeout/2
+	summary := s.waitForSummary(t, time.Second)
+	if elapsed := time.Since(start); elapsed < lastActive+timeout {
+		t.Errorf("Connection closed %v after the last activity", elapsed-lastActive)
+	}
+	if summary.UploadBytes != 3 {
+		t.Errorf("Unexpected upload: %d", summary.UploadBytes)
+	}
+}
+
+// The idle timeout is measured from the last activity, using the registry's clock.
+func TestIdleTimeoutFakeClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.conns.clock = fake
+		h.SetIdleTimeout(time.Minute)
+	})
+	waitForConns(t, s.h, 1)
+	fake.Advance(30 * time.Second)
+	s.app.Write([]byte("x"))
+	if _, err := io.ReadFull(s.upstream, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// The timer fires at 60s, when the connection has only been inactive for 30s.
+	fake.Advance(45 * time.Second)
+	select {
+	case <-s.listener.summaries:
+		t.Fatal("Active connection was closed")
+	default:
+	}
+	fake.Advance(15 * time.Second)
+	summary := s.waitForSummary(t, time.Second)
+	if summary.UploadBytes != 1 || summary.Duration != 90 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+}
+
+// Active connections are closed at the maximum lifetime, unlike idle ones.
+func TestMaxConnLifetime(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	reasons := make(chan string, 1)
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.conns.clock = fake
+		h.SetIdleTimeout(20 * time.Second)
+		h.SetMaxConnLifetime(time.Minute)
+		h.SetCloseHook(func(r TCPConnRecord) { reasons <- r.CloseReason })
+	})
+	waitForConns(t, s.h, 1)
+	// Forward data every 10 seconds, so the idle timeout never expires.
+	for i := 0; i < 5; i++ {
+		s.app.Write([]byte("x"))
+		if _, err := io.ReadFull(s.upstream, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		fake.Advance(10 * time.Second)
+	}
+	select {
+	case <-s.listener.summaries:
+		t.Fatal("Connection was closed before its maximum lifetime")
+	default:
+	}
+	s.app.Write([]byte("x"))
+	if _, err := io.ReadFull(s.upstream, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(10 * time.Second)
+	summary := s.waitForSummary(t, time.Second)
+	if summary.UploadBytes != 6 || summary.Duration != 60 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+	if reason := <-reasons; reason != CloseReasonMaxLifetime {
+		t.Errorf("Wrong close reason: %q", reason)
+	}
+}
+
+func TestIdleTimeoutNoData(t *testing.T) {
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetHalfOpenPolicy(50*time.Millisecond, true)
+		h.SetIdleTimeout(time.Minute)
+	})
+	// The no-data timer closes the connection long before the idle timeout.
+	s.waitForSummary(t, time.Second)
+}
+
+// A response sent shortly after the client half-closes is delivered in full.
+func TestHalfCloseGraceResponse(t *testing.T) {
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetHalfCloseGrace(time.Second)
+	})
+	s.app.Write([]byte("request"))
+	s.app.CloseWrite()
+	if b, err := ioutil.ReadAll(s.upstream); err != nil || string(b) != "request" {
+		t.Fatalf("Upstream read %q, %v", b, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	s.upstream.Write([]byte("response"))
+	s.upstream.Close()
+	if b, err := ioutil.ReadAll(s.app); err != nil || string(b) != "response" {
+		t.Errorf("Response truncated: %q, %v", b, err)
+	}
+	s.waitForSummary(t, time.Second)
+}
+
+// A server that never closes its side is disconnected after the grace period.
+func TestHalfCloseGraceExpires(t *testing.T) {
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetHalfCloseGrace(100 * time.Millisecond)
+	})
+	s.app.CloseWrite()
+	if _, err := ioutil.ReadAll(s.upstream); err != nil {
+		t.Fatal(err)
+	}
+	s.waitForSummary(t, time.Second)
+}
+
+// Waits until the only active connection is in `state`.
+func waitForState(t *testing.T, h *tcpHandler, state string) ConnInfo {
+	var conns []ConnInfo
+	for i := 0; i < 100; i++ {
+		conns = h.Connections()
+		if len(conns) == 1 && conns[0].State == state {
+			return conns[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected one connection in state %s, got %+v", state, conns)
+	return ConnInfo{}
+}
+
+func TestConnectionState(t *testing.T) {
+	s := makeForwardSetup(t, nil)
+	s.app.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s.upstream, buf); err != nil {
+		t.Fatal(err)
+	}
+	info := waitForState(t, s.h, ConnStateEstablished)
+	if info.UploadBytes != 5 || info.Client.String() != s.app.RemoteAddr().String() {
+		t.Errorf("Wrong info: %+v", info)
+	}
+
+	s.app.CloseWrite()
+	waitForState(t, s.h, ConnStateClientClosed)
+
+	s.upstream.Close()
+	s.waitForSummary(t, time.Second)
+	if conns := s.h.Connections(); len(conns) != 0 {
+		t.Errorf("Closed connections should not be reported: %+v", conns)
+	}
+}
+
+func TestDialTimeoutResets(t *testing.T) {
+	// A deadline in the past causes every dial to time out.
+	dialer := &net.Dialer{Deadline: time.Unix(1, 0)}
+	h := NewTCPHandler(net.TCPAddr{}, dialer, newFakeTCPListener())
+	failures := make(chan DialFailure, 1)
+	h.SetDialFailureHook(func(f DialFailure) { failures <- f })
+	_, local := makePair(t)
+	target := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	// Returning an error causes the core to reset the connection.
+	if err := h.Handle(&fakeTCPConn{local}, target); err == nil {
+		t.Fatal("Expected dial error")
+	}
+	select {
+	case f := <-failures:
+		if !f.Timeout || f.Err == nil || f.Target.Port != 80 {
+			t.Errorf("Unexpected failure: %+v", f)
+		}
+	default:
+		t.Fatal("Hook was not called")
+	}
+}
+
+func TestDialRefusedResets(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	failures := make(chan DialFailure, 1)
+	h.SetDialFailureHook(func(f DialFailure) { failures <- f })
+	_, local := makePair(t)
+	// Nothing is listening on port 1.
+	target := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	if err := h.Handle(&fakeTCPConn{local}, target); err == nil {
+		t.Fatal("Expected dial error")
+	}
+	if f := <-failures; f.Timeout {
+		t.Errorf("Refusal should not be a timeout: %v", f.Err)
+	}
+}
+
+func TestDialUsesHTTPSStrategy(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	server, received := makeEchoServer(t)
+	// The echo server isn't on port 443, but the HTTPS strategy still applies.
+	c, err := h.Dial(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(interface{ Phase() string }); !ok {
+		t.Errorf("Expected a split retry connection, got %T", c)
+	}
+	c.Write([]byte("hello"))
+	c.CloseWrite()
+	if got := <-received; string(got) != "hello" {
+		t.Errorf("Server received %q", got)
+	}
+	c.Close()
+
+	h.SetAlwaysSplitHTTPS(true)
+	c, err = h.Dial(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(interface{ Phase() string }); ok {
+		t.Error("Always splitting should not retry")
+	}
+}
+
+type retryRecorder chan *split.RetryStats
+
+func (r retryRecorder) OnRetryComplete(stats *split.RetryStats) {
+	r <- stats
+}
+
+func TestRetryListener(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	retries := make(retryRecorder, 1)
+	h.SetRetryListener(retries)
+	if !h.EffectiveConfig().RetryListener {
+		t.Error("The listener should be reported")
+	}
+	server, _ := makeEchoServer(t)
+	c, err := h.Dial(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	c.CloseWrite()
+	if _, err := c.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case stats := <-retries:
+		if stats.NoRetry != split.NoRetrySucceeded || stats.Bytes != 5 {
+			t.Errorf("Unexpected stats: %+v", *stats)
+		}
+	default:
+		t.Error("The listener should be notified of the decision")
+	}
+}
+
+// experimentTagger tags each connection with its client and target.
+type experimentTagger struct{}
+
+func (experimentTagger) ExperimentTag(client, target string) string {
+	return client + "->" + target
+}
+
+func TestExperimentTag(t *testing.T) {
+	listener := newFakeTCPListener()
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, listener).(*tcpHandler)
+	h.SetExperimentTagger(experimentTagger{})
+	records := make(chan TCPConnRecord, 1)
+	h.SetCloseHook(func(r TCPConnRecord) { records <- r })
+	server, _ := makeEchoServer(t)
+	if err := handleEcho(t, h, server); err != nil {
+		t.Fatal(err)
+	}
+	var r TCPConnRecord
+	select {
+	case r = <-records:
+	case <-time.After(time.Second):
+		t.Fatal("No close record")
+	}
+	if want := r.Client.String() + "->" + server.String(); r.ExperimentTag != want || r.Summary.ExperimentTag != want {
+		t.Errorf("Expected tag %q, got %q and %q", want, r.ExperimentTag, r.Summary.ExperimentTag)
+	}
+
+	// The tag is passed to the retrier, which echoes it in the RetryStats.
+	summary := &TCPSocketSummary{ExperimentTag: "split-arm"}
+	c, _, err := h.dialHTTPS(h.currentDialer(), server, summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if summary.Retry == nil || summary.Retry.ExperimentTag != "split-arm" {
+		t.Errorf("The tag should be echoed in the RetryStats: %+v", summary.Retry)
+	}
+
+	h.SetExperimentTagger(nil)
+	if err := handleEcho(t, h, server); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-records; r.ExperimentTag != "" {
+		t.Errorf("Unexpected tag without a tagger: %q", r.ExperimentTag)
+	}
+}
+
+// deadPeerConn is an upstream connection whose reads fail as they do when
+// keepalive probes go unanswered.
+type deadPeerConn struct {
+	*net.TCPConn
+}
+
+var errKeepaliveTimeout = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ETIMEDOUT)}
+
+func (c deadPeerConn) Read(b []byte) (int, error)         { return 0, errKeepaliveTimeout }
+func (c deadPeerConn) WriteTo(w io.Writer) (int64, error) { return 0, errKeepaliveTimeout }
+
+func TestDeadPeerClose(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener()).(*tcpHandler)
+	reasons := make(chan string, 1)
+	h.SetCloseHook(func(r TCPConnRecord) { reasons <- r.CloseReason })
+	_, local := makePair(t)
+	remote, _ := makePair(t)
+	// The app is still connected, so the connection only closes if the bridge
+	// reacts to the error.
+	go h.forward(&fakeTCPConn{local}, deadPeerConn{remote}, StrategyDirect, &TCPSocketSummary{}, nil)
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonDeadPeer {
+			t.Errorf("Expected %q, got %q", CloseReasonDeadPeer, reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dead connection was not closed")
+	}
+
+	if !isDeadPeer(errKeepaliveTimeout) {
+		t.Error("A keepalive timeout should mean a dead peer")
+	}
+	for _, err := range []error{nil, io.EOF, os.ErrDeadlineExceeded, syscall.ECONNRESET} {
+		if isDeadPeer(err) {
+			t.Errorf("%v should not mean a dead peer", err)
+		}
+	}
+}
+
+func TestUpstreamWriteTimeout(t *testing.T) {
+	reasons := make(chan string, 1)
+	s := makeForwardSetup(t, func(h *tcpHandler) {
+		h.SetUpstreamWriteTimeout(100 * time.Millisecond)
+		h.SetCloseHook(func(r TCPConnRecord) { reasons <- r.CloseReason })
+	})
+	// The server never reads, so the upstream writes block once the buffers
+	// fill.
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			if _, err := s.app.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonWriteTimeout {
+			t.Errorf("Expected %q, got %q", CloseReasonWriteTimeout, reason)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The wedged write never timed out")
+	}
+}
+
+func TestTCPPortPolicy(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	server, received := makeEchoServer(t)
+	p := filter.NewPortPolicy(filter.Allowlist)
+	p.AddRange(server.Port, server.Port)
+	h.SetPortPolicy(p)
+
+	app, local := makePair(t)
+	if err := h.Handle(&fakeTCPConn{local}, server); err != nil {
+		t.Fatal(err)
+	}
+	app.Write([]byte("hello"))
+	app.CloseWrite()
+	if reply, err := ioutil.ReadAll(app); err != nil || string(reply) != "hello" {
+		t.Errorf("Allowed port: got %q, %v", reply, err)
+	}
+	<-received
+
+	_, local = makePair(t)
+	blocked := &net.TCPAddr{IP: server.IP, Port: 25}
+	if err := h.Handle(&fakeTCPConn{local}, blocked); err == nil {
+		t.Error("Connection to an unlisted port should fail")
+	}
+	if n := h.DropCounts()[DropBlockedPort]; n != 1 {
+		t.Errorf("Expected 1 blocked connection, got %d", n)
+	}
+}
+
+// Returns a server that closes each connection as soon as it is accepted.
+func makeRejectingServer(t *testing.T) *net.TCPAddr {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestImmediateClose(t *testing.T) {
+	server := makeRejectingServer(t)
+	for _, policy := range []string{ImmediateCloseHalfClose, ImmediateCloseFull, ImmediateCloseReset} {
+		listener := newFakeTCPListener()
+		h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, listener)
+		if err := h.SetImmediateClosePolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+		reasons := make(chan string, 1)
+		h.SetCloseHook(func(r TCPConnRecord) { reasons <- r.CloseReason })
+		app, local := makePair(t)
+		if err := h.Handle(&fakeTCPConn{local}, server); err != nil {
+			t.Fatal(err)
+		}
+		// The app is still open, and the close reaches it promptly.
+		app.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := app.Read(make([]byte, 1))
+		if policy == ImmediateCloseReset {
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Errorf("%s: expected a reset, got %d, %v", policy, n, err)
+			}
+		} else if n != 0 || err != io.EOF {
+			t.Errorf("%s: expected a clean close, got %d, %v", policy, n, err)
+		}
+
+		if policy == ImmediateCloseHalfClose {
+			// The client can still close its side normally.
+			app.CloseWrite()
+		}
+		select {
+		case reason := <-reasons:
+			if policy == ImmediateCloseHalfClose && reason != "" {
+				t.Errorf("%s: unexpected close reason %q", policy, reason)
+			} else if policy != ImmediateCloseHalfClose && reason != CloseReasonImmediateClose {
+				t.Errorf("%s: expected %q, got %q", policy, CloseReasonImmediateClose, reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: the connection was not torn down", policy)
+		}
+		app.Close()
+	}
+
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	if err := h.SetImmediateClosePolicy("bogus"); err == nil {
+		t.Error("Unknown policy should be rejected")
+	}
+}
+
+func TestSplitCachePersistence(t *testing.T) {
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	if _, err := h.DumpSplitCache(); err == nil {
+		t.Error("Dump should fail when learned splits are disabled")
+	}
+	if err := h.LoadSplitCache([]byte(`{"Version":1}`), 0); err == nil {
+		t.Error("Load should fail when learned splits are disabled")
+	}
+	h.SetLearnedSplits(10)
+	dump := []byte(`{"Version":1,"Entries":[{"Key":"www.example","Offset":7,"Learned":"2000-01-01T00:00:00Z"}]}`)
+	if err := h.LoadSplitCache(dump, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.(*tcpHandler).learnedSplits.Len(); n != 0 {
+		t.Errorf("The stale split should be dropped: %d", n)
+	}
+	if err := h.LoadSplitCache(dump, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := h.DumpSplitCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, newFakeTCPListener())
+	restored.SetLearnedSplits(10)
+	if err := restored.LoadSplitCache(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := restored.(*tcpHandler).learnedSplits.Len(); n != 1 {
+		t.Errorf("Expected the split to round-trip: %d", n)
+	}
+}
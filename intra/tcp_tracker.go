@@ -0,0 +1,350 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/clock"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+)
+
+// tcpTracker records the live state of a forwarded TCP connection.
+type tcpTracker struct {
+	// The byte counters and activity time are updated atomically by the copy
+	// loops.  They are first in the struct to ensure 64-bit alignment on 32-bit
+	// platforms.
+	upload     int64
+	download   int64
+	lastActive int64 // UnixNano time of the last forwarded data, or of the start.
+	local      core.TCPConn
+	remote     split.DuplexConn
+	clock      clock.Clock
+	start      time.Time
+	timer      clock.Timer   // Fires when the half-open threshold is reached.
+	idleTimer  clock.Timer   // Fires when the idle timeout might have expired.
+	graceTimer clock.Timer   // Fires when the half-close grace period expires.
+	lifeTimer  clock.Timer   // Fires when the maximum lifetime expires.
+	done       chan struct{} // Closed when the connection is no longer tracked.
+	closed     chan struct{} // Closed by the first call to close.
+	// Interceptor transforms for each direction, or nil.  Set before the copy
+	// loops start.
+	uploadTransform   transform
+	downloadTransform transform
+	// budget tracks usage of the ByteBudget, or is nil if it is unlimited.
+	budget *connBudget
+	// writeTimeout bounds each upstream write by the upload loop, or is zero.
+	writeTimeout time.Duration
+
+	mu           sync.Mutex // Protects the fields below.
+	closeReason  string     // Why the bridge closed the connection, if it did.
+	clientClosed bool       // True once the upload loop has finished.
+	serverClosed bool       // True once the download loop has finished.
+	closing      bool       // True once closed has been closed.
+}
+
+// idle reports whether no bytes have been forwarded in either direction.
+func (t *tcpTracker) idle() bool {
+	return atomic.LoadInt64(&t.upload) == 0 && atomic.LoadInt64(&t.download) == 0
+}
+
+// rejected reports whether the server closed the connection before any data
+// was forwarded in either direction, while the client was still open, and
+// without the bridge closing it first.
+func (t *tcpTracker) rejected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.idle() && !t.clientClosed && t.closeReason == ""
+}
+
+// inactive returns the time since data was last forwarded.
+func (t *tcpTracker) inactive() time.Duration {
+	return time.Duration(t.clock.Now().UnixNano() - atomic.LoadInt64(&t.lastActive))
+}
+
+// close tears down both sides of the connection, which causes the copy loops
+// to exit.  `reason` is reported in the TCPConnRecord, unless another reason
+// was recorded first.
+func (t *tcpTracker) close(reason string) {
+	t.mu.Lock()
+	if t.closeReason == "" {
+		t.closeReason = reason
+	}
+	if !t.closing {
+		t.closing = true
+		close(t.closed)
+	}
+	t.mu.Unlock()
+	t.local.Close()
+	t.remote.Close()
+}
+
+// reason returns the reason passed to the first call to close, or "".
+func (t *tcpTracker) reason() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeReason
+}
+
+// finished records that the upload (`client` is true) or download loop has
+// finished.
+func (t *tcpTracker) finished(client bool) {
+	t.mu.Lock()
+	if client {
+		t.clientClosed = true
+	} else {
+		t.serverClosed = true
+	}
+	t.mu.Unlock()
+}
+
+// info returns a snapshot of the connection.
+func (t *tcpTracker) info() ConnInfo {
+	t.mu.Lock()
+	state := ConnStateEstablished
+	switch {
+	case t.clientClosed && t.serverClosed:
+		state = ConnStateClosing
+	case t.clientClosed:
+		state = ConnStateClientClosed
+	case t.serverClosed:
+		state = ConnStateServerClosed
+	}
+	t.mu.Unlock()
+	return ConnInfo{
+		Client:        t.local.LocalAddr(),
+		Target:        t.remote.RemoteAddr(),
+		Start:         t.start,
+		State:         state,
+		UploadBytes:   atomic.LoadInt64(&t.upload),
+		DownloadBytes: atomic.LoadInt64(&t.download),
+	}
+}
+
+// countingReader adds the number of bytes read to `n`, and records the time
+// of the read in `last`.
+type countingReader struct {
+	io.Reader
+	n     *int64
+	last  *int64
+	clock clock.Clock
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		atomic.AddInt64(r.n, int64(n))
+		atomic.StoreInt64(r.last, r.clock.Now().UnixNano())
+	}
+	return n, err
+}
+
+// countingWriter adds the number of bytes written to `n`, and records the time
+// of the write in `last`.
+type countingWriter struct {
+	io.Writer
+	n     *int64
+	last  *int64
+	clock clock.Clock
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if n > 0 {
+		atomic.AddInt64(w.n, int64(n))
+		atomic.StoreInt64(w.last, w.clock.Now().UnixNano())
+	}
+	return n, err
+}
+
+// tcpRegistry holds the set of active TCP connections.
+type tcpRegistry struct {
+	mu    sync.Mutex // Protects all fields.
+	conns map[*tcpTracker]struct{}
+	// Connections that have forwarded no data for longer than this are half-open.
+	// Zero disables half-open detection.
+	halfOpenThreshold time.Duration
+	// If true, half-open connections are closed when they reach the threshold.
+	reapHalfOpen bool
+	// Connections that have forwarded no data for this long since their last
+	// activity are closed.  Zero disables the idle timeout.
+	idleTimeout time.Duration
+	// Connections are closed this long after they start, even if they are
+	// active.  Zero disables the limit.
+	maxLifetime time.Duration
+	// After the client half-closes a connection, it is closed completely if the
+	// server hasn't also closed it within this grace period.  Zero disables the
+	// grace period, so the server may keep the connection half-open.
+	halfCloseGrace time.Duration
+	// clock is the source of time for all connections.  Nil means clock.Real.
+	clock clock.Clock
+}
+
+// add starts tracking a connection.
+func (r *tcpRegistry) add(local core.TCPConn, remote split.DuplexConn) *tcpTracker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := clock.Or(r.clock)
+	start := c.Now()
+	t := &tcpTracker{
+		lastActive: start.UnixNano(),
+		local:      local,
+		remote:     remote,
+		clock:      c,
+		start:      start,
+		done:       make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	if r.conns == nil {
+		r.conns = make(map[*tcpTracker]struct{})
+	}
+	r.conns[t] = struct{}{}
+	if r.reapHalfOpen && r.halfOpenThreshold > 0 {
+		t.timer = c.AfterFunc(r.halfOpenThreshold, func() {
+			if t.idle() {
+				log.Infof("Closing half-open connection to %v", remote.RemoteAddr())
+				t.close(CloseReasonHalfOpen)
+			}
+		})
+	}
+	if timeout := r.idleTimeout; timeout > 0 {
+		t.idleTimer = c.AfterFunc(timeout, func() { r.checkIdle(t, timeout) })
+	}
+	if r.maxLifetime > 0 {
+		t.lifeTimer = c.AfterFunc(r.maxLifetime, func() {
+			log.Infof("Closing connection to %v at its maximum lifetime", remote.RemoteAddr())
+			t.close(CloseReasonMaxLifetime)
+		})
+	}
+	return t
+}
+
+// remove stops tracking a connection.
+func (r *tcpRegistry) remove(t *tcpTracker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+	}
+	if t.graceTimer != nil {
+		t.graceTimer.Stop()
+	}
+	if t.lifeTimer != nil {
+		t.lifeTimer.Stop()
+	}
+	close(t.done)
+	delete(r.conns, t)
+}
+
+// setHalfOpenPolicy configures half-open detection for new connections.
+func (r *tcpRegistry) setHalfOpenPolicy(threshold time.Duration, reap bool) {
+	r.mu.Lock()
+	r.halfOpenThreshold = threshold
+	r.reapHalfOpen = reap
+	r.mu.Unlock()
+}
+
+// checkIdle closes `t` if it has been inactive for `timeout`, and otherwise
+// rearms its idle timer.
+func (r *tcpRegistry) checkIdle(t *tcpTracker, timeout time.Duration) {
+	r.mu.Lock()
+	if _, ok := r.conns[t]; !ok {
+		// Already removed.
+		r.mu.Unlock()
+		return
+	}
+	inactive := t.inactive()
+	if inactive < timeout {
+		t.idleTimer.Reset(timeout - inactive)
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+	log.Infof("Closing idle connection to %v", t.remote.RemoteAddr())
+	t.close(CloseReasonIdle)
+}
+
+// halfClosed records that the client has half-closed `t`, and starts the
+// half-close grace period, if any.
+func (r *tcpRegistry) halfClosed(t *tcpTracker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.conns[t]; !ok || r.halfCloseGrace <= 0 {
+		return
+	}
+	t.graceTimer = t.clock.AfterFunc(r.halfCloseGrace, func() {
+		log.Infof("Closing half-closed connection to %v", t.remote.RemoteAddr())
+		t.close(CloseReasonHalfCloseGrace)
+	})
+}
+
+// setHalfCloseGrace configures the half-close grace period for connections
+// that are half-closed in the future.
+func (r *tcpRegistry) setHalfCloseGrace(grace time.Duration) {
+	r.mu.Lock()
+	r.halfCloseGrace = grace
+	r.mu.Unlock()
+}
+
+// setIdleTimeout configures the idle timeout for new connections.
+func (r *tcpRegistry) setIdleTimeout(timeout time.Duration) {
+	r.mu.Lock()
+	r.idleTimeout = timeout
+	r.mu.Unlock()
+}
+
+// setMaxLifetime configures the maximum lifetime of new connections.
+func (r *tcpRegistry) setMaxLifetime(lifetime time.Duration) {
+	r.mu.Lock()
+	r.maxLifetime = lifetime
+	r.mu.Unlock()
+}
+
+// halfOpen returns the number of active connections that have forwarded
+// no data for longer than the half-open threshold.
+func (r *tcpRegistry) halfOpen() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.halfOpenThreshold <= 0 {
+		return 0
+	}
+	count := 0
+	for t := range r.conns {
+		if t.idle() && t.clock.Now().Sub(t.start) >= r.halfOpenThreshold {
+			count++
+		}
+	}
+	return count
+}
+
+// snapshot returns the state of every active connection.
+func (r *tcpRegistry) snapshot() []ConnInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]ConnInfo, 0, len(r.conns))
+	for t := range r.conns {
+		infos = append(infos, t.info())
+	}
+	return infos
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/clock"
+)
+
+// ThroughputLimit caps the aggregate throughput of all forwarded TCP
+// connections, in each direction.  Zero fields are unlimited.
+type ThroughputLimit struct {
+	UploadBytesPerSec   int64 // From the clients to the servers.
+	DownloadBytesPerSec int64 // From the servers to the clients.
+}
+
+// ThroughputStats is the aggregate throughput of all forwarded TCP connections,
+// as an exponentially weighted moving average with a time constant of
+// throughputTau.
+type ThroughputStats struct {
+	UploadBytesPerSec   float64
+	DownloadBytesPerSec float64
+}
+
+// throughputTau is the time constant of the throughput average.
+const throughputTau = 2 * time.Second
+
+// minThroughputRead is the smallest read that a limited connection may make,
+// however low the limit.
+const minThroughputRead = 512
+
+// tokenBucket limits the rate of bytes read by many readers.  Bytes are charged
+// after each read, rather than reserved before it, so that a read that blocks
+// doesn't hold tokens that other readers could use.  The bucket may therefore
+// go into debt, and readers wait until it is repaid before reading again.  The
+// bucket holds up to 100 ms of bytes, so idle periods allow only a small burst.
+type tokenBucket struct {
+	mu     sync.Mutex // Protects all fields.
+	rate   int64      // Bytes per second, or zero if unlimited.
+	tokens float64    // Negative when in debt.
+	last   time.Time  // When tokens was last updated, or zero if never.
+}
+
+func (b *tokenBucket) burst() float64 {
+	return float64(b.rate) / 10
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	b.rate = rate
+	b.tokens = b.burst()
+	b.last = time.Time{}
+}
+
+func (b *tokenBucket) limit() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// maxRead returns the largest read that may be charged at once, so that no
+// single read runs up a long debt, or 0 if the bucket is unlimited.
+func (b *tokenBucket) maxRead() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	if max := int(b.burst()); max > minThroughputRead {
+		return max
+	}
+	return minThroughputRead
+}
+
+// refill adds the tokens earned since the last update.  The caller must hold mu.
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst(), b.tokens+now.Sub(b.last).Seconds()*float64(b.rate))
+	}
+	b.last = now
+}
+
+// charge deducts `n` bytes at time `now`.
+func (b *tokenBucket) charge(now time.Time, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+// delay returns how long, as of `now`, a reader must wait for the debt to be
+// repaid.
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// rateMeter is an exponentially weighted moving average of a byte rate.  Each
+// byte adds 1/throughputTau to the rate, which then decays exponentially, so a
+// constant rate converges to its true value.
+type rateMeter struct {
+	mu   sync.Mutex // Protects all fields.
+	rate float64    // Bytes per second, as of last.
+	last time.Time
+}
+
+func (m *rateMeter) decay(now time.Time) {
+	if dt := now.Sub(m.last); dt > 0 && !m.last.IsZero() {
+		m.rate *= math.Exp(-dt.Seconds() / throughputTau.Seconds())
+	}
+	m.last = now
+}
+
+func (m *rateMeter) add(now time.Time, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decay(now)
+	m.rate += float64(n) / throughputTau.Seconds()
+}
+
+func (m *rateMeter) read(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decay(now)
+	return m.rate
+}
+
+// direction is the shared throughput state of one direction of the tunnel.
+type direction struct {
+	bucket tokenBucket
+	meter  rateMeter
+}
+
+// throughput limits and measures the aggregate throughput of a handler.
+type throughput struct {
+	up, down direction
+	// clock is the source of time.  Nil means clock.Real.  Tests replace it.
+	clock clock.Clock
+}
+
+// reader returns a reader that draws from `d`, and stops waiting for the
+// limit once `closed` is closed.
+func (t *throughput) reader(r io.Reader, d *direction, closed <-chan struct{}) io.Reader {
+	return throughputReader{r, d, clock.Or(t.clock), closed}
+}
+
+func (t *throughput) stats() ThroughputStats {
+	now := clock.Or(t.clock).Now()
+	return ThroughputStats{
+		UploadBytesPerSec:   t.up.meter.read(now),
+		DownloadBytesPerSec: t.down.meter.read(now),
+	}
+}
+
+// throughputReader charges each read to the shared direction, and waits before
+// reading while the direction is over its limit.  The wait always ends when the
+// connection is closed, so a closing connection can't be stuck in the limiter.
+type throughputReader struct {
+	r      io.Reader
+	dir    *direction
+	clock  clock.Clock
+	closed <-chan struct{}
+}
+
+func (r throughputReader) Read(p []byte) (int, error) {
+	for {
+		wait := r.dir.bucket.delay(r.clock.Now())
+		if wait <= 0 {
+			break
+		}
+		ready := make(chan struct{})
+		timer := r.clock.AfterFunc(wait, func() { close(ready) })
+		select {
+		case <-ready:
+			continue
+		case <-r.closed:
+			timer.Stop()
+		}
+		break
+	}
+	if max := r.dir.bucket.maxRead(); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		now := r.clock.Now()
+		r.dir.meter.add(now, n)
+		r.dir.bucket.charge(now, n)
+	}
+	return n, err
+}
+
+func (h *tcpHandler) SetThroughputLimit(l ThroughputLimit) {
+	h.throughput.up.bucket.setRate(l.UploadBytesPerSec)
+	h.throughput.down.bucket.setRate(l.DownloadBytesPerSec)
+}
+
+func (h *tcpHandler) Throughput() ThroughputStats {
+	return h.throughput.stats()
+}
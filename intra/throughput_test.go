@@ -0,0 +1,210 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/internal/clock"
+)
+
+// Returns the address of a server that writes to each connection until it
+// fails.
+func makeSourceServer(t *testing.T) *net.TCPAddr {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				chunk := make([]byte, 8192)
+				for {
+					if _, err := c.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	var b tokenBucket
+	b.charge(now, 1e6)
+	if wait := b.delay(now); wait != 0 {
+		t.Errorf("An unlimited bucket should not wait: %v", wait)
+	}
+	b.setRate(1000)
+	if max := b.maxRead(); max != minThroughputRead {
+		t.Errorf("Unexpected max read %d", max)
+	}
+	// The bucket starts with a burst of 100 ms.
+	b.charge(now, 100)
+	if wait := b.delay(now); wait != 0 {
+		t.Errorf("The burst should not wait: %v", wait)
+	}
+	b.charge(now, 200)
+	if wait := b.delay(now); wait != 200*time.Millisecond {
+		t.Errorf("Expected to wait 200 ms, got %v", wait)
+	}
+	// Every reader's bytes are charged to the same debt.
+	b.charge(now, 100)
+	if wait := b.delay(now.Add(100 * time.Millisecond)); wait != 200*time.Millisecond {
+		t.Errorf("Expected to wait 200 ms, got %v", wait)
+	}
+	// Idle time repays the debt, but only refills the burst.
+	now = now.Add(time.Hour)
+	b.charge(now, 200)
+	if wait := b.delay(now); wait != 100*time.Millisecond {
+		t.Errorf("Expected to wait 100 ms after idling, got %v", wait)
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	now := time.Unix(0, 0)
+	var m rateMeter
+	for i := 0; i < 200; i++ {
+		m.add(now, 1000)
+		now = now.Add(100 * time.Millisecond)
+	}
+	if rate := m.read(now); math.Abs(rate-10000) > 500 {
+		t.Errorf("Expected about 10000 B/s, got %f", rate)
+	}
+	// The average decays when there is no traffic.
+	if rate := m.read(now.Add(10 * throughputTau)); rate > 1 {
+		t.Errorf("Expected the rate to decay, got %f", rate)
+	}
+}
+
+func TestThroughputLimit(t *testing.T) {
+	const conns = 4
+	const limit = 256 * 1024
+	const duration = time.Second
+	listener := &fakeTCPListener{make(chan *TCPSocketSummary, conns)}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, listener)
+	h.SetThroughputLimit(ThroughputLimit{DownloadBytesPerSec: limit})
+	server := makeSourceServer(t)
+
+	var total int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < conns; i++ {
+		app, local := makePair(t)
+		if err := h.Handle(&fakeTCPConn{local}, server); err != nil {
+			t.Fatal(err)
+		}
+		app.SetReadDeadline(start.Add(duration))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer app.Close()
+			n, _ := io.Copy(ioutil.Discard, app)
+			atomic.AddInt64(&total, n)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	// Each connection may read one chunk before it waits, and the bucket starts
+	// with a burst.
+	max := float64(limit)*elapsed.Seconds() + float64(limit)/10 + conns*float64(limit)/10
+	if float64(total) > max {
+		t.Errorf("Received %d bytes in %v, more than the limit allows (%f)", total, elapsed, max)
+	}
+	if float64(total) < float64(limit)*elapsed.Seconds()/2 {
+		t.Errorf("Received only %d bytes in %v", total, elapsed)
+	}
+	stats := h.Throughput()
+	if stats.DownloadBytesPerSec <= 0 || stats.DownloadBytesPerSec > 1.2*limit {
+		t.Errorf("Unexpected aggregate throughput %f", stats.DownloadBytesPerSec)
+	}
+	if stats.UploadBytesPerSec != 0 {
+		t.Errorf("Nothing was uploaded: %f", stats.UploadBytesPerSec)
+	}
+	if c := h.EffectiveConfig().Throughput; c.DownloadBytesPerSec != limit || c.UploadBytesPerSec != 0 {
+		t.Errorf("Unexpected config %+v", c)
+	}
+}
+
+func TestThroughputCloseWhileWaiting(t *testing.T) {
+	listener := &fakeTCPListener{make(chan *TCPSocketSummary, 1)}
+	h := NewTCPHandler(net.TCPAddr{}, &net.Dialer{}, listener).(*tcpHandler)
+	// The first read puts the bucket deep into debt.
+	h.SetThroughputLimit(ThroughputLimit{DownloadBytesPerSec: 10})
+	h.SetMaxConnLifetime(200 * time.Millisecond)
+	server := makeSourceServer(t)
+	app, local := makePair(t)
+	defer app.Close()
+	if err := h.Handle(&fakeTCPConn{local}, server); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the connection ends the wait, which would otherwise take almost
+	// a minute.
+	waitForGoroutines(t, h, 0)
+}
+
+func TestThroughputFakeClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	tp := &throughput{clock: fake}
+	tp.up.bucket.setRate(1000)
+	closed := make(chan struct{})
+	r := tp.reader(zeroReader{}, &tp.up, closed)
+	buf := make([]byte, 1000)
+	if n, _ := r.Read(buf); n != minThroughputRead {
+		t.Fatalf("Expected a read of %d, got %d", minThroughputRead, n)
+	}
+	// The next read waits until the debt of the first is repaid.
+	done := make(chan struct{})
+	go func() {
+		r.Read(buf)
+		done <- struct{}{}
+		// This read waits until the reader is closed.
+		r.Read(buf)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("The read should wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	fake.Advance(time.Second)
+	<-done
+	close(closed)
+	<-done
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -20,11 +20,14 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/eycorsican/go-tun2socks/core"
 
 	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/tunnel"
 )
 
@@ -45,8 +48,114 @@ type Tunnel interface {
 	// to the TUN device.  The transport can be changed at any time during operation, but
 	// must not be nil.
 	SetDNS(doh.Transport)
+	// When set to true, the DoH transport connects to its server directly, using
+	// the split and retry strategy of tunneled HTTPS connections, for this
+	// transport and any set later.  The proxy and the dial retry policy are not
+	// used.  The server's name is still resolved without DoH.  Transports
+	// that don't support a custom dialer are unaffected.
+	SetDoHStrategyDialer(bool)
+	// When set to true, UDP DNS queries to port 53 of any address, not only the
+	// fake DNS address, are resolved by the DNSTransport, so that apps with a
+	// hardcoded resolver don't bypass it.
+	SetDNSCapture(bool)
 	// When set to true, Intra will pre-emptively split all HTTPS connections.
 	SetAlwaysSplitHTTPS(bool)
+	// Get the destination filter.  It is initially an empty blocklist, which
+	// permits all destinations.  Changes to the filter take effect immediately.
+	GetFilter() *filter.Filter
+	// Get the destination port policy.  It is initially an empty blocklist,
+	// which permits all ports.  Changes to the policy take effect immediately.
+	GetPortPolicy() *filter.PortPolicy
+	// Set the IP TTL (or IPv6 hop limit) used for upstream TCP connections.
+	// Zero restores the system default.
+	SetUpstreamTTL(int)
+	// Restrict the local ports of upstream TCP and UDP sockets to the inclusive
+	// range `min`-`max`.  If every port in the range is in use, an ephemeral port
+	// is used instead.  Zero for both restores the default.
+	SetUpstreamPortRange(min, max int) error
+	// Clamp the TCP maximum segment size of upstream connections to `mss`, where
+	// supported.  Zero restores the system default.
+	SetMSSClamp(mss int)
+	// When set to true, the MSS of each upstream TCP connection is also clamped to
+	// the MSS that the app advertised when it connected, if that is smaller.
+	SetMirrorClientMSS(bool)
+	// When set to true, the receive buffer of each upstream TCP connection is
+	// sized to the window that the app advertised when it connected, so that the
+	// upstream advertises a similar window scale.  SACK and timestamps follow the
+	// system settings.
+	SetMirrorClientOptions(bool)
+	// When set to true, the IP TTL (or IPv6 hop limit) of each upstream TCP
+	// connection matches the TTL of the app's packets, instead of the
+	// SetUpstreamTTL value.
+	SetMirrorClientTTL(bool)
+	// Configure detection of half-open TCP connections, which have forwarded no
+	// data for at least `seconds`.  If `reap` is true, they are closed.  Zero
+	// disables detection.
+	SetHalfOpenPolicy(seconds int, reap bool)
+	// Get the number of TCP connections that are currently half-open.
+	GetHalfOpenCount() int
+	// Get the number of goroutines running on behalf of TCP connections, UDP
+	// associations and DNS queries.  For leak detection, this should return to
+	// its baseline once all connections have closed.
+	GetConnGoroutineCount() int
+	// Get the number of file descriptors open in this process, or -1 if it is
+	// not available on this platform.
+	GetOpenFDCount() int
+	// Configure the connection timeouts.  TCP connections and UDP associations
+	// that have not exchanged any data within `noDataSeconds` are closed.  Those
+	// that have, but then forward no data for `idleSeconds`, are also closed.
+	// Zero disables a timer, except that the UDP idle timeout remains 5 minutes.
+	// Setting `noDataSeconds` replaces any half-open policy.
+	SetTimeouts(noDataSeconds, idleSeconds int)
+	// Override the UDP idle timeout for associations whose first non-DNS
+	// datagram was sent to `port`, e.g. to keep QUIC or game flows longer.
+	// Zero removes the override.
+	SetUDPPortTimeout(port, idleSeconds int) error
+	// Limit the number of UDP associations.  When the limit is reached, the
+	// least recently active association is closed to make room.  Zero removes
+	// the limit.
+	SetMaxUDPFlows(n int) error
+	// Set how packets from the TUN device are checked before they reach the
+	// network stack, to PacketCheckOff (the default), PacketCheckCount or
+	// PacketCheckDrop.  The stack itself doesn't verify checksums or report
+	// the packets it discards.
+	SetPacketCheckPolicy(policy string) error
+	// Get the number of packets whose IP, TCP or UDP header was truncated or
+	// inconsistent, while packet checking was enabled.
+	GetMalformedPacketCount() int64
+	// Get the number of packets with a wrong IPv4 header, TCP or UDP checksum,
+	// while packet checking was enabled.
+	GetBadChecksumCount() int64
+	// Get the fully resolved configuration, with defaults applied and secrets
+	// redacted, for debugging.  It is not exported by gobind; use
+	// GetEffectiveConfigJSON instead.
+	EffectiveConfig() EffectiveConfig
+	// Get the EffectiveConfig, encoded as JSON.
+	GetEffectiveConfigJSON() (string, error)
+	// Flush the DNS cache, if the DoH transport has one, and the learned
+	// splits, without affecting active connections.
+	FlushCaches()
+	// Set a listener that is notified, with the RetryStats, when the retry
+	// decision of each TCP connection that may be retried is made.  This
+	// reports how often retries occur and succeed without waiting for the
+	// connection to close.  Nil disables it.
+	SetRetryListener(split.RetryListener)
+	// Set a tagger that assigns an opaque experiment tag to each new TCP
+	// connection.  The tag is echoed in the RetryStats and the
+	// TCPSocketSummary, so that outcomes can be grouped by experiment arm.
+	// Nil disables tagging.
+	SetExperimentTagger(ExperimentTagger)
+	// Serialize the learned splits, so that they can be restored by
+	// LoadSplitCache after the tunnel restarts.
+	DumpSplitCache() ([]byte, error)
+	// Restore the learned splits written by DumpSplitCache, dropping splits
+	// that were learned more than `maxAgeSeconds` ago.  Zero keeps splits of any
+	// age.
+	LoadSplitCache(data []byte, maxAgeSeconds int) error
+	// Zero the drop counts of the TCP and UDP handlers, the packet check counts,
+	// and the statistics of the DoH transport, if it has any, without affecting
+	// active connections.
+	ResetStats()
 	// Enable reporting of SNIs that resulted in connection failures, using the
 	// Choir library for privacy-preserving error reports.  `file` is the path
 	// that Choir should use to store its persistent state, `suffix` is the
@@ -57,9 +166,14 @@ type Tunnel interface {
 
 type intratunnel struct {
 	tunnel.Tunnel
-	tcp TCPHandler
-	udp UDPHandler
-	dns doh.Transport
+	tcp    TCPHandler
+	udp    UDPHandler
+	dns    doh.Transport
+	filter *filter.Filter
+	ports  *filter.PortPolicy
+	// If true, DoH transports connect with t.tcp.Dial.
+	dohStrategyDialer bool
+	packets           packetChecker
 }
 
 // NewTunnel creates a connected Intra session.
@@ -76,10 +190,12 @@ func NewTunnel(fakedns string, dohdns doh.Transport, tunWriter io.WriteCloser, d
 	if tunWriter == nil {
 		return nil, errors.New("Must provide a valid TUN writer")
 	}
-	core.RegisterOutputFn(tunWriter.Write)
 	t := &intratunnel{
 		Tunnel: tunnel.NewTunnel(tunWriter, core.NewLWIPStack()),
+		filter: filter.NewFilter(filter.Blocklist),
+		ports:  filter.NewPortPolicy(filter.Blocklist),
 	}
+	core.RegisterOutputFn(tunnel.OutputFn(t, tunWriter))
 	if err := t.registerConnectionHandlers(fakedns, dialer, config, listener); err != nil {
 		return nil, err
 	}
@@ -87,6 +203,22 @@ func NewTunnel(fakedns string, dohdns doh.Transport, tunWriter io.WriteCloser, d
 	return t, nil
 }
 
+// Disconnect cancels outstanding DNS queries and dial retries, and then
+// disconnects the tunnel.
+func (t *intratunnel) Disconnect() {
+	t.udp.Shutdown()
+	t.tcp.Shutdown()
+	t.Tunnel.Disconnect()
+}
+
+// Fail cancels outstanding DNS queries and dial retries, and then fails the
+// tunnel.
+func (t *intratunnel) Fail(err error) {
+	t.udp.Shutdown()
+	t.tcp.Shutdown()
+	t.Tunnel.Fail(err)
+}
+
 // Registers Intra's custom UDP and TCP connection handlers to the tun2socks core.
 func (t *intratunnel) registerConnectionHandlers(fakedns string, dialer *net.Dialer, config *net.ListenConfig, listener Listener) error {
 	// RFC 4787 REQ-5 requires a timeout no shorter than 5 minutes.
@@ -97,6 +229,8 @@ func (t *intratunnel) registerConnectionHandlers(fakedns string, dialer *net.Dia
 		return err
 	}
 	t.udp = NewUDPHandler(*udpfakedns, timeout, config, listener)
+	t.udp.SetFilter(t.filter)
+	t.udp.SetPortPolicy(t.ports)
 	core.RegisterUDPConnHandler(t.udp)
 
 	tcpfakedns, err := net.ResolveTCPAddr("tcp", fakedns)
@@ -104,24 +238,173 @@ func (t *intratunnel) registerConnectionHandlers(fakedns string, dialer *net.Dia
 		return err
 	}
 	t.tcp = NewTCPHandler(*tcpfakedns, dialer, listener)
+	t.tcp.SetFilter(t.filter)
+	t.tcp.SetPortPolicy(t.ports)
 	core.RegisterTCPConnHandler(t.tcp)
 	return nil
 }
 
 func (t *intratunnel) SetDNS(dns doh.Transport) {
 	t.dns = dns
+	t.applyDoHDialer()
 	t.udp.SetDNS(dns)
 	t.tcp.SetDNS(dns)
 }
 
+func (t *intratunnel) SetDoHStrategyDialer(enabled bool) {
+	t.dohStrategyDialer = enabled
+	t.applyDoHDialer()
+}
+
+// applyDoHDialer sets the dialer of the current DoH transport, if it supports
+// one.  The transport resolves its server's name with the system resolver, so
+// dialing through the TCP handler doesn't depend on the transport itself.
+func (t *intratunnel) applyDoHDialer() {
+	d, ok := t.dns.(interface{ SetDialFunc(doh.DialFunc) })
+	if !ok {
+		return
+	}
+	if t.dohStrategyDialer {
+		d.SetDialFunc(t.tcp.Dial)
+	} else {
+		d.SetDialFunc(nil)
+	}
+}
+
+func (t *intratunnel) FlushCaches() {
+	t.tcp.FlushCaches()
+	if c, ok := t.dns.(interface{ Flush() }); ok {
+		c.Flush()
+	}
+}
+
+func (t *intratunnel) SetRetryListener(l split.RetryListener) {
+	t.tcp.SetRetryListener(l)
+}
+
+func (t *intratunnel) SetExperimentTagger(tagger ExperimentTagger) {
+	t.tcp.SetExperimentTagger(tagger)
+}
+
+func (t *intratunnel) DumpSplitCache() ([]byte, error) {
+	return t.tcp.DumpSplitCache()
+}
+
+func (t *intratunnel) LoadSplitCache(data []byte, maxAgeSeconds int) error {
+	return t.tcp.LoadSplitCache(data, time.Duration(maxAgeSeconds)*time.Second)
+}
+
+func (t *intratunnel) ResetStats() {
+	t.tcp.ResetStats()
+	t.udp.ResetStats()
+	t.packets.reset()
+	if s, ok := t.dns.(interface{ ResetStats() }); ok {
+		s.ResetStats()
+	}
+}
+
 func (t *intratunnel) GetDNS() doh.Transport {
 	return t.dns
 }
 
+func (t *intratunnel) SetDNSCapture(capture bool) {
+	t.udp.SetDNSCapture(capture)
+}
+
 func (t *intratunnel) SetAlwaysSplitHTTPS(s bool) {
 	t.tcp.SetAlwaysSplitHTTPS(s)
 }
 
+func (t *intratunnel) GetFilter() *filter.Filter {
+	return t.filter
+}
+
+func (t *intratunnel) GetPortPolicy() *filter.PortPolicy {
+	return t.ports
+}
+
+func (t *intratunnel) SetUpstreamTTL(ttl int) {
+	t.tcp.SetUpstreamTTL(ttl)
+}
+
+func (t *intratunnel) SetUpstreamPortRange(min, max int) error {
+	if err := t.tcp.SetPortRange(min, max); err != nil {
+		return err
+	}
+	return t.udp.SetPortRange(min, max)
+}
+
+func (t *intratunnel) SetMSSClamp(mss int) {
+	t.tcp.SetMSSClamp(mss)
+}
+
+func (t *intratunnel) SetMirrorClientMSS(mirror bool) {
+	t.tcp.SetClientMSSMirroring(mirror)
+}
+
+func (t *intratunnel) SetMirrorClientOptions(mirror bool) {
+	t.tcp.SetClientOptionMirroring(mirror)
+}
+
+func (t *intratunnel) SetMirrorClientTTL(mirror bool) {
+	t.tcp.SetClientTTLMirroring(mirror)
+}
+
+// Write passes each packet to the TCP handler, which records the options of SYNs,
+// before writing it to the network stack.  Packets that fail the packet check
+// are discarded without an error if the policy is PacketCheckDrop.
+func (t *intratunnel) Write(data []byte) (int, error) {
+	if !t.packets.allow(data) {
+		return len(data), nil
+	}
+	t.tcp.ObservePacket(data)
+	return t.Tunnel.Write(data)
+}
+
+func (t *intratunnel) SetPacketCheckPolicy(policy string) error {
+	return t.packets.setPolicy(policy)
+}
+
+func (t *intratunnel) GetMalformedPacketCount() int64 {
+	return atomic.LoadInt64(&t.packets.malformed)
+}
+
+func (t *intratunnel) GetBadChecksumCount() int64 {
+	return atomic.LoadInt64(&t.packets.badChecksum)
+}
+
+func (t *intratunnel) SetHalfOpenPolicy(seconds int, reap bool) {
+	t.tcp.SetHalfOpenPolicy(time.Duration(seconds)*time.Second, reap)
+}
+
+func (t *intratunnel) SetTimeouts(noDataSeconds, idleSeconds int) {
+	noData := time.Duration(noDataSeconds) * time.Second
+	idle := time.Duration(idleSeconds) * time.Second
+	t.tcp.SetHalfOpenPolicy(noData, true)
+	t.tcp.SetIdleTimeout(idle)
+	t.udp.SetTimeouts(noData, idle)
+}
+
+func (t *intratunnel) SetUDPPortTimeout(port, idleSeconds int) error {
+	return t.udp.SetPortTimeout(port, time.Duration(idleSeconds)*time.Second)
+}
+
+func (t *intratunnel) SetMaxUDPFlows(n int) error {
+	return t.udp.SetMaxFlows(n)
+}
+
+func (t *intratunnel) GetHalfOpenCount() int {
+	return t.tcp.HalfOpen()
+}
+
+func (t *intratunnel) GetConnGoroutineCount() int {
+	return t.tcp.Goroutines() + t.udp.Goroutines()
+}
+
+func (t *intratunnel) GetOpenFDCount() int {
+	return openFDs()
+}
+
 func (t *intratunnel) EnableSNIReporter(filename, suffix, country string) error {
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
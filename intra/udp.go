@@ -18,16 +18,19 @@ package intra
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 
 	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
 )
 
 // UDPSocketSummary describes a non-DNS UDP association, reported when it is discarded.
@@ -42,21 +45,174 @@ type UDPListener interface {
 	OnUDPSocketClosed(*UDPSocketSummary)
 }
 
+// UDPDialFailure describes an association whose upstream socket couldn't be
+// created, e.g. because it couldn't be bound or protected.
+type UDPDialFailure struct {
+	Target *net.UDPAddr
+	Err    error
+}
+
+// UDPDialFailureHook is called when an upstream socket can't be created, before
+// the association is rejected.
+type UDPDialFailureHook func(UDPDialFailure)
+
+// Classes of UDP associations, as reported in UDPFlowInfo.
+const (
+	// UDPFlowOneshot is an association that has only carried DNS queries to the
+	// fake DNS address.  It is closed as soon as a response is delivered.
+	UDPFlowOneshot = "oneshot"
+	// UDPFlowComplex is an association that has carried other traffic.  It is
+	// closed by the idle timeout.
+	UDPFlowComplex = "complex"
+)
+
+// UDPFlowInfo describes an active UDP association, for debugging.
+type UDPFlowInfo struct {
+	Client        *net.UDPAddr // The app's address, as seen on the TUN device.
+	Start         time.Time
+	Idle          time.Duration // Time since the last datagram in either direction.
+	Class         string        // UDPFlowOneshot or UDPFlowComplex.
+	Port          int           // Destination port of the first non-DNS datagram, or 0.
+	UploadBytes   int64         // Non-DNS bytes sent.
+	DownloadBytes int64         // Non-DNS bytes received.
+	DNSQueries    int64
+	QueryID       uint16 // ID of the last DNS query, if DNSQueries is positive.
+}
+
 type tracker struct {
-	conn     *net.UDPConn
-	start    time.Time
-	upload   int64 // Non-DNS upload bytes
-	download int64 // Non-DNS download bytes
+	// The counters are first in the struct to ensure 64-bit alignment on
+	// 32-bit platforms.  They are updated atomically.
+	upload     int64 // Non-DNS upload bytes
+	download   int64 // Non-DNS download bytes
+	queries    int64 // DNS queries
+	lastActive int64 // UnixNano time of the last datagram, or of the start.
+	queryID    int32 // ID of the last DNS query.
+	port       int32 // Destination port of the first non-DNS datagram, or 0.
+	conn       *net.UDPConn
+	start      time.Time
 }
 
 func makeTracker(conn *net.UDPConn) *tracker {
-	return &tracker{conn, time.Now(), 0, 0}
+	now := time.Now()
+	return &tracker{conn: conn, start: now, lastActive: now.UnixNano()}
+}
+
+// oneshot reports whether the association hasn't carried any non-DNS traffic.
+func (t *tracker) oneshot() bool {
+	return atomic.LoadInt64(&t.upload) == 0 && atomic.LoadInt64(&t.download) == 0
+}
+
+func (t *tracker) active() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
+
+// query records a DNS query `q` sent on the association.
+func (t *tracker) query(q []byte) {
+	if len(q) >= 2 {
+		atomic.StoreInt32(&t.queryID, int32(binary.BigEndian.Uint16(q)))
+	}
+	atomic.AddInt64(&t.queries, 1)
+}
+
+func (t *tracker) info(client *net.UDPAddr) UDPFlowInfo {
+	info := UDPFlowInfo{
+		Client:        client,
+		Start:         t.start,
+		Idle:          time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActive))),
+		Class:         UDPFlowComplex,
+		Port:          int(atomic.LoadInt32(&t.port)),
+		UploadBytes:   atomic.LoadInt64(&t.upload),
+		DownloadBytes: atomic.LoadInt64(&t.download),
+		DNSQueries:    atomic.LoadInt64(&t.queries),
+		QueryID:       uint16(atomic.LoadInt32(&t.queryID)),
+	}
+	if info.UploadBytes == 0 && info.DownloadBytes == 0 {
+		info.Class = UDPFlowOneshot
+	}
+	return info
 }
 
 // UDPHandler adds DOH support to the base UDPConnHandler interface.
 type UDPHandler interface {
 	core.UDPConnHandler
 	SetDNS(dns doh.Transport)
+	// SetFilter sets the destination filter.  It must be called before the
+	// handler is registered.  A nil filter permits all destinations.
+	SetFilter(*filter.Filter)
+	// SetPortPolicy sets the destination port policy.  It must be called before
+	// the handler is registered.  A nil policy permits all ports.
+	SetPortPolicy(*filter.PortPolicy)
+	// SetLocalIPv6Policy sets how datagrams to link-local (fe80::/10) and
+	// unique-local (fc00::/7) IPv6 destinations are handled.  `policy` is
+	// LocalIPv6Drop (the default) or LocalIPv6Allow.  It must be called before
+	// the handler is registered.
+	SetLocalIPv6Policy(policy string) error
+	// SetControl sets a hook that is called with each new upstream socket before
+	// it binds, after the ListenConfig's own Control function.  If it returns
+	// an error, the association fails.  nil removes the hook.
+	SetControl(ControlFunc)
+	// SetPortRange restricts the local ports of new upstream sockets to the
+	// inclusive range `min`-`max`.  If every port is in use, an ephemeral port
+	// is used instead.  Zero for both disables the restriction.
+	SetPortRange(min, max int) error
+	// SetTimeouts configures how long associations are kept.  Associations that
+	// have not received any data within `noData` of their creation are closed,
+	// which quickly reclaims sockets used by scanners and misdirected packets.
+	// Otherwise, associations are closed after `idle` without any activity.
+	// A zero `noData` disables that timer, and a zero `idle` keeps the current
+	// idle timeout.
+	SetTimeouts(noData, idle time.Duration)
+	// SetPortTimeout overrides the idle timeout for associations whose first
+	// non-DNS datagram was sent to `port`, e.g. a longer timeout for QUIC on
+	// port 443 or for games, or a shorter one for DNS to port 53.  Zero
+	// removes the override.  Associations that have only carried queries to
+	// the fake DNS address are closed when the last response is delivered, so
+	// they aren't affected.
+	SetPortTimeout(port int, idle time.Duration) error
+	// SetMaxFlows limits the number of associations.  When a new association
+	// would exceed the limit, the least recently active association is closed,
+	// and counted as DropEvicted.  Zero removes the limit.
+	SetMaxFlows(n int) error
+	// SetDNSDedupWindow suppresses DNS queries that are identical (including the
+	// ID) to a query sent less than `window` ago that has not been answered yet.
+	// The original query's response is delivered to both.  Zero disables
+	// deduplication.
+	SetDNSDedupWindow(window time.Duration)
+	// SetDNSCapture, if true, redirects datagrams to port 53 of any address to
+	// DOH, not only those to the fake DNS address, so that apps with a
+	// hardcoded resolver can't bypass the DoH transport.  Each response
+	// appears to come from the address that the query was sent to.
+	SetDNSCapture(bool)
+	// DropCounts returns the number of datagrams dropped so far, by reason.
+	DropCounts() map[string]int64
+	// Flows returns a snapshot of the active associations, in no particular
+	// order.
+	Flows() []UDPFlowInfo
+	// ResetStats zeroes the drop counts.  Active associations are unaffected.
+	ResetStats()
+	// SetDropLogInterval enables logging of dropped datagrams, at most once per
+	// `interval` for each reason.  Zero disables logging.
+	SetDropLogInterval(interval time.Duration)
+	// SetDialFailureHook sets a hook that is called when the upstream socket of a
+	// new association can't be created.  No association is created in that
+	// case, so the client's datagrams are dropped.
+	SetDialFailureHook(UDPDialFailureHook)
+	// SetStackWriteRetries sets the number of times a datagram is written to the
+	// TUN device again after a transient network stack error, with
+	// exponential backoff.  Zero disables retries, so the association is
+	// closed on any error.  The default is DefaultStackWriteRetries.
+	SetStackWriteRetries(n int)
+	// EffectiveConfig returns the handler's current configuration, with defaults
+	// applied.
+	EffectiveConfig() UDPConfig
+	// Goroutines returns the number of goroutines running on behalf of
+	// associations.  It returns to zero once every association has closed.
+	Goroutines() int
+	// Shutdown cancels all outstanding DNS queries, including queries that
+	// other associations are waiting for due to deduplication.  Their waiters
+	// receive the error response, if any, promptly.  Queries received after
+	// Shutdown fail immediately.
+	Shutdown()
 }
 
 type udpHandler struct {
@@ -64,11 +220,32 @@ type udpHandler struct {
 	sync.RWMutex
 
 	timeout  time.Duration
+	noData   time.Duration
 	udpConns map[core.UDPConn]*tracker
 	fakedns  net.UDPAddr
+	capture  bool
 	dns      doh.Transport
-	config   *net.ListenConfig
+	base     *net.ListenConfig // ListenConfig provided by the caller.
+	config   *net.ListenConfig // base, with the Control hook applied.
+	control  ControlFunc
 	listener UDPListener
+	filter   *filter.Filter
+	policy   *filter.PortPolicy
+	scope    string // A LocalIPv6 policy, or "" for the default.
+	ports    portRange
+	dedup    dnsDedup
+	drops    dropCounter
+	// Idle timeouts by the destination port of the first non-DNS datagram.
+	portTimeouts map[int]time.Duration
+	maxFlows     int // Zero if the number of associations is unlimited.
+	// Goroutines started for associations and DNS queries.
+	goroutines goroutineCounter
+	// Retries after transient errors writing to the stack.
+	stackRetries    int
+	dialFailureHook UDPDialFailureHook
+	// ctx is the context of all DNS queries, which Shutdown cancels.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewUDPHandler makes a UDP handler with Intra-style DNS redirection:
@@ -78,12 +255,18 @@ type udpHandler struct {
 // `config` is used to bind new external UDP ports.
 // `listener` receives a summary about each UDP binding when it expires.
 func NewUDPHandler(fakedns net.UDPAddr, timeout time.Duration, config *net.ListenConfig, listener UDPListener) UDPHandler {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &udpHandler{
 		timeout:  timeout,
 		udpConns: make(map[core.UDPConn]*tracker, 8),
 		fakedns:  fakedns,
+		base:     config,
 		config:   config,
 		listener: listener,
+
+		stackRetries: DefaultStackWriteRetries,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
@@ -96,15 +279,22 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 	}()
 
 	for {
-		t.conn.SetDeadline(time.Now().Add(h.timeout))
+		t.conn.SetDeadline(h.deadline(t))
 		n, addr, err := t.conn.ReadFrom(buf)
 		if err != nil {
 			return
 		}
 
 		udpaddr := addr.(*net.UDPAddr)
-		t.download += int64(n)
-		_, err = conn.WriteFrom(buf[:n], udpaddr)
+		atomic.AddInt64(&t.download, int64(n))
+		t.active()
+		h.RLock()
+		retries := h.stackRetries
+		h.RUnlock()
+		err = retryStackWrite(retries, func() error {
+			_, err := conn.WriteFrom(buf[:n], udpaddr)
+			return err
+		})
 		if err != nil {
 			log.Warnf("failed to write UDP data to TUN")
 			return
@@ -112,67 +302,282 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 	}
 }
 
+// deadline returns the time at which `t` should be closed if there is no
+// further activity.
+func (h *udpHandler) deadline(t *tracker) time.Time {
+	h.RLock()
+	timeout, noData := h.timeout, h.noData
+	if idle, ok := h.portTimeouts[int(atomic.LoadInt32(&t.port))]; ok {
+		timeout = idle
+	}
+	h.RUnlock()
+	d := time.Now().Add(timeout)
+	if noData > 0 && atomic.LoadInt64(&t.download) == 0 {
+		if n := t.start.Add(noData); n.Before(d) {
+			d = n
+		}
+	}
+	return d
+}
+
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
-	bindAddr := &net.UDPAddr{IP: nil, Port: 0}
-	pc, err := h.config.ListenPacket(context.TODO(), bindAddr.Network(), bindAddr.String())
+	h.RLock()
+	ports := h.ports
+	config := h.config
+	h.RUnlock()
+	pc, err := ports.listenPacket(config)
 	if err != nil {
-		log.Errorf("failed to bind udp address")
+		log.Errorf("failed to bind udp address: %v", err)
+		h.drops.drop(DropBindFailed, "UDP association to %s: %v", target, err)
+		h.RLock()
+		hook := h.dialFailureHook
+		h.RUnlock()
+		if hook != nil {
+			hook(UDPDialFailure{Target: target, Err: err})
+		}
 		return err
 	}
 	t := makeTracker(pc.(*net.UDPConn))
 	h.Lock()
 	h.udpConns[conn] = t
+	var evicted core.UDPConn
+	if h.maxFlows > 0 && len(h.udpConns) > h.maxFlows {
+		evicted = h.leastRecentlyActive(conn)
+	}
 	h.Unlock()
-	go h.fetchUDPInput(conn, t)
+	if evicted != nil {
+		h.drops.drop(DropEvicted, "UDP association from %v", evicted.LocalAddr())
+		h.Close(evicted)
+	}
+	h.goroutines.goroutine(func() { h.fetchUDPInput(conn, t) })
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
 
-func (h *udpHandler) doDoh(dns doh.Transport, t *tracker, conn core.UDPConn, data []byte) {
-	resp, err := dns.Query(data)
-	if resp != nil {
-		_, err = conn.WriteFrom(resp, &h.fakedns)
+// leastRecentlyActive returns the association, other than `except`, whose last
+// datagram is the oldest.  The caller must hold h's lock.  This is linear in
+// the number of associations, but it only runs when the flow limit is reached,
+// and it keeps the per-datagram path free of any shared ordering.
+func (h *udpHandler) leastRecentlyActive(except core.UDPConn) core.UDPConn {
+	var oldest core.UDPConn
+	var oldestActive int64
+	for conn, t := range h.udpConns {
+		if conn == except {
+			continue
+		}
+		if active := atomic.LoadInt64(&t.lastActive); oldest == nil || active < oldestActive {
+			oldest, oldestActive = conn, active
+		}
 	}
+	return oldest
+}
+
+func (h *udpHandler) doDoh(dns doh.Transport, key string, q *dnsQuery, data []byte) {
+	resp, err := doh.QueryContext(h.ctx, dns, data)
 	if err != nil {
 		log.Warnf("DoH query failed: %v", err)
 	}
-	// Note: Reading t.upload and t.download on this thread, while they are written on
-	// other threads, is theoretically a race condition.  In practice, this race is
-	// impossible on 64-bit platforms, likely impossible on 32-bit platforms, and
-	// low-impact if it occurs (a mixed-use socket might be closed early).
-	if t.upload == 0 && t.download == 0 {
+	if resp != nil {
+		// DOH responses can be larger than the client accepts over UDP.
+		resp = doh.LimitUDPResponse(data, resp)
+	}
+	// Duplicate queries are identical to `data`, so the same limit applies.
+	for _, w := range h.dedup.finish(key, q) {
+		h.deliverDNS(w, resp)
+	}
+}
+
+// deliverDNS writes the DNS response `resp` (if any) to the waiting association.
+func (h *udpHandler) deliverDNS(w dnsWaiter, resp []byte) {
+	if resp != nil {
+		if _, err := w.conn.WriteFrom(resp, w.from); err != nil {
+			log.Warnf("Failed to write DNS response: %v", err)
+		}
+	}
+	if w.t.oneshot() {
 		// conn was only used for this DNS query, so it's unlikely to be used again.
-		h.Close(conn)
+		h.Close(w.conn)
 	}
 }
 
 func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
 	h.RLock()
 	dns := h.dns
+	capture := h.capture
 	t, ok1 := h.udpConns[conn]
 	h.RUnlock()
 
 	if !ok1 {
+		h.drops.drop(DropNoAssociation, "UDP datagram from %v to %v", conn.LocalAddr(), addr)
 		return fmt.Errorf("connection %v->%v does not exists", conn.LocalAddr(), addr)
 	}
+	addr = normalizeUDPAddr(addr)
 
 	// Update deadline.
-	t.conn.SetDeadline(time.Now().Add(h.timeout))
+	t.conn.SetDeadline(h.deadline(t))
+	t.active()
 
+	from := addr
 	if addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port {
+		from = &h.fakedns
+	} else if !capture || addr.Port != 53 {
+		from = nil
+	}
+	if from != nil {
 		dataCopy := append([]byte{}, data...)
-		go h.doDoh(dns, t, conn, dataCopy)
+		t.query(dataCopy)
+		if h.filter != nil {
+			dns = filter.NewTransport(dns, h.filter)
+		}
+		key := string(dataCopy)
+		q, first := h.dedup.join(key, dnsWaiter{conn, t, from})
+		if !first {
+			log.Debugf("Suppressed duplicate DNS query")
+			return nil
+		}
+		h.goroutines.goroutine(func() { h.doDoh(dns, key, q, dataCopy) })
 		return nil
 	}
-	t.upload += int64(len(data))
+	if err := checkLocalIPv6(h.scope, addr.IP); err != nil {
+		// Drop the datagram.
+		log.Debugf("Blocked UDP datagram to %s: %v", addr, err)
+		h.drops.drop(DropLocalIPv6, "UDP datagram to %s", addr)
+		return err
+	}
+	if h.policy != nil && !h.policy.AllowPort(addr.Port) {
+		// Drop the datagram.
+		log.Debugf("Blocked UDP datagram to port %d", addr.Port)
+		h.drops.drop(DropBlockedPort, "UDP datagram to %s", addr)
+		return fmt.Errorf("destination port %d is blocked", addr.Port)
+	}
+	if h.filter != nil && !h.filter.AllowIP(addr.IP) {
+		// Drop the datagram.
+		log.Debugf("Blocked UDP datagram to %s", addr.String())
+		h.drops.drop(DropBlocked, "UDP datagram to %s", addr)
+		return fmt.Errorf("destination %s is blocked", addr.String())
+	}
+	atomic.AddInt64(&t.upload, int64(len(data)))
+	if atomic.CompareAndSwapInt32(&t.port, 0, int32(addr.Port)) {
+		// The association now has a port, which may have its own timeout.
+		t.conn.SetDeadline(h.deadline(t))
+	}
 	_, err := t.conn.WriteTo(data, addr)
 	if err != nil {
 		log.Warnf("failed to forward UDP payload")
+		h.drops.drop(DropSendFailed, "UDP datagram to %s: %v", addr, err)
 		return errors.New("failed to write UDP data")
 	}
 	return nil
 }
 
+func (h *udpHandler) SetControl(f ControlFunc) {
+	config := h.base
+	if f != nil {
+		c := *h.base
+		c.Control = chainControl(h.base.Control, f)
+		config = &c
+	}
+	h.Lock()
+	h.control = f
+	h.config = config
+	h.Unlock()
+}
+
+func (h *udpHandler) SetPortRange(min, max int) error {
+	ports, err := makePortRange(min, max)
+	if err != nil {
+		return err
+	}
+	h.Lock()
+	h.ports = ports
+	h.Unlock()
+	return nil
+}
+
+func (h *udpHandler) SetTimeouts(noData, idle time.Duration) {
+	h.Lock()
+	h.noData = noData
+	if idle > 0 {
+		h.timeout = idle
+	}
+	h.Unlock()
+}
+
+func (h *udpHandler) SetPortTimeout(port int, idle time.Duration) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("Invalid port: %d", port)
+	}
+	if idle < 0 {
+		return fmt.Errorf("Negative timeout: %v", idle)
+	}
+	h.Lock()
+	defer h.Unlock()
+	if idle == 0 {
+		delete(h.portTimeouts, port)
+		return nil
+	}
+	if h.portTimeouts == nil {
+		h.portTimeouts = make(map[int]time.Duration)
+	}
+	h.portTimeouts[port] = idle
+	return nil
+}
+
+func (h *udpHandler) SetMaxFlows(n int) error {
+	if n < 0 {
+		return fmt.Errorf("Negative flow limit: %d", n)
+	}
+	h.Lock()
+	h.maxFlows = n
+	h.Unlock()
+	return nil
+}
+
+func (h *udpHandler) Shutdown() {
+	h.cancel()
+}
+
+func (h *udpHandler) SetDNSDedupWindow(window time.Duration) {
+	h.dedup.setWindow(window)
+}
+
+func (h *udpHandler) SetDNSCapture(capture bool) {
+	h.Lock()
+	h.capture = capture
+	h.Unlock()
+}
+
+func (h *udpHandler) SetDialFailureHook(hook UDPDialFailureHook) {
+	h.Lock()
+	h.dialFailureHook = hook
+	h.Unlock()
+}
+
+func (h *udpHandler) Goroutines() int {
+	return h.goroutines.count()
+}
+
+func (h *udpHandler) DropCounts() map[string]int64 {
+	return h.drops.snapshot()
+}
+
+func (h *udpHandler) ResetStats() {
+	h.drops.reset()
+}
+
+func (h *udpHandler) SetDropLogInterval(interval time.Duration) {
+	h.drops.setLogInterval(interval)
+}
+
+func (h *udpHandler) SetStackWriteRetries(n int) {
+	if n < 0 {
+		n = 0
+	}
+	h.Lock()
+	h.stackRetries = n
+	h.Unlock()
+}
+
 func (h *udpHandler) Close(conn core.UDPConn) {
 	conn.Close()
 
@@ -183,11 +588,29 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 		t.conn.Close()
 		// TODO: Cancel any outstanding DoH queries.
 		duration := int32(time.Since(t.start).Seconds())
-		h.listener.OnUDPSocketClosed(&UDPSocketSummary{t.upload, t.download, duration})
+		h.listener.OnUDPSocketClosed(&UDPSocketSummary{atomic.LoadInt64(&t.upload), atomic.LoadInt64(&t.download), duration})
 		delete(h.udpConns, conn)
 	}
 }
 
+func (h *udpHandler) Flows() []UDPFlowInfo {
+	h.RLock()
+	defer h.RUnlock()
+	flows := make([]UDPFlowInfo, 0, len(h.udpConns))
+	for conn, t := range h.udpConns {
+		flows = append(flows, t.info(conn.LocalAddr()))
+	}
+	return flows
+}
+
+func (h *udpHandler) SetFilter(f *filter.Filter) {
+	h.filter = f
+}
+
+func (h *udpHandler) SetPortPolicy(p *filter.PortPolicy) {
+	h.policy = p
+}
+
 func (h *udpHandler) SetDNS(dns doh.Transport) {
 	h.Lock()
 	h.dns = dns
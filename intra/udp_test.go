@@ -0,0 +1,608 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/filter"
+)
+
+// fakeUDPConn implements core.UDPConn, standing in for a UDP socket on the
+// TUN device.
+type fakeUDPConn struct {
+	received  chan []byte
+	senders   chan *net.UDPAddr // The source address of each received datagram.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeUDPConn() *fakeUDPConn {
+	return &fakeUDPConn{received: make(chan []byte, 10), senders: make(chan *net.UDPAddr, 10), closed: make(chan struct{})}
+}
+
+func (c *fakeUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+}
+
+func (c *fakeUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error {
+	return nil
+}
+
+func (c *fakeUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case c.senders <- addr:
+	default:
+		// Tests that don't check the sources needn't drain them.
+	}
+	c.received <- append([]byte{}, data...)
+	return len(data), nil
+}
+
+func (c *fakeUDPConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// fakeUDPListener reports each summary on a channel.
+type fakeUDPListener chan *UDPSocketSummary
+
+func (l fakeUDPListener) OnUDPSocketClosed(s *UDPSocketSummary) {
+	l <- s
+}
+
+// Returns a UDP server that replies to each datagram if `reply` is true.
+func makeUDPServer(t *testing.T, reply bool) *net.UDPAddr {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		buf := make([]byte, 100)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply {
+				server.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+	return server.LocalAddr().(*net.UDPAddr)
+}
+
+// Sends one datagram to `server` through a new association, and returns the
+// time it took for the association to be closed.
+func timeAssociation(t *testing.T, h UDPHandler, server *net.UDPAddr) time.Duration {
+	conn := newFakeUDPConn()
+	start := time.Now()
+	if err := h.Connect(conn, server); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, []byte("hello"), server); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Association was not closed")
+	}
+	return time.Since(start)
+}
+
+func TestUDPNoDataTimeout(t *testing.T) {
+	listener := make(fakeUDPListener, 1)
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, listener)
+	h.SetTimeouts(50*time.Millisecond, 500*time.Millisecond)
+	if elapsed := timeAssociation(t, h, makeUDPServer(t, false)); elapsed > 400*time.Millisecond {
+		t.Errorf("Association with no data took %v to close", elapsed)
+	}
+	if s := <-listener; s.UploadBytes != 5 || s.DownloadBytes != 0 {
+		t.Errorf("Unexpected summary: %v", s)
+	}
+}
+
+func TestUDPDialFailure(t *testing.T) {
+	errProtect := errors.New("Protect failed")
+	config := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return errProtect
+		},
+	}
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, config, make(fakeUDPListener, 1)).(*udpHandler)
+	failures := make(chan UDPDialFailure, 1)
+	h.SetDialFailureHook(func(f UDPDialFailure) { failures <- f })
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+	if err := h.Connect(newFakeUDPConn(), target); !errors.Is(err, errProtect) {
+		t.Fatalf("Expected the Control error, got %v", err)
+	}
+	select {
+	case f := <-failures:
+		if f.Target != target || !errors.Is(f.Err, errProtect) {
+			t.Errorf("Unexpected failure: %+v", f)
+		}
+	default:
+		t.Fatal("The failure was not reported")
+	}
+	if n := h.DropCounts()[DropBindFailed]; n != 1 {
+		t.Errorf("Expected one drop, got %d", n)
+	}
+	h.RLock()
+	n := len(h.udpConns)
+	h.RUnlock()
+	if n != 0 || h.Goroutines() != 0 {
+		t.Errorf("The failed association leaked: %d trackers, %d goroutines", n, h.Goroutines())
+	}
+}
+
+func TestUDPIdleTimeout(t *testing.T) {
+	listener := make(fakeUDPListener, 1)
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, listener)
+	h.SetTimeouts(50*time.Millisecond, 300*time.Millisecond)
+	if elapsed := timeAssociation(t, h, makeUDPServer(t, true)); elapsed < 300*time.Millisecond {
+		t.Errorf("Active association closed after %v", elapsed)
+	}
+	if s := <-listener; s.UploadBytes != 5 || s.DownloadBytes != 5 {
+		t.Errorf("Unexpected summary: %v", s)
+	}
+}
+
+func TestUDPPortTimeout(t *testing.T) {
+	listener := make(fakeUDPListener, 1)
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, listener)
+	server := makeUDPServer(t, true)
+	if err := h.SetPortTimeout(server.Port, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Without the override, the echoed datagram would keep the association
+	// open for a minute.
+	if elapsed := timeAssociation(t, h, server); elapsed > time.Second {
+		t.Errorf("Association took %v to close", elapsed)
+	}
+	if s := <-listener; s.DownloadBytes != 5 {
+		t.Errorf("Unexpected summary: %v", s)
+	}
+	if c := h.EffectiveConfig(); c.PortTimeouts[server.Port] != 100*time.Millisecond {
+		t.Errorf("Unexpected port timeouts: %v", c.PortTimeouts)
+	}
+	h.SetPortTimeout(server.Port, 0)
+	if c := h.EffectiveConfig(); c.PortTimeouts != nil {
+		t.Errorf("The override should be removed: %v", c.PortTimeouts)
+	}
+	if err := h.SetPortTimeout(0, time.Second); err == nil {
+		t.Error("Port 0 should be rejected")
+	}
+	if err := h.SetPortTimeout(443, -time.Second); err == nil {
+		t.Error("A negative timeout should be rejected")
+	}
+}
+
+func TestUDPMaxFlows(t *testing.T) {
+	listener := make(fakeUDPListener, 3)
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, listener).(*udpHandler)
+	if err := h.SetMaxFlows(2); err != nil {
+		t.Fatal(err)
+	}
+	server := makeUDPServer(t, false)
+	a, b, c := newFakeUDPConn(), newFakeUDPConn(), newFakeUDPConn()
+	for _, conn := range []*fakeUDPConn{a, b} {
+		if err := h.Connect(conn, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Make `b` the least recently active.
+	time.Sleep(10 * time.Millisecond)
+	if err := h.ReceiveTo(a, []byte("hello"), server); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Connect(c, server); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-b.closed:
+	default:
+		t.Fatal("The least recently active association should be evicted")
+	}
+	for _, conn := range []*fakeUDPConn{a, c} {
+		select {
+		case <-conn.closed:
+			t.Error("An active association was evicted")
+		default:
+		}
+	}
+	if n := len(h.Flows()); n != 2 {
+		t.Errorf("Expected 2 flows, got %d", n)
+	}
+	if n := h.DropCounts()[DropEvicted]; n != 1 {
+		t.Errorf("Expected one eviction, got %d", n)
+	}
+	if s := <-listener; s.UploadBytes != 0 {
+		t.Errorf("Unexpected summary for the evicted association: %v", s)
+	}
+	if err := h.SetMaxFlows(-1); err == nil {
+		t.Error("A negative limit should be rejected")
+	}
+	h.Close(a)
+	h.Close(c)
+}
+
+// blockingDNS echoes each query as its response once `release` is closed.
+type blockingDNS struct {
+	doh.Transport
+	release chan struct{}
+	mu      sync.Mutex
+	queries [][]byte
+}
+
+func (d *blockingDNS) Query(q []byte) ([]byte, error) {
+	d.mu.Lock()
+	d.queries = append(d.queries, q)
+	d.mu.Unlock()
+	<-d.release
+	return q, nil
+}
+
+func (d *blockingDNS) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queries)
+}
+
+// Sends `queries` to the fake DNS address, each from a new association, and
+// returns the associations.
+func sendQueries(t *testing.T, h UDPHandler, fakedns *net.UDPAddr, queries ...[]byte) []*fakeUDPConn {
+	var conns []*fakeUDPConn
+	for _, q := range queries {
+		conn := newFakeUDPConn()
+		if err := h.Connect(conn, fakedns); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.ReceiveTo(conn, q, fakedns); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func expectResponse(t *testing.T, conn *fakeUDPConn, q []byte) {
+	select {
+	case resp := <-conn.received:
+		if !bytes.Equal(resp, q) {
+			t.Errorf("Wrong response: %v", resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No response")
+	}
+}
+
+func TestDNSDedupDuplicate(t *testing.T) {
+	fakedns := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	h := NewUDPHandler(*fakedns, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 10))
+	h.SetDNSDedupWindow(time.Second)
+	dns := &blockingDNS{release: make(chan struct{})}
+	h.SetDNS(dns)
+	q := []byte{0x12, 0x34, 1, 2, 3}
+	conns := sendQueries(t, h, fakedns, q, q)
+	time.Sleep(50 * time.Millisecond)
+	if n := dns.count(); n != 1 {
+		t.Errorf("Expected one upstream query, got %d", n)
+	}
+	close(dns.release)
+	for _, conn := range conns {
+		expectResponse(t, conn, q)
+	}
+	// After the response, the same query is sent upstream again.
+	expectResponse(t, sendQueries(t, h, fakedns, q)[0], q)
+	if n := dns.count(); n != 2 {
+		t.Errorf("Expected two upstream queries, got %d", n)
+	}
+}
+
+func TestDNSCapture(t *testing.T) {
+	fakedns := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	h := NewUDPHandler(*fakedns, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 10))
+	dns := &blockingDNS{release: make(chan struct{})}
+	close(dns.release)
+	h.SetDNS(dns)
+	q := []byte{0x12, 0x34, 1, 2, 3}
+	// Nothing listens on these local ports, so forwarded datagrams are lost.
+	hardcoded := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+	sendQueries(t, h, hardcoded, q)
+	if n := dns.count(); n != 0 {
+		t.Errorf("Without capture, queries should be forwarded: %d", n)
+	}
+
+	h.SetDNSCapture(true)
+	if !h.(*udpHandler).EffectiveConfig().DNSCapture {
+		t.Error("Capture should be reported")
+	}
+	conn := sendQueries(t, h, hardcoded, q)[0]
+	expectResponse(t, conn, q)
+	if from := <-conn.senders; from.String() != hardcoded.String() {
+		t.Errorf("The response should come from %s, got %s", hardcoded, from)
+	}
+	if n := dns.count(); n != 1 {
+		t.Errorf("Expected one DoH query, got %d", n)
+	}
+	// The fake DNS address keeps working, and other ports aren't captured.
+	conn = sendQueries(t, h, fakedns, q)[0]
+	expectResponse(t, conn, q)
+	if from := <-conn.senders; from != &h.(*udpHandler).fakedns {
+		t.Errorf("The response should come from the fake DNS address, got %s", from)
+	}
+	sendQueries(t, h, other, q)
+	if n := dns.count(); n != 2 {
+		t.Errorf("Expected two DoH queries, got %d", n)
+	}
+}
+
+func TestDNSDedupDistinct(t *testing.T) {
+	fakedns := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	h := NewUDPHandler(*fakedns, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 10))
+	h.SetDNSDedupWindow(time.Second)
+	dns := &blockingDNS{release: make(chan struct{})}
+	h.SetDNS(dns)
+	// Same question, different IDs.
+	q1 := []byte{0x12, 0x34, 1, 2, 3}
+	q2 := []byte{0x12, 0x35, 1, 2, 3}
+	conns := sendQueries(t, h, fakedns, q1, q2)
+	time.Sleep(50 * time.Millisecond)
+	if n := dns.count(); n != 2 {
+		t.Errorf("Expected two upstream queries, got %d", n)
+	}
+	close(dns.release)
+	expectResponse(t, conns[0], q1)
+	expectResponse(t, conns[1], q2)
+}
+
+func TestDNSDedupWindowExpired(t *testing.T) {
+	fakedns := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	h := NewUDPHandler(*fakedns, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 10))
+	h.SetDNSDedupWindow(20 * time.Millisecond)
+	dns := &blockingDNS{release: make(chan struct{})}
+	h.SetDNS(dns)
+	q := []byte{0x12, 0x34, 1, 2, 3}
+	first := sendQueries(t, h, fakedns, q)
+	time.Sleep(50 * time.Millisecond)
+	second := sendQueries(t, h, fakedns, q)
+	time.Sleep(50 * time.Millisecond)
+	if n := dns.count(); n != 2 {
+		t.Errorf("Expected two upstream queries, got %d", n)
+	}
+	close(dns.release)
+	expectResponse(t, first[0], q)
+	expectResponse(t, second[0], q)
+}
+
+// paddingDNS answers each query with the query followed by `padding` zero bytes.
+type paddingDNS struct {
+	doh.Transport
+	padding int
+}
+
+func (d paddingDNS) Query(q []byte) ([]byte, error) {
+	return append(append([]byte{}, q...), make([]byte, d.padding)...), nil
+}
+
+// Returns a query that advertises a UDP payload size of `size`, or has no
+// OPT record if `size` is zero.
+func makeEDNSQuery(t *testing.T, size int) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("large.example."),
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	if size > 0 {
+		var h dnsmessage.ResourceHeader
+		if err := h.SetEDNS0(size, dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		msg.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+	}
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestDNSResponseLimit(t *testing.T) {
+	fakedns := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	h := NewUDPHandler(*fakedns, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 10))
+	h.SetDNS(paddingDNS{padding: 1000})
+
+	large := makeEDNSQuery(t, 4096)
+	small := makeEDNSQuery(t, 0)
+	conns := sendQueries(t, h, fakedns, large, small)
+	for i, conn := range conns {
+		var resp []byte
+		select {
+		case resp = <-conn.received:
+		case <-time.After(time.Second):
+			t.Fatal("No response")
+		}
+		var msg dnsmessage.Message
+		truncated := msg.Unpack(resp) == nil && msg.Truncated
+		if i == 0 && (truncated || len(resp) != len(large)+1000) {
+			t.Errorf("Response should fit in 4096 bytes: %d bytes", len(resp))
+		}
+		if i == 1 && (!truncated || len(resp) > 512) {
+			t.Errorf("Expected a truncated response without EDNS, got %d bytes", len(resp))
+		}
+	}
+}
+
+func TestShutdownReleasesDNSWaiters(t *testing.T) {
+	fakedns := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	h := NewUDPHandler(*fakedns, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 10))
+	h.SetDNSDedupWindow(time.Second)
+	dns := &blockingDNS{release: make(chan struct{})}
+	defer close(dns.release)
+	h.SetDNS(dns)
+	q := []byte{0x12, 0x34, 1, 2, 3}
+	conns := sendQueries(t, h, fakedns, q, q)
+	time.Sleep(50 * time.Millisecond)
+	if n := dns.count(); n != 1 {
+		t.Fatalf("Expected one upstream query, got %d", n)
+	}
+
+	h.Shutdown()
+	// Both the original query and its duplicate fail without a response, so
+	// their DNS-only associations are closed.
+	for _, conn := range conns {
+		select {
+		case <-conn.closed:
+		case <-time.After(time.Second):
+			t.Fatal("Waiter was not released")
+		}
+		select {
+		case resp := <-conn.received:
+			t.Errorf("Unexpected response: %v", resp)
+		default:
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for h.Goroutines() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines after shutdown", h.Goroutines())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Later queries fail immediately.
+	late := sendQueries(t, h, fakedns, []byte{0x56, 0x78, 1, 2, 3})[0]
+	select {
+	case <-late.closed:
+	case <-time.After(time.Second):
+		t.Error("Query after shutdown was not released")
+	}
+	if n := dns.count(); n != 1 {
+		t.Errorf("Queries after shutdown should not be sent, got %d", n)
+	}
+}
+
+func TestUDPPortPolicy(t *testing.T) {
+	h := NewUDPHandler(net.UDPAddr{}, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 1)).(*udpHandler)
+	server := makeUDPServer(t, true)
+	p := filter.NewPortPolicy(filter.Blocklist)
+	p.AddRange(25, 25)
+	h.SetPortPolicy(p)
+
+	conn := newFakeUDPConn()
+	if err := h.Connect(conn, server); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(conn)
+	if err := h.ReceiveTo(conn, []byte("hello"), server); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reply := <-conn.received:
+		if string(reply) != "hello" {
+			t.Errorf("Allowed port: got %q", reply)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No reply from an allowed port")
+	}
+
+	blocked := &net.UDPAddr{IP: server.IP, Port: 25}
+	if err := h.ReceiveTo(conn, []byte("spam"), blocked); err == nil {
+		t.Error("Datagram to a blocked port should fail")
+	}
+	if n := h.DropCounts()[DropBlockedPort]; n != 1 {
+		t.Errorf("Expected 1 blocked datagram, got %d", n)
+	}
+}
+
+func TestUDPFlows(t *testing.T) {
+	fakedns := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+	h := NewUDPHandler(*fakedns, time.Minute, &net.ListenConfig{}, make(fakeUDPListener, 10))
+	dns := &blockingDNS{release: make(chan struct{})}
+	h.SetDNS(dns)
+	if flows := h.Flows(); len(flows) != 0 {
+		t.Errorf("Expected no flows, got %v", flows)
+	}
+
+	// A DNS-only association, whose query is pending.
+	sendQueries(t, h, fakedns, []byte{0xbe, 0xef, 1, 2, 3})
+
+	// An association that carries other traffic, and then a DNS query.
+	server := makeUDPServer(t, true)
+	conn := newFakeUDPConn()
+	if err := h.Connect(conn, server); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ReceiveTo(conn, []byte("hello"), server); err != nil {
+		t.Fatal(err)
+	}
+	expectResponse(t, conn, []byte("hello"))
+	if err := h.ReceiveTo(conn, []byte{0x01, 0x02, 4, 5}, fakedns); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	flows := h.Flows()
+	if len(flows) != 2 {
+		t.Fatalf("Expected 2 flows, got %v", flows)
+	}
+	byClass := make(map[string]UDPFlowInfo)
+	for _, f := range flows {
+		byClass[f.Class] = f
+	}
+	oneshot, ok := byClass[UDPFlowOneshot]
+	if !ok || oneshot.DNSQueries != 1 || oneshot.QueryID != 0xbeef || oneshot.UploadBytes != 0 {
+		t.Errorf("Unexpected DNS flow: %+v", oneshot)
+	}
+	if oneshot.Idle < 50*time.Millisecond || oneshot.Idle > 5*time.Second {
+		t.Errorf("Implausible idle time: %v", oneshot.Idle)
+	}
+	mixed, ok := byClass[UDPFlowComplex]
+	if !ok || mixed.UploadBytes != 5 || mixed.DownloadBytes != 5 || mixed.DNSQueries != 1 || mixed.QueryID != 0x0102 {
+		t.Errorf("Unexpected mixed flow: %+v", mixed)
+	}
+	if !mixed.Client.IP.Equal(net.IPv4(10, 0, 0, 1)) || mixed.Start.IsZero() {
+		t.Errorf("Missing flow identity: %+v", mixed)
+	}
+
+	// Once its response is delivered, the DNS-only association is closed.
+	close(dns.release)
+	deadline := time.Now().Add(time.Second)
+	for len(h.Flows()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The DNS flow was not closed: %v", h.Flows())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f := h.Flows()[0]; f.Class != UDPFlowComplex {
+		t.Errorf("The wrong flow was closed: %+v", f)
+	}
+}
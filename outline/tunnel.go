@@ -64,11 +64,9 @@ func NewTunnel(host string, port int, password, cipher string, isUDPEnabled bool
 	if err != nil {
 		return nil, fmt.Errorf("Invalid Shadowsocks proxy parameters: %v", err.Error())
 	}
-	core.RegisterOutputFn(func(data []byte) (int, error) {
-		return tunWriter.Write(data)
-	})
 	lwipStack := core.NewLWIPStack()
 	base := tunnel.NewTunnel(tunWriter, lwipStack)
+	core.RegisterOutputFn(tunnel.OutputFn(base, tunWriter))
 	t := &outlinetunnel{base, lwipStack, host, port, password, cipher, isUDPEnabled}
 	t.registerConnectionHandlers()
 	return t, nil
@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"errors"
+	"io"
 	"os"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
@@ -31,12 +32,47 @@ func MakeTunFile(fd int) (*os.File, error) {
 	return file, nil
 }
 
+// isFatal reports whether `err` indicates that the TUN device can no longer be
+// used.  Other errors, such as ENOBUFS or ENOMEM under load, are transient, so
+// the packet is dropped and the tunnel continues.
+func isFatal(err error) bool {
+	for _, fatal := range []error{os.ErrClosed, io.EOF, unix.EBADF, unix.EIO, unix.ENODEV, unix.ENXIO} {
+		if errors.Is(err, fatal) {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputFn returns a function for core.RegisterOutputFn that writes packets to
+// `tunWriter`, and fails `tunnel` if a write fails fatally.
+func OutputFn(tunnel Tunnel, tunWriter io.Writer) func([]byte) (int, error) {
+	return func(data []byte) (int, error) {
+		n, err := tunWriter.Write(data)
+		if err != nil && isFatal(err) && tunnel.IsConnected() {
+			// The output function is called with the lwIP mutex held, so the
+			// stack can't be closed synchronously.
+			go tunnel.Fail(err)
+		}
+		return n, err
+	}
+}
+
 // ProcessInputPackets reads packets from a TUN device `tun` and writes them to `tunnel`.
-func ProcessInputPackets(tunnel Tunnel, tun *os.File) {
+// If reading fails fatally, the tunnel is failed and this function returns.
+func ProcessInputPackets(tunnel Tunnel, tun io.Reader) {
 	buffer := make([]byte, vpnMtu)
 	for tunnel.IsConnected() {
 		len, err := tun.Read(buffer)
 		if err != nil {
+			if !tunnel.IsConnected() {
+				// The device was closed by Disconnect.
+				return
+			}
+			if isFatal(err) {
+				tunnel.Fail(err)
+				return
+			}
 			log.Warnf("Failed to read packet from TUN: %v", err)
 			continue
 		}
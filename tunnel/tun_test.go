@@ -0,0 +1,190 @@
+// Copyright 2020 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tunnel
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeStack implements core.LWIPStack.
+type fakeStack struct {
+	mu      sync.Mutex
+	packets int
+	closed  bool
+}
+
+func (s *fakeStack) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets++
+	return len(b), nil
+}
+
+func (s *fakeStack) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeStack) RestartTimeouts() {}
+
+// fakeDevice returns a sequence of read results, then blocks.  Writes fail
+// with writeErr.
+type fakeDevice struct {
+	reads    []error
+	closed   chan struct{}
+	writeErr error
+}
+
+func newFakeDevice(reads ...error) *fakeDevice {
+	return &fakeDevice{reads, make(chan struct{}), unix.EIO}
+}
+
+func (d *fakeDevice) Read(b []byte) (int, error) {
+	if len(d.reads) == 0 {
+		<-d.closed
+		return 0, errors.New("closed")
+	}
+	err := d.reads[0]
+	d.reads = d.reads[1:]
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (d *fakeDevice) Write(b []byte) (int, error) {
+	return 0, d.writeErr
+}
+
+func (d *fakeDevice) Close() error {
+	close(d.closed)
+	return nil
+}
+
+type fakeErrorListener chan error
+
+func (l fakeErrorListener) OnTunError(err error) {
+	l <- err
+}
+
+func TestTunReadError(t *testing.T) {
+	stack := &fakeStack{}
+	dev := newFakeDevice(nil, unix.EAGAIN, unix.ENOBUFS, nil, unix.EBADF)
+	tun := NewTunnel(dev, stack)
+	listener := make(fakeErrorListener, 2)
+	tun.SetTunErrorListener(listener)
+
+	done := make(chan struct{})
+	go func() {
+		ProcessInputPackets(tun, dev)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ProcessInputPackets did not exit")
+	}
+	select {
+	case err := <-listener:
+		if !errors.Is(err, unix.EBADF) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	default:
+		t.Fatal("Listener was not notified")
+	}
+	if tun.IsConnected() {
+		t.Error("Tunnel should be disconnected")
+	}
+	if !stack.closed {
+		t.Error("Stack should be closed")
+	}
+	if stack.packets != 2 {
+		t.Errorf("Expected 2 packets, got %d", stack.packets)
+	}
+	// Later failures are not reported.
+	tun.Fail(unix.EIO)
+	if len(listener) != 0 {
+		t.Error("Listener should only be notified once")
+	}
+}
+
+func TestTunWriteError(t *testing.T) {
+	dev := newFakeDevice()
+	tun := NewTunnel(dev, &fakeStack{})
+	listener := make(fakeErrorListener, 1)
+	tun.SetTunErrorListener(listener)
+	output := OutputFn(tun, dev)
+	if _, err := output([]byte{0}); err == nil {
+		t.Error("Expected write error")
+	}
+	select {
+	case err := <-listener:
+		if !errors.Is(err, unix.EIO) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Listener was not notified")
+	}
+	if tun.IsConnected() {
+		t.Error("Tunnel should be disconnected")
+	}
+}
+
+func TestTunTransientWriteError(t *testing.T) {
+	for _, transient := range []error{unix.ENOBUFS, unix.ENOMEM, unix.EAGAIN} {
+		dev := newFakeDevice()
+		dev.writeErr = transient
+		tun := NewTunnel(dev, &fakeStack{})
+		listener := make(fakeErrorListener, 1)
+		tun.SetTunErrorListener(listener)
+		output := OutputFn(tun, dev)
+		if _, err := output([]byte{0}); !errors.Is(err, transient) {
+			t.Errorf("Expected %v, got %v", transient, err)
+		}
+		select {
+		case err := <-listener:
+			t.Errorf("A transient error failed the tunnel: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if !tun.IsConnected() {
+			t.Errorf("%v: the tunnel should stay connected", transient)
+		}
+		tun.Disconnect()
+	}
+}
+
+func TestDisconnectIsNotAnError(t *testing.T) {
+	dev := newFakeDevice()
+	tun := NewTunnel(dev, &fakeStack{})
+	listener := make(fakeErrorListener, 1)
+	tun.SetTunErrorListener(listener)
+	done := make(chan struct{})
+	go func() {
+		ProcessInputPackets(tun, dev)
+		close(done)
+	}()
+	tun.Disconnect()
+	<-done
+	if len(listener) != 0 {
+		t.Error("Disconnect should not notify the listener")
+	}
+}
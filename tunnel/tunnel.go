@@ -17,10 +17,21 @@ package tunnel
 import (
 	"errors"
 	"io"
+	"sync"
 
+	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
+// TunErrorListener is notified when the TUN device fails, e.g. because it was
+// removed or the OS revoked permission to use it.  This is distinct from errors
+// on individual connections.
+type TunErrorListener interface {
+	// OnTunError is called at most once, after the tunnel has been disconnected
+	// due to `err`.
+	OnTunError(err error)
+}
+
 // Tunnel represents a session on a TUN device.
 type Tunnel interface {
 	// IsConnected indicates whether the tunnel is in a connected state.
@@ -29,34 +40,66 @@ type Tunnel interface {
 	Disconnect()
 	// Write writes input data to the TUN interface.
 	Write(data []byte) (int, error)
+	// SetTunErrorListener sets the listener that is notified if the TUN device fails.
+	SetTunErrorListener(TunErrorListener)
+	// Fail disconnects the tunnel due to a fatal TUN device error, and notifies
+	// the TunErrorListener.  Only the first call has any effect.
+	Fail(err error)
 }
 
 type tunnel struct {
 	tunWriter   io.WriteCloser
 	lwipStack   core.LWIPStack
+	mu          sync.Mutex // Protects isConnected and errListener.
 	isConnected bool
+	errListener TunErrorListener
+	failOnce    sync.Once
 }
 
 func (t *tunnel) IsConnected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.isConnected
 }
 
 func (t *tunnel) Disconnect() {
-	if !t.isConnected {
+	t.mu.Lock()
+	wasConnected := t.isConnected
+	t.isConnected = false
+	t.mu.Unlock()
+	if !wasConnected {
 		return
 	}
-	t.isConnected = false
 	t.lwipStack.Close()
 	t.tunWriter.Close()
 }
 
 func (t *tunnel) Write(data []byte) (int, error) {
-	if !t.isConnected {
+	if !t.IsConnected() {
 		return 0, errors.New("Failed to write, network stack closed")
 	}
 	return t.lwipStack.Write(data)
 }
 
+func (t *tunnel) SetTunErrorListener(l TunErrorListener) {
+	t.mu.Lock()
+	t.errListener = l
+	t.mu.Unlock()
+}
+
+func (t *tunnel) Fail(err error) {
+	t.failOnce.Do(func() {
+		log.Errorf("TUN device failed: %v", err)
+		t.Disconnect()
+		t.mu.Lock()
+		l := t.errListener
+		t.mu.Unlock()
+		if l != nil {
+			l.OnTunError(err)
+		}
+	})
+}
+
 func NewTunnel(tunWriter io.WriteCloser, lwipStack core.LWIPStack) Tunnel {
-	return &tunnel{tunWriter, lwipStack, true}
+	return &tunnel{tunWriter: tunWriter, lwipStack: lwipStack, isConnected: true}
 }